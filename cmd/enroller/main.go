@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/auth"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/clientcert"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/api"
-	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/auth"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/configs"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/discovery/consul"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/utils"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/health"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc"
 	"net/http"
 	"os"
 	"os/signal"
@@ -19,6 +26,11 @@ import (
 	jaegercfg "github.com/uber/jaeger-client-go/config"
 )
 
+var (
+	errNoClientCAs = errors.New("client certificates are required but no client CAs are configured")
+	errNoEnroller  = errors.New("no enroller instances found")
+)
+
 func main() {
 	var logger log.Logger
 	{
@@ -35,8 +47,17 @@ func main() {
 	}
 	level.Info(logger).Log("msg", "Environment configuration values loaded")
 
-	auth := auth.NewAuth(cfg.KeycloakHostname, cfg.KeycloakPort, cfg.KeycloakProtocol, cfg.KeycloakRealm, cfg.KeycloakCA)
+	auth, err := newAuth(cfg)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not start authentication system client")
+		os.Exit(1)
+	}
 	level.Info(logger).Log("msg", "Connection established with authentication system")
+	policy := newPolicy(cfg)
+	if err := policy.Validate(); err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load access policy")
+		os.Exit(1)
+	}
 	jcfg, err := jaegercfg.FromEnv()
 	if err != nil {
 		level.Error(logger).Log("err", err, "msg", "Could not load Jaeger configuration values fron environment")
@@ -79,17 +100,45 @@ func main() {
 		os.Exit(1)
 	}
 	level.Info(logger).Log("msg", "Connection established with Consul Service Discovery")
-	err = consulsd.Register("https", "manufacturingenroll", cfg.Port)
+	err = consulsd.Register("https", "manufacturingenroll", cfg.Port, healthPort(cfg))
 	if err != nil {
 		level.Error(logger).Log("err", err, "msg", "Could not register service liveness information to Consul")
 		os.Exit(1)
 	}
 	level.Info(logger).Log("msg", "Service liveness information registered to Consul")
+
+	certs, err := newClientCertPolicy(cfg)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load client certificate policy")
+		os.Exit(1)
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load client certificate CAs")
+		os.Exit(1)
+	}
+	if cfg.RequireClientCert && cfg.HealthPort == "" {
+		level.Warn(logger).Log("msg", "Client certificates are required and no health port is set, probes without a client certificate will be rejected")
+	}
+
+	checker := health.NewChecker(0)
+	checker.Add("oidc", auth.Check)
+	checker.Add("consul", consulsd.Check)
+	checker.Add("enroller", func(ctx context.Context) error {
+		if !s.Health(ctx) {
+			return errNoEnroller
+		}
+		return nil
+	})
+
 	mux := http.NewServeMux()
 
-	mux.Handle("/v1/", api.MakeHTTPHandler(s, log.With(logger, "component", "HTTP"), auth, tracer))
+	mux.Handle("/v1/", api.MakeHTTPHandler(s, log.With(logger, "component", "HTTP"), auth, policy, certs, cfg.RevokeRole, cfg.PublicURL, cfg.TrustForwardedHeaders, tracer))
 	http.Handle("/", accessControl(mux, cfg.UIProtocol, cfg.UIHost, cfg.UIPort))
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/v1/health/live", health.LiveHandler())
+	http.Handle("/v1/health/ready", health.ReadyHandler(checker))
 
 	errs := make(chan error)
 	go func() {
@@ -98,11 +147,26 @@ func main() {
 		errs <- fmt.Errorf("%s", <-c)
 	}()
 
+	server := &http.Server{Addr: ":" + cfg.Port, TLSConfig: tlsConfig}
+
 	go func() {
 		level.Info(logger).Log("transport", "HTTPS", "address", ":"+cfg.Port, "msg", "listening")
-		errs <- http.ListenAndServeTLS(":"+cfg.Port, cfg.CertFile, cfg.KeyFile, nil)
+		errs <- server.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
 	}()
 
+	if cfg.HealthPort != "" {
+		// Probes present no client certificate, so they are served without
+		// requesting one.
+		probes := http.NewServeMux()
+		probes.Handle("/v1/health/live", health.LiveHandler())
+		probes.Handle("/v1/health/ready", health.ReadyHandler(checker))
+		probeServer := &http.Server{Addr: ":" + cfg.HealthPort, Handler: probes}
+		go func() {
+			level.Info(logger).Log("transport", "HTTPS", "address", ":"+cfg.HealthPort, "msg", "listening for probes")
+			errs <- probeServer.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+		}()
+	}
+
 	level.Info(logger).Log("exit", <-errs)
 	err = consulsd.Deregister()
 	if err != nil {
@@ -113,6 +177,65 @@ func main() {
 
 }
 
+// newClientCertPolicy maps client certificates issued by ClientCAs to
+// identities with the rules in ClientCertPolicy. Client certificates are
+// not accepted in place of tokens when no rules are configured.
+func newClientCertPolicy(cfg configs.Config) (*clientcert.Policy, error) {
+	if cfg.ClientCertPolicy == "" {
+		return nil, nil
+	}
+	roots, err := utils.CreateCAPool(cfg.ClientCAs)
+	if err != nil {
+		return nil, err
+	}
+	return clientcert.LoadPolicy(roots, cfg.ClientCertPolicy)
+}
+
+// newTLSConfig requests a client certificate issued by ClientCAs, required
+// for every connection when RequireClientCert is set.
+func newTLSConfig(cfg configs.Config) (*tls.Config, error) {
+	if cfg.ClientCAs == "" {
+		if cfg.RequireClientCert {
+			return nil, errNoClientCAs
+		}
+		return &tls.Config{}, nil
+	}
+	clientCAs, err := utils.CreateCAPool(cfg.ClientCAs)
+	if err != nil {
+		return nil, err
+	}
+	clientAuth := tls.VerifyClientCertIfGiven
+	if cfg.RequireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{ClientAuth: clientAuth, ClientCAs: clientCAs}, nil
+}
+
+// healthPort is the port the readiness probe is served at for the Consul
+// check: HealthPort when set, otherwise the port of the API.
+func healthPort(cfg configs.Config) string {
+	if cfg.HealthPort != "" {
+		return cfg.HealthPort
+	}
+	return cfg.Port
+}
+
+// newAuth validates tokens of the OIDC provider at OIDCIssuer, or of the
+// Keycloak realm when no issuer is configured.
+func newAuth(cfg configs.Config) (auth.Auth, error) {
+	issuer, ca := cfg.OIDCIssuer, cfg.OIDCCA
+	if issuer == "" {
+		issuer = cfg.KeycloakProtocol + "://" + cfg.KeycloakHostname + ":" + cfg.KeycloakPort + "/auth/realms/" + cfg.KeycloakRealm
+		ca = cfg.KeycloakCA
+	}
+	mapping := oidc.ClaimMapping{UsernameClaim: cfg.UsernameClaim, RolesClaims: cfg.RolesClaims}
+	return auth.NewAuth(issuer, ca, cfg.OIDCAudience, cfg.OIDCKeysTTL, mapping)
+}
+
+func newPolicy(cfg configs.Config) auth.Policy {
+	return auth.Policy{AdminRoles: cfg.AdminRoles, OperatorRoles: cfg.OperatorRoles, AuditorRoles: cfg.AuditorRoles}
+}
+
 func accessControl(h http.Handler, UIProtocol string, UIHost string, UIPort string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var uiURL string
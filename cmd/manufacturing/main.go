@@ -1,17 +1,36 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
-	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/auth"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/auth"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/clientcert"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/health"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/api"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client/cmp"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client/est"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client/extension"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client/scep"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/configs"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/discovery/consul"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys/memory"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys/pkcs11"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/ledger/bolt"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/registry/devices"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/rotation"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -22,6 +41,8 @@ import (
 	jaegercfg "github.com/uber/jaeger-client-go/config"
 )
 
+var errNoClientCAs = errors.New("client certificates are required but no client CAs are configured")
+
 func main() {
 	var logger log.Logger
 	{
@@ -38,9 +59,19 @@ func main() {
 	}
 	level.Info(logger).Log("msg", "Environment configuration values loaded")
 
-	auth := auth.NewAuth(cfg.KeycloakHostname, cfg.KeycloakPort, cfg.KeycloakProtocol, cfg.KeycloakRealm, cfg.KeycloakCA)
+	auth, err := newAuth(cfg)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not start authentication system client")
+		os.Exit(1)
+	}
 	level.Info(logger).Log("msg", "Connection established with authentication system")
 
+	policy := newPolicy(cfg)
+	if err := policy.Validate(); err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load access policy")
+		os.Exit(1)
+	}
+
 	jcfg, err := jaegercfg.FromEnv()
 	if err != nil {
 		level.Error(logger).Log("err", err, "msg", "Could not load Jaeger configuration values fron environment")
@@ -55,13 +86,86 @@ func main() {
 	defer closer.Close()
 	level.Info(logger).Log("msg", "Jaeger tracer started")
 
-	client := extension.NewClient(cfg.ProxyAddress, cfg.ConsulProtocol, cfg.ConsulHost, cfg.ConsulPort, cfg.ConsulCA, cfg.ProxyCA, logger, tracer)
-	level.Info(logger).Log("msg", "Remote SCEP Client started")
+	enroller, err := newEnroller(cfg, logger)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not start enrollment protocol backend")
+		os.Exit(1)
+	}
+	level.Info(logger).Log("msg", "Enrollment protocol backend started", "protocol", cfg.EnrollmentProtocol)
+
+	keyProvider, err := newKeyProvider(cfg, logger)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not start device key provider")
+		os.Exit(1)
+	}
+	defer keyProvider.Close()
+	level.Info(logger).Log("msg", "Device key provider started", "provider", cfg.KeyProvider)
+
+	client, err := extension.NewClient(cfg.ProxyAddress, cfg.ConsulProtocol, cfg.ConsulHost, cfg.ConsulPort, cfg.ConsulCA, cfg.ProxyCA, cfg.TrustAnchors, cfg.RSAPSS, keyProvider, enroller, cfg.EnrollmentProtocol, logger, tracer)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load trust anchors")
+		os.Exit(1)
+	}
+	level.Info(logger).Log("msg", "DMS client started", "protocol", cfg.EnrollmentProtocol)
+
+	authCRT, err := rotation.LoadCredentials(cfg.AuthKeyFile)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load renewed DMS certificate", "file", cfg.AuthKeyFile)
+		os.Exit(1)
+	}
+	if authCRT != nil {
+		if err := client.SetCredentials(nil, *authCRT, nil); err != nil {
+			level.Warn(logger).Log("err", err, "msg", "Renewed DMS certificate is not usable, waiting for configuration")
+		}
+	}
+
+	if cfg.AuthRenewCAName != "" {
+		rotator := rotation.NewRotator(client, enroller, cfg.AuthKeyFile, cfg.AuthRenewCAName, cfg.AuthRenewBefore, cfg.AuthRenewInterval,
+			kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+				Namespace: "device_manufacturing_system",
+				Subsystem: "manufacturing_service",
+				Name:      "auth_certificate_expiry_days",
+				Help:      "Days left before the DMS authentication certificate expires.",
+			}, []string{}),
+			kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "device_manufacturing_system",
+				Subsystem: "manufacturing_service",
+				Name:      "auth_certificate_rotations",
+				Help:      "Number of DMS authentication certificate renewals.",
+			}, []string{"error"}),
+			log.With(logger, "component", "rotation"),
+		)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go rotator.Run(ctx)
+		level.Info(logger).Log("msg", "DMS certificate rotation started", "ca", cfg.AuthRenewCAName)
+	}
+
+	registry, err := devices.NewClient(cfg.DevicesAddress, cfg.DevicesCA, cfg.DevicesCertFile, cfg.DevicesKeyFile, logger)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not start Device Manager client")
+		os.Exit(1)
+	}
+	level.Info(logger).Log("msg", "Device Manager client started")
+
+	keyPolicy, err := api.NewKeyPolicy(cfg.AllowedKeys)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load allowed device keys")
+		os.Exit(1)
+	}
+
+	ledger, err := bolt.NewLedger(cfg.LedgerFile, logger)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not open provisioning ledger")
+		os.Exit(1)
+	}
+	defer ledger.Close()
+	level.Info(logger).Log("msg", "Provisioning ledger opened", "path", cfg.LedgerFile)
 
 	fieldKeys := []string{"method", "error"}
 	var s api.Service
 	{
-		s = api.NewDeviceService(cfg.AuthKeyFile, client)
+		s = api.NewDeviceService(cfg.AuthKeyFile, cfg.BatchConcurrency, keyPolicy, client, registry, ledger, logger)
 		s = api.LoggingMidleware(logger)(s)
 		s = api.NewInstumentingMiddleware(
 			kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
@@ -85,17 +189,45 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = consulsd.Register("https", "manufacturing", cfg.Port)
+	err = consulsd.Register("https", "manufacturing", cfg.Port, healthPort(cfg))
 	if err != nil {
 		level.Error(logger).Log("err", err, "msg", "Could not register service liveness information to Consul")
 		os.Exit(1)
 	}
 	level.Info(logger).Log("msg", "Service liveness information registered to Consul")
+
+	certs, err := newClientCertPolicy(cfg)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load client certificate policy")
+		os.Exit(1)
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load client certificate CAs")
+		os.Exit(1)
+	}
+	if cfg.RequireClientCert && cfg.HealthPort == "" {
+		level.Warn(logger).Log("msg", "Client certificates are required and no health port is set, probes without a client certificate will be rejected")
+	}
+
+	checker := health.NewChecker(0)
+	checker.Add("oidc", auth.Check)
+	checker.Add("consul", consulsd.Check)
+	// The upstream extension and the enrollment server can only be reached
+	// once a DMS certificate is configured through the API, so they do not
+	// gate readiness.
+	checker.AddOptional("enroller", client.CheckEnroller)
+	checker.AddOptional("credentials", client.CheckCredentials)
+	checker.AddOptional("scepextension", client.CheckInstances)
+
 	mux := http.NewServeMux()
 
-	mux.Handle("/v1/", api.MakeHTTPHandler(s, log.With(logger, "component", "HTTP"), auth, tracer))
+	mux.Handle("/v1/", api.MakeHTTPHandler(s, log.With(logger, "component", "HTTP"), auth, policy, certs, checker, keyProvider, tracer))
 	http.Handle("/", accessControl(mux, cfg.UIProtocol, cfg.UIHost, cfg.UIPort))
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/v1/health/live", health.LiveHandler())
+	http.Handle("/v1/health/ready", health.ReadyHandler(checker))
 
 	errs := make(chan error)
 	go func() {
@@ -104,11 +236,26 @@ func main() {
 		errs <- fmt.Errorf("%s", <-c)
 	}()
 
+	server := &http.Server{Addr: ":" + cfg.Port, TLSConfig: tlsConfig}
+
 	go func() {
 		level.Info(logger).Log("transport", "HTTPS", "address", ":"+cfg.Port, "msg", "listening")
-		errs <- http.ListenAndServeTLS(":"+cfg.Port, cfg.CertFile, cfg.KeyFile, nil)
+		errs <- server.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
 	}()
 
+	if cfg.HealthPort != "" {
+		// Probes present no client certificate, so they are served without
+		// requesting one.
+		probes := http.NewServeMux()
+		probes.Handle("/v1/health/live", health.LiveHandler())
+		probes.Handle("/v1/health/ready", health.ReadyHandler(checker))
+		probeServer := &http.Server{Addr: ":" + cfg.HealthPort, Handler: probes}
+		go func() {
+			level.Info(logger).Log("transport", "HTTPS", "address", ":"+cfg.HealthPort, "msg", "listening for probes")
+			errs <- probeServer.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+		}()
+	}
+
 	level.Info(logger).Log("exit", <-errs)
 	err = consulsd.Deregister()
 	if err != nil {
@@ -118,6 +265,88 @@ func main() {
 	level.Info(logger).Log("msg", "Service liveness information deregistered from Consul")
 }
 
+// healthPort is the port the readiness probe is served at for the Consul
+// check: HealthPort when set, otherwise the port of the API.
+func healthPort(cfg configs.Config) string {
+	if cfg.HealthPort != "" {
+		return cfg.HealthPort
+	}
+	return cfg.Port
+}
+
+// newAuth validates tokens of the OIDC provider at OIDCIssuer, or of the
+// Keycloak realm when no issuer is configured.
+func newAuth(cfg configs.Config) (auth.Auth, error) {
+	issuer, ca := cfg.OIDCIssuer, cfg.OIDCCA
+	if issuer == "" {
+		issuer = cfg.KeycloakProtocol + "://" + cfg.KeycloakHostname + ":" + cfg.KeycloakPort + "/auth/realms/" + cfg.KeycloakRealm
+		ca = cfg.KeycloakCA
+	}
+	mapping := oidc.ClaimMapping{UsernameClaim: cfg.UsernameClaim, RolesClaims: cfg.RolesClaims}
+	return auth.NewAuth(issuer, ca, cfg.OIDCAudience, cfg.OIDCKeysTTL, mapping)
+}
+
+func newPolicy(cfg configs.Config) auth.Policy {
+	return auth.Policy{AdminRoles: cfg.AdminRoles, OperatorRoles: cfg.OperatorRoles, AuditorRoles: cfg.AuditorRoles}
+}
+
+func newEnroller(cfg configs.Config, logger log.Logger) (client.Enroller, error) {
+	switch cfg.EnrollmentProtocol {
+	case "", "est":
+		return est.NewEnroller(cfg.EnrollmentAddress, cfg.EnrollmentCA, logger)
+	case "scep":
+		return scep.NewEnroller(cfg.EnrollmentAddress, cfg.EnrollmentCA, logger)
+	case "cmp":
+		return cmp.NewEnroller(cfg.EnrollmentAddress, cfg.EnrollmentCA, logger)
+	default:
+		return nil, fmt.Errorf("unsupported enrollment protocol %q", cfg.EnrollmentProtocol)
+	}
+}
+
+// newClientCertPolicy maps client certificates issued by ClientCAs to
+// identities with the rules in ClientCertPolicy. Client certificates are
+// not accepted in place of tokens when no rules are configured.
+func newClientCertPolicy(cfg configs.Config) (*clientcert.Policy, error) {
+	if cfg.ClientCertPolicy == "" {
+		return nil, nil
+	}
+	roots, err := utils.CreateCAPool(cfg.ClientCAs)
+	if err != nil {
+		return nil, err
+	}
+	return clientcert.LoadPolicy(roots, cfg.ClientCertPolicy)
+}
+
+// newTLSConfig requests a client certificate, used by devices to
+// authenticate re-enrollment requests and by machine callers in place of a
+// token. Client certificates are verified against the trust anchors of
+// issued device certificates and the ClientCAs of machine callers, and are
+// required for every connection when RequireClientCert is set.
+func newTLSConfig(cfg configs.Config) (*tls.Config, error) {
+	if cfg.TrustAnchors == "" && cfg.ClientCAs == "" {
+		if cfg.RequireClientCert {
+			return nil, errNoClientCAs
+		}
+		return &tls.Config{}, nil
+	}
+	clientCAs := x509.NewCertPool()
+	for _, file := range []string{cfg.TrustAnchors, cfg.ClientCAs} {
+		if file == "" {
+			continue
+		}
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs.AppendCertsFromPEM(pem)
+	}
+	clientAuth := tls.VerifyClientCertIfGiven
+	if cfg.RequireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{ClientAuth: clientAuth, ClientCAs: clientCAs}, nil
+}
+
 func accessControl(h http.Handler, UIProtocol string, UIHost string, UIPort string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var uiURL string
@@ -137,3 +366,18 @@ func accessControl(h http.Handler, UIProtocol string, UIHost string, UIPort stri
 		h.ServeHTTP(w, r)
 	})
 }
+
+func newKeyProvider(cfg configs.Config, logger log.Logger) (keys.Provider, error) {
+	switch cfg.KeyProvider {
+	case "", "memory":
+		return memory.NewProvider(), nil
+	case "pkcs11":
+		provider, err := pkcs11.NewProvider(cfg.PKCS11Module, cfg.PKCS11TokenLabel, cfg.PKCS11PIN, cfg.PKCS11WrappingKey, logger)
+		if err != nil {
+			return nil, err
+		}
+		return provider, nil
+	default:
+		return nil, fmt.Errorf("unsupported key provider %q", cfg.KeyProvider)
+	}
+}
@@ -1,6 +1,10 @@
 package x509util
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -48,3 +52,55 @@ func TestCreateCertificateRequest(t *testing.T) {
 		t.Errorf("have %s, want %s", have, want)
 	}
 }
+
+func TestCreateCertificateRequestKeyTypes(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p521Key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		priv    crypto.Signer
+		sigAlgo x509.SignatureAlgorithm
+		want    x509.SignatureAlgorithm
+	}{
+		{"RSA", rsaKey, 0, x509.SHA256WithRSA},
+		{"RSA-PSS", rsaKey, x509.SHA256WithRSAPSS, x509.SHA256WithRSAPSS},
+		{"ECDSA P-521", p521Key, 0, x509.ECDSAWithSHA512},
+		{"Ed25519", ed25519Key, 0, x509.PureEd25519},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template := CertificateRequest{
+				CertificateRequest: x509.CertificateRequest{
+					Subject:            pkix.Name{CommonName: "test.acme.co"},
+					SignatureAlgorithm: tt.sigAlgo,
+				},
+				ChallengePassword: "foobar",
+			}
+			derBytes, err := CreateCertificateRequest(rand.Reader, &template, tt.priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := x509.ParseCertificateRequest(derBytes)
+			if err != nil {
+				t.Fatalf("failed to create certificate request: %s", err)
+			}
+			if have := out.SignatureAlgorithm; have != tt.want {
+				t.Errorf("have %s, want %s", have, tt.want)
+			}
+			if err := out.CheckSignature(); err != nil {
+				t.Errorf("failed to check certificate request signature: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+// Package apierrors defines the error kinds shared by the services and their
+// encoding as RFC 7807 problem details.
+package apierrors
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Kind classifies an error and decides its HTTP status.
+type Kind int
+
+const (
+	Internal Kind = iota
+	Validation
+	Unauthenticated
+	Forbidden
+	NotFound
+	Conflict
+	NotAcceptable
+	UpstreamUnavailable
+)
+
+// Error is an error of a given kind. Status, when set, overrides the status
+// of the kind, keeping the status returned by an upstream service.
+type Error struct {
+	Kind   Kind
+	Status int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New returns an error of kind with the given text.
+func New(kind Kind, text string) error {
+	return &Error{Kind: kind, Err: errors.New(text)}
+}
+
+// Wrap returns err as an error of kind. Errors that already have a kind are
+// returned unchanged.
+func Wrap(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// KindOf returns the kind of err, Internal for errors without a kind.
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return Internal
+}
+
+// StatusCode returns the HTTP status for err.
+func StatusCode(err error) int {
+	var e *Error
+	if !errors.As(err, &e) {
+		return http.StatusInternalServerError
+	}
+	if e.Status != 0 {
+		return e.Status
+	}
+	switch e.Kind {
+	case Validation:
+		return http.StatusBadRequest
+	case Unauthenticated:
+		return http.StatusUnauthorized
+	case Forbidden:
+		return http.StatusForbidden
+	case NotFound:
+		return http.StatusNotFound
+	case Conflict:
+		return http.StatusConflict
+	case NotAcceptable:
+		return http.StatusNotAcceptable
+	case UpstreamUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// maxDetailSize bounds the part of an upstream error body kept as detail.
+const maxDetailSize = 4 << 10
+
+// FromResponse returns nil for 2xx responses of an upstream service and
+// otherwise an error keeping its status, so client errors reach the caller
+// as such. Upstream server errors are reported as 502 Bad Gateway.
+func FromResponse(service string, r *http.Response) error {
+	if r.StatusCode >= 200 && r.StatusCode <= 299 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(r.Body, maxDetailSize))
+	detail := strings.TrimSpace(string(body))
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == ProblemContentType {
+		var p Problem
+		if json.Unmarshal(body, &p) == nil && p.Detail != "" {
+			detail = p.Detail
+		}
+	}
+	err := fmt.Errorf("%s rejected request: %s", service, r.Status)
+	if detail != "" {
+		err = fmt.Errorf("%s rejected request: %s: %s", service, r.Status, detail)
+	}
+	if r.StatusCode >= 500 {
+		return &Error{Kind: UpstreamUnavailable, Status: http.StatusBadGateway, Err: err}
+	}
+	return &Error{Kind: kindFrom(r.StatusCode), Status: r.StatusCode, Err: err}
+}
+
+func kindFrom(status int) Kind {
+	switch status {
+	case http.StatusUnauthorized:
+		return Unauthenticated
+	case http.StatusForbidden:
+		return Forbidden
+	case http.StatusNotFound:
+		return NotFound
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return Conflict
+	case http.StatusNotAcceptable:
+		return NotAcceptable
+	default:
+		return Validation
+	}
+}
+
+// ProblemContentType is the media type of RFC 7807 problem details.
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// EncodeProblem writes err as problem details with the status of its kind
+// and the detail returned by Detail.
+func EncodeProblem(w http.ResponseWriter, err error) {
+	status := StatusCode(err)
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: Detail(err),
+	})
+}
+
+// Detail returns the text of err to send to a client. Server errors,
+// including those of upstream services, may carry internal details such as
+// hostnames or storage paths and are replaced with a generic detail; the
+// full error is left to the logs of the service and of its transport error
+// handler.
+func Detail(err error) string {
+	if StatusCode(err) >= 500 {
+		return genericDetail(KindOf(err))
+	}
+	return err.Error()
+}
+
+func genericDetail(kind Kind) string {
+	if kind == UpstreamUnavailable {
+		return "an upstream service is unavailable"
+	}
+	return "internal error"
+}
@@ -0,0 +1,131 @@
+package apierrors
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusCode(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		ret  int
+	}{
+		{"Error without kind", errors.New("failure"), http.StatusInternalServerError},
+		{"Validation error", New(Validation, "invalid"), http.StatusBadRequest},
+		{"Authentication error", New(Unauthenticated, "no token"), http.StatusUnauthorized},
+		{"Authorization error", New(Forbidden, "no role"), http.StatusForbidden},
+		{"Not found error", New(NotFound, "missing"), http.StatusNotFound},
+		{"Conflict error", New(Conflict, "in use"), http.StatusConflict},
+		{"Upstream error", New(UpstreamUnavailable, "unreachable"), http.StatusServiceUnavailable},
+		{"Wrapped error", fmt.Errorf("request: %w", New(NotFound, "missing")), http.StatusNotFound},
+		{"Upstream status", &Error{Kind: Validation, Status: http.StatusUnprocessableEntity, Err: errors.New("rejected")}, http.StatusUnprocessableEntity},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			if code := StatusCode(tc.err); code != tc.ret {
+				t.Errorf("Got result is %d; want %d", code, tc.ret)
+			}
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	notFound := New(NotFound, "missing")
+	if err := Wrap(UpstreamUnavailable, notFound); err != notFound {
+		t.Errorf("Got result is %v; want the error unchanged", err)
+	}
+	cause := errors.New("connection refused")
+	err := Wrap(UpstreamUnavailable, cause)
+	if KindOf(err) != UpstreamUnavailable || !errors.Is(err, cause) {
+		t.Errorf("Got result is %v; want upstream error wrapping %v", err, cause)
+	}
+	if Wrap(Validation, nil) != nil {
+		t.Error("Got error wrapping nil; want nil")
+	}
+}
+
+func TestFromResponse(t *testing.T) {
+	testCases := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		kind        Kind
+		ret         int
+		detail      string
+	}{
+		{"Success", http.StatusCreated, "", "", Internal, 0, ""},
+		{"Client error", http.StatusNotFound, "text/plain", "csr not found\n", NotFound, http.StatusNotFound, "csr not found"},
+		{"Problem details", http.StatusConflict, ProblemContentType, `{"title":"Conflict","status":409,"detail":"already approved"}`, Conflict, http.StatusConflict, "already approved"},
+		{"Unprocessable request", http.StatusUnprocessableEntity, "", "", Validation, http.StatusUnprocessableEntity, ""},
+		{"Server error", http.StatusInternalServerError, "", "database down", UpstreamUnavailable, http.StatusBadGateway, "database down"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			r := &http.Response{
+				StatusCode: tc.status,
+				Status:     fmt.Sprintf("%d %s", tc.status, http.StatusText(tc.status)),
+				Header:     http.Header{"Content-Type": []string{tc.contentType}},
+				Body:       ioutil.NopCloser(strings.NewReader(tc.body)),
+			}
+			err := FromResponse("enroller", r)
+			if tc.ret == 0 {
+				if err != nil {
+					t.Fatalf("Got result is %s; want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Got result is nil; want error")
+			}
+			if KindOf(err) != tc.kind || StatusCode(err) != tc.ret {
+				t.Errorf("Got kind %d and status %d; want %d and %d", KindOf(err), StatusCode(err), tc.kind, tc.ret)
+			}
+			if !strings.HasSuffix(err.Error(), r.Status) && !strings.HasSuffix(err.Error(), ": "+tc.detail) {
+				t.Errorf("Got result is %s; want detail %q", err, tc.detail)
+			}
+		})
+	}
+}
+
+func TestEncodeProblem(t *testing.T) {
+	testCases := []struct {
+		name   string
+		err    error
+		status int
+		detail string
+	}{
+		{"Client error", New(Conflict, "only CSRs with status NEW can be approved or denied"), http.StatusConflict, "only CSRs with status NEW can be approved or denied"},
+		{"Error without kind", errors.New("open /var/lib/dms/ledger.db: permission denied"), http.StatusInternalServerError, "internal error"},
+		{"Upstream unavailable", Wrap(UpstreamUnavailable, errors.New("dial tcp 10.0.0.7:8085: connection refused")), http.StatusServiceUnavailable, "an upstream service is unavailable"},
+		{"Upstream server error", &Error{Kind: UpstreamUnavailable, Status: http.StatusBadGateway, Err: errors.New("enroller rejected request: 500 Internal Server Error: pq: connection refused")}, http.StatusBadGateway, "an upstream service is unavailable"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			EncodeProblem(w, tc.err)
+
+			if w.Code != tc.status {
+				t.Errorf("Got status %d; want %d", w.Code, tc.status)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != ProblemContentType {
+				t.Errorf("Got content type %s; want %s", ct, ProblemContentType)
+			}
+			var p Problem
+			if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+				t.Fatalf("Could not decode problem: %s", err)
+			}
+			want := Problem{Type: "about:blank", Title: http.StatusText(tc.status), Status: tc.status, Detail: tc.detail}
+			if p != want {
+				t.Errorf("Got problem %+v; want %+v", p, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// Package auth validates the OIDC tokens of the callers of the services and
+// enforces their access levels.
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc"
+
+	stdjwt "github.com/dgrijalva/jwt-go"
+)
+
+type Auth interface {
+	Kf(token *stdjwt.Token) (interface{}, error)
+	ClaimsFactory() stdjwt.Claims
+	// Check reports whether the signing keys of the OIDC provider can be
+	// retrieved.
+	Check(ctx context.Context) error
+}
+
+type auth struct {
+	keys     *oidc.KeySet
+	audience string
+	mapping  oidc.ClaimMapping
+}
+
+var (
+	errProviderCA      = errors.New("error reading OIDC provider CA")
+	errBadClaims       = apierrors.New(apierrors.Unauthenticated, "unexpected JWT claims")
+	errInvalidIssuer   = apierrors.New(apierrors.Unauthenticated, "token was not issued by the OIDC provider")
+	errInvalidAudience = apierrors.New(apierrors.Unauthenticated, "token audience does not include this service")
+	errMissingExpiry   = apierrors.New(apierrors.Unauthenticated, "token has no expiration time")
+)
+
+// NewAuth validates tokens of the OIDC provider identified by issuer with
+// the signing keys in the JWKS of its discovery document, cached for
+// keysTTL. The provider certificate is verified against providerCA, or the
+// system roots when empty. When audience is set, tokens must include it in
+// their aud claim. The username and roles of the caller are read from the
+// claims named by mapping.
+func NewAuth(issuer string, providerCA string, audience string, keysTTL time.Duration, mapping oidc.ClaimMapping) (Auth, error) {
+	var caCertPool *x509.CertPool
+	if providerCA != "" {
+		caCert, err := ioutil.ReadFile(providerCA)
+		if err != nil {
+			return nil, errProviderCA
+		}
+		caCertPool = x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: caCertPool,
+			},
+		},
+	}
+	discoveryURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	return &auth{keys: oidc.NewKeySet(discoveryURL, client, keysTTL), audience: audience, mapping: mapping}, nil
+}
+
+func (a *auth) Check(ctx context.Context) error {
+	return a.keys.Check(ctx)
+}
+
+func (a *auth) ClaimsFactory() stdjwt.Claims {
+	return &oidc.Claims{}
+}
+
+// Kf returns the provider key the token was signed with, identified by its
+// kid header, once its issuer, audience and expiration time are checked,
+// and resolves the username and roles of the caller. Expiration itself is
+// checked by the parser.
+func (a *auth) Kf(token *stdjwt.Token) (interface{}, error) {
+	claims, ok := token.Claims.(*oidc.Claims)
+	if !ok {
+		return nil, errBadClaims
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, err := a.keys.Key(kid, token.Method.Alg())
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := a.keys.Issuer()
+	if err != nil {
+		return nil, err
+	}
+	if claims.Issuer != issuer {
+		return nil, errInvalidIssuer
+	}
+	if a.audience != "" && !claims.Audience.Contains(a.audience) {
+		return nil, errInvalidAudience
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, errMissingExpiry
+	}
+	a.mapping.Resolve(claims)
+	return key, nil
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc/oidctest"
+
+	stdjwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestKf(t *testing.T) {
+	issuer := oidctest.NewIssuer()
+	defer issuer.Close()
+	auth := setup(t, issuer, oidc.ClaimMapping{})
+
+	testCases := []struct {
+		name   string
+		claims map[string]interface{}
+		ret    error
+	}{
+		{"Valid token", map[string]interface{}{"aud": "lamassu-dms"}, nil},
+		{"Audience list", map[string]interface{}{"aud": []string{"account", "lamassu-dms"}}, nil},
+		{"Other issuer", map[string]interface{}{"aud": "lamassu-dms", "iss": "https://other"}, errInvalidIssuer},
+		{"Other audience", map[string]interface{}{"aud": "account"}, errInvalidAudience},
+		{"Missing expiration time", map[string]interface{}{"aud": "lamassu-dms", "exp": nil}, errMissingExpiry},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			_, err := stdjwt.ParseWithClaims(issuer.Token(tc.claims), auth.ClaimsFactory(), auth.Kf)
+			if err != nil {
+				err = err.(*stdjwt.ValidationError).Inner
+			}
+			if tc.ret != err {
+				t.Errorf("Got result is %v; want %v", err, tc.ret)
+			}
+		})
+	}
+}
+
+func TestKfClaimMapping(t *testing.T) {
+	issuer := oidctest.NewIssuer()
+	defer issuer.Close()
+
+	testCases := []struct {
+		name     string
+		mapping  oidc.ClaimMapping
+		claims   map[string]interface{}
+		username string
+		roles    []string
+	}{
+		{
+			"Keycloak claims",
+			oidc.ClaimMapping{},
+			map[string]interface{}{
+				"preferred_username": "operator",
+				"realm_access":       map[string]interface{}{"roles": []string{"operator"}},
+				"resource_access":    map[string]interface{}{"lamassu-dms": map[string]interface{}{"roles": []string{"auditor"}}},
+			},
+			"operator",
+			[]string{"lamassu-dms:auditor", "operator"},
+		},
+		{
+			"Custom claims",
+			oidc.ClaimMapping{UsernameClaim: "email", RolesClaims: []string{"groups"}},
+			map[string]interface{}{
+				"email":              "operator@example.com",
+				"preferred_username": "operator",
+				"groups":             []string{"operators", "auditors"},
+			},
+			"operator@example.com",
+			[]string{"auditors", "operators"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			auth := setup(t, issuer, tc.mapping)
+			tc.claims["aud"] = "lamassu-dms"
+			token, err := stdjwt.ParseWithClaims(issuer.Token(tc.claims), auth.ClaimsFactory(), auth.Kf)
+			if err != nil {
+				t.Fatalf("Got result is %s; want valid token", err)
+			}
+			claims := token.Claims.(*oidc.Claims)
+			if claims.Username != tc.username {
+				t.Errorf("Got username is %s; want %s", claims.Username, tc.username)
+			}
+			sort.Strings(claims.Roles)
+			if fmt.Sprint(claims.Roles) != fmt.Sprint(tc.roles) {
+				t.Errorf("Got roles are %v; want %v", claims.Roles, tc.roles)
+			}
+		})
+	}
+}
+
+func setup(t *testing.T, issuer *oidctest.Issuer, mapping oidc.ClaimMapping) *auth {
+	t.Helper()
+
+	ca := filepath.Join(t.TempDir(), "issuer.crt")
+	if err := ioutil.WriteFile(ca, issuer.CA(), 0644); err != nil {
+		t.Fatal("Unable to write OIDC provider CA")
+	}
+	a, err := NewAuth(issuer.URL(), ca, "lamassu-dms", time.Hour, mapping)
+	if err != nil {
+		t.Fatal("Unable to create authentication client")
+	}
+	return a.(*auth)
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc"
+
+	"github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+)
+
+var (
+	ErrForbidden = apierrors.New(apierrors.Forbidden, "the authenticated user does not have the required role")
+	errNoRoles   = errors.New("no admin, operator or auditor roles configured")
+)
+
+// Policy lists the roles granted each access level, as resolved from the
+// token by the claim mapping: with the default mapping, a realm role name
+// or client:role for a role of a Keycloak client. Admins also have
+// operator and auditor access, and operators auditor access. A level
+// without roles is only granted by the levels above it.
+type Policy struct {
+	AdminRoles    []string
+	OperatorRoles []string
+	AuditorRoles  []string
+}
+
+// Validate reports an error when no level has roles, as every request
+// would be rejected.
+func (p Policy) Validate() error {
+	if len(p.AdminRoles) == 0 && len(p.OperatorRoles) == 0 && len(p.AuditorRoles) == 0 {
+		return errNoRoles
+	}
+	return nil
+}
+
+// RequireAdmin, RequireOperator and RequireAuditor return endpoint
+// middlewares enforcing an access level on requests whose token was parsed
+// by a preceding oidc.NewParser.
+func (p Policy) RequireAdmin() endpoint.Middleware {
+	return requireLevel(p.AdminRoles)
+}
+
+func (p Policy) RequireOperator() endpoint.Middleware {
+	return requireLevel(p.OperatorRoles, p.AdminRoles)
+}
+
+func (p Policy) RequireAuditor() endpoint.Middleware {
+	return requireLevel(p.AuditorRoles, p.OperatorRoles, p.AdminRoles)
+}
+
+// requireLevel accepts any of the roles of level or of the levels above it,
+// and rejects every request when none of them has roles.
+func requireLevel(level []string, above ...[]string) endpoint.Middleware {
+	roles := append([]string{}, level...)
+	for _, r := range above {
+		roles = append(roles, r...)
+	}
+	return RequireRole(roles...)
+}
+
+// RequireRole returns an endpoint middleware that rejects requests whose
+// token, parsed by a preceding oidc.NewParser, does not grant any of the
+// roles.
+func RequireRole(roles ...string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			claims, ok := ctx.Value(jwt.JWTClaimsContextKey).(*oidc.Claims)
+			if !ok {
+				return nil, ErrForbidden
+			}
+			for _, role := range roles {
+				if claims.HasRole(role) {
+					return next(ctx, request)
+				}
+			}
+			return nil, ErrForbidden
+		}
+	}
+}
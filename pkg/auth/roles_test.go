@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc"
+
+	"github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+)
+
+func TestRequireRole(t *testing.T) {
+	next := func(ctx context.Context, request interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	testCases := []struct {
+		name   string
+		claims interface{}
+		ret    error
+	}{
+		{"User has the role", &oidc.Claims{Roles: []string{"admin", "revoker"}}, nil},
+		{"User does not have the role", &oidc.Claims{Roles: []string{"admin"}}, ErrForbidden},
+		{"Request is not authenticated", nil, ErrForbidden},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			ctx := context.Background()
+			if tc.claims != nil {
+				ctx = context.WithValue(ctx, jwt.JWTClaimsContextKey, tc.claims)
+			}
+			_, err := RequireRole("revoker")(next)(ctx, nil)
+			if tc.ret != err {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	next := func(ctx context.Context, request interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	policy := Policy{AdminRoles: []string{"admin"}, OperatorRoles: []string{"operator", "lamassu-dms:operator"}}
+	admin := &oidc.Claims{Roles: []string{"admin"}}
+	operator := &oidc.Claims{Roles: []string{"operator"}}
+	clientOperator := &oidc.Claims{Roles: []string{"lamassu-dms:operator"}}
+	auditor := &oidc.Claims{Roles: []string{"auditor"}}
+	testCases := []struct {
+		name   string
+		claims *oidc.Claims
+		level  endpoint.Middleware
+		ret    error
+	}{
+		{"Admin has admin access", admin, policy.RequireAdmin(), nil},
+		{"Operator has no admin access", operator, policy.RequireAdmin(), ErrForbidden},
+		{"Admin has operator access", admin, policy.RequireOperator(), nil},
+		{"Operator has operator access", operator, policy.RequireOperator(), nil},
+		{"Client role grants operator access", clientOperator, policy.RequireOperator(), nil},
+		{"Auditor has no operator access", auditor, policy.RequireOperator(), ErrForbidden},
+		{"Operator has auditor access", operator, policy.RequireAuditor(), nil},
+		{"Auditor access without roles is closed", auditor, policy.RequireAuditor(), ErrForbidden},
+		{"Level without roles above is closed", admin, Policy{}.RequireAdmin(), ErrForbidden},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), jwt.JWTClaimsContextKey, tc.claims)
+			_, err := tc.level(next)(ctx, nil)
+			if tc.ret != err {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+		})
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy Policy
+		ret    error
+	}{
+		{"Roles for every level", Policy{AdminRoles: []string{"admin"}, OperatorRoles: []string{"operator"}, AuditorRoles: []string{"auditor"}}, nil},
+		{"Admin roles only", Policy{AdminRoles: []string{"admin"}}, nil},
+		{"No roles", Policy{}, errNoRoles},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			if err := tc.policy.Validate(); err != tc.ret {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+// Package clientcert authenticates machine callers, such as flashing
+// stations, by the client certificate of their TLS connection. A Policy
+// maps certificate subjects and SANs to identities with roles, enforced
+// by the same role middlewares as OIDC tokens.
+package clientcert
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc"
+
+	"github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+var (
+	ErrUntrustedCertificate = apierrors.New(apierrors.Unauthenticated, "client certificate is not issued by a trusted machine CA")
+	ErrUnknownCertificate   = apierrors.New(apierrors.Unauthenticated, "client certificate does not match any identity")
+	errInvalidMatch         = errors.New("invalid match, must be cn:, o:, ou:, dns:, uri: or email: followed by a pattern")
+)
+
+// Rule grants Roles to the certificates matching Match, a field and a
+// path.Match pattern separated by a colon: cn:station-*, o:ACME,
+// ou:Flashing, dns:*.stations.example.com, uri:spiffe://example.com/* or
+// email:*@example.com. The username of the identity is Username, or the
+// subject common name when empty.
+type Rule struct {
+	Match    string   `json:"match"`
+	Username string   `json:"username,omitempty"`
+	Roles    []string `json:"roles"`
+}
+
+// Policy maps client certificates issued by the CAs in Roots to
+// identities.
+type Policy struct {
+	Roots *x509.CertPool
+	Rules []Rule
+}
+
+// LoadPolicy reads the rules of a Policy from a JSON file with a rules
+// array.
+func LoadPolicy(roots *x509.CertPool, file string) (*Policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var p struct {
+		Rules []Rule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	for _, r := range p.Rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Match, err)
+		}
+	}
+	return &Policy{Roots: roots, Rules: p.Rules}, nil
+}
+
+func (r Rule) validate() error {
+	i := strings.Index(r.Match, ":")
+	if i < 0 || fields[r.Match[:i]] == nil {
+		return errInvalidMatch
+	}
+	if _, err := path.Match(r.Match[i+1:], ""); err != nil {
+		return err
+	}
+	return nil
+}
+
+// fields returns the values of a certificate matched by each rule field.
+var fields = map[string]func(*x509.Certificate) []string{
+	"cn":  func(c *x509.Certificate) []string { return []string{c.Subject.CommonName} },
+	"o":   func(c *x509.Certificate) []string { return c.Subject.Organization },
+	"ou":  func(c *x509.Certificate) []string { return c.Subject.OrganizationalUnit },
+	"dns": func(c *x509.Certificate) []string { return c.DNSNames },
+	"uri": func(c *x509.Certificate) []string {
+		uris := make([]string, 0, len(c.URIs))
+		for _, u := range c.URIs {
+			uris = append(uris, u.String())
+		}
+		return uris
+	},
+	"email": func(c *x509.Certificate) []string { return c.EmailAddresses },
+}
+
+func (r Rule) matches(cert *x509.Certificate) bool {
+	i := strings.Index(r.Match, ":")
+	if i < 0 || fields[r.Match[:i]] == nil {
+		return false
+	}
+	for _, v := range fields[r.Match[:i]](cert) {
+		if ok, _ := path.Match(r.Match[i+1:], v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Identity returns the identity of the caller authenticated with the
+// certificate chain of a TLS connection. The certificate must be issued by
+// one of the Roots of the policy, regardless of the CAs the server accepts
+// for other purposes, and match at least one rule. The roles of every
+// matching rule are granted.
+func (p *Policy) Identity(chain []*x509.Certificate) (*oidc.Claims, error) {
+	if len(chain) == 0 {
+		return nil, ErrUntrustedCertificate
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	cert := chain[0]
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         p.Roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, ErrUntrustedCertificate
+	}
+
+	claims := &oidc.Claims{Subject: cert.Subject.String()}
+	matched := false
+	for _, r := range p.Rules {
+		if !r.matches(cert) {
+			continue
+		}
+		if !matched {
+			claims.Username = r.Username
+		}
+		matched = true
+		claims.Roles = append(claims.Roles, r.Roles...)
+	}
+	if !matched {
+		return nil, ErrUnknownCertificate
+	}
+	if claims.Username == "" {
+		claims.Username = cert.Subject.CommonName
+	}
+	return claims, nil
+}
+
+type contextKey int
+
+const identityContextKey contextKey = iota
+
+type identity struct {
+	claims *oidc.Claims
+	err    error
+}
+
+// HTTPToContext returns a RequestFunc that resolves the identity of the
+// client certificate of the request, if any, under policy. A nil policy
+// ignores client certificates.
+func HTTPToContext(policy *Policy) httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if policy == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return ctx
+		}
+		claims, err := policy.Identity(r.TLS.PeerCertificates)
+		return context.WithValue(ctx, identityContextKey, identity{claims: claims, err: err})
+	}
+}
+
+// NewAuthenticator returns an endpoint middleware accepting either a
+// bearer token, checked by parse, or a client certificate identity set in
+// the context by HTTPToContext. A bearer token takes precedence; without
+// one, the identity of the certificate is set as the claims of the
+// request for the role middlewares.
+func NewAuthenticator(parse endpoint.Middleware) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		withToken := parse(next)
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if _, ok := ctx.Value(jwt.JWTTokenContextKey).(string); ok {
+				return withToken(ctx, request)
+			}
+			id, ok := ctx.Value(identityContextKey).(identity)
+			if !ok {
+				return withToken(ctx, request)
+			}
+			if id.err != nil {
+				return nil, id.err
+			}
+			return next(context.WithValue(ctx, jwt.JWTClaimsContextKey, id.claims), request)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package clientcert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc"
+
+	"github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+)
+
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T, cn string) issuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate CA key")
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("Unable to create CA certificate")
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return issuer{cert: cert, key: key}
+}
+
+func (ca issuer) issue(t *testing.T, subject pkix.Name, dns []string, uris []string, usage x509.ExtKeyUsage) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate client key")
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dns,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	for _, u := range uris {
+		parsed, _ := url.Parse(u)
+		tmpl.URIs = append(tmpl.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal("Unable to create client certificate")
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestIdentity(t *testing.T) {
+	ca := newCA(t, "Stations CA")
+	other := newCA(t, "Devices CA")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	policy := &Policy{Roots: roots, Rules: []Rule{
+		{Match: "cn:station-*", Roles: []string{"operator"}},
+		{Match: "ou:Quality", Username: "quality-station", Roles: []string{"auditor"}},
+		{Match: "uri:spiffe://factory.example.com/*", Roles: []string{"auditor"}},
+		{Match: "dns:*.stations.example.com", Roles: []string{"operator"}},
+	}}
+
+	testCases := []struct {
+		name     string
+		cert     *x509.Certificate
+		username string
+		roles    []string
+		err      error
+	}{
+		{"Common name rule", ca.issue(t, pkix.Name{CommonName: "station-01"}, nil, nil, x509.ExtKeyUsageClientAuth), "station-01", []string{"operator"}, nil},
+		{"Several rules", ca.issue(t, pkix.Name{CommonName: "station-02", OrganizationalUnit: []string{"Quality"}}, nil, nil, x509.ExtKeyUsageClientAuth), "station-02", []string{"auditor", "operator"}, nil},
+		{"Rule username", ca.issue(t, pkix.Name{CommonName: "qa-01", OrganizationalUnit: []string{"Quality"}}, nil, nil, x509.ExtKeyUsageClientAuth), "quality-station", []string{"auditor"}, nil},
+		{"URI SAN rule", ca.issue(t, pkix.Name{CommonName: "line-3"}, nil, []string{"spiffe://factory.example.com/line-3"}, x509.ExtKeyUsageClientAuth), "line-3", []string{"auditor"}, nil},
+		{"DNS SAN rule", ca.issue(t, pkix.Name{CommonName: "flasher"}, []string{"flasher.stations.example.com"}, nil, x509.ExtKeyUsageClientAuth), "flasher", []string{"operator"}, nil},
+		{"No matching rule", ca.issue(t, pkix.Name{CommonName: "laptop"}, nil, nil, x509.ExtKeyUsageClientAuth), "", nil, ErrUnknownCertificate},
+		{"Other CA", other.issue(t, pkix.Name{CommonName: "station-01"}, nil, nil, x509.ExtKeyUsageClientAuth), "", nil, ErrUntrustedCertificate},
+		{"Server certificate", ca.issue(t, pkix.Name{CommonName: "station-01"}, nil, nil, x509.ExtKeyUsageServerAuth), "", nil, ErrUntrustedCertificate},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			claims, err := policy.Identity([]*x509.Certificate{tc.cert})
+			if err != tc.err {
+				t.Fatalf("Got error is %v; want %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+			if claims.Username != tc.username {
+				t.Errorf("Got username is %s; want %s", claims.Username, tc.username)
+			}
+			sort.Strings(claims.Roles)
+			if fmt.Sprint(claims.Roles) != fmt.Sprint(tc.roles) {
+				t.Errorf("Got roles are %v; want %v", claims.Roles, tc.roles)
+			}
+		})
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	testCases := []struct {
+		name  string
+		rules string
+		valid bool
+	}{
+		{"Valid rules", `{"rules":[{"match":"cn:station-*","roles":["operator"]},{"match":"dns:*.example.com","roles":["auditor"]}]}`, true},
+		{"Unknown field", `{"rules":[{"match":"serial:01","roles":["operator"]}]}`, false},
+		{"Missing field", `{"rules":[{"match":"station-*","roles":["operator"]}]}`, false},
+		{"Malformed pattern", `{"rules":[{"match":"cn:[station","roles":["operator"]}]}`, false},
+		{"Malformed JSON", `{"rules":`, false},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "policy.json")
+			if err := ioutil.WriteFile(file, []byte(tc.rules), 0644); err != nil {
+				t.Fatal("Unable to write policy file")
+			}
+			_, err := LoadPolicy(x509.NewCertPool(), file)
+			if (err == nil) != tc.valid {
+				t.Errorf("Got error is %v; want valid %t", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	errToken := errors.New("token parsed")
+	parse := func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			return nil, errToken
+		}
+	}
+	next := func(ctx context.Context, request interface{}) (interface{}, error) {
+		claims, _ := ctx.Value(jwt.JWTClaimsContextKey).(*oidc.Claims)
+		return claims, nil
+	}
+	station := &oidc.Claims{Username: "station-01"}
+
+	testCases := []struct {
+		name   string
+		token  bool
+		id     *identity
+		claims *oidc.Claims
+		err    error
+	}{
+		{"Token only", true, nil, nil, errToken},
+		{"Token and certificate", true, &identity{claims: station}, nil, errToken},
+		{"Certificate only", false, &identity{claims: station}, station, nil},
+		{"Rejected certificate", false, &identity{err: ErrUnknownCertificate}, nil, ErrUnknownCertificate},
+		{"No credentials", false, nil, nil, errToken},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			ctx := context.Background()
+			if tc.token {
+				ctx = context.WithValue(ctx, jwt.JWTTokenContextKey, "token")
+			}
+			if tc.id != nil {
+				ctx = context.WithValue(ctx, identityContextKey, *tc.id)
+			}
+			resp, err := NewAuthenticator(parse)(next)(ctx, nil)
+			if err != tc.err {
+				t.Fatalf("Got error is %v; want %v", err, tc.err)
+			}
+			if err == nil && resp.(*oidc.Claims) != tc.claims {
+				t.Errorf("Got claims are %v; want %v", resp, tc.claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+)
+
+// maxCSRSize bounds the body of a CSR submission.
+const maxCSRSize = 64 << 10
+
+var (
+	errInvalidCSR   = apierrors.New(apierrors.Validation, "invalid certificate request")
+	errCSRSignature = apierrors.New(apierrors.Validation, "invalid certificate request signature")
+	errCNEmpty      = apierrors.New(apierrors.Validation, "invalid certificate request, CN is required")
+)
+
+// parseCSR accepts a PKCS#10 certificate request PEM encoded, DER encoded
+// or DER encoded in base64 as in RFC 8951, and checks its signature.
+func parseCSR(data []byte) (*x509.CertificateRequest, error) {
+	data = bytes.TrimSpace(data)
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST" {
+			return nil, errInvalidCSR
+		}
+		data = block.Bytes
+	} else if der, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(data), nil))); err == nil {
+		data = der
+	}
+	csr, err := x509.ParseCertificateRequest(data)
+	if err != nil {
+		return nil, errInvalidCSR
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, errCSRSignature
+	}
+	if csr.Subject.CommonName == "" {
+		return nil, errCNEmpty
+	}
+	return csr, nil
+}
+
+// pemCSR returns csr PEM encoded.
+func pemCSR(csr *x509.CertificateRequest) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+func TestParseCSR(t *testing.T) {
+	der := testCSR(t, "device")
+	tampered := append([]byte(nil), der...)
+	tampered[len(tampered)-1] ^= 0xff
+	req, _ := x509.ParseCertificateRequest(der)
+
+	testCases := []struct {
+		name string
+		data []byte
+		ret  error
+	}{
+		{"PEM CSR is valid", []byte(pemCSR(req)), nil},
+		{"DER CSR is valid", der, nil},
+		{"Base64 CSR is valid", []byte(base64.StdEncoding.EncodeToString(der)), nil},
+		{"CSR is not valid", []byte("this is not a CSR"), errInvalidCSR},
+		{"PEM block is not a CSR", []byte("-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"), errInvalidCSR},
+		{"CSR signature is not valid", tampered, errCSRSignature},
+		{"CN is empty", testCSR(t, ""), errCNEmpty},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			_, err := parseCSR(tc.data)
+			if tc.ret != err {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+		})
+	}
+}
+
+func testCSR(t *testing.T, cn string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate key")
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+	if err != nil {
+		t.Fatal("Unable to create CSR")
+	}
+	return der
+}
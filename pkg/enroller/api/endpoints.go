@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"crypto/x509"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/models/csr"
 
 	"github.com/go-kit/kit/endpoint"
@@ -14,6 +15,12 @@ type Endpoints struct {
 	GetCSRsEndpoint      endpoint.Endpoint
 	GetCSRStatusEndpoint endpoint.Endpoint
 	GetCRTEndpoint       endpoint.Endpoint
+	GetCSRFileEndpoint   endpoint.Endpoint
+	RevokeCSREndpoint    endpoint.Endpoint
+	RevokeCRTEndpoint    endpoint.Endpoint
+	ApproveCSREndpoint   endpoint.Endpoint
+	DenyCSREndpoint      endpoint.Endpoint
+	SubmitCSREndpoint    endpoint.Endpoint
 }
 
 func MakeServerEndpoints(s Service, otTracer stdopentracing.Tracer) Endpoints {
@@ -37,11 +44,47 @@ func MakeServerEndpoints(s Service, otTracer stdopentracing.Tracer) Endpoints {
 		getCRTEndpoint = MakeGetCRTEndpoint(s)
 		getCRTEndpoint = opentracing.TraceServer(otTracer, "GetCRT")(getCRTEndpoint)
 	}
+	var getCSRFileEndpoint endpoint.Endpoint
+	{
+		getCSRFileEndpoint = MakeGetCSRFileEndpoint(s)
+		getCSRFileEndpoint = opentracing.TraceServer(otTracer, "GetCSRFile")(getCSRFileEndpoint)
+	}
+	var revokeCSREndpoint endpoint.Endpoint
+	{
+		revokeCSREndpoint = MakeRevokeCSREndpoint(s)
+		revokeCSREndpoint = opentracing.TraceServer(otTracer, "RevokeCSR")(revokeCSREndpoint)
+	}
+	var revokeCRTEndpoint endpoint.Endpoint
+	{
+		revokeCRTEndpoint = MakeRevokeCRTEndpoint(s)
+		revokeCRTEndpoint = opentracing.TraceServer(otTracer, "RevokeCRT")(revokeCRTEndpoint)
+	}
+	var approveCSREndpoint endpoint.Endpoint
+	{
+		approveCSREndpoint = MakeApproveCSREndpoint(s)
+		approveCSREndpoint = opentracing.TraceServer(otTracer, "ApproveCSR")(approveCSREndpoint)
+	}
+	var denyCSREndpoint endpoint.Endpoint
+	{
+		denyCSREndpoint = MakeDenyCSREndpoint(s)
+		denyCSREndpoint = opentracing.TraceServer(otTracer, "DenyCSR")(denyCSREndpoint)
+	}
+	var submitCSREndpoint endpoint.Endpoint
+	{
+		submitCSREndpoint = MakeSubmitCSREndpoint(s)
+		submitCSREndpoint = opentracing.TraceServer(otTracer, "SubmitCSR")(submitCSREndpoint)
+	}
 	return Endpoints{
 		HealthEndpoint:       healthEndpoint,
 		GetCSRsEndpoint:      getCSRsEndpoint,
 		GetCSRStatusEndpoint: getCSRStatusEndpoint,
 		GetCRTEndpoint:       getCRTEndpoint,
+		GetCSRFileEndpoint:   getCSRFileEndpoint,
+		RevokeCSREndpoint:    revokeCSREndpoint,
+		RevokeCRTEndpoint:    revokeCRTEndpoint,
+		ApproveCSREndpoint:   approveCSREndpoint,
+		DenyCSREndpoint:      denyCSREndpoint,
+		SubmitCSREndpoint:    submitCSREndpoint,
 	}
 }
 
@@ -54,9 +97,9 @@ func MakeHealthEndpoint(s Service) endpoint.Endpoint {
 
 func MakeGetCSRsEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		_ = request.(getCSRsRequest)
-		csrs := s.GetCSRs(ctx)
-		return getCSRsResponse{CSRs: csrs}, nil
+		req := request.(getCSRsRequest)
+		page, err := s.GetCSRs(ctx, req.Query)
+		return getCSRsResponse{CSRs: csr.CSRs{CSRs: page.CSRs}, Query: req.Query, Next: page.Next, Prev: page.Prev, Err: err}, nil
 	}
 }
 
@@ -76,6 +119,54 @@ func MakeGetCRTEndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+func MakeGetCSRFileEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getCRTRequest)
+		data, err := s.GetCSRFile(ctx, req.ID)
+		return getCRTResponse{Data: data, Err: err}, nil
+	}
+}
+
+func MakeRevokeCSREndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(revokeRequest)
+		err = s.RevokeCSR(ctx, req.ID, req.Reason)
+		return revokeResponse{Err: err}, nil
+	}
+}
+
+func MakeRevokeCRTEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(revokeRequest)
+		err = s.RevokeCRT(ctx, req.Serial, req.Reason)
+		return revokeResponse{Err: err}, nil
+	}
+}
+
+func MakeApproveCSREndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(updateCSRStatusRequest)
+		csr, err := s.ApproveCSR(ctx, req.ID, req.Comment)
+		return getCSRStatusResponse{CSR: csr, Err: err}, nil
+	}
+}
+
+func MakeDenyCSREndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(updateCSRStatusRequest)
+		csr, err := s.DenyCSR(ctx, req.ID, req.Comment)
+		return getCSRStatusResponse{CSR: csr, Err: err}, nil
+	}
+}
+
+func MakeSubmitCSREndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(submitCSRRequest)
+		csr, err := s.SubmitCSR(ctx, req.CSR, req.Metadata)
+		return getCSRStatusResponse{CSR: csr, Err: err}, nil
+	}
+}
+
 type healthRequest struct{}
 
 type healthResponse struct {
@@ -83,14 +174,33 @@ type healthResponse struct {
 	Err     error `json:"err,omitempty"`
 }
 
-type getCSRsRequest struct{}
+type getCSRsRequest struct {
+	Query csr.Query
+}
 
+// getCSRsResponse is a page of CSRs. Query, Next and Prev are used to
+// build its HAL links.
 type getCSRsResponse struct {
-	CSRs csr.CSRs `json:"csr"`
+	CSRs  csr.CSRs  `json:"csr"`
+	Query csr.Query `json:"-"`
+	Next  string    `json:"-"`
+	Prev  string    `json:"-"`
+	Err   error     `json:"-"`
+}
+
+func (r getCSRsResponse) error() error { return r.Err }
+
+type halLink struct {
+	Href string `json:"href"`
 }
 
+// getCSRsEmbeddedResponse is a page of CSRs returned by the Enroller.
 type getCSRsEmbeddedResponse struct {
-	CSRs csr.Data `json:"_embedded"`
+	CSRs  csr.Data `json:"_embedded"`
+	Links struct {
+		Next *halLink `json:"next"`
+		Prev *halLink `json:"prev"`
+	} `json:"_links"`
 }
 
 type getCSRStatusRequest struct {
@@ -114,3 +224,40 @@ type getCRTResponse struct {
 }
 
 func (r getCRTResponse) error() error { return r.Err }
+
+// revokeRequest identifies the certificate to revoke by CSR ID or by serial
+// number. ReasonCode is the RFC 5280 code of Reason, sent along with it to
+// the Enroller.
+type revokeRequest struct {
+	ID         int    `json:"-"`
+	Serial     string `json:"-"`
+	Reason     string `json:"reason"`
+	ReasonCode int    `json:"reason_code"`
+}
+
+type revokeResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r revokeResponse) error() error { return r.Err }
+
+// updateCSRStatusRequest is sent to the Enroller to approve or deny a CSR.
+// Operator is the user who took the decision. The Enroller rejects the
+// update with 409 Conflict unless the CSR still has ExpectedStatus.
+type updateCSRStatusRequest struct {
+	ID             int    `json:"-"`
+	Status         string `json:"status"`
+	ExpectedStatus string `json:"expected_status"`
+	Comment        string `json:"comment,omitempty"`
+	Operator       string `json:"operator"`
+}
+
+// submitCSRRequest is a certificate request with free form metadata, such
+// as the device or batch it belongs to. It is sent to the Enroller with
+// the CSR PEM encoded.
+type submitCSRRequest struct {
+	CSR      *x509.CertificateRequest `json:"-"`
+	PEM      string                   `json:"csr"`
+	Metadata map[string]string        `json:"metadata,omitempty"`
+	Operator string                   `json:"operator,omitempty"`
+}
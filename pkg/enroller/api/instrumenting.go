@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
 	csrmodel "github.com/lamassuiot/device-manufacturing-system/pkg/enroller/models/csr"
 	"time"
@@ -35,14 +36,14 @@ func (mw *instrumentingMiddleware) Health(ctx context.Context) bool {
 	return mw.next.Health(ctx)
 }
 
-func (mw *instrumentingMiddleware) GetCSRs(ctx context.Context) (csrs csrmodel.CSRs) {
+func (mw *instrumentingMiddleware) GetCSRs(ctx context.Context, query csrmodel.Query) (page csrmodel.Page, err error) {
 	defer func(begin time.Time) {
-		lvs := []string{"method", "GetCSRs", "error", "false"}
+		lvs := []string{"method", "GetCSRs", "error", fmt.Sprint(err != nil)}
 		mw.requestCount.With(lvs...).Add(1)
 		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return mw.next.GetCSRs(ctx)
+	return mw.next.GetCSRs(ctx, query)
 }
 
 func (mw *instrumentingMiddleware) GetCSRStatus(ctx context.Context, id int) (csr csrmodel.CSR, err error) {
@@ -64,3 +65,63 @@ func (mw *instrumentingMiddleware) GetCRT(ctx context.Context, id int) (data []b
 
 	return mw.next.GetCRT(ctx, id)
 }
+
+func (mw *instrumentingMiddleware) GetCSRFile(ctx context.Context, id int) (data []byte, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "GetCSRFile", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.GetCSRFile(ctx, id)
+}
+
+func (mw *instrumentingMiddleware) RevokeCSR(ctx context.Context, id int, reason string) (err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "RevokeCSR", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.RevokeCSR(ctx, id, reason)
+}
+
+func (mw *instrumentingMiddleware) RevokeCRT(ctx context.Context, serial string, reason string) (err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "RevokeCRT", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.RevokeCRT(ctx, serial, reason)
+}
+
+func (mw *instrumentingMiddleware) ApproveCSR(ctx context.Context, id int, comment string) (csr csrmodel.CSR, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "ApproveCSR", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.ApproveCSR(ctx, id, comment)
+}
+
+func (mw *instrumentingMiddleware) DenyCSR(ctx context.Context, id int, comment string) (csr csrmodel.CSR, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "DenyCSR", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.DenyCSR(ctx, id, comment)
+}
+
+func (mw *instrumentingMiddleware) SubmitCSR(ctx context.Context, csr *x509.CertificateRequest, metadata map[string]string) (created csrmodel.CSR, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "SubmitCSR", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.SubmitCSR(ctx, csr, metadata)
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/models/csr"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/nvellon/hal"
+)
+
+type contextKey int
+
+const baseURLContextKey contextKey = iota
+
+// baseURLToContext stores the external URL of the service in the context,
+// used as base of the HAL links. publicURL is used when configured,
+// otherwise it is taken from the request. The Forwarded or
+// X-Forwarded-Proto and X-Forwarded-Host headers override the request only
+// when trustForwarded is set, as any client can send them unless a reverse
+// proxy in front of the service replaces them.
+func baseURLToContext(publicURL string, trustForwarded bool) httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if publicURL != "" {
+			return context.WithValue(ctx, baseURLContextKey, strings.TrimSuffix(publicURL, "/"))
+		}
+		return context.WithValue(ctx, baseURLContextKey, requestBaseURL(r, trustForwarded))
+	}
+}
+
+func requestBaseURL(r *http.Request, trustForwarded bool) string {
+	proto, host := "http", r.Host
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if !trustForwarded {
+		return proto + "://" + host
+	}
+	if v := r.Header.Get("X-Forwarded-Proto"); v != "" {
+		proto = strings.TrimSpace(strings.Split(v, ",")[0])
+	}
+	if v := r.Header.Get("X-Forwarded-Host"); v != "" {
+		host = strings.TrimSpace(strings.Split(v, ",")[0])
+	}
+	// Forwarded (RFC 7239) takes precedence, only its first element
+	// describes the client request.
+	if v := r.Header.Get("Forwarded"); v != "" {
+		for _, pair := range strings.Split(strings.Split(v, ",")[0], ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			value := strings.Trim(kv[1], `"`)
+			switch strings.ToLower(kv[0]) {
+			case "proto":
+				proto = value
+			case "host":
+				host = value
+			}
+		}
+	}
+	return proto + "://" + host
+}
+
+func baseURL(ctx context.Context) string {
+	base, _ := ctx.Value(baseURLContextKey).(string)
+	return base
+}
+
+func csrHref(ctx context.Context, id int) string {
+	return baseURL(ctx) + "/v1/csrs/" + strconv.Itoa(id)
+}
+
+func csrsHref(ctx context.Context, query csr.Query, cursor string) string {
+	query.Cursor = cursor
+	return baseURL(ctx) + "/v1/csrs?" + query.Values().Encode()
+}
+
+// csrResource links a CSR to its PKCS#10 file and, once approved, to the
+// issued certificate.
+func csrResource(ctx context.Context, c csr.CSR) *hal.Resource {
+	href := csrHref(ctx, c.Id)
+	csrHal := hal.NewResource(c, href)
+	csrHal.AddLink("file", hal.NewLink(href+"/file", hal.LinkAttr{
+		"type": string("application/pkcs10"),
+	}))
+	if c.Status == csr.ApprobedStatus {
+		csrHal.AddLink("crt", hal.NewLink(href+"/crt", hal.LinkAttr{
+			"type": string("application/x-pem-file"),
+		}))
+	}
+	return csrHal
+}
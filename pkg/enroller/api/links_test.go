@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/models/csr"
+
+	"github.com/nvellon/hal"
+)
+
+func TestBaseURLToContext(t *testing.T) {
+	testCases := []struct {
+		name           string
+		publicURL      string
+		trustForwarded bool
+		headers        map[string]string
+		tls            bool
+		ret            string
+	}{
+		{"Request host", "", false, nil, false, "http://enroller:8889"},
+		{"Request host over TLS", "", false, nil, true, "https://enroller:8889"},
+		{"Public URL", "https://lamassu.example.com/enroller/", true, map[string]string{"X-Forwarded-Host": "proxy.example.com"}, false, "https://lamassu.example.com/enroller"},
+		{"X-Forwarded headers", "", true, map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "proxy.example.com, internal"}, false, "https://proxy.example.com"},
+		{"Forwarded header", "", true, map[string]string{"Forwarded": `for=192.0.2.60;proto=https;host="lamassu.example.com", for=10.0.0.1`, "X-Forwarded-Host": "proxy.example.com"}, false, "https://lamassu.example.com"},
+		{"Spoofed X-Forwarded headers are ignored by default", "", false, map[string]string{"X-Forwarded-Proto": "http", "X-Forwarded-Host": "attacker.example.com"}, true, "https://enroller:8889"},
+		{"Spoofed Forwarded header is ignored by default", "", false, map[string]string{"Forwarded": `proto=http;host="attacker.example.com"`}, false, "http://enroller:8889"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://enroller:8889/v1/csrs/1", nil)
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			if tc.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			ctx := baseURLToContext(tc.publicURL, tc.trustForwarded)(context.Background(), r)
+			if base := baseURL(ctx); base != tc.ret {
+				t.Errorf("Got result is %s; want %s", base, tc.ret)
+			}
+		})
+	}
+}
+
+func TestCSRResource(t *testing.T) {
+	ctx := context.WithValue(context.Background(), baseURLContextKey, "https://enroller.example.com")
+	testCases := []struct {
+		name   string
+		status string
+		crt    bool
+	}{
+		{"Pending CSR", csr.PendingStatus, false},
+		{"Approved CSR", csr.ApprobedStatus, true},
+		{"Denied CSR", csr.DeniedStatus, false},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			res := csrResource(ctx, csr.CSR{Id: 7, Status: tc.status})
+			links := map[hal.Relation]string{
+				"self": "https://enroller.example.com/v1/csrs/7",
+				"file": "https://enroller.example.com/v1/csrs/7/file",
+			}
+			if tc.crt {
+				links["crt"] = "https://enroller.example.com/v1/csrs/7/crt"
+			}
+			for rel, href := range links {
+				l, ok := res.Links[rel]
+				if !ok {
+					t.Fatalf("Got no %s link; want %s", rel, href)
+				}
+				if got := l.(hal.Link)["href"]; got != href {
+					t.Errorf("Got %s link %s; want %s", rel, got, href)
+				}
+			}
+			if _, ok := res.Links["crt"]; ok != tc.crt {
+				t.Errorf("Got crt link %t; want %t", ok, tc.crt)
+			}
+		})
+	}
+}
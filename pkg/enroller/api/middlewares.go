@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"crypto/x509"
 	csrmodel "github.com/lamassuiot/device-manufacturing-system/pkg/enroller/models/csr"
 	"time"
 
@@ -35,14 +36,17 @@ func (mw loggingMiddleware) Health(ctx context.Context) (healthy bool) {
 	return mw.next.Health(ctx)
 }
 
-func (mw loggingMiddleware) GetCSRs(ctx context.Context) (csrs csrmodel.CSRs) {
+func (mw loggingMiddleware) GetCSRs(ctx context.Context, query csrmodel.Query) (page csrmodel.Page, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "GetCSRs",
+			"query", query.Values().Encode(),
+			"csrs", len(page.CSRs),
 			"took", time.Since(begin),
+			"err", err,
 		)
 	}(time.Now())
-	return mw.next.GetCSRs(ctx)
+	return mw.next.GetCSRs(ctx, query)
 }
 
 func (mw loggingMiddleware) GetCSRStatus(ctx context.Context, id int) (csr csrmodel.CSR, err error) {
@@ -70,3 +74,85 @@ func (mw loggingMiddleware) GetCRT(ctx context.Context, id int) (data []byte, er
 	}(time.Now())
 	return mw.next.GetCRT(ctx, id)
 }
+
+func (mw loggingMiddleware) GetCSRFile(ctx context.Context, id int) (data []byte, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetCSRFile",
+			"request_csr_id", id,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.GetCSRFile(ctx, id)
+}
+
+func (mw loggingMiddleware) RevokeCSR(ctx context.Context, id int, reason string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "RevokeCSR",
+			"request_csr_id", id,
+			"reason", reason,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.RevokeCSR(ctx, id, reason)
+}
+
+func (mw loggingMiddleware) RevokeCRT(ctx context.Context, serial string, reason string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "RevokeCRT",
+			"serial", serial,
+			"reason", reason,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.RevokeCRT(ctx, serial, reason)
+}
+
+func (mw loggingMiddleware) ApproveCSR(ctx context.Context, id int, comment string) (csr csrmodel.CSR, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "ApproveCSR",
+			"request_csr_id", id,
+			"operator", operatorFrom(ctx),
+			"comment", comment,
+			"csr_status", csr.Status,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.ApproveCSR(ctx, id, comment)
+}
+
+func (mw loggingMiddleware) DenyCSR(ctx context.Context, id int, comment string) (csr csrmodel.CSR, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "DenyCSR",
+			"request_csr_id", id,
+			"operator", operatorFrom(ctx),
+			"comment", comment,
+			"csr_status", csr.Status,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.DenyCSR(ctx, id, comment)
+}
+
+func (mw loggingMiddleware) SubmitCSR(ctx context.Context, csr *x509.CertificateRequest, metadata map[string]string) (created csrmodel.CSR, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "SubmitCSR",
+			"subject", csr.Subject.String(),
+			"operator", operatorFrom(ctx),
+			"response_csr_id", created.Id,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.SubmitCSR(ctx, csr, metadata)
+}
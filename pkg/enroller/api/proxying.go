@@ -3,6 +3,8 @@ package api
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/models/csr"
 	csrmodel "github.com/lamassuiot/device-manufacturing-system/pkg/enroller/models/csr"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/utils"
@@ -44,7 +46,7 @@ func ProxyingMiddleware(proxyURL string, proxyCA string, consulProtocol string,
 		client := consulsd.NewClient(consulClient)
 		instancer := consulsd.NewInstancer(client, logger, "enroller", tags, passingOnly)
 
-		var getCSRsEndpoint, getCSRStatusEndpoint, getCRTEndpoint endpoint.Endpoint
+		var getCSRsEndpoint, getCSRStatusEndpoint, getCRTEndpoint, getCSRFileEndpoint, revokeCSREndpoint, revokeCRTEndpoint, updateCSRStatusEndpoint, submitCSREndpoint endpoint.Endpoint
 
 		getCSRsFactory := makeGetCSRsFactory("GET", proxyURL, proxyCA, logger, otTracer)
 		getCSRsEndpointer := sd.NewEndpointer(instancer, getCSRsFactory, logger)
@@ -67,7 +69,42 @@ func ProxyingMiddleware(proxyURL string, proxyCA string, consulProtocol string,
 		getCRTEndpoint = getCRTRetry
 		getCRTEndpoint = opentracing.TraceClient(otTracer, "GetCRT")(getCRTEndpoint)
 
-		return proxymw{next, logger, getCSRsEndpoint, getCSRStatusEndpoint, getCRTEndpoint}
+		getCSRFileFactory := makeGetCSRFileFactory("GET", proxyURL, proxyCA, logger, otTracer)
+		getCSRFileEndpointer := sd.NewEndpointer(instancer, getCSRFileFactory, logger)
+		getCSRFileBalancer := lb.NewRoundRobin(getCSRFileEndpointer)
+		getCSRFileRetry := lb.Retry(1, duration, getCSRFileBalancer)
+		getCSRFileEndpoint = getCSRFileRetry
+		getCSRFileEndpoint = opentracing.TraceClient(otTracer, "GetCSRFile")(getCSRFileEndpoint)
+
+		revokeCSRFactory := makeRevokeFactory("POST", encodeRevokeCSRRequest, proxyURL, proxyCA, logger, otTracer)
+		revokeCSREndpointer := sd.NewEndpointer(instancer, revokeCSRFactory, logger)
+		revokeCSRBalancer := lb.NewRoundRobin(revokeCSREndpointer)
+		revokeCSRRetry := lb.Retry(1, duration, revokeCSRBalancer)
+		revokeCSREndpoint = revokeCSRRetry
+		revokeCSREndpoint = opentracing.TraceClient(otTracer, "RevokeCSR")(revokeCSREndpoint)
+
+		revokeCRTFactory := makeRevokeFactory("POST", encodeRevokeCRTRequest, proxyURL, proxyCA, logger, otTracer)
+		revokeCRTEndpointer := sd.NewEndpointer(instancer, revokeCRTFactory, logger)
+		revokeCRTBalancer := lb.NewRoundRobin(revokeCRTEndpointer)
+		revokeCRTRetry := lb.Retry(1, duration, revokeCRTBalancer)
+		revokeCRTEndpoint = revokeCRTRetry
+		revokeCRTEndpoint = opentracing.TraceClient(otTracer, "RevokeCRT")(revokeCRTEndpoint)
+
+		updateCSRStatusFactory := makeUpdateCSRStatusFactory("PUT", proxyURL, proxyCA, logger, otTracer)
+		updateCSRStatusEndpointer := sd.NewEndpointer(instancer, updateCSRStatusFactory, logger)
+		updateCSRStatusBalancer := lb.NewRoundRobin(updateCSRStatusEndpointer)
+		updateCSRStatusRetry := lb.Retry(1, duration, updateCSRStatusBalancer)
+		updateCSRStatusEndpoint = updateCSRStatusRetry
+		updateCSRStatusEndpoint = opentracing.TraceClient(otTracer, "UpdateCSRStatus")(updateCSRStatusEndpoint)
+
+		submitCSRFactory := makeSubmitCSRFactory("POST", proxyURL, proxyCA, logger, otTracer)
+		submitCSREndpointer := sd.NewEndpointer(instancer, submitCSRFactory, logger)
+		submitCSRBalancer := lb.NewRoundRobin(submitCSREndpointer)
+		submitCSRRetry := lb.Retry(1, duration, submitCSRBalancer)
+		submitCSREndpoint = submitCSRRetry
+		submitCSREndpoint = opentracing.TraceClient(otTracer, "SubmitCSR")(submitCSREndpoint)
+
+		return proxymw{next, logger, getCSRsEndpoint, getCSRStatusEndpoint, getCRTEndpoint, getCSRFileEndpoint, revokeCSREndpoint, revokeCRTEndpoint, updateCSRStatusEndpoint, submitCSREndpoint, instancer}
 	}
 }
 
@@ -77,27 +114,56 @@ type proxymw struct {
 	getCSRs      endpoint.Endpoint
 	getCSRStatus endpoint.Endpoint
 	getCRT       endpoint.Endpoint
+	getCSRFile   endpoint.Endpoint
+	revokeCSR    endpoint.Endpoint
+	revokeCRT    endpoint.Endpoint
+	updateCSR    endpoint.Endpoint
+	submitCSR    endpoint.Endpoint
+	instancer    sd.Instancer
 }
 
+// Health reports unhealthy while no enroller instance passing its Consul
+// health checks is found.
 func (mw proxymw) Health(ctx context.Context) bool {
+	if mw.instancer != nil && len(discovered(mw.instancer).Instances) == 0 {
+		return false
+	}
 	return mw.next.Health(ctx)
 }
 
-func (mw proxymw) GetCSRs(ctx context.Context) csrmodel.CSRs {
+// discovered returns the current state of instancer. The event is read
+// before deregistering, as instancers push the current state on Register
+// and block broadcasting to full channels.
+func discovered(instancer sd.Instancer) sd.Event {
+	events := make(chan sd.Event, 1)
+	instancer.Register(events)
+	event := <-events
+	instancer.Deregister(events)
+	return event
+}
+
+func (mw proxymw) GetCSRs(ctx context.Context, query csrmodel.Query) (csrmodel.Page, error) {
 	level.Info(mw.logger).Log("msg", "Proxying GetCSRs request to Enroller")
-	response, err := mw.getCSRs(ctx, getCSRsRequest{})
+	response, err := mw.getCSRs(ctx, getCSRsRequest{Query: query})
 	if err != nil {
 		level.Error(mw.logger).Log("err", err, "msg", "Error proxying GetCSRs request to Enroller")
-		return csrmodel.CSRs{}
+		return csrmodel.Page{}, upstreamError(err)
 	}
 	resp := response.(getCSRsEmbeddedResponse)
+	var page csrmodel.Page
+	// The Enroller embeds a single CSR as an object instead of a list.
 	if resp.CSRs.EmbeddedCSRs != nil {
-		return csrmodel.CSRs{CSRs: []csrmodel.CSR{resp.CSRs.EmbeddedCSRs.CSRs}}
+		page.CSRs = []csrmodel.CSR{resp.CSRs.EmbeddedCSRs.CSRs}
 	} else if resp.CSRs.CSRs != nil {
-		return csrmodel.CSRs{CSRs: resp.CSRs.CSRs.CSRs}
-	} else {
-		return csrmodel.CSRs{}
+		page.CSRs = resp.CSRs.CSRs.CSRs
+	}
+	if resp.Links.Next != nil {
+		page.Next = cursorFrom(resp.Links.Next.Href)
 	}
+	if resp.Links.Prev != nil {
+		page.Prev = cursorFrom(resp.Links.Prev.Href)
+	}
+	return page, nil
 }
 
 func (mw proxymw) GetCSRStatus(ctx context.Context, id int) (csrmodel.CSR, error) {
@@ -105,7 +171,7 @@ func (mw proxymw) GetCSRStatus(ctx context.Context, id int) (csrmodel.CSR, error
 	response, err := mw.getCSRStatus(ctx, getCSRStatusRequest{ID: id})
 	if err != nil {
 		level.Error(mw.logger).Log("err", err, "msg", "Error proxying GetCSRStatus request to Enroller")
-		return csrmodel.CSR{}, err
+		return csrmodel.CSR{}, upstreamError(err)
 	}
 	resp := response.(csr.CSR)
 	return resp, nil
@@ -116,7 +182,7 @@ func (mw proxymw) GetCRT(ctx context.Context, id int) ([]byte, error) {
 	response, err := mw.getCRT(ctx, getCRTRequest{ID: id})
 	if err != nil {
 		level.Error(mw.logger).Log("err", err, "msg", "Error proxying GetCRT request to Enroller")
-		return nil, err
+		return nil, upstreamError(err)
 	}
 	resp := response.(getCRTResponse)
 	if resp.Err != nil {
@@ -125,6 +191,100 @@ func (mw proxymw) GetCRT(ctx context.Context, id int) ([]byte, error) {
 	return resp.Data, nil
 }
 
+func (mw proxymw) GetCSRFile(ctx context.Context, id int) ([]byte, error) {
+	level.Info(mw.logger).Log("msg", "Proxying GetCSRFile request to Enroller")
+	response, err := mw.getCSRFile(ctx, getCRTRequest{ID: id})
+	if err != nil {
+		level.Error(mw.logger).Log("err", err, "msg", "Error proxying GetCSRFile request to Enroller")
+		return nil, upstreamError(err)
+	}
+	return response.(getCRTResponse).Data, nil
+}
+
+func (mw proxymw) RevokeCSR(ctx context.Context, id int, reason string) error {
+	level.Info(mw.logger).Log("msg", "Proxying RevokeCSR request to Enroller")
+	code, err := revocationReason(reason)
+	if err != nil {
+		return err
+	}
+	_, err = mw.revokeCSR(ctx, revokeRequest{ID: id, Reason: reason, ReasonCode: code})
+	if err != nil {
+		level.Error(mw.logger).Log("err", err, "msg", "Error proxying RevokeCSR request to Enroller")
+		return upstreamError(err)
+	}
+	return nil
+}
+
+func (mw proxymw) RevokeCRT(ctx context.Context, serial string, reason string) error {
+	level.Info(mw.logger).Log("msg", "Proxying RevokeCRT request to Enroller")
+	code, err := revocationReason(reason)
+	if err != nil {
+		return err
+	}
+	_, err = mw.revokeCRT(ctx, revokeRequest{Serial: serial, Reason: reason, ReasonCode: code})
+	if err != nil {
+		level.Error(mw.logger).Log("err", err, "msg", "Error proxying RevokeCRT request to Enroller")
+		return upstreamError(err)
+	}
+	return nil
+}
+
+func (mw proxymw) ApproveCSR(ctx context.Context, id int, comment string) (csrmodel.CSR, error) {
+	level.Info(mw.logger).Log("msg", "Proxying ApproveCSR request to Enroller")
+	return mw.updateCSRStatus(ctx, id, csrmodel.ApprobedStatus, comment)
+}
+
+func (mw proxymw) DenyCSR(ctx context.Context, id int, comment string) (csrmodel.CSR, error) {
+	level.Info(mw.logger).Log("msg", "Proxying DenyCSR request to Enroller")
+	return mw.updateCSRStatus(ctx, id, csrmodel.DeniedStatus, comment)
+}
+
+// updateCSRStatus sets the status of a CSR that is still pending, on
+// behalf of the user authenticated in ctx. The Enroller only applies the
+// update while the CSR has the expected status, so concurrent approvals and
+// denials cannot both succeed.
+func (mw proxymw) updateCSRStatus(ctx context.Context, id int, status string, comment string) (csrmodel.CSR, error) {
+	response, err := mw.updateCSR(ctx, updateCSRStatusRequest{ID: id, Status: status, ExpectedStatus: csrmodel.PendingStatus, Comment: comment, Operator: operatorFrom(ctx)})
+	if err != nil {
+		err = upstreamError(err)
+		if apierrors.KindOf(err) == apierrors.Conflict {
+			return csrmodel.CSR{}, errCSRNotPending
+		}
+		level.Error(mw.logger).Log("err", err, "msg", "Error proxying CSR status update to Enroller", "status", status)
+		return csrmodel.CSR{}, err
+	}
+	return response.(csr.CSR), nil
+}
+
+func (mw proxymw) SubmitCSR(ctx context.Context, req *x509.CertificateRequest, metadata map[string]string) (csrmodel.CSR, error) {
+	level.Info(mw.logger).Log("msg", "Proxying SubmitCSR request to Enroller")
+	response, err := mw.submitCSR(ctx, submitCSRRequest{CSR: req, PEM: pemCSR(req), Metadata: metadata, Operator: operatorFrom(ctx)})
+	if err != nil {
+		level.Error(mw.logger).Log("err", err, "msg", "Error proxying SubmitCSR request to Enroller")
+		return csrmodel.CSR{}, upstreamError(err)
+	}
+	return response.(csr.CSR), nil
+}
+
+// upstreamError returns the error of the last attempt of a retried request
+// to the Enroller. Errors without a kind, such as connection failures or a
+// missing instance, mean the Enroller is unavailable.
+func upstreamError(err error) error {
+	if retryErr, ok := err.(lb.RetryError); ok {
+		err = retryErr.Final
+	}
+	return apierrors.Wrap(apierrors.UpstreamUnavailable, err)
+}
+
+// cursorFrom returns the cursor query parameter of a page link.
+func cursorFrom(href string) string {
+	u, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("cursor")
+}
+
 func makeProxyClient(u *url.URL, proxyCA string) *http.Client {
 	if u.Path == "" {
 		u.Path = "/v1/csrs"
@@ -221,3 +381,103 @@ func makeGetCRTFactory(method, path, proxyCA string, logger log.Logger, otTracer
 	}
 
 }
+
+func makeGetCSRFileFactory(method, path, proxyCA string, logger log.Logger, otTracer stdopentracing.Tracer) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		if !strings.HasPrefix(instance, "http") {
+			instance = "https://" + instance
+		}
+		u, err := url.Parse(instance)
+		if err != nil {
+			panic(err)
+		}
+		httpc := makeProxyClient(u, proxyCA)
+		options := []httptransport.ClientOption{
+			httptransport.SetClient(httpc),
+			httptransport.ClientBefore(jwt.ContextToHTTP()),
+		}
+
+		return httptransport.NewClient(
+			method,
+			u,
+			encodeGetCSRFileRequest,
+			decodeGetCSRFileResponse,
+			append(options, httptransport.ClientBefore(opentracing.ContextToHTTP(otTracer, logger)))...,
+		).Endpoint(), nil, nil
+	}
+}
+
+func makeRevokeFactory(method string, enc httptransport.EncodeRequestFunc, path, proxyCA string, logger log.Logger, otTracer stdopentracing.Tracer) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		if !strings.HasPrefix(instance, "http") {
+			instance = "https://" + instance
+		}
+		u, err := url.Parse(instance)
+		if err != nil {
+			panic(err)
+		}
+		httpc := makeProxyClient(u, proxyCA)
+		options := []httptransport.ClientOption{
+			httptransport.SetClient(httpc),
+			httptransport.ClientBefore(jwt.ContextToHTTP()),
+		}
+
+		return httptransport.NewClient(
+			method,
+			u,
+			enc,
+			decodeRevokeResponse,
+			append(options, httptransport.ClientBefore(opentracing.ContextToHTTP(otTracer, logger)))...,
+		).Endpoint(), nil, nil
+	}
+}
+
+func makeUpdateCSRStatusFactory(method, path, proxyCA string, logger log.Logger, otTracer stdopentracing.Tracer) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		if !strings.HasPrefix(instance, "http") {
+			instance = "https://" + instance
+		}
+		u, err := url.Parse(instance)
+		if err != nil {
+			panic(err)
+		}
+		httpc := makeProxyClient(u, proxyCA)
+		options := []httptransport.ClientOption{
+			httptransport.SetClient(httpc),
+			httptransport.ClientBefore(jwt.ContextToHTTP()),
+		}
+
+		return httptransport.NewClient(
+			method,
+			u,
+			encodeUpdateCSRStatusRequest,
+			decodeUpdateCSRStatusResponse,
+			append(options, httptransport.ClientBefore(opentracing.ContextToHTTP(otTracer, logger)))...,
+		).Endpoint(), nil, nil
+	}
+}
+
+func makeSubmitCSRFactory(method, path, proxyCA string, logger log.Logger, otTracer stdopentracing.Tracer) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		if !strings.HasPrefix(instance, "http") {
+			instance = "https://" + instance
+		}
+		u, err := url.Parse(instance)
+		if err != nil {
+			panic(err)
+		}
+		httpc := makeProxyClient(u, proxyCA)
+		options := []httptransport.ClientOption{
+			httptransport.SetClient(httpc),
+			httptransport.ClientBefore(jwt.ContextToHTTP()),
+		}
+
+		return httptransport.NewClient(
+			method,
+			u,
+			encodeSubmitCSRRequest,
+			decodeSubmitCSRResponse,
+			append(options, httptransport.ClientBefore(opentracing.ContextToHTTP(otTracer, logger)))...,
+		).Endpoint(), nil, nil
+	}
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+	csrmodel "github.com/lamassuiot/device-manufacturing-system/pkg/enroller/models/csr"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc"
+
+	"github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+)
+
+func TestUpdateCSRStatus(t *testing.T) {
+	ctx := context.WithValue(context.Background(), jwt.JWTClaimsContextKey, &oidc.Claims{Username: "operator"})
+
+	testCases := []struct {
+		name    string
+		current string
+		approve bool
+		status  string
+		ret     error
+	}{
+		{"Pending CSR is approved", csrmodel.PendingStatus, true, csrmodel.ApprobedStatus, nil},
+		{"Pending CSR is denied", csrmodel.PendingStatus, false, csrmodel.DeniedStatus, nil},
+		{"Approved CSR cannot be denied", csrmodel.ApprobedStatus, false, "", errCSRNotPending},
+		{"Revoked CSR cannot be approved", csrmodel.RevokedStatus, true, "", errCSRNotPending},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			var sent *updateCSRStatusRequest
+			mw := proxymw{
+				logger: log.NewNopLogger(),
+				updateCSR: func(ctx context.Context, request interface{}) (interface{}, error) {
+					req := request.(updateCSRStatusRequest)
+					sent = &req
+					if req.ExpectedStatus != tc.current {
+						conflict := apierrors.New(apierrors.Conflict, "enroller rejected request: 409 Conflict")
+						return nil, lb.RetryError{RawErrors: []error{conflict}, Final: conflict}
+					}
+					return csrmodel.CSR{Id: req.ID, Status: req.Status}, nil
+				},
+			}
+
+			var csr csrmodel.CSR
+			var err error
+			if tc.approve {
+				csr, err = mw.ApproveCSR(ctx, 7, "checked")
+			} else {
+				csr, err = mw.DenyCSR(ctx, 7, "checked")
+			}
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if sent == nil || sent.ExpectedStatus != csrmodel.PendingStatus {
+				t.Fatalf("Got status update %+v; want it conditional on status %s", sent, csrmodel.PendingStatus)
+			}
+			if err != nil {
+				return
+			}
+			if csr.Status != tc.status {
+				t.Errorf("Got status %s; want %s", csr.Status, tc.status)
+			}
+			if sent.ID != 7 || sent.Status != tc.status || sent.Comment != "checked" || sent.Operator != "operator" {
+				t.Errorf("Got status update %+v; want %s of CSR 7 by operator", *sent, tc.status)
+			}
+		})
+	}
+}
+
+func TestGetCSRs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		upstream string
+		csrs     int
+		next     string
+		prev     string
+	}{
+		{"Page with several CSRs", `{"_embedded":{"csr":[{"id":1},{"id":2}]},"_links":{"next":{"href":"/v1/csrs?cursor=c&page_size=2"},"prev":{"href":"/v1/csrs?cursor=a&page_size=2"}}}`, 2, "c", "a"},
+		{"Page with a single CSR", `{"_embedded":{"csr":{"id":1}},"_links":{}}`, 1, "", ""},
+		{"Empty page", `{"_embedded":{},"_links":{}}`, 0, "", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			mw := proxymw{
+				logger: log.NewNopLogger(),
+				getCSRs: func(ctx context.Context, request interface{}) (interface{}, error) {
+					var resp getCSRsEmbeddedResponse
+					err := json.Unmarshal([]byte(tc.upstream), &resp)
+					return resp, err
+				},
+			}
+			page, err := mw.GetCSRs(context.Background(), csrmodel.Query{PageSize: 2})
+			if err != nil {
+				t.Fatalf("Got result is %s; want nil", err)
+			}
+			if len(page.CSRs) != tc.csrs || page.Next != tc.next || page.Prev != tc.prev {
+				t.Errorf("Got %d CSRs, next %q and prev %q; want %d, %q and %q", len(page.CSRs), page.Next, page.Prev, tc.csrs, tc.next, tc.prev)
+			}
+		})
+	}
+}
+
+func TestUpstreamError(t *testing.T) {
+	notFound := apierrors.New(apierrors.NotFound, "enroller rejected request: 404 Not Found")
+	testCases := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"Enroller response status", lb.RetryError{RawErrors: []error{notFound}, Final: notFound}, http.StatusNotFound},
+		{"Enroller unreachable", lb.RetryError{RawErrors: []error{errors.New("connection refused")}, Final: errors.New("connection refused")}, http.StatusServiceUnavailable},
+		{"No Enroller instances", lb.ErrNoEndpoints, http.StatusServiceUnavailable},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			mw := proxymw{
+				logger: log.NewNopLogger(),
+				getCRT: func(ctx context.Context, request interface{}) (interface{}, error) {
+					return nil, tc.err
+				},
+			}
+			_, err := mw.GetCRT(context.Background(), 7)
+			if status := apierrors.StatusCode(err); status != tc.status {
+				t.Errorf("Got status %d; want %d", status, tc.status)
+			}
+		})
+	}
+}
+
+// fakeInstancer pushes state on Register, like the Consul instancer.
+type fakeInstancer struct {
+	state sd.Event
+}
+
+func (i fakeInstancer) Register(ch chan<- sd.Event)   { ch <- i.state }
+func (i fakeInstancer) Deregister(ch chan<- sd.Event) {}
+func (i fakeInstancer) Stop()                         {}
+
+func TestProxyHealth(t *testing.T) {
+	testCases := []struct {
+		name  string
+		event sd.Event
+		ret   bool
+	}{
+		{"Enroller instances are found", sd.Event{Instances: []string{"enroller:8085"}}, true},
+		{"No Enroller instances", sd.Event{}, false},
+		{"Consul unreachable", sd.Event{Err: errors.New("connection refused")}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			mw := proxymw{next: NewEnrrolerService(), logger: log.NewNopLogger(), instancer: fakeInstancer{tc.event}}
+			if healthy := mw.Health(context.Background()); healthy != tc.ret {
+				t.Errorf("Got result is %t; want %t", healthy, tc.ret)
+			}
+		})
+	}
+}
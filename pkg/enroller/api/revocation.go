@@ -0,0 +1,42 @@
+package api
+
+import (
+	"regexp"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+)
+
+// revocationReasons are the CRLReason codes defined in RFC 5280, section
+// 5.3.1. Code 7 is not used, and removeFromCRL (8) is left out as it only
+// appears in delta CRLs and does not revoke a certificate.
+var revocationReasons = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"cACompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"certificateHold":      6,
+	"privilegeWithdrawn":   9,
+	"aACompromise":         10,
+}
+
+var (
+	errInvalidRevocationReason = apierrors.New(apierrors.Validation, "invalid revocation reason, it must be one of the CRLReason names of RFC 5280")
+	errInvalidSerial           = apierrors.New(apierrors.Validation, "invalid certificate serial number")
+)
+
+var serialPattern = regexp.MustCompile(`^[0-9a-fA-F]{2}(:?[0-9a-fA-F]{2})*$`)
+
+// revocationReason returns the RFC 5280 code of a reason name. An empty
+// name is unspecified.
+func revocationReason(name string) (int, error) {
+	if name == "" {
+		name = "unspecified"
+	}
+	code, ok := revocationReasons[name]
+	if !ok {
+		return 0, errInvalidRevocationReason
+	}
+	return code, nil
+}
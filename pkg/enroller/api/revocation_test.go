@@ -0,0 +1,54 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRevocationReason(t *testing.T) {
+	testCases := []struct {
+		name   string
+		reason string
+		code   int
+		ret    error
+	}{
+		{"Empty reason is unspecified", "", 0, nil},
+		{"Key compromise", "keyCompromise", 1, nil},
+		{"AA compromise", "aACompromise", 10, nil},
+		{"Reason is unknown", "stolen", 0, errInvalidRevocationReason},
+		{"Reason does not revoke", "removeFromCRL", 0, errInvalidRevocationReason},
+		{"Reason is a code", "1", 0, errInvalidRevocationReason},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			code, err := revocationReason(tc.reason)
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if code != tc.code {
+				t.Errorf("Got reason code %d; want %d", code, tc.code)
+			}
+		})
+	}
+}
+
+func TestSerialPattern(t *testing.T) {
+	testCases := []struct {
+		serial string
+		valid  bool
+	}{
+		{"01", true},
+		{"3f:a2:0b", true},
+		{"3FA20B", true},
+		{"3f:a2:0", false},
+		{"xyz", false},
+		{"", false},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.serial), func(t *testing.T) {
+			if serialPattern.MatchString(tc.serial) != tc.valid {
+				t.Errorf("Got valid is %t; want %t", !tc.valid, tc.valid)
+			}
+		})
+	}
+}
@@ -2,18 +2,40 @@ package api
 
 import (
 	"context"
+	"crypto/x509"
 	"errors"
-	csrmodel "github.com/lamassuiot/device-manufacturing-system/pkg/enroller/models/csr"
 	"sync"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+	csrmodel "github.com/lamassuiot/device-manufacturing-system/pkg/enroller/models/csr"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc"
+
+	"github.com/go-kit/kit/auth/jwt"
 )
 
 type Service interface {
 	Health(ctx context.Context) bool
-	GetCSRs(ctx context.Context) csrmodel.CSRs
+	GetCSRs(ctx context.Context, query csrmodel.Query) (csrmodel.Page, error)
 	GetCSRStatus(ctx context.Context, id int) (csrmodel.CSR, error)
 	GetCRT(ctx context.Context, id int) ([]byte, error)
+	// GetCSRFile returns the PKCS#10 request of the CSR id in DER.
+	GetCSRFile(ctx context.Context, id int) ([]byte, error)
+	// RevokeCSR revokes the certificate issued for the CSR id and
+	// RevokeCRT the certificate with serial number serial, with an
+	// RFC 5280 CRLReason name.
+	RevokeCSR(ctx context.Context, id int, reason string) error
+	RevokeCRT(ctx context.Context, serial string, reason string) error
+	// ApproveCSR and DenyCSR move a CSR out of the NEW status, recording
+	// the authenticated user and an optional comment.
+	ApproveCSR(ctx context.Context, id int, comment string) (csrmodel.CSR, error)
+	DenyCSR(ctx context.Context, id int, comment string) (csrmodel.CSR, error)
+	// SubmitCSR sends a validated certificate request to the Enroller,
+	// returning the created CSR with its ID.
+	SubmitCSR(ctx context.Context, csr *x509.CertificateRequest, metadata map[string]string) (csrmodel.CSR, error)
 }
 
+var errCSRNotPending = apierrors.New(apierrors.Conflict, "only CSRs with status NEW can be approved or denied")
+
 type enrollerService struct {
 	mtx sync.Mutex
 }
@@ -26,8 +48,8 @@ func (s *enrollerService) Health(ctx context.Context) bool {
 	return true
 }
 
-func (s *enrollerService) GetCSRs(ctx context.Context) csrmodel.CSRs {
-	return csrmodel.CSRs{}
+func (s *enrollerService) GetCSRs(ctx context.Context, query csrmodel.Query) (csrmodel.Page, error) {
+	return csrmodel.Page{}, errors.New("this method must be proxied")
 }
 
 func (s *enrollerService) GetCSRStatus(ctx context.Context, id int) (csrmodel.CSR, error) {
@@ -38,4 +60,41 @@ func (s *enrollerService) GetCRT(ctx context.Context, id int) ([]byte, error) {
 	return nil, errors.New("this method must be proxied")
 }
 
+func (s *enrollerService) GetCSRFile(ctx context.Context, id int) ([]byte, error) {
+	return nil, errors.New("this method must be proxied")
+}
+
+func (s *enrollerService) RevokeCSR(ctx context.Context, id int, reason string) error {
+	return errors.New("this method must be proxied")
+}
+
+func (s *enrollerService) RevokeCRT(ctx context.Context, serial string, reason string) error {
+	return errors.New("this method must be proxied")
+}
+
+func (s *enrollerService) ApproveCSR(ctx context.Context, id int, comment string) (csrmodel.CSR, error) {
+	return csrmodel.CSR{}, errors.New("this method must be proxied")
+}
+
+func (s *enrollerService) DenyCSR(ctx context.Context, id int, comment string) (csrmodel.CSR, error) {
+	return csrmodel.CSR{}, errors.New("this method must be proxied")
+}
+
+func (s *enrollerService) SubmitCSR(ctx context.Context, csr *x509.CertificateRequest, metadata map[string]string) (csrmodel.CSR, error) {
+	return csrmodel.CSR{}, errors.New("this method must be proxied")
+}
+
 type ServiceMiddleware func(Service) Service
+
+// operatorFrom returns the user who authenticated the request, as set in
+// the context by the JWT parser.
+func operatorFrom(ctx context.Context) string {
+	claims, ok := ctx.Value(jwt.JWTClaimsContextKey).(*oidc.Claims)
+	if !ok {
+		return ""
+	}
+	if claims.Username != "" {
+		return claims.Username
+	}
+	return claims.Subject
+}
@@ -4,33 +4,58 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/auth"
-	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/models/csr"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+	authpkg "github.com/lamassuiot/device-manufacturing-system/pkg/auth"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/clientcert"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/models/csr"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc"
 
-	stdjwt "github.com/dgrijalva/jwt-go"
 	"github.com/go-kit/kit/auth/jwt"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/tracing/opentracing"
-	"github.com/nvellon/hal"
-	stdopentracing "github.com/opentracing/opentracing-go"
-
 	"github.com/go-kit/kit/transport"
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
+	"github.com/nvellon/hal"
+	stdopentracing "github.com/opentracing/opentracing-go"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
 )
 
-func MakeHTTPHandler(s Service, logger log.Logger, auth auth.Auth, otTracer stdopentracing.Tracer) http.Handler {
+var errInvalidQuery = apierrors.New(apierrors.Validation, "invalid query, check status, sort, created_after, created_before and page_size")
+
+// sortFields are the CSR fields the Enroller can sort by.
+var sortFields = map[string]bool{"id": true, "cn": true, "o": true, "status": true, "created_at": true}
+
+// MakeHTTPHandler serves the enroller API. Reading CSRs requires auditor
+// access and submitting, approving or denying them operator access under
+// policy. Revocation requires the revokeRole role instead. Callers
+// authenticate with a token or, when certs is not nil, a client certificate
+// mapped to an identity by certs. HAL links are built on publicURL, or on
+// the request URL when it is empty.
+func MakeHTTPHandler(s Service, logger log.Logger, auth authpkg.Auth, policy authpkg.Policy, certs *clientcert.Policy, revokeRole string, publicURL string, trustForwarded bool, otTracer stdopentracing.Tracer) http.Handler {
 	r := mux.NewRouter()
 	e := MakeServerEndpoints(s, otTracer)
+	authenticate := clientcert.NewAuthenticator(oidc.NewParser(auth.Kf, auth.ClaimsFactory))
 
 	options := []httptransport.ServerOption{
 		httptransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
 		httptransport.ServerErrorEncoder(encodeError),
 		httptransport.ServerBefore(jwt.HTTPToContext()),
+		httptransport.ServerBefore(clientcert.HTTPToContext(certs)),
+		httptransport.ServerBefore(baseURLToContext(publicURL, trustForwarded)),
 	}
 
 	r.Methods("GET").Path("/v1/health").Handler(httptransport.NewServer(
@@ -41,26 +66,68 @@ func MakeHTTPHandler(s Service, logger log.Logger, auth auth.Auth, otTracer stdo
 	))
 
 	r.Methods("GET").Path("/v1/csrs").Handler(httptransport.NewServer(
-		jwt.NewParser(auth.Kf, stdjwt.SigningMethodRS256, auth.KeycloakClaimsFactory)(e.GetCSRsEndpoint),
+		authenticate(policy.RequireAuditor()(e.GetCSRsEndpoint)),
 		decodeGetCSRsRequest,
 		encodeGetCSRsResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "GetPendingCSRs", logger)))...,
 	))
 	r.
 		Methods("GET").Path("/v1/csrs/{id}").Handler(httptransport.NewServer(
-		jwt.NewParser(auth.Kf, stdjwt.SigningMethodRS256, auth.KeycloakClaimsFactory)(e.GetCSRStatusEndpoint),
+		authenticate(policy.RequireAuditor()(e.GetCSRStatusEndpoint)),
 		decodeGetCSRStatusRequest,
 		encodeGetCSRStatusResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "GetPendingCSRDB", logger)))...,
 	))
 
 	r.Methods("GET").Path("/v1/csrs/{id}/crt").Handler(httptransport.NewServer(
-		jwt.NewParser(auth.Kf, stdjwt.SigningMethodRS256, auth.KeycloakClaimsFactory)(e.GetCRTEndpoint),
+		authenticate(policy.RequireAuditor()(e.GetCRTEndpoint)),
 		decodeGetCRTRequest,
 		encodeGetCRTResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "GetPendingCSRFile", logger)))...,
 	))
 
+	r.Methods("POST").Path("/v1/csrs/{id}/revoke").Handler(httptransport.NewServer(
+		authenticate(authpkg.RequireRole(revokeRole)(e.RevokeCSREndpoint)),
+		decodeRevokeCSRRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "RevokeCSR", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/crts/{serial}/revoke").Handler(httptransport.NewServer(
+		authenticate(authpkg.RequireRole(revokeRole)(e.RevokeCRTEndpoint)),
+		decodeRevokeCRTRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "RevokeCRT", logger)))...,
+	))
+
+	r.Methods("GET").Path("/v1/csrs/{id}/file").Handler(httptransport.NewServer(
+		authenticate(policy.RequireAuditor()(e.GetCSRFileEndpoint)),
+		decodeGetCRTRequest,
+		encodeGetCSRFileResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "GetCSRFile", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/csrs").Handler(httptransport.NewServer(
+		authenticate(policy.RequireOperator()(e.SubmitCSREndpoint)),
+		decodeSubmitCSRRequest,
+		encodeSubmitCSRResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "SubmitCSR", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/csrs/{id}/approve").Handler(httptransport.NewServer(
+		authenticate(policy.RequireOperator()(e.ApproveCSREndpoint)),
+		decodeUpdateCSRStatusRequest,
+		encodeGetCSRStatusResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "ApproveCSR", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/csrs/{id}/deny").Handler(httptransport.NewServer(
+		authenticate(policy.RequireOperator()(e.DenyCSREndpoint)),
+		decodeUpdateCSRStatusRequest,
+		encodeGetCSRStatusResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "DenyCSR", logger)))...,
+	))
+
 	return r
 }
 
@@ -73,15 +140,62 @@ func decodeHealthRequest(ctx context.Context, r *http.Request) (request interfac
 	return req, nil
 }
 
+// decodeGetCSRsRequest reads the status, cn and o (prefix) filters, the
+// created_after and created_before RFC 3339 dates, the sort field and the
+// page_size and cursor of the page.
 func decodeGetCSRsRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
-	var req getCSRsRequest
-	return req, nil
+	q := r.URL.Query()
+	query := csr.Query{
+		Status:       strings.ToUpper(q.Get("status")),
+		CommonName:   q.Get("cn"),
+		Organization: q.Get("o"),
+		Sort:         q.Get("sort"),
+		PageSize:     defaultPageSize,
+		Cursor:       q.Get("cursor"),
+	}
+	switch query.Status {
+	case "", csr.PendingStatus, csr.ApprobedStatus, csr.DeniedStatus, csr.RevokedStatus:
+	default:
+		return nil, errInvalidQuery
+	}
+	if query.Sort != "" && !sortFields[strings.TrimPrefix(query.Sort, "-")] {
+		return nil, errInvalidQuery
+	}
+	if v := q.Get("created_after"); v != "" {
+		if query.CreatedAfter, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, errInvalidQuery
+		}
+	}
+	if v := q.Get("created_before"); v != "" {
+		if query.CreatedBefore, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, errInvalidQuery
+		}
+	}
+	if v := q.Get("page_size"); v != "" {
+		if query.PageSize, err = strconv.Atoi(v); err != nil || query.PageSize <= 0 || query.PageSize > maxPageSize {
+			return nil, errInvalidQuery
+		}
+	}
+	return getCSRsRequest{Query: query}, nil
 }
 
+// encodeGetCSRsResponse links the page to the adjacent ones with the same
+// query and the cursors returned by the Enroller.
 func encodeGetCSRsResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	resp := response.(getCSRsResponse)
+	if resp.Err != nil {
+		encodeError(ctx, resp.Err, w)
+		return nil
+	}
+	page := hal.NewResource(resp, csrsHref(ctx, resp.Query, resp.Query.Cursor))
+	if resp.Next != "" {
+		page.AddNewLink("next", csrsHref(ctx, resp.Query, resp.Next))
+	}
+	if resp.Prev != "" {
+		page.AddNewLink("prev", csrsHref(ctx, resp.Query, resp.Prev))
+	}
 	w.Header().Set("Content-Type", "application/hal+json; charset=utf-8")
-	return json.NewEncoder(w).Encode(resp)
+	return json.NewEncoder(w).Encode(page)
 }
 
 func decodeGetCSRStatusRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
@@ -92,7 +206,7 @@ func decodeGetCSRStatusRequest(ctx context.Context, r *http.Request) (request in
 	}
 	idNum, err := strconv.Atoi(id)
 	if err != nil {
-		return nil, err
+		return nil, apierrors.Wrap(apierrors.Validation, err)
 	}
 	return getCSRStatusRequest{ID: idNum}, nil
 }
@@ -104,12 +218,7 @@ func encodeGetCSRStatusResponse(ctx context.Context, w http.ResponseWriter, resp
 		return nil
 	}
 	w.Header().Set("Content-Type", "application/hal+json; charset=utf-8")
-	csrHal := hal.NewResource(resp.CSR, "http://localhost:8889/v1/csrs/"+strconv.Itoa(resp.CSR.Id))
-	csrLink := hal.NewLink("http://localhost:8889/v1/csrs/"+strconv.Itoa(resp.CSR.Id)+"/file", hal.LinkAttr{
-		"type": string("application/pkcs10"),
-	})
-	csrHal.AddLink("file", csrLink)
-	return json.NewEncoder(w).Encode(csrHal)
+	return json.NewEncoder(w).Encode(csrResource(ctx, resp.CSR))
 }
 
 func decodeGetCRTRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
@@ -120,7 +229,7 @@ func decodeGetCRTRequest(ctx context.Context, r *http.Request) (request interfac
 	}
 	idNum, err := strconv.Atoi(id)
 	if err != nil {
-		return nil, err
+		return nil, apierrors.Wrap(apierrors.Validation, err)
 	}
 	return getCRTRequest{ID: idNum}, nil
 }
@@ -134,6 +243,9 @@ func encodeGetCRTRequest(ctx context.Context, r *http.Request, request interface
 }
 
 func decodeGetCRTResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := apierrors.FromResponse("enroller", r); err != nil {
+		return nil, err
+	}
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return nil, err
@@ -152,12 +264,45 @@ func encodeGetCRTResponse(ctx context.Context, w http.ResponseWriter, response i
 	return nil
 }
 
+func encodeGetCSRFileResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(getCRTResponse)
+	if resp.Err != nil {
+		encodeError(ctx, resp.Err, w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/pkcs10")
+	w.Write(resp.Data)
+	return nil
+}
+
+func encodeGetCSRFileRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	req := request.(getCRTRequest)
+	r.URL.Path = "/v1/csrs/" + url.QueryEscape(strconv.Itoa(req.ID)) + "/file"
+	return encodeRequest(ctx, r, request)
+}
+
+func decodeGetCSRFileResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := apierrors.FromResponse("enroller", r); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return getCRTResponse{Data: data}, nil
+}
+
 func encodeGetCSRsRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	req := request.(getCSRsRequest)
 	r.URL.Path = "/v1/csrs"
-	return encodeRequest(ctx, r, request)
+	r.URL.RawQuery = req.Query.Values().Encode()
+	return nil
 }
 
 func decodeGetCSRsResponse(ctx context.Context, r *http.Response) (interface{}, error) {
+	if err := apierrors.FromResponse("enroller", r); err != nil {
+		return nil, err
+	}
 	var response getCSRsEmbeddedResponse
 	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
 		return nil, err
@@ -173,6 +318,152 @@ func encodeGetCSRStatusRequest(ctx context.Context, r *http.Request, request int
 }
 
 func decodeGetCSRStatusResponse(ctx context.Context, r *http.Response) (interface{}, error) {
+	if err := apierrors.FromResponse("enroller", r); err != nil {
+		return nil, err
+	}
+	var response csr.CSR
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// decodeRevokeRequest reads the optional revocation reason of the body. An
+// empty body revokes with reason unspecified.
+func decodeRevokeRequest(r *http.Request) (revokeRequest, error) {
+	var req revokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return revokeRequest{}, apierrors.Wrap(apierrors.Validation, err)
+	}
+	code, err := revocationReason(req.Reason)
+	if err != nil {
+		return revokeRequest{}, err
+	}
+	req.ReasonCode = code
+	return req, nil
+}
+
+func decodeRevokeCSRRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	idNum, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, apierrors.Wrap(apierrors.Validation, err)
+	}
+	req, err := decodeRevokeRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	req.ID = idNum
+	return req, nil
+}
+
+func decodeRevokeCRTRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	serial := mux.Vars(r)["serial"]
+	if !serialPattern.MatchString(serial) {
+		return nil, errInvalidSerial
+	}
+	req, err := decodeRevokeRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	req.Serial = strings.ToLower(serial)
+	return req, nil
+}
+
+func encodeRevokeCSRRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	req := request.(revokeRequest)
+	r.URL.Path = "/v1/csrs/" + url.PathEscape(strconv.Itoa(req.ID)) + "/revoke"
+	return encodeRequest(ctx, r, request)
+}
+
+func encodeRevokeCRTRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	req := request.(revokeRequest)
+	r.URL.Path = "/v1/crts/" + url.PathEscape(req.Serial) + "/revoke"
+	return encodeRequest(ctx, r, request)
+}
+
+func decodeRevokeResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := apierrors.FromResponse("enroller", r); err != nil {
+		return nil, err
+	}
+	return revokeResponse{}, nil
+}
+
+// decodeUpdateCSRStatusRequest reads the optional comment of an approval
+// or denial.
+func decodeUpdateCSRStatusRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	idNum, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, apierrors.Wrap(apierrors.Validation, err)
+	}
+	var req updateCSRStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return nil, apierrors.Wrap(apierrors.Validation, err)
+	}
+	req.ID = idNum
+	return req, nil
+}
+
+func encodeUpdateCSRStatusRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	req := request.(updateCSRStatusRequest)
+	r.URL.Path = "/v1/csrs/" + url.PathEscape(strconv.Itoa(req.ID))
+	return encodeRequest(ctx, r, request)
+}
+
+func decodeUpdateCSRStatusResponse(ctx context.Context, r *http.Response) (interface{}, error) {
+	if err := apierrors.FromResponse("enroller", r); err != nil {
+		return nil, err
+	}
+	var response csr.CSR
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// decodeSubmitCSRRequest accepts a JSON body with the CSR and its metadata,
+// or the bare CSR with Content-Type application/pkcs10.
+func decodeSubmitCSRRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxCSRSize))
+	if err != nil {
+		return nil, errInvalidCSR
+	}
+	var req submitCSRRequest
+	data := body
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/pkcs10" {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, apierrors.Wrap(apierrors.Validation, err)
+		}
+		data = []byte(req.PEM)
+	}
+	req.CSR, err = parseCSR(data)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func encodeSubmitCSRResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(getCSRStatusResponse)
+	if resp.Err != nil {
+		encodeError(ctx, resp.Err, w)
+		return nil
+	}
+	w.Header().Set("Location", csrHref(ctx, resp.CSR.Id))
+	w.Header().Set("Content-Type", "application/hal+json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(csrResource(ctx, resp.CSR))
+}
+
+func encodeSubmitCSRRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	r.URL.Path = "/v1/csrs"
+	r.Header.Set("Content-Type", "application/json")
+	return encodeRequest(ctx, r, request)
+}
+
+func decodeSubmitCSRResponse(ctx context.Context, r *http.Response) (interface{}, error) {
+	if err := apierrors.FromResponse("enroller", r); err != nil {
+		return nil, err
+	}
 	var response csr.CSR
 	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
 		return nil, err
@@ -206,12 +497,14 @@ func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 	if err == nil {
 		panic("encodeError with nil error")
 	}
-	http.Error(w, err.Error(), codeFrom(err))
+	apierrors.EncodeProblem(w, tokenError(err))
 }
 
-func codeFrom(err error) int {
+// tokenError marks the errors of the JWT parser as authentication errors.
+func tokenError(err error) error {
 	switch err {
-	default:
-		return http.StatusInternalServerError
+	case jwt.ErrTokenContextMissing, jwt.ErrTokenInvalid, jwt.ErrTokenExpired, jwt.ErrTokenMalformed, jwt.ErrTokenNotActive, jwt.ErrUnexpectedSigningMethod:
+		return apierrors.Wrap(apierrors.Unauthenticated, err)
 	}
+	return err
 }
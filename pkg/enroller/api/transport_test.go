@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/enroller/models/csr"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDecodeGetCSRsRequest(t *testing.T) {
+	testCases := []struct {
+		name  string
+		query string
+		want  csr.Query
+		ret   error
+	}{
+		{"Default page", "", csr.Query{PageSize: defaultPageSize}, nil},
+		{"Filters and page", "status=new&cn=dev&o=Lamassu&sort=-id&page_size=10&cursor=abc", csr.Query{Status: csr.PendingStatus, CommonName: "dev", Organization: "Lamassu", Sort: "-id", PageSize: 10, Cursor: "abc"}, nil},
+		{"Date range", "created_after=2021-01-01T00:00:00Z&created_before=2021-02-01T00:00:00Z", csr.Query{CreatedAfter: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), CreatedBefore: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC), PageSize: defaultPageSize}, nil},
+		{"Status is unknown", "status=pending", csr.Query{}, errInvalidQuery},
+		{"Sort field is unknown", "sort=mail", csr.Query{}, errInvalidQuery},
+		{"Date is not RFC 3339", "created_after=2021-01-01", csr.Query{}, errInvalidQuery},
+		{"Page size is too large", "page_size=5000", csr.Query{}, errInvalidQuery},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/csrs?"+tc.query, nil)
+			req, err := decodeGetCSRsRequest(context.Background(), r)
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err != nil {
+				return
+			}
+			if got := req.(getCSRsRequest).Query; got != tc.want {
+				t.Errorf("Got query %+v; want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecodeRevokeCSRRequest(t *testing.T) {
+	testCases := []struct {
+		name   string
+		body   string
+		code   int
+		status int
+	}{
+		{"Empty body is unspecified", "", 0, http.StatusOK},
+		{"Reason is a CRLReason name", `{"reason":"keyCompromise"}`, 1, http.StatusOK},
+		{"Reason does not revoke", `{"reason":"removeFromCRL"}`, 0, http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/v1/csrs/1/revoke", strings.NewReader(tc.body))
+			r = mux.SetURLVars(r, map[string]string{"id": "1"})
+			req, err := decodeRevokeCSRRequest(context.Background(), r)
+			if err != nil {
+				w := httptest.NewRecorder()
+				encodeError(context.Background(), err, w)
+				if w.Code != tc.status {
+					t.Errorf("Got status %d; want %d", w.Code, tc.status)
+				}
+				return
+			}
+			if tc.status != http.StatusOK {
+				t.Fatalf("Got result is nil; want status %d", tc.status)
+			}
+			if got := req.(revokeRequest).ReasonCode; got != tc.code {
+				t.Errorf("Got reason code %d; want %d", got, tc.code)
+			}
+		})
+	}
+}
+
+func TestEncodeGetCSRsResponse(t *testing.T) {
+	resp := getCSRsResponse{
+		CSRs:  csr.CSRs{CSRs: []csr.CSR{{Id: 1, CommonName: "dev-1"}}},
+		Query: csr.Query{Status: csr.PendingStatus, PageSize: 1, Cursor: "b"},
+		Next:  "c",
+		Prev:  "a",
+	}
+	w := httptest.NewRecorder()
+	ctx := context.WithValue(context.Background(), baseURLContextKey, "https://enroller.example.com")
+	if err := encodeGetCSRsResponse(ctx, w, resp); err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+
+	var body struct {
+		CSRs  csr.CSRs `json:"csr"`
+		Links map[string]struct {
+			Href string `json:"href"`
+		} `json:"_links"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("Could not decode response: %s", err)
+	}
+	if len(body.CSRs.CSRs) != 1 {
+		t.Errorf("Got %d CSRs; want 1", len(body.CSRs.CSRs))
+	}
+	links := map[string]string{
+		"self": "https://enroller.example.com/v1/csrs?cursor=b&page_size=1&status=NEW",
+		"next": "https://enroller.example.com/v1/csrs?cursor=c&page_size=1&status=NEW",
+		"prev": "https://enroller.example.com/v1/csrs?cursor=a&page_size=1&status=NEW",
+	}
+	for rel, href := range links {
+		if body.Links[rel].Href != href {
+			t.Errorf("Got %s link %s; want %s", rel, body.Links[rel].Href, href)
+		}
+	}
+}
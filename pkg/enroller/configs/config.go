@@ -1,9 +1,14 @@
 package configs
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
 
 type Config struct {
-	Port string
+	Port       string
+	HealthPort string
 
 	UIHost     string
 	UIPort     string
@@ -20,10 +25,29 @@ type Config struct {
 	KeycloakRealm    string
 	KeycloakCA       string
 
+	OIDCIssuer    string
+	OIDCCA        string
+	OIDCAudience  string
+	OIDCKeysTTL   time.Duration
+	UsernameClaim string
+	RolesClaims   []string
+
 	CertFile     string
 	KeyFile      string
 	ProxyAddress string
 	ProxyCA      string
+
+	ClientCAs         string
+	ClientCertPolicy  string
+	RequireClientCert bool
+
+	RevokeRole    string
+	AdminRoles    []string
+	OperatorRoles []string
+	AuditorRoles  []string
+
+	PublicURL             string
+	TrustForwardedHeaders bool
 }
 
 func NewConfig(prefix string) (Config, error) {
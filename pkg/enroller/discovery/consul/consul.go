@@ -1,6 +1,8 @@
 package consul
 
 import (
+	"context"
+	"errors"
 	"strconv"
 
 	"math/rand"
@@ -13,7 +15,10 @@ import (
 	"github.com/hashicorp/consul/api"
 )
 
+var errNoLeader = errors.New("Consul cluster has no leader")
+
 type ServiceDiscovery struct {
+	consul       *api.Client
 	client       consulsd.Client
 	logger       log.Logger
 	registration *api.AgentServiceRegistration
@@ -30,16 +35,16 @@ func NewServiceDiscovery(consulProtocol string, consulHost string, consulPort st
 		return nil, err
 	}
 	client := consulsd.NewClient(consulClient)
-	return &ServiceDiscovery{client: client, logger: logger}, nil
+	return &ServiceDiscovery{consul: consulClient, client: client, logger: logger}, nil
 }
 
-func (sd *ServiceDiscovery) Register(advProtocol string, advHost string, advPort string) error {
+func (sd *ServiceDiscovery) Register(advProtocol string, advHost string, advPort string, healthPort string) error {
 	check := api.AgentServiceCheck{
-		HTTP:          advProtocol + "://" + advHost + ":" + advPort + "/v1/health",
+		HTTP:          advProtocol + "://" + advHost + ":" + healthPort + "/v1/health/ready",
 		Interval:      "10s",
-		Timeout:       "1s",
+		Timeout:       "3s",
 		TLSSkipVerify: true,
-		Notes:         "Basic health checks",
+		Notes:         "Readiness checks",
 	}
 
 	port, _ := strconv.Atoi(advPort)
@@ -59,3 +64,16 @@ func (sd *ServiceDiscovery) Register(advProtocol string, advHost string, advPort
 func (sd *ServiceDiscovery) Deregister() error {
 	return sd.client.Deregister(sd.registration)
 }
+
+// Check asks the Consul agent for the cluster leader, which fails when the
+// agent cannot be reached or the cluster cannot elect one.
+func (sd *ServiceDiscovery) Check(ctx context.Context) error {
+	leader, err := sd.consul.Status().Leader()
+	if err != nil {
+		return err
+	}
+	if leader == "" {
+		return errNoLeader
+	}
+	return nil
+}
@@ -41,6 +41,10 @@ func (d *Data) UnmarshalJSON(data []byte) error {
 		return err
 	}
 	switch temp.Embedded.(type) {
+	case nil:
+		// Empty page
+		d.EmbeddedCSRs = nil
+		d.CSRs = nil
 	case map[string]interface{}:
 		var c EmbeddedCSRs
 		if err := json.Unmarshal(data, &c); err != nil {
@@ -0,0 +1,55 @@
+package csr
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Query selects and orders the CSRs listed by the Enroller. Empty fields do
+// not filter. CommonName and Organization match by prefix, and Sort is a
+// field name, prefixed with "-" for descending order. Cursor is the
+// position of a page as returned by the Enroller.
+type Query struct {
+	Status        string
+	CommonName    string
+	Organization  string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Sort          string
+	PageSize      int
+	Cursor        string
+}
+
+// Page is a page of the CSRs matching a Query, with the cursors of the
+// adjacent pages. A cursor is empty when there is no such page.
+type Page struct {
+	CSRs []CSR
+	Next string
+	Prev string
+}
+
+// Values returns q as the query parameters of GET /v1/csrs.
+func (q Query) Values() url.Values {
+	v := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	set("status", q.Status)
+	set("cn", q.CommonName)
+	set("o", q.Organization)
+	if !q.CreatedAfter.IsZero() {
+		v.Set("created_after", q.CreatedAfter.Format(time.RFC3339))
+	}
+	if !q.CreatedBefore.IsZero() {
+		v.Set("created_before", q.CreatedBefore.Format(time.RFC3339))
+	}
+	set("sort", q.Sort)
+	if q.PageSize > 0 {
+		v.Set("page_size", strconv.Itoa(q.PageSize))
+	}
+	set("cursor", q.Cursor)
+	return v
+}
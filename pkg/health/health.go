@@ -0,0 +1,149 @@
+// Package health serves the liveness and readiness probes of the services.
+// Liveness only tells that the process serves requests; readiness runs a
+// Check per dependency and reports each of them. Optional checks cover
+// dependencies the service can run without, such as those configured at
+// runtime, and are reported degraded without failing readiness.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	StatusUp       = "up"
+	StatusDegraded = "degraded"
+	StatusDown     = "down"
+
+	// DefaultTimeout bounds each check when the Checker is created with a
+	// zero timeout.
+	DefaultTimeout = 2 * time.Second
+)
+
+var errTimeout = errors.New("check timed out")
+
+// Check reports whether a dependency is usable, returning the reason when
+// it is not.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of a Check.
+type Result struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the outcome of every Check of a Checker. Status is up when
+// all of them are, down when a required check is and degraded otherwise.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Checker runs the readiness checks of a service.
+type Checker struct {
+	timeout  time.Duration
+	names    []string
+	checks   map[string]Check
+	optional map[string]bool
+}
+
+// NewChecker returns a Checker giving each check up to timeout.
+func NewChecker(timeout time.Duration) *Checker {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Checker{timeout: timeout, checks: make(map[string]Check), optional: make(map[string]bool)}
+}
+
+// Add registers check under name, replacing any check with that name.
+func (c *Checker) Add(name string, check Check) {
+	c.add(name, check, false)
+}
+
+// AddOptional registers check under name like Add, but reports it
+// degraded instead of down when it fails.
+func (c *Checker) AddOptional(name string, check Check) {
+	c.add(name, check, true)
+}
+
+func (c *Checker) add(name string, check Check, optional bool) {
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+	c.optional[name] = optional
+}
+
+// Run runs every check concurrently. A check that does not return within
+// the timeout is reported down; it is left to finish on its own.
+func (c *Checker) Run(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	report := Report{Status: StatusUp, Checks: make(map[string]Result, len(c.names))}
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range c.names {
+		wg.Add(1)
+		go func(name string, check Check, optional bool) {
+			defer wg.Done()
+			res := Result{Status: StatusUp}
+			if err := run(ctx, check); err != nil {
+				res = Result{Status: StatusDown, Error: err.Error()}
+				if optional {
+					res.Status = StatusDegraded
+				}
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			report.Checks[name] = res
+			if res.Status == StatusDown || (res.Status == StatusDegraded && report.Status == StatusUp) {
+				report.Status = res.Status
+			}
+		}(name, c.checks[name], c.optional[name])
+	}
+	wg.Wait()
+	return report
+}
+
+func run(ctx context.Context, check Check) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errTimeout
+	}
+}
+
+// LiveHandler answers 200 OK while the process serves requests, without
+// checking any dependency.
+func LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodeReport(w, Report{Status: StatusUp, Checks: map[string]Result{}})
+	})
+}
+
+// ReadyHandler answers 200 OK unless a required check of c is down, and 503
+// Service Unavailable otherwise, with the Report as body.
+func ReadyHandler(c *Checker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodeReport(w, c.Run(r.Context()))
+	})
+}
+
+func encodeReport(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status == StatusDown {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,79 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyHandler(t *testing.T) {
+	up := func(ctx context.Context) error { return nil }
+	down := func(ctx context.Context) error { return errors.New("connection refused") }
+	hung := func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}
+
+	testCases := []struct {
+		name     string
+		checks   map[string]Check
+		optional map[string]Check
+		code     int
+		ret      string
+		status   map[string]string
+	}{
+		{"Every check is up", map[string]Check{"consul": up, "oidc": up}, map[string]Check{"enroller": up}, http.StatusOK, StatusUp, map[string]string{"consul": StatusUp, "oidc": StatusUp, "enroller": StatusUp}},
+		{"A check is down", map[string]Check{"consul": up, "oidc": down}, nil, http.StatusServiceUnavailable, StatusDown, map[string]string{"consul": StatusUp, "oidc": StatusDown}},
+		{"A check times out", map[string]Check{"consul": hung, "oidc": up}, nil, http.StatusServiceUnavailable, StatusDown, map[string]string{"consul": StatusDown, "oidc": StatusUp}},
+		{"An optional check is down", map[string]Check{"consul": up, "oidc": up}, map[string]Check{"credentials": down}, http.StatusOK, StatusDegraded, map[string]string{"consul": StatusUp, "oidc": StatusUp, "credentials": StatusDegraded}},
+		{"A check and an optional check are down", map[string]Check{"consul": up, "oidc": down}, map[string]Check{"credentials": down}, http.StatusServiceUnavailable, StatusDown, map[string]string{"consul": StatusUp, "oidc": StatusDown, "credentials": StatusDegraded}},
+		{"No checks", map[string]Check{}, nil, http.StatusOK, StatusUp, map[string]string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			c := NewChecker(50 * time.Millisecond)
+			for name, check := range tc.checks {
+				c.Add(name, check)
+			}
+			for name, check := range tc.optional {
+				c.AddOptional(name, check)
+			}
+			rec := httptest.NewRecorder()
+			ReadyHandler(c).ServeHTTP(rec, httptest.NewRequest("GET", "/v1/health/ready", nil))
+			if rec.Code != tc.code {
+				t.Errorf("Got status code is %d; want %d", rec.Code, tc.code)
+			}
+			var report Report
+			if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+				t.Fatalf("Unable to decode report: %s", err)
+			}
+			if report.Status != tc.ret {
+				t.Errorf("Got status is %s; want %s", report.Status, tc.ret)
+			}
+			if len(report.Checks) != len(tc.status) {
+				t.Errorf("Got %d checks reported; want %d", len(report.Checks), len(tc.status))
+			}
+			for name, status := range tc.status {
+				if got := report.Checks[name]; got.Status != status {
+					t.Errorf("Got %s check is %s; want %s", name, got.Status, status)
+				}
+				if got := report.Checks[name]; got.Status != StatusUp && got.Error == "" {
+					t.Errorf("Got %s check is %s without error", name, got.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestLiveHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	LiveHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/v1/health/live", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Got status code is %d; want %d", rec.Code, http.StatusOK)
+	}
+}
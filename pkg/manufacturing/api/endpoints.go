@@ -2,19 +2,39 @@ package api
 
 import (
 	"context"
+	"crypto/x509"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/health"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/ledger"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
 
 	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/go-kit/kit/tracing/opentracing"
 	stdopentracing "github.com/opentracing/opentracing-go"
 )
 
 type Endpoints struct {
-	HealthEndpoint        endpoint.Endpoint
-	PostSetConfigEndpoint endpoint.Endpoint
-	PostGetCRTEndpoint    endpoint.Endpoint
+	HealthEndpoint             endpoint.Endpoint
+	PostSetConfigEndpoint      endpoint.Endpoint
+	PostRollbackConfigEndpoint endpoint.Endpoint
+	GetConfigEndpoint          endpoint.Endpoint
+	PostGetCRTEndpoint         endpoint.Endpoint
+	PostGetCRTBatchEndpoint    endpoint.Endpoint
+	PostEnrollCSREndpoint      endpoint.Endpoint
+	PostReenrollEndpoint       endpoint.Endpoint
+	GetRecordsEndpoint         endpoint.Endpoint
+	GetRecordEndpoint          endpoint.Endpoint
 }
 
-func MakeServerEndpoints(s Service, otTracer stdopentracing.Tracer) Endpoints {
+// MakeServerEndpoints returns the endpoints of s. Errors that are not
+// returned as a whole to the caller, such as those of the devices of a
+// batch, are logged to logger in full.
+func MakeServerEndpoints(s Service, logger log.Logger, otTracer stdopentracing.Tracer) Endpoints {
 	var healthEndpoint endpoint.Endpoint
 	{
 		healthEndpoint = MakeHealthEndpoint(s)
@@ -25,15 +45,57 @@ func MakeServerEndpoints(s Service, otTracer stdopentracing.Tracer) Endpoints {
 		postSetConfigEndpoint = MakePostSetConfigEndpoint(s)
 		postSetConfigEndpoint = opentracing.TraceServer(otTracer, "PostSetConfig")(postSetConfigEndpoint)
 	}
+	var postRollbackConfigEndpoint endpoint.Endpoint
+	{
+		postRollbackConfigEndpoint = MakePostRollbackConfigEndpoint(s)
+		postRollbackConfigEndpoint = opentracing.TraceServer(otTracer, "PostRollbackConfig")(postRollbackConfigEndpoint)
+	}
+	var getConfigEndpoint endpoint.Endpoint
+	{
+		getConfigEndpoint = MakeGetConfigEndpoint(s, logger)
+		getConfigEndpoint = opentracing.TraceServer(otTracer, "GetConfig")(getConfigEndpoint)
+	}
 	var postGetCRTEndpoint endpoint.Endpoint
 	{
 		postGetCRTEndpoint = MakePostGetCRTEndpoint(s)
 		postGetCRTEndpoint = opentracing.TraceServer(otTracer, "PostGetCRT")(postGetCRTEndpoint)
 	}
+	var postGetCRTBatchEndpoint endpoint.Endpoint
+	{
+		postGetCRTBatchEndpoint = MakePostGetCRTBatchEndpoint(s, logger)
+		postGetCRTBatchEndpoint = opentracing.TraceServer(otTracer, "PostGetCRTBatch")(postGetCRTBatchEndpoint)
+	}
+	var postEnrollCSREndpoint endpoint.Endpoint
+	{
+		postEnrollCSREndpoint = MakePostEnrollCSREndpoint(s)
+		postEnrollCSREndpoint = opentracing.TraceServer(otTracer, "PostEnrollCSR")(postEnrollCSREndpoint)
+	}
+	var postReenrollEndpoint endpoint.Endpoint
+	{
+		postReenrollEndpoint = MakePostReenrollEndpoint(s)
+		postReenrollEndpoint = opentracing.TraceServer(otTracer, "PostReenroll")(postReenrollEndpoint)
+	}
+	var getRecordsEndpoint endpoint.Endpoint
+	{
+		getRecordsEndpoint = MakeGetRecordsEndpoint(s)
+		getRecordsEndpoint = opentracing.TraceServer(otTracer, "GetRecords")(getRecordsEndpoint)
+	}
+	var getRecordEndpoint endpoint.Endpoint
+	{
+		getRecordEndpoint = MakeGetRecordEndpoint(s)
+		getRecordEndpoint = opentracing.TraceServer(otTracer, "GetRecord")(getRecordEndpoint)
+	}
 	return Endpoints{
-		HealthEndpoint:        healthEndpoint,
-		PostSetConfigEndpoint: postSetConfigEndpoint,
-		PostGetCRTEndpoint:    postGetCRTEndpoint,
+		HealthEndpoint:             healthEndpoint,
+		PostSetConfigEndpoint:      postSetConfigEndpoint,
+		PostRollbackConfigEndpoint: postRollbackConfigEndpoint,
+		GetConfigEndpoint:          getConfigEndpoint,
+		PostGetCRTEndpoint:         postGetCRTEndpoint,
+		PostGetCRTBatchEndpoint:    postGetCRTBatchEndpoint,
+		PostEnrollCSREndpoint:      postEnrollCSREndpoint,
+		PostReenrollEndpoint:       postReenrollEndpoint,
+		GetRecordsEndpoint:         getRecordsEndpoint,
+		GetRecordEndpoint:          getRecordEndpoint,
 	}
 }
 
@@ -52,19 +114,104 @@ func MakePostSetConfigEndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+func MakePostRollbackConfigEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		err = s.PostRollbackConfig(ctx)
+		return postSetConfigResponse{Err: err}, nil
+	}
+}
+
+// MakeGetConfigEndpoint logs the discovery error of the upstream extension
+// instances in full and only reports it as unavailable.
+func MakeGetConfigEndpoint(s Service, logger log.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		status, err := s.GetConfig(ctx)
+		if status.InstancesErr != nil {
+			level.Error(logger).Log("err", status.InstancesErr, "msg", "Could not discover upstream extension instances")
+		}
+		return newGetConfigResponse(status, err), nil
+	}
+}
+
 func MakePostGetCRTEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(postGetCRTRequest)
-		data, err := s.PostGetCRT(ctx, req.KeyAlg, req.KeySize, req.C, req.ST, req.L, req.O, req.OU, req.CN, req.EMAIL, req.DeviceID, "")
-		return postGetCRTResponse{Data: data, Err: err}, nil
+		creds, err := s.PostGetCRT(ctx, req.KeyAlg, req.KeySize, req.C, req.ST, req.L, req.O, req.OU, req.CN, req.EMAIL, req.DeviceID, req.CaName, req.IdempotencyKey, req.Reprovision)
+		return postGetCRTResponse{Credentials: creds, Format: req.Format, Password: req.Password, Err: err}, nil
+	}
+}
+
+// MakePostGetCRTBatchEndpoint reports the status of each failed device
+// with the detail of apierrors.Detail.
+func MakePostGetCRTBatchEndpoint(s Service, logger log.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postGetCRTBatchRequest)
+		results, err := s.PostGetCRTBatch(ctx, req.Devices)
+		if err != nil {
+			return postGetCRTBatchResponse{Err: err}, nil
+		}
+		resp := postGetCRTBatchResponse{Results: make([]deviceResult, 0, len(results))}
+		for _, r := range results {
+			res := deviceResult{DeviceID: r.DeviceID}
+			if r.Err == nil {
+				res.credentialsEnvelope, r.Err = newCredentialsEnvelope(r.Credentials, req.Password)
+			}
+			if r.Err != nil {
+				res.Status, res.Err = apierrors.StatusCode(r.Err), apierrors.Detail(r.Err)
+				if res.Status >= 500 {
+					level.Error(logger).Log("err", r.Err, "msg", "Could not provision device of batch", "device_id", r.DeviceID)
+				}
+				resp.Failed++
+			} else {
+				resp.Succeeded++
+			}
+			resp.Results = append(resp.Results, res)
+		}
+		return resp, nil
+	}
+}
+
+func MakePostEnrollCSREndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postEnrollCSRRequest)
+		creds, err := s.PostEnrollCSR(ctx, req.CSR, req.DeviceID, req.CaName, req.IdempotencyKey, req.Reprovision)
+		return postEnrollCSRResponse{Credentials: creds, Format: req.Format, Err: err}, nil
+	}
+}
+
+func MakePostReenrollEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postReenrollRequest)
+		creds, err := s.PostReenroll(ctx, req.Current, req.CSR, req.IdempotencyKey)
+		return postEnrollCSRResponse{Credentials: creds, Format: req.Format, Err: err}, nil
+	}
+}
+
+func MakeGetRecordsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getRecordsRequest)
+		records, err := s.GetRecords(ctx, req.Filter)
+		return getRecordsResponse{Records: records, Err: err}, nil
+	}
+}
+
+func MakeGetRecordEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getRecordRequest)
+		rec, err := s.GetRecord(ctx, req.ID)
+		return getRecordResponse{Record: rec, Err: err}, nil
 	}
 }
 
 type healthRequest struct{}
 
+// healthResponse is the health of the service. Status and Checks report
+// its dependencies, filled in by the transport.
 type healthResponse struct {
-	Healthy bool  `json:"healthy,omitempty"`
-	Err     error `json:"err,omitempty"`
+	Healthy bool                     `json:"healthy,omitempty"`
+	Status  string                   `json:"status,omitempty"`
+	Checks  map[string]health.Result `json:"checks,omitempty"`
+	Err     error                    `json:"err,omitempty"`
 }
 
 type postSetConfigRequest struct {
@@ -82,23 +229,127 @@ type postSetConfigResponse struct {
 
 func (r postSetConfigResponse) error() error { return r.Err }
 
+type getConfigResponse struct {
+	Started        bool               `json:"started"`
+	CA             string             `json:"ca,omitempty"`
+	Certificate    *certificateStatus `json:"certificate,omitempty"`
+	Instances      []string           `json:"instances"`
+	InstancesError string             `json:"instances_error,omitempty"`
+	Err            error              `json:"error,omitempty"`
+}
+
+type certificateStatus struct {
+	Subject  string    `json:"subject"`
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+func newGetConfigResponse(status client.Status, err error) getConfigResponse {
+	resp := getConfigResponse{Started: status.Started, CA: status.CA, Instances: status.Instances, Err: err}
+	if resp.Instances == nil {
+		resp.Instances = []string{}
+	}
+	if status.InstancesErr != nil {
+		resp.InstancesError = apierrors.Detail(&apierrors.Error{Kind: apierrors.UpstreamUnavailable, Err: status.InstancesErr})
+	}
+	if crt := status.Certificate; crt != nil {
+		resp.Certificate = &certificateStatus{Subject: crt.Subject.String(), Serial: utils.SerialNumber(crt.SerialNumber), NotAfter: crt.NotAfter}
+	}
+	return resp
+}
+
+func (r getConfigResponse) error() error { return r.Err }
+
 type postGetCRTRequest struct {
-	KeyAlg   string `json:"keyAlg"`
-	KeySize  int    `json:"keySize"`
-	C        string `json:"c"`
-	ST       string `json:"string"`
-	L        string `json:"l"`
-	O        string `json:"o"`
-	OU       string `json:"ou"`
-	CN       string `json:"cn"`
-	EMAIL    string `json:"email"`
-	DeviceID string `json:"device_id"`
-	CaName   string `json:"ca_name"`
+	KeyAlg         string `json:"keyAlg"`
+	KeySize        int    `json:"keySize"`
+	C              string `json:"c"`
+	ST             string `json:"st"`
+	L              string `json:"l"`
+	O              string `json:"o"`
+	OU             string `json:"ou"`
+	CN             string `json:"cn"`
+	EMAIL          string `json:"email"`
+	DeviceID       string `json:"device_id"`
+	CaName         string `json:"ca_name"`
+	Password       string `json:"password"`
+	Reprovision    bool   `json:"reprovision"`
+	IdempotencyKey string `json:"-"`
+	Format         string `json:"-"`
 }
 
 type postGetCRTResponse struct {
-	Data []byte `json:"crt"`
-	Err  error  `json:"error,omitempty"`
+	Credentials *Credentials
+	Format      string
+	Password    string
+	Err         error
 }
 
 func (r postGetCRTResponse) error() error { return r.Err }
+
+type postEnrollCSRRequest struct {
+	CSR            string `json:"csr"`
+	DeviceID       string `json:"device_id"`
+	CaName         string `json:"ca_name"`
+	Reprovision    bool   `json:"reprovision"`
+	IdempotencyKey string `json:"-"`
+	Format         string `json:"-"`
+}
+
+type postEnrollCSRResponse struct {
+	Credentials *Credentials
+	Format      string
+	Err         error
+}
+
+func (r postEnrollCSRResponse) error() error { return r.Err }
+
+type postReenrollRequest struct {
+	CSR            string            `json:"csr"`
+	Current        *x509.Certificate `json:"-"`
+	IdempotencyKey string            `json:"-"`
+	Format         string            `json:"-"`
+}
+
+type postGetCRTBatchRequest struct {
+	Devices  []DeviceRequest `json:"devices"`
+	Password string          `json:"password"`
+}
+
+type deviceResult struct {
+	DeviceID string `json:"device_id"`
+	credentialsEnvelope
+	Status int    `json:"status,omitempty"`
+	Err    string `json:"error,omitempty"`
+}
+
+type postGetCRTBatchResponse struct {
+	Results   []deviceResult `json:"results"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Err       error          `json:"error,omitempty"`
+}
+
+func (r postGetCRTBatchResponse) error() error { return r.Err }
+
+type getRecordsRequest struct {
+	Filter ledger.Filter
+}
+
+type getRecordsResponse struct {
+	Records []ledger.Record `json:"records"`
+	Err     error           `json:"error,omitempty"`
+}
+
+func (r getRecordsResponse) error() error { return r.Err }
+
+type getRecordRequest struct {
+	ID string
+}
+
+type getRecordResponse struct {
+	ledger.Record
+	Err error `json:"error,omitempty"`
+}
+
+func (r getRecordResponse) error() error { return r.Err }
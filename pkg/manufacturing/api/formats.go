@@ -0,0 +1,210 @@
+package api
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// Media types of the formats issued credentials can be returned in.
+const (
+	pemContentType            = "application/x-pem-file"
+	pkcs12ContentType         = "application/x-pkcs12"
+	encryptedPKCS8ContentType = "application/pkcs8-encrypted"
+	jsonContentType           = "application/json"
+)
+
+var (
+	// credentialsFormats are the formats offered for certificates issued
+	// with a key pair generated by the DMS, in order of preference.
+	credentialsFormats = []string{pemContentType, pkcs12ContentType, encryptedPKCS8ContentType, jsonContentType}
+	// wrappedCredentialsFormats are the formats offered when the key
+	// provider only exports wrapped keys, which PKCS#12 cannot hold.
+	wrappedCredentialsFormats = []string{pemContentType, encryptedPKCS8ContentType, jsonContentType}
+	// certificateFormats are the formats offered for certificates issued
+	// from a CSR, for which the DMS does not hold the private key.
+	certificateFormats = []string{pemContentType, jsonContentType}
+)
+
+var (
+	errNotAcceptable    = apierrors.New(apierrors.NotAcceptable, "none of the accepted formats can be produced")
+	errPasswordRequired = apierrors.New(apierrors.Validation, "invalid content, password is required for the requested format")
+)
+
+// credentialsEnvelope is the JSON representation of issued credentials.
+type credentialsEnvelope struct {
+	Certificate string `json:"crt"`
+	Chain       string `json:"chain,omitempty"`
+	PrivateKey  string `json:"key,omitempty"`
+}
+
+// negotiateFormat selects the offer that best matches an Accept header. An
+// empty header accepts any offer, in which case the first one is chosen.
+func negotiateFormat(accept string, offers []string) (string, error) {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], nil
+	}
+
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	excluded := make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		r := mediaRange{mediaType: strings.ToLower(strings.TrimSpace(params[0])), q: 1}
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					r.q = q
+				}
+			}
+		}
+		if r.q <= 0 {
+			excluded[r.mediaType] = true
+		} else if r.mediaType != "" {
+			ranges = append(ranges, r)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	for _, r := range ranges {
+		for _, offer := range offers {
+			if !excluded[offer] && mediaTypeMatches(r.mediaType, offer) {
+				return offer, nil
+			}
+		}
+	}
+	return "", errNotAcceptable
+}
+
+func mediaTypeMatches(mediaRange, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+	if strings.HasSuffix(mediaRange, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*"))
+	}
+	return false
+}
+
+// requiresPassword reports whether the private key is always encrypted in
+// the given format.
+func requiresPassword(format string) bool {
+	return format == pkcs12ContentType || format == encryptedPKCS8ContentType
+}
+
+// offeredCredentialsFormats returns the formats credentials generated by
+// provider can be returned in, so that a format that cannot hold its keys is
+// refused before any certificate is issued.
+func offeredCredentialsFormats(provider keys.Provider) []string {
+	if provider.WrapsKeys() {
+		return wrappedCredentialsFormats
+	}
+	return credentialsFormats
+}
+
+// encodeCredentials serializes creds in the given format, returning the
+// content type of the result. PEM bundles hold the certificate followed by
+// its CA chain and the private key. The private key is encrypted with
+// password when the format requires it, and in the JSON envelope when it
+// is set. PKCS#12 files are encrypted with AES-256-CBC and PBKDF2 rather
+// than the legacy RC2 and 3DES algorithms. Keys exported wrapped by the key
+// provider are returned as they are, and cannot be packed in PKCS#12.
+func encodeCredentials(format string, creds *Credentials, password string) (string, []byte, error) {
+	if requiresPassword(format) && password == "" {
+		return "", nil, errPasswordRequired
+	}
+	if requiresPassword(format) && creds.PrivateKey == nil {
+		return "", nil, errNotAcceptable
+	}
+	if _, wrapped := creds.PrivateKey.(*keys.EncryptedKey); wrapped && format == pkcs12ContentType {
+		return "", nil, errNotAcceptable
+	}
+
+	switch format {
+	case pemContentType:
+		data := append(utils.PEMCert(creds.Certificate.Raw), pemChain(creds.Chain)...)
+		if creds.PrivateKey != nil {
+			key, err := pemPrivateKey(creds.PrivateKey, "")
+			if err != nil {
+				return "", nil, err
+			}
+			data = append(data, key...)
+		}
+		return pemContentType, data, nil
+	case encryptedPKCS8ContentType:
+		key, err := pemPrivateKey(creds.PrivateKey, password)
+		if err != nil {
+			return "", nil, err
+		}
+		data := append(utils.PEMCert(creds.Certificate.Raw), pemChain(creds.Chain)...)
+		return encryptedPKCS8ContentType, append(data, key...), nil
+	case pkcs12ContentType:
+		data, err := pkcs12.Modern.Encode(creds.PrivateKey, creds.Certificate, creds.Chain, password)
+		if err != nil {
+			return "", nil, err
+		}
+		return pkcs12ContentType, data, nil
+	case jsonContentType:
+		envelope, err := newCredentialsEnvelope(creds, password)
+		if err != nil {
+			return "", nil, err
+		}
+		data, err := json.Marshal(envelope)
+		if err != nil {
+			return "", nil, err
+		}
+		return jsonContentType, data, nil
+	default:
+		return "", nil, errNotAcceptable
+	}
+}
+
+func newCredentialsEnvelope(creds *Credentials, password string) (credentialsEnvelope, error) {
+	envelope := credentialsEnvelope{
+		Certificate: string(utils.PEMCert(creds.Certificate.Raw)),
+		Chain:       string(pemChain(creds.Chain)),
+	}
+	if creds.PrivateKey == nil {
+		return envelope, nil
+	}
+	key, err := pemPrivateKey(creds.PrivateKey, password)
+	if err != nil {
+		return envelope, err
+	}
+	envelope.PrivateKey = string(key)
+	return envelope, nil
+}
+
+// pemPrivateKey encodes key, encrypted with password when it is set. Keys
+// wrapped by the key provider are already encrypted and ignore password.
+func pemPrivateKey(key crypto.PrivateKey, password string) ([]byte, error) {
+	if wrapped, ok := key.(*keys.EncryptedKey); ok {
+		return pem.EncodeToMemory(&pem.Block{Type: utils.EncryptedKeyPEMBlockType, Bytes: wrapped.DER}), nil
+	}
+	if password != "" {
+		return utils.PEMEncryptedKey(key, password)
+	}
+	return utils.PEMKey(key)
+}
+
+func pemChain(chain []*x509.Certificate) []byte {
+	var data []byte
+	for _, crt := range chain {
+		data = append(data, utils.PEMCert(crt.Raw)...)
+	}
+	return data
+}
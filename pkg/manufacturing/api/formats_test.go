@@ -0,0 +1,320 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys/memory"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
+	"golang.org/x/crypto/pbkdf2"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	testCases := []struct {
+		name   string
+		accept string
+		offers []string
+		format string
+		ret    error
+	}{
+		{"Missing header defaults to PEM", "", credentialsFormats, pemContentType, nil},
+		{"Any media type defaults to PEM", "*/*", credentialsFormats, pemContentType, nil},
+		{"Exact media type is selected", "application/x-pkcs12", credentialsFormats, pkcs12ContentType, nil},
+		{"Highest quality is selected", "application/json;q=0.5, application/pkcs8-encrypted", credentialsFormats, encryptedPKCS8ContentType, nil},
+		{"Excluded media type is skipped", "application/x-pem-file;q=0, application/*", credentialsFormats, pkcs12ContentType, nil},
+		{"Key formats are not offered for CSR enrollment", "application/x-pkcs12", certificateFormats, "", errNotAcceptable},
+		{"PKCS#12 is not offered for wrapped keys", "application/x-pkcs12", wrappedCredentialsFormats, "", errNotAcceptable},
+		{"Unknown media type is not acceptable", "text/html", credentialsFormats, "", errNotAcceptable},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			format, err := negotiateFormat(tc.accept, tc.offers)
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if format != tc.format {
+				t.Errorf("Got format %s; want %s", format, tc.format)
+			}
+		})
+	}
+}
+
+func TestEncodeCredentials(t *testing.T) {
+	const password = "s3cr3t"
+	testCases := []struct {
+		name     string
+		keyAlg   string
+		keySize  int
+		format   string
+		password string
+		noKey    bool
+		ret      error
+	}{
+		{"RSA key in PEM bundle", "RSA", 2048, pemContentType, "", false, nil},
+		{"EC key in PEM bundle", "EC", 256, pemContentType, "", false, nil},
+		{"Ed25519 key in PEM bundle", "Ed25519", 0, pemContentType, "", false, nil},
+		{"Ed25519 key in PKCS#12", "Ed25519", 0, pkcs12ContentType, password, false, nil},
+		{"Certificate only in PEM bundle", "EC", 256, pemContentType, "", true, nil},
+		{"EC key in PKCS#12", "EC", 256, pkcs12ContentType, password, false, nil},
+		{"RSA key in encrypted PKCS#8", "RSA", 2048, encryptedPKCS8ContentType, password, false, nil},
+		{"EC key in JSON envelope", "EC", 384, jsonContentType, "", false, nil},
+		{"Encrypted EC key in JSON envelope", "EC", 384, jsonContentType, password, false, nil},
+		{"PKCS#12 without password", "EC", 256, pkcs12ContentType, "", false, errPasswordRequired},
+		{"PKCS#12 without key", "EC", 256, pkcs12ContentType, password, true, errNotAcceptable},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			key, err := testSCEPKey(tc.keyAlg, tc.keySize)
+			if err != nil {
+				t.Fatal("Unable to generate key")
+			}
+			crt, err := testSCEPCert(key)
+			if err != nil {
+				t.Fatal("Unable to create certificate")
+			}
+			creds := &Credentials{Certificate: crt, Chain: []*x509.Certificate{crt}, PrivateKey: key}
+			if tc.noKey {
+				creds.PrivateKey = nil
+			}
+
+			contentType, data, err := encodeCredentials(tc.format, creds, tc.password)
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err != nil {
+				return
+			}
+
+			var gotKey interface{}
+			switch tc.format {
+			case pemContentType, encryptedPKCS8ContentType:
+				if contentType != tc.format {
+					t.Errorf("Got content type %s; want %s", contentType, tc.format)
+				}
+				gotKey = parsePEMBundle(t, data, crt, tc.password)
+			case pkcs12ContentType:
+				var gotCrt *x509.Certificate
+				var gotChain []*x509.Certificate
+				gotKey, gotCrt, gotChain, err = pkcs12.DecodeChain(data, tc.password)
+				if err != nil {
+					t.Fatalf("Unable to decode PKCS#12: %s", err)
+				}
+				if !gotCrt.Equal(crt) || len(gotChain) != 1 {
+					t.Error("PKCS#12 certificate or chain does not match")
+				}
+				pbes2, _ := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13})
+				if !bytes.Contains(data, pbes2) {
+					t.Error("PKCS#12 is not encrypted with PBES2")
+				}
+			case jsonContentType:
+				var envelope credentialsEnvelope
+				if err := json.Unmarshal(data, &envelope); err != nil {
+					t.Fatalf("Unable to decode JSON envelope: %s", err)
+				}
+				gotKey = parsePEMBundle(t, []byte(envelope.Certificate+envelope.Chain+envelope.PrivateKey), crt, tc.password)
+			}
+			if !samePrivateKey(gotKey, creds.PrivateKey) {
+				t.Error("Encoded private key does not match")
+			}
+		})
+	}
+}
+
+func TestEncodeWrappedCredentials(t *testing.T) {
+	key, err := testSCEPKey("EC", 256)
+	if err != nil {
+		t.Fatal("Unable to generate key")
+	}
+	crt, err := testSCEPCert(key)
+	if err != nil {
+		t.Fatal("Unable to create certificate")
+	}
+	wrapped := &keys.EncryptedKey{DER: []byte("wrapped key")}
+	creds := &Credentials{Certificate: crt, Chain: []*x509.Certificate{crt}, PrivateKey: wrapped}
+
+	testCases := []struct {
+		name     string
+		format   string
+		password string
+		ret      error
+	}{
+		{"Wrapped key in PEM bundle", pemContentType, "", nil},
+		{"Wrapped key in encrypted PKCS#8", encryptedPKCS8ContentType, "s3cr3t", nil},
+		{"Wrapped key in JSON envelope", jsonContentType, "s3cr3t", nil},
+		{"Wrapped key in PKCS#12", pkcs12ContentType, "s3cr3t", errNotAcceptable},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			_, data, err := encodeCredentials(tc.format, creds, tc.password)
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err != nil {
+				return
+			}
+			if tc.format == jsonContentType {
+				var envelope credentialsEnvelope
+				if err := json.Unmarshal(data, &envelope); err != nil {
+					t.Fatalf("Unable to decode JSON envelope: %s", err)
+				}
+				data = []byte(envelope.PrivateKey)
+			}
+			var block *pem.Block
+			for rest := data; ; {
+				if block, rest = pem.Decode(rest); block == nil || block.Type != utils.CertPEMBlockType {
+					break
+				}
+			}
+			if block == nil || block.Type != utils.EncryptedKeyPEMBlockType || string(block.Bytes) != string(wrapped.DER) {
+				t.Error("Wrapped key is not returned as it was exported")
+			}
+		})
+	}
+}
+
+// wrappingProvider stands for a key provider which exports wrapped keys.
+type wrappingProvider struct {
+	keys.Provider
+}
+
+func (p wrappingProvider) WrapsKeys() bool {
+	return true
+}
+
+func TestDecodePostGetCRTRequestFormat(t *testing.T) {
+	testCases := []struct {
+		name     string
+		provider keys.Provider
+		accept   string
+		format   string
+		ret      error
+	}{
+		{"PKCS#12 is offered for plain keys", memory.NewProvider(), "application/x-pkcs12", pkcs12ContentType, nil},
+		{"PKCS#12 is refused for wrapped keys", wrappingProvider{}, "application/x-pkcs12", "", errNotAcceptable},
+		{"Next format is selected for wrapped keys", wrappingProvider{}, "application/x-pkcs12, application/pkcs8-encrypted;q=0.5", encryptedPKCS8ContentType, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/v1/device", strings.NewReader(`{"password":"s3cr3t"}`))
+			r.Header.Set("Accept", tc.accept)
+			req, err := decodePostGetCRTRequest(tc.provider)(context.Background(), r)
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err != nil {
+				return
+			}
+			if format := req.(postGetCRTRequest).Format; format != tc.format {
+				t.Errorf("Got format %s; want %s", format, tc.format)
+			}
+		})
+	}
+}
+
+// parsePEMBundle checks the certificate and chain of a PEM bundle and
+// returns its private key, checking that the block type matches the key
+// encoding.
+func parsePEMBundle(t *testing.T, data []byte, crt *x509.Certificate, password string) interface{} {
+	t.Helper()
+
+	block, rest := pem.Decode(data)
+	if err := utils.CheckPEMBlock(block, utils.CertPEMBlockType); err != nil || string(block.Bytes) != string(crt.Raw) {
+		t.Fatal("PEM bundle does not start with the issued certificate")
+	}
+	block, rest = pem.Decode(rest)
+	if err := utils.CheckPEMBlock(block, utils.CertPEMBlockType); err != nil {
+		t.Fatal("PEM bundle does not contain the CA chain")
+	}
+	block, _ = pem.Decode(rest)
+	if block == nil {
+		return nil
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case utils.KeyPEMBlockType:
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case utils.ECKeyPEMBlockType:
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case utils.PKCS8KeyPEMBlockType:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case utils.EncryptedKeyPEMBlockType:
+		key, err = x509.ParsePKCS8PrivateKey(decryptPKCS8(t, block.Bytes, password))
+	default:
+		t.Fatalf("Unexpected PEM block type %s", block.Type)
+	}
+	if err != nil {
+		t.Fatalf("Unable to parse %s block: %s", block.Type, err)
+	}
+	return key
+}
+
+func decryptPKCS8(t *testing.T, der []byte, password string) []byte {
+	t.Helper()
+
+	var info struct {
+		Algo          pkix.AlgorithmIdentifier
+		EncryptedData []byte
+	}
+	var params struct {
+		KDF pkix.AlgorithmIdentifier
+		Enc pkix.AlgorithmIdentifier
+	}
+	var kdf struct {
+		Salt       []byte
+		Iterations int
+		KeyLength  int
+		PRF        pkix.AlgorithmIdentifier
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		t.Fatalf("Unable to parse EncryptedPrivateKeyInfo: %s", err)
+	}
+	if _, err := asn1.Unmarshal(info.Algo.Parameters.FullBytes, &params); err != nil {
+		t.Fatalf("Unable to parse PBES2 parameters: %s", err)
+	}
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf); err != nil {
+		t.Fatalf("Unable to parse PBKDF2 parameters: %s", err)
+	}
+	if _, err := asn1.Unmarshal(params.Enc.Parameters.FullBytes, &iv); err != nil {
+		t.Fatalf("Unable to parse IV: %s", err)
+	}
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(password), kdf.Salt, kdf.Iterations, kdf.KeyLength, sha256.New))
+	if err != nil {
+		t.Fatal("Unable to create cipher")
+	}
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.EncryptedData)
+	return plain[:len(plain)-int(plain[len(plain)-1])]
+}
+
+func samePrivateKey(a, b interface{}) bool {
+	switch a := a.(type) {
+	case *rsa.PrivateKey:
+		return a.Equal(b)
+	case *ecdsa.PrivateKey:
+		return a.Equal(b)
+	case ed25519.PrivateKey:
+		return a.Equal(b)
+	default:
+		return a == nil && b == nil
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/ledger"
+)
+
+var (
+	errIdempotencyConflict = apierrors.New(apierrors.Conflict, "idempotency key was already used for a different request")
+	errRequestInProgress   = apierrors.New(apierrors.Conflict, "a request with the same idempotency key is in progress")
+	errAlreadyProvisioned  = apierrors.New(apierrors.Conflict, "device already provisioned and its private key is not kept, set reprovision to issue new credentials")
+	errDeviceConflict      = apierrors.New(apierrors.Conflict, "device already provisioned by a different request, set reprovision to issue new credentials")
+)
+
+// headerKeyPrefix keeps the keys sent by callers apart from the device IDs
+// used as keys of requests without one.
+const headerKeyPrefix = "key:"
+
+// idempotencyKeyFor returns the key identifying retries of a provisioning
+// request: the Idempotency-Key header when sent, or the device ID.
+func idempotencyKeyFor(idempotencyKey string, deviceId string) string {
+	if idempotencyKey != "" {
+		return headerKeyPrefix + idempotencyKey
+	}
+	return deviceId
+}
+
+// requestHash fingerprints the parameters of a provisioning request, so
+// that a retry can be told apart from a different request reusing its
+// idempotency key.
+func requestHash(params ...interface{}) string {
+	h := sha256.New()
+	for _, p := range params {
+		fmt.Fprintf(h, "%v\x00", p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// begin claims the idempotency key and the device of rec until the
+// returned release function is called. Unless reprovision is set, it
+// returns the record of the certificate already issued for the same
+// request, or errIdempotencyConflict when the key was used for a different
+// one. A key sent by the caller, as told by explicit, stays bound to its
+// first request even with reprovision set, while reprovision replaces the
+// request of a device ID. Requests provisioning a device, rather than
+// renewing its certificate, are also checked against the last certificate
+// issued to the device whatever key it was requested with, and fail with
+// errDeviceConflict when it was for a different request. Failed attempts
+// are not replayed and can be retried. Requests without key are not
+// checked.
+func (s *deviceService) begin(ctx context.Context, rec ledger.Record, explicit bool, reprovision bool) (prev *ledger.Record, release func(), err error) {
+	key := rec.IdempotencyKey
+	if key == "" {
+		return nil, func() {}, nil
+	}
+	claimed := []string{key}
+	if rec.DeviceID != "" && rec.DeviceID != key {
+		claimed = append(claimed, rec.DeviceID)
+	}
+
+	s.mtx.Lock()
+	for _, k := range claimed {
+		if s.inFlight[k] {
+			s.mtx.Unlock()
+			return nil, nil, errRequestInProgress
+		}
+	}
+	for _, k := range claimed {
+		s.inFlight[k] = true
+	}
+	s.mtx.Unlock()
+	release = func() {
+		s.mtx.Lock()
+		for _, k := range claimed {
+			delete(s.inFlight, k)
+		}
+		s.mtx.Unlock()
+	}
+
+	if reprovision && !explicit {
+		return nil, release, nil
+	}
+	var issued ledger.Record
+	conflict := errIdempotencyConflict
+	err = ledger.ErrNotFound
+	if explicit || rec.Renews != "" {
+		issued, err = s.ledger.LastIssued(ctx, key)
+	}
+	if err == ledger.ErrNotFound && rec.Renews == "" && !reprovision {
+		if explicit {
+			conflict = errDeviceConflict
+		}
+		issued, err = s.ledger.LastIssuedToDevice(ctx, rec.DeviceID)
+	}
+	switch {
+	case err == ledger.ErrNotFound:
+		return nil, release, nil
+	case err != nil:
+		release()
+		return nil, nil, errLedgerRead
+	case issued.RequestHash != rec.RequestHash:
+		release()
+		return nil, nil, conflict
+	case reprovision:
+		return nil, release, nil
+	default:
+		return &issued, release, nil
+	}
+}
+
+// replayCredentials returns the certificate and chain stored in the record
+// of an earlier request.
+func replayCredentials(rec *ledger.Record) (*Credentials, error) {
+	crt, err := x509.ParseCertificate(rec.Certificate)
+	if err != nil {
+		return nil, errLedgerRead
+	}
+	creds := &Credentials{Certificate: crt}
+	for _, der := range rec.Chain {
+		ca, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errLedgerRead
+		}
+		creds.Chain = append(creds.Chain, ca)
+	}
+	return creds, nil
+}
@@ -2,9 +2,13 @@ package api
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
 	"time"
 
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/ledger"
+
 	"github.com/go-kit/kit/metrics"
 )
 
@@ -34,14 +38,44 @@ func (mw *instrumentingMiddleware) Health(ctx context.Context) bool {
 	return mw.next.Health(ctx)
 }
 
-func (mw *instrumentingMiddleware) PostGetCRT(ctx context.Context, keyAlg string, keySize int, c, st, l, o, ou, cn, email, deviceId, caName string) (data []byte, err error) {
+func (mw *instrumentingMiddleware) PostGetCRT(ctx context.Context, keyAlg string, keySize int, c, st, l, o, ou, cn, email, deviceId, caName string, idempotencyKey string, reprovision bool) (creds *Credentials, err error) {
 	defer func(begin time.Time) {
 		lvs := []string{"method", "PostGetCRT", "error", fmt.Sprint(err != nil)}
 		mw.requestCount.With(lvs...).Add(1)
 		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return mw.next.PostGetCRT(ctx, keyAlg, keySize, c, st, l, o, ou, cn, email, deviceId, "")
+	return mw.next.PostGetCRT(ctx, keyAlg, keySize, c, st, l, o, ou, cn, email, deviceId, caName, idempotencyKey, reprovision)
+}
+
+func (mw *instrumentingMiddleware) PostGetCRTBatch(ctx context.Context, devices []DeviceRequest) (results []DeviceResult, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "PostGetCRTBatch", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.PostGetCRTBatch(ctx, devices)
+}
+
+func (mw *instrumentingMiddleware) PostEnrollCSR(ctx context.Context, csr string, deviceId, caName string, idempotencyKey string, reprovision bool) (creds *Credentials, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "PostEnrollCSR", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.PostEnrollCSR(ctx, csr, deviceId, caName, idempotencyKey, reprovision)
+}
+
+func (mw *instrumentingMiddleware) PostReenroll(ctx context.Context, current *x509.Certificate, csr string, idempotencyKey string) (creds *Credentials, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "PostReenroll", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.PostReenroll(ctx, current, csr, idempotencyKey)
 }
 
 func (mw *instrumentingMiddleware) PostSetConfig(ctx context.Context, authCRT string, CA string) (err error) {
@@ -53,3 +87,43 @@ func (mw *instrumentingMiddleware) PostSetConfig(ctx context.Context, authCRT st
 
 	return mw.next.PostSetConfig(ctx, authCRT, CA)
 }
+
+func (mw *instrumentingMiddleware) PostRollbackConfig(ctx context.Context) (err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "PostRollbackConfig", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.PostRollbackConfig(ctx)
+}
+
+func (mw *instrumentingMiddleware) GetConfig(ctx context.Context) (status client.Status, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "GetConfig", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.GetConfig(ctx)
+}
+
+func (mw *instrumentingMiddleware) GetRecords(ctx context.Context, filter ledger.Filter) (records []ledger.Record, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "GetRecords", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.GetRecords(ctx, filter)
+}
+
+func (mw *instrumentingMiddleware) GetRecord(ctx context.Context, id string) (rec ledger.Record, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "GetRecord", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.GetRecord(ctx, id)
+}
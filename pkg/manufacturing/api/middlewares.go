@@ -2,8 +2,13 @@ package api
 
 import (
 	"context"
+	"crypto/x509"
 	"time"
 
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/ledger"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
 	"github.com/go-kit/kit/log"
 )
 
@@ -34,7 +39,7 @@ func (mw loggingMidleware) Health(ctx context.Context) (healthy bool) {
 	return mw.next.Health(ctx)
 }
 
-func (mw loggingMidleware) PostGetCRT(ctx context.Context, keyAlg string, keySize int, c, st, l, o, ou, cn, email, deviceId, caName string) (data []byte, err error) {
+func (mw loggingMidleware) PostGetCRT(ctx context.Context, keyAlg string, keySize int, c, st, l, o, ou, cn, email, deviceId, caName string, idempotencyKey string, reprovision bool) (creds *Credentials, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "PostGetCRT",
@@ -50,9 +55,60 @@ func (mw loggingMidleware) PostGetCRT(ctx context.Context, keyAlg string, keySiz
 			"took", time.Since(begin),
 			"err", err,
 			"deviceId", deviceId,
+			"ca_name", caName,
+			"idempotency_key", idempotencyKey,
+			"reprovision", reprovision,
+		)
+	}(time.Now())
+	return mw.next.PostGetCRT(ctx, keyAlg, keySize, c, st, l, o, ou, cn, email, deviceId, caName, idempotencyKey, reprovision)
+}
+
+func (mw loggingMidleware) PostGetCRTBatch(ctx context.Context, devices []DeviceRequest) (results []DeviceResult, err error) {
+	defer func(begin time.Time) {
+		failed := 0
+		for _, r := range results {
+			if r.Err != nil {
+				failed++
+			}
+		}
+		mw.logger.Log(
+			"method", "PostGetCRTBatch",
+			"devices", len(devices),
+			"failed", failed,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.PostGetCRTBatch(ctx, devices)
+}
+
+func (mw loggingMidleware) PostEnrollCSR(ctx context.Context, csr string, deviceId, caName string, idempotencyKey string, reprovision bool) (creds *Credentials, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PostEnrollCSR",
+			"deviceId", deviceId,
+			"ca_name", caName,
+			"idempotency_key", idempotencyKey,
+			"reprovision", reprovision,
+			"took", time.Since(begin),
+			"err", err,
 		)
 	}(time.Now())
-	return mw.next.PostGetCRT(ctx, keyAlg, keySize, c, st, l, o, ou, cn, email, deviceId, "")
+	return mw.next.PostEnrollCSR(ctx, csr, deviceId, caName, idempotencyKey, reprovision)
+}
+
+func (mw loggingMidleware) PostReenroll(ctx context.Context, current *x509.Certificate, csr string, idempotencyKey string) (creds *Credentials, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PostReenroll",
+			"subject", current.Subject.String(),
+			"serial", utils.SerialNumber(current.SerialNumber),
+			"idempotency_key", idempotencyKey,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.PostReenroll(ctx, current, csr, idempotencyKey)
 }
 
 func (mw loggingMidleware) PostSetConfig(ctx context.Context, authCRT string, CA string) (err error) {
@@ -66,3 +122,55 @@ func (mw loggingMidleware) PostSetConfig(ctx context.Context, authCRT string, CA
 	}(time.Now())
 	return mw.next.PostSetConfig(ctx, authCRT, CA)
 }
+
+func (mw loggingMidleware) PostRollbackConfig(ctx context.Context) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PostRollbackConfig",
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.PostRollbackConfig(ctx)
+}
+
+func (mw loggingMidleware) GetConfig(ctx context.Context) (status client.Status, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetConfig",
+			"started", status.Started,
+			"instances", len(status.Instances),
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.GetConfig(ctx)
+}
+
+func (mw loggingMidleware) GetRecords(ctx context.Context, filter ledger.Filter) (records []ledger.Record, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetRecords",
+			"deviceId", filter.DeviceID,
+			"operator", filter.Operator,
+			"outcome", filter.Outcome,
+			"serial", filter.Serial,
+			"records", len(records),
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.GetRecords(ctx, filter)
+}
+
+func (mw loggingMidleware) GetRecord(ctx context.Context, id string) (rec ledger.Record, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetRecord",
+			"id", id,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.GetRecord(ctx, id)
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Key algorithms devices can be issued certificates for.
+const (
+	keyAlgRSA     = "RSA"
+	keyAlgEC      = "EC"
+	keyAlgEd25519 = "Ed25519"
+)
+
+// DefaultKeyPolicy is used when no allowed keys are configured.
+var DefaultKeyPolicy = []string{"RSA:2048", "RSA:3072", "RSA:4096", "EC:256", "EC:384", "EC:521", "Ed25519"}
+
+// KeyPolicy is the set of key algorithms and sizes accepted for device
+// keys, both generated by the DMS and submitted in a CSR.
+type KeyPolicy struct {
+	allowed map[string]map[int]bool
+}
+
+// NewKeyPolicy parses a list of allowed keys with the form ALG:SIZE, e.g.
+// RSA:3072 or EC:521. Ed25519 keys have a fixed size and are allowed with
+// just the algorithm name.
+func NewKeyPolicy(allowed []string) (KeyPolicy, error) {
+	if len(allowed) == 0 {
+		allowed = DefaultKeyPolicy
+	}
+	p := KeyPolicy{allowed: make(map[string]map[int]bool)}
+	for _, entry := range allowed {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		keyAlg, keySize := parts[0], 0
+		if len(parts) == 2 {
+			size, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return KeyPolicy{}, fmt.Errorf("invalid key size in %q", entry)
+			}
+			keySize = size
+		}
+		switch {
+		case keyAlg == keyAlgRSA && keySize >= 2048:
+		case keyAlg == keyAlgEC && (keySize == 256 || keySize == 384 || keySize == 521):
+		case keyAlg == keyAlgEd25519 && len(parts) == 1:
+		default:
+			return KeyPolicy{}, fmt.Errorf("unsupported key %q", entry)
+		}
+		if p.allowed[keyAlg] == nil {
+			p.allowed[keyAlg] = make(map[int]bool)
+		}
+		p.allowed[keyAlg][keySize] = true
+	}
+	return p, nil
+}
+
+// Check returns the error reported to the caller when a key of keyAlg and
+// keySize is not allowed by the policy. The size of Ed25519 keys is ignored.
+func (p KeyPolicy) Check(keyAlg string, keySize int) error {
+	sizes, ok := p.allowed[keyAlg]
+	if !ok {
+		return errUnsupportedKey
+	}
+	if keyAlg == keyAlgEd25519 || sizes[keySize] {
+		return nil
+	}
+	switch keyAlg {
+	case keyAlgEC:
+		return errUnsupportedECSize
+	default:
+		return errUnsupportedRSASize
+	}
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestKeyPolicy(t *testing.T) {
+	policy, err := NewKeyPolicy([]string{"RSA:3072", "EC:521", "Ed25519"})
+	if err != nil {
+		t.Fatalf("Unable to create key policy: %s", err)
+	}
+
+	testCases := []struct {
+		name    string
+		keyAlg  string
+		keySize int
+		ret     error
+	}{
+		{"Allowed RSA size", "RSA", 3072, nil},
+		{"RSA size not in policy", "RSA", 2048, errUnsupportedRSASize},
+		{"Allowed EC size", "EC", 521, nil},
+		{"EC size not in policy", "EC", 256, errUnsupportedECSize},
+		{"Ed25519 ignores key size", "Ed25519", 256, nil},
+		{"Algorithm not in policy", "DSA", 2048, errUnsupportedKey},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			err := policy.Check(tc.keyAlg, tc.keySize)
+			if tc.ret != err {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+		})
+	}
+}
+
+func TestNewKeyPolicy(t *testing.T) {
+	testCases := []struct {
+		name    string
+		allowed []string
+		valid   bool
+	}{
+		{"Default policy", nil, true},
+		{"Weak RSA key", []string{"RSA:1024"}, false},
+		{"Unknown curve", []string{"EC:224"}, false},
+		{"Invalid size", []string{"RSA:big"}, false},
+		{"Ed25519 with size", []string{"Ed25519:256"}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			_, err := NewKeyPolicy(tc.allowed)
+			if tc.valid != (err == nil) {
+				t.Errorf("Got result is %v; want valid %t", err, tc.valid)
+			}
+		})
+	}
+}
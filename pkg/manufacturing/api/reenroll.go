@@ -0,0 +1,94 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/ledger"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+)
+
+// PostReenroll renews current, the still valid certificate a device
+// authenticated with, for the key of csr. The key may be the current one
+// or a rotated one, but the subject must not change. The device ID and CA
+// are taken from the ledger record of current, so only certificates issued
+// by this service can be renewed. Retries are identified by the serial
+// number of current and the CSR unless an idempotency key is given, so a
+// device can retry with a new CSR after losing the key of the first one.
+func (s *deviceService) PostReenroll(ctx context.Context, current *x509.Certificate, csr string, idempotencyKey string) (creds *Credentials, err error) {
+	req, err := parseCSR([]byte(csr))
+	if err != nil {
+		return nil, errInvalidCSR
+	}
+
+	if err := req.CheckSignature(); err != nil {
+		return nil, errCSRSignature
+	}
+
+	keyAlg, keySize, err := publicKeyParams(req.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.keyPolicy.Check(keyAlg, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Subject.String() != current.Subject.String() {
+		return nil, errSubjectMismatch
+	}
+
+	issued, err := s.issuedRecord(ctx, current)
+	if err != nil {
+		return nil, err
+	}
+
+	serial := utils.SerialNumber(current.SerialNumber)
+	rec := ledger.Record{
+		IdempotencyKey: idempotencyKeyFor(idempotencyKey, serial+":"+requestHash(req.Raw)),
+		RequestHash:    requestHash(req.Raw, serial),
+		DeviceID:       issued.DeviceID,
+		Subject:        req.Subject.String(),
+		KeyAlg:         keyAlg,
+		KeySize:        keySize,
+		CAName:         issued.CAName,
+		Renews:         serial,
+		Operator:       current.Subject.CommonName,
+	}
+	prev, release, err := s.begin(ctx, rec, idempotencyKey != "", false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if prev != nil {
+		return s.replay(ctx, rec, prev)
+	}
+
+	cert, chain, err := s.client.ReenrollCSR(ctx, req, current, issued.CAName)
+	if err == nil && s.registry.RegisterCertificate(ctx, issued.DeviceID, issued.CAName, cert) != nil {
+		err = errDeviceRegistration
+	}
+	err = s.record(ctx, rec, cert, chain, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credentials{Certificate: cert, Chain: chain}, nil
+}
+
+// issuedRecord returns the ledger record of the provisioning attempt that
+// issued crt, or errUnknownCertificate when there is none.
+func (s *deviceService) issuedRecord(ctx context.Context, crt *x509.Certificate) (ledger.Record, error) {
+	rec, err := s.ledger.BySerial(ctx, crt.Issuer.String(), utils.SerialNumber(crt.SerialNumber))
+	switch {
+	case err == ledger.ErrNotFound:
+		return ledger.Record{}, errUnknownCertificate
+	case err != nil:
+		return ledger.Record{}, errLedgerRead
+	case !bytes.Equal(rec.Certificate, crt.Raw):
+		return ledger.Record{}, errUnknownCertificate
+	}
+	return rec, nil
+}
@@ -1,23 +1,29 @@
 package api
 
 import (
-	"bytes"
 	"context"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
+	"crypto/x509/pkix"
 	"encoding/pem"
-	"fmt"
 	"io/ioutil"
-	"net/http"
 	"sync"
+	"time"
 
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/ledger"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/registry"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc"
 
-	"github.com/pkg/errors"
+	"github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 )
 
 const (
@@ -28,40 +34,118 @@ const (
 type Service interface {
 	Health(ctx context.Context) bool
 	PostSetConfig(ctx context.Context, authCRT string, CA string) error
-	PostGetCRT(ctx context.Context, keyAlg string, keySize int, c, st, l, o, ou, cn, email, deviceId, caName string) (data []byte, err error)
+	PostRollbackConfig(ctx context.Context) error
+	GetConfig(ctx context.Context) (client.Status, error)
+	PostGetCRT(ctx context.Context, keyAlg string, keySize int, c, st, l, o, ou, cn, email, deviceId, caName string, idempotencyKey string, reprovision bool) (creds *Credentials, err error)
+	PostGetCRTBatch(ctx context.Context, devices []DeviceRequest) ([]DeviceResult, error)
+	PostEnrollCSR(ctx context.Context, csr string, deviceId, caName string, idempotencyKey string, reprovision bool) (creds *Credentials, err error)
+	PostReenroll(ctx context.Context, current *x509.Certificate, csr string, idempotencyKey string) (creds *Credentials, err error)
+	GetRecords(ctx context.Context, filter ledger.Filter) ([]ledger.Record, error)
+	GetRecord(ctx context.Context, id string) (ledger.Record, error)
 }
 
+// Credentials are the certificate issued to a device, the CA chain it was
+// validated against and, when the key pair was generated by the DMS, its
+// private key. Encoding them in the format requested by the caller is left
+// to the transport.
+type Credentials struct {
+	Certificate *x509.Certificate
+	Chain       []*x509.Certificate
+	PrivateKey  crypto.PrivateKey
+}
+
+// DeviceRequest holds the subject and key parameters of a single device
+// provisioned through PostGetCRTBatch.
+type DeviceRequest struct {
+	KeyAlg      string `json:"keyAlg"`
+	KeySize     int    `json:"keySize"`
+	C           string `json:"c"`
+	ST          string `json:"st"`
+	L           string `json:"l"`
+	O           string `json:"o"`
+	OU          string `json:"ou"`
+	CN          string `json:"cn"`
+	EMAIL       string `json:"email"`
+	DeviceID    string `json:"device_id"`
+	CaName      string `json:"ca_name"`
+	Reprovision bool   `json:"reprovision"`
+}
+
+// DeviceResult is the outcome of provisioning one device of a batch. Err is
+// set when that device could not be provisioned; the rest of the batch is
+// not affected by it.
+type DeviceResult struct {
+	DeviceID    string
+	Credentials *Credentials
+	Err         error
+}
+
+const (
+	defaultBatchConcurrency = 8
+	maxBatchSize            = 1000
+)
+
 type deviceService struct {
-	mtx         sync.RWMutex
-	authKeyFile string
-	client      client.Client
+	mtx              sync.RWMutex
+	authKeyFile      string
+	batchConcurrency int
+	keyPolicy        KeyPolicy
+	client           client.Client
+	registry         registry.Registry
+	ledger           ledger.Ledger
+	inFlight         map[string]bool
+	logger           log.Logger
 }
 
-func NewDeviceService(authKeyFile string, client client.Client) Service {
-	return &deviceService{authKeyFile: authKeyFile, client: client}
+func NewDeviceService(authKeyFile string, batchConcurrency int, keyPolicy KeyPolicy, client client.Client, registry registry.Registry, ledger ledger.Ledger, logger log.Logger) Service {
+	if batchConcurrency <= 0 {
+		batchConcurrency = defaultBatchConcurrency
+	}
+	return &deviceService{authKeyFile: authKeyFile, batchConcurrency: batchConcurrency, keyPolicy: keyPolicy, client: client, registry: registry, ledger: ledger, inFlight: make(map[string]bool), logger: logger}
 }
 
 var (
 	//Client errors
-	errGetAuthKey         = errors.New("error obtaining authentication key")
-	errInvalidCert        = errors.New("invalid certificate")
-	errKeyMatching        = errors.New("private and public key do not match")
-	errUnsupportedKey     = errors.New("unsupported key algorithm")
-	errUnsupportedECSize  = errors.New("unsupported EC key size")
-	errUnsupportedRSASize = errors.New("unsupported RSA key size")
-	errCNEmpty            = errors.New("invalid content, CN is required")
+	errGetAuthKey         = apierrors.New(apierrors.Validation, "error obtaining authentication key")
+	errInvalidCert        = apierrors.New(apierrors.Validation, "invalid certificate")
+	errKeyMatching        = apierrors.New(apierrors.Validation, "private and public key do not match")
+	errUnsupportedKey     = apierrors.New(apierrors.Validation, "unsupported key algorithm")
+	errUnsupportedECSize  = apierrors.New(apierrors.Validation, "unsupported EC key size")
+	errUnsupportedRSASize = apierrors.New(apierrors.Validation, "unsupported RSA key size")
+	errCNEmpty            = apierrors.New(apierrors.Validation, "invalid content, CN is required")
+	errInvalidCSR         = apierrors.New(apierrors.Validation, "invalid certificate request")
+	errCSRSignature       = apierrors.New(apierrors.Validation, "invalid certificate request signature")
+	errInvalidCountry     = apierrors.New(apierrors.Validation, "invalid content, C must be a two letter country code")
+	errBatchEmpty         = apierrors.New(apierrors.Validation, "invalid content, at least one device is required")
+	errBatchTooLarge      = apierrors.New(apierrors.Validation, "invalid content, too many devices in batch")
+	errRecordNotFound     = apierrors.New(apierrors.NotFound, "ledger record not found")
+	errSubjectMismatch    = apierrors.New(apierrors.Validation, "invalid certificate request, subject does not match the current certificate")
+	errUnknownCertificate = apierrors.New(apierrors.Forbidden, "client certificate was not issued by this service")
 
 	//Server errors
-	errRemoteConnection = errors.New("unable to start remote connection")
+	errRemoteConnection   = apierrors.New(apierrors.UpstreamUnavailable, "unable to start remote connection")
+	errDeviceRegistration = apierrors.New(apierrors.UpstreamUnavailable, "unable to register issued certificate in Device Manager")
+	errLedgerWrite        = apierrors.New(apierrors.Internal, "unable to record provisioning in ledger")
+	errLedgerRead         = apierrors.New(apierrors.Internal, "unable to read provisioning ledger")
 )
 
+// Health reports degraded until the upstream extension is configured with
+// a DMS certificate within its validity period and at least one extension
+// instance is discovered.
 func (s *deviceService) Health(ctx context.Context) bool {
-	return true
+	status := s.client.Status(ctx)
+	if !status.Started || status.Certificate == nil || len(status.Instances) == 0 {
+		return false
+	}
+	now := time.Now()
+	return !now.Before(status.Certificate.NotBefore) && !now.After(status.Certificate.NotAfter)
 }
 
+// PostSetConfig swaps the DMS certificate used with the proxy and the
+// enrollment server for authCRT, paired with the key in authKeyFile. The
+// certificate is rejected unless it is valid and chains to the proxy CA.
 func (s *deviceService) PostSetConfig(ctx context.Context, authCRT string, CA string) error {
 	authKey, err := loadAuthKey(s.authKeyFile)
-	fmt.Println(s.authKeyFile)
 	if err != nil {
 		return errGetAuthKey
 	}
@@ -76,18 +160,40 @@ func (s *deviceService) PostSetConfig(ctx context.Context, authCRT string, CA st
 	}
 	err = s.client.StartClient(ctx, CA, []tls.Certificate{cert})
 	if err != nil {
-		return errRemoteConnection
+		return clientConfigError(err)
 	}
 	return nil
 }
 
-func (s *deviceService) PostGetCRT(ctx context.Context, keyAlg string, keySize int, c, st, l, o, ou, cn, email, deviceId, caName string) (data []byte, err error) {
-	err = checkKeyAlg(keyAlg)
+// PostRollbackConfig reactivates the DMS certificate replaced by the last
+// PostSetConfig.
+func (s *deviceService) PostRollbackConfig(ctx context.Context) error {
+	err := s.client.RollbackCredentials(ctx)
 	if err != nil {
-		return nil, err
+		return clientConfigError(err)
+	}
+	return nil
+}
+
+// GetConfig reports the CA and DMS certificate set by the last
+// PostSetConfig and the upstream extension instances currently discovered.
+func (s *deviceService) GetConfig(ctx context.Context) (client.Status, error) {
+	return s.client.Status(ctx), nil
+}
+
+// clientConfigError keeps the validation and conflict errors of the client
+// credentials, reported to the caller, and hides the rest behind
+// errRemoteConnection.
+func clientConfigError(err error) error {
+	switch apierrors.KindOf(err) {
+	case apierrors.Validation, apierrors.Conflict:
+		return err
 	}
+	return errRemoteConnection
+}
 
-	err = checkKeySize(keyAlg, keySize)
+func (s *deviceService) PostGetCRT(ctx context.Context, keyAlg string, keySize int, c, st, l, o, ou, cn, email, deviceId, caName string, idempotencyKey string, reprovision bool) (creds *Credentials, err error) {
+	err = s.keyPolicy.Check(keyAlg, keySize)
 	if err != nil {
 		return nil, err
 	}
@@ -96,57 +202,258 @@ func (s *deviceService) PostGetCRT(ctx context.Context, keyAlg string, keySize i
 		return nil, errCNEmpty
 	}
 
-	cert, key, err := s.client.GetCertificate(ctx, keyAlg, keySize, c, st, l, o, ou, cn, email, caName)
+	subject := pkix.Name{Country: nonEmpty(c), Province: nonEmpty(st), Locality: nonEmpty(l), Organization: nonEmpty(o), OrganizationalUnit: nonEmpty(ou), CommonName: cn}
+	rec := ledger.Record{
+		IdempotencyKey: idempotencyKeyFor(idempotencyKey, deviceId),
+		RequestHash:    requestHash(keyAlg, keySize, subject.String(), email, deviceId, caName),
+		DeviceID:       deviceId,
+		Subject:        subject.String(),
+		KeyAlg:         keyAlg,
+		KeySize:        keySize,
+		CAName:         caName,
+	}
+	prev, release, err := s.begin(ctx, rec, idempotencyKey != "", reprovision)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	// The private key of an unregistered certificate was never handed out,
+	// so the device gets new credentials instead.
+	if prev != nil && prev.Outcome == ledger.OutcomeIssued {
+		return nil, errAlreadyProvisioned
+	}
+
+	cert, chain, key, err := s.client.GetCertificate(ctx, keyAlg, keySize, c, st, l, o, ou, cn, email, caName)
+	if err == nil && s.registry.RegisterCertificate(ctx, deviceId, caName, cert) != nil {
+		err = errDeviceRegistration
+	}
+	err = s.record(ctx, rec, cert, chain, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credentials{Certificate: cert, Chain: chain, PrivateKey: key}, nil
+}
+
+func (s *deviceService) PostGetCRTBatch(ctx context.Context, devices []DeviceRequest) ([]DeviceResult, error) {
+	if len(devices) == 0 {
+		return nil, errBatchEmpty
+	}
+	if len(devices) > maxBatchSize {
+		return nil, errBatchTooLarge
+	}
+
+	results := make([]DeviceResult, len(devices))
+	sem := make(chan struct{}, s.batchConcurrency)
+	var wg sync.WaitGroup
+	for i, d := range devices {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i] = DeviceResult{DeviceID: d.DeviceID, Err: ctx.Err()}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, d DeviceRequest) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			creds, err := s.PostGetCRT(ctx, d.KeyAlg, d.KeySize, d.C, d.ST, d.L, d.O, d.OU, d.CN, d.EMAIL, d.DeviceID, d.CaName, "", d.Reprovision)
+			results[i] = DeviceResult{DeviceID: d.DeviceID, Credentials: creds, Err: err}
+		}(i, d)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+func (s *deviceService) PostEnrollCSR(ctx context.Context, csr string, deviceId, caName string, idempotencyKey string, reprovision bool) (creds *Credentials, err error) {
+	req, err := parseCSR([]byte(csr))
+	if err != nil {
+		return nil, errInvalidCSR
+	}
+
+	if err := req.CheckSignature(); err != nil {
+		return nil, errCSRSignature
+	}
+
+	keyAlg, keySize, err := publicKeyParams(req.PublicKey)
 	if err != nil {
 		return nil, err
 	}
 
-	var repKey []byte
-	switch key.(type) {
-	case *rsa.PrivateKey:
-		repKey = x509.MarshalPKCS1PrivateKey(key.(*rsa.PrivateKey))
-	case *ecdsa.PrivateKey:
-		repKey, err = x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+	err = s.keyPolicy.Check(keyAlg, keySize)
+	if err != nil {
+		return nil, err
 	}
+
+	err = checkSubject(req.Subject)
 	if err != nil {
 		return nil, err
 	}
 
-	postBody, _ := json.Marshal(map[string]string{
-		"ca_name":  caName,
-		"serial_number": "lalalalalallal", //TODO: serial number comes decoding the cert
-	})
+	rec := ledger.Record{
+		IdempotencyKey: idempotencyKeyFor(idempotencyKey, deviceId),
+		RequestHash:    requestHash(req.Raw, deviceId, caName),
+		DeviceID:       deviceId,
+		Subject:        req.Subject.String(),
+		KeyAlg:         keyAlg,
+		KeySize:        keySize,
+		CAName:         caName,
+	}
+	prev, release, err := s.begin(ctx, rec, idempotencyKey != "", reprovision)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if prev != nil {
+		return s.replay(ctx, rec, prev)
+	}
 
-	//TODO: finish this
-	responseBody := bytes.NewBuffer(postBody)
-	resp, err := http.Post("https://devices/v1/devices/" + deviceId + "/issue/dms/", "application/json", responseBody)
+	cert, chain, err := s.client.EnrollCSR(ctx, req, caName)
+	if err == nil && s.registry.RegisterCertificate(ctx, deviceId, caName, cert) != nil {
+		err = errDeviceRegistration
+	}
+	err = s.record(ctx, rec, cert, chain, err)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println(deviceId, resp)
 
-	return append(utils.PEMCert(cert.Raw), utils.PEMKey(repKey)...), nil
+	return &Credentials{Certificate: cert, Chain: chain}, nil
 }
 
-func checkKeyAlg(keyAlg string) error {
-	if keyAlg != "EC" && keyAlg != "RSA" {
-		return errUnsupportedKey
+func (s *deviceService) GetRecords(ctx context.Context, filter ledger.Filter) ([]ledger.Record, error) {
+	records, err := s.ledger.List(ctx, filter)
+	if err != nil {
+		return nil, errLedgerRead
 	}
-	return nil
+	return records, nil
+}
+
+func (s *deviceService) GetRecord(ctx context.Context, id string) (ledger.Record, error) {
+	rec, err := s.ledger.Get(ctx, id)
+	if err == ledger.ErrNotFound {
+		return ledger.Record{}, errRecordNotFound
+	}
+	if err != nil {
+		return ledger.Record{}, errLedgerRead
+	}
+	return rec, nil
+}
+
+// replay returns the credentials of prev, the earlier attempt of the
+// request described by rec. A certificate left unregistered by it is
+// registered first and the outcome recorded.
+func (s *deviceService) replay(ctx context.Context, rec ledger.Record, prev *ledger.Record) (*Credentials, error) {
+	creds, err := replayCredentials(prev)
+	if err != nil || prev.Outcome != ledger.OutcomeUnregistered {
+		return creds, err
+	}
+	if s.registry.RegisterCertificate(ctx, prev.DeviceID, prev.CAName, creds.Certificate) != nil {
+		err = errDeviceRegistration
+	}
+	err = s.record(ctx, rec, creds.Certificate, creds.Chain, err)
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
 }
 
-// TODO: mas variedad
-func checkKeySize(keyAlg string, keySize int) error {
-	if keyAlg == "EC" && keySize != 384 && keySize != 256 {
-		return errUnsupportedECSize
+// record appends the outcome of a provisioning attempt, the certificate
+// issued by it if any and the operator who requested it to the ledger,
+// unless rec already names the operator. A certificate that could not be
+// registered is recorded as unregistered, so that a retry registers it
+// rather than leaving it valid and unaccounted for. It returns err, or
+// errLedgerWrite when a successful attempt cannot be recorded: credentials
+// are never handed out without an audit entry.
+func (s *deviceService) record(ctx context.Context, rec ledger.Record, crt *x509.Certificate, chain []*x509.Certificate, err error) error {
+	if rec.Operator == "" {
+		rec.Operator = operatorFrom(ctx)
+	}
+	rec.Outcome = ledger.OutcomeIssued
+	if crt != nil {
+		rec.Serial = utils.SerialNumber(crt.SerialNumber)
+		rec.Issuer = crt.Issuer.String()
+		rec.NotBefore = crt.NotBefore
+		rec.NotAfter = crt.NotAfter
+		rec.Certificate = crt.Raw
+		for _, ca := range chain {
+			rec.Chain = append(rec.Chain, ca.Raw)
+		}
+	}
+	switch {
+	case err == errDeviceRegistration && crt != nil:
+		rec.Outcome = ledger.OutcomeUnregistered
+		rec.Error = err.Error()
+	case err != nil:
+		rec.Outcome = ledger.OutcomeFailed
+		rec.Error = err.Error()
+	}
+	if _, lerr := s.ledger.Append(ctx, rec); lerr != nil {
+		if err != nil {
+			level.Error(s.logger).Log("err", lerr, "msg", "Could not record provisioning failure", "device_id", rec.DeviceID, "outcome", rec.Outcome, "serial", rec.Serial)
+			return err
+		}
+		return errLedgerWrite
 	}
+	return err
+}
+
+// operatorFrom returns the user who authenticated the request, as set in
+// the context by the JWT parser.
+func operatorFrom(ctx context.Context) string {
+	claims, ok := ctx.Value(jwt.JWTClaimsContextKey).(*oidc.Claims)
+	if !ok {
+		return ""
+	}
+	if claims.Username != "" {
+		return claims.Username
+	}
+	return claims.Subject
+}
 
-	if keyAlg == "RSA" && keySize != 2048 && keySize != 4096 {
-		return errUnsupportedRSASize
+// parseCSR accepts a PEM or DER encoded PKCS#10 certificate request.
+func parseCSR(data []byte) (*x509.CertificateRequest, error) {
+	pemBlock, _ := pem.Decode(data)
+	if pemBlock != nil {
+		if err := utils.CheckPEMBlock(pemBlock, utils.CSRPEMBlockType); err != nil {
+			return nil, err
+		}
+		data = pemBlock.Bytes
+	}
+	return x509.ParseCertificateRequest(data)
+}
+
+func publicKeyParams(pub interface{}) (keyAlg string, keySize int, err error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return keyAlgRSA, pub.N.BitLen(), nil
+	case *ecdsa.PublicKey:
+		return keyAlgEC, pub.Curve.Params().BitSize, nil
+	case ed25519.PublicKey:
+		return keyAlgEd25519, 0, nil
+	default:
+		return "", 0, errUnsupportedKey
+	}
+}
+
+func checkSubject(subject pkix.Name) error {
+	if subject.CommonName == "" {
+		return errCNEmpty
+	}
+	for _, c := range subject.Country {
+		if len(c) != 2 {
+			return errInvalidCountry
+		}
 	}
 	return nil
 }
 
+func nonEmpty(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return []string{value}
+}
+
 func loadAuthKey(keyPath string) ([]byte, error) {
 	keyPEM, err := ioutil.ReadFile(keyPath)
 	if err != nil {
@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
@@ -12,24 +13,38 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/configs"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/ledger"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/mocks"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/registry"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc"
 	"io/ioutil"
 	"math/big"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/log"
 )
 
 type serviceSetUp struct {
 	authKeyFile string
+	keyPolicy   KeyPolicy
 	client      client.Client
+	registry    registry.Registry
+	ledger      *mocks.MockLedger
 }
 
 func TestPostSetConfig(t *testing.T) {
 	stu := setup(t)
-	srv := NewDeviceService(stu.authKeyFile, stu.client)
+	srv := NewDeviceService(stu.authKeyFile, 0, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
 	ctx := context.Background()
 
 	stu.client.(*mocks.MockClient).StartClientFn = func(ctx context.Context, CA string, authCRT []tls.Certificate) error {
@@ -55,47 +70,669 @@ func TestPostSetConfig(t *testing.T) {
 	}
 }
 
+func TestPostRollbackConfig(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.authKeyFile, 0, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
+	ctx := context.Background()
+
+	errNoPrevious := apierrors.New(apierrors.Conflict, "no previous DMS certificate to roll back to")
+	errExpired := apierrors.New(apierrors.Validation, "DMS certificate is expired or not yet valid")
+	testCases := []struct {
+		name      string
+		clientErr error
+		ret       error
+	}{
+		{"Previous certificate is restored", nil, nil},
+		{"There is no previous certificate", errNoPrevious, errNoPrevious},
+		{"Previous certificate is expired", errExpired, errExpired},
+		{"Client fails", errors.New("connection refused"), errRemoteConnection},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			stu.client.(*mocks.MockClient).RollbackCredentialsFn = func(ctx context.Context) error {
+				return tc.clientErr
+			}
+			err := srv.PostRollbackConfig(ctx)
+			if tc.ret != err {
+				t.Errorf("Got result is %v; want %v", err, tc.ret)
+			}
+		})
+	}
+}
+
+func TestHealth(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.authKeyFile, 0, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
+	ctx := context.Background()
+
+	valid := &x509.Certificate{NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	expired := &x509.Certificate{NotBefore: time.Now().Add(-2 * time.Hour), NotAfter: time.Now().Add(-time.Hour)}
+	instances := []string{"scepextension:8088"}
+	testCases := []struct {
+		name   string
+		status client.Status
+		ret    bool
+	}{
+		{"Client is configured", client.Status{Started: true, CA: "dms", Certificate: valid, Instances: instances}, true},
+		{"Client is not started", client.Status{Certificate: valid, Instances: instances}, false},
+		{"Certificate is missing", client.Status{Started: true, CA: "dms", Instances: instances}, false},
+		{"Certificate is expired", client.Status{Started: true, CA: "dms", Certificate: expired, Instances: instances}, false},
+		{"No instances are discovered", client.Status{Started: true, CA: "dms", Certificate: valid, InstancesErr: errors.New("consul unavailable")}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			stu.client.(*mocks.MockClient).StatusFn = func(ctx context.Context) client.Status {
+				return tc.status
+			}
+			if healthy := srv.Health(ctx); healthy != tc.ret {
+				t.Errorf("Got result is %t; want %t", healthy, tc.ret)
+			}
+		})
+	}
+}
+
 func TestPostGetCRT(t *testing.T) {
 	stu := setup(t)
-	srv := NewDeviceService(stu.authKeyFile, stu.client)
+	srv := NewDeviceService(stu.authKeyFile, 0, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
+	ctx := context.Background()
+
+	stu.client.(*mocks.MockClient).GetCertificateFn = func(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string) (*x509.Certificate, []*x509.Certificate, crypto.PrivateKey, error) {
+		key, err := testSCEPKey(keyAlg, keySize)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		cert, err := testSCEPCert(key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		return cert, []*x509.Certificate{cert}, key, nil
+	}
+	stu.registry.(*mocks.MockRegistry).RegisterCertificateFn = func(ctx context.Context, deviceID string, caName string, crt *x509.Certificate) error {
+		if deviceID == "rejected" {
+			return errors.New("rejected")
+		}
+		return nil
+	}
+
+	testCases := []struct {
+		name     string
+		keyAlg   string
+		keySize  int
+		cn       string
+		deviceID string
+		ret      error
+	}{
+		{"Key Algorithm is unsupported", "unsupportedAlg", 1024, "test", "d1", errUnsupportedKey},
+		{"EC Key size is unsupported", "EC", 2048, "test", "d2", errUnsupportedECSize},
+		{"RSA Key size is unsupported", "RSA", 1024, "test", "d3", errUnsupportedRSASize},
+		{"CN is empty", "RSA", 2048, "", "d4", errCNEmpty},
+		{"EC Key, size and CN are valid", "EC", 256, "test", "d5", nil},
+		{"EC P-521 Key, size and CN are valid", "EC", 521, "test", "d6", nil},
+		{"RSA Key, size, and CN are valid", "RSA", 2048, "test", "d7", nil},
+		{"RSA 3072 Key, size, and CN are valid", "RSA", 3072, "test", "d8", nil},
+		{"Ed25519 Key and CN are valid", "Ed25519", 0, "test", "d9", nil},
+		{"Device Manager rejects registration", "EC", 256, "test", "rejected", errDeviceRegistration},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			creds, err := srv.PostGetCRT(ctx, tc.keyAlg, tc.keySize, "", "", "", "", "", tc.cn, "", tc.deviceID, "", tc.name, false)
+			if tc.ret != err {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err == nil && len(creds.Chain) != 1 {
+				t.Errorf("Got %d chain certificates; want 1", len(creds.Chain))
+			}
+		})
+	}
+}
+
+func TestPostGetCRTEndpointCAName(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.authKeyFile, 0, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
+	srv = LoggingMidleware(log.NewNopLogger())(srv)
+	ctx := context.Background()
+
+	stu.client.(*mocks.MockClient).GetCertificateFn = func(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string) (*x509.Certificate, []*x509.Certificate, crypto.PrivateKey, error) {
+		key, err := testSCEPKey(keyAlg, keySize)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		cert, err := testSCEPCert(key)
+		return cert, []*x509.Certificate{cert}, key, err
+	}
+	var registered string
+	stu.registry.(*mocks.MockRegistry).RegisterCertificateFn = func(ctx context.Context, deviceID string, caName string, crt *x509.Certificate) error {
+		registered = caName
+		return nil
+	}
+
+	req := postGetCRTRequest{KeyAlg: "EC", KeySize: 256, CN: "test", DeviceID: "d1", CaName: "Lamassu-CA"}
+	resp, err := MakePostGetCRTEndpoint(srv)(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.(postGetCRTResponse).Err; err != nil {
+		t.Fatalf("Got result is %s; want %s", err, error(nil))
+	}
+	if registered != req.CaName {
+		t.Errorf("Registered CA is %q; want %q", registered, req.CaName)
+	}
+}
+
+func TestPostGetCRTBatch(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.authKeyFile, 2, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
 	ctx := context.Background()
 
-	stu.client.(*mocks.MockClient).GetCertificateFn = func(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string) (*x509.Certificate, crypto.PrivateKey, error) {
+	errUpstream := errors.New("upstream failure")
+	stu.client.(*mocks.MockClient).GetCertificateFn = func(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string) (*x509.Certificate, []*x509.Certificate, crypto.PrivateKey, error) {
+		if cn == "upstream" {
+			return nil, nil, nil, errUpstream
+		}
 		key, err := testSCEPKey(keyAlg, keySize)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		cert, err := testSCEPCert(key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return cert, nil, key, nil
+	}
+
+	testCases := []struct {
+		name    string
+		devices []DeviceRequest
+		ret     error
+		results []error
+	}{
+		{"Batch is empty", []DeviceRequest{}, errBatchEmpty, nil},
+		{"Batch is too large", make([]DeviceRequest, maxBatchSize+1), errBatchTooLarge, nil},
+		{"Batch reports per device failures", []DeviceRequest{
+			{KeyAlg: "unsupportedAlg", KeySize: 1024, CN: "test", DeviceID: "1"},
+			{KeyAlg: "EC", KeySize: 2048, CN: "test", DeviceID: "2"},
+			{KeyAlg: "RSA", KeySize: 2048, CN: "", DeviceID: "3"},
+			{KeyAlg: "RSA", KeySize: 2048, CN: "upstream", DeviceID: "4"},
+			{KeyAlg: "EC", KeySize: 256, CN: "test", DeviceID: "5"},
+		}, nil, []error{errUnsupportedKey, errUnsupportedECSize, errCNEmpty, errUpstream, nil}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			results, err := srv.PostGetCRTBatch(ctx, tc.devices)
+			if tc.ret != err {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+			if len(results) != len(tc.results) {
+				t.Fatalf("Got %d results; want %d", len(results), len(tc.results))
+			}
+			for i, r := range results {
+				if r.DeviceID != tc.devices[i].DeviceID {
+					t.Errorf("Got device %s at position %d; want %s", r.DeviceID, i, tc.devices[i].DeviceID)
+				}
+				if r.Err != tc.results[i] {
+					t.Errorf("Got device %s result %s; want %s", r.DeviceID, r.Err, tc.results[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPostGetCRTBatchEndpoint(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.authKeyFile, 2, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
+	ctx := context.Background()
+
+	stu.client.(*mocks.MockClient).GetCertificateFn = func(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string) (*x509.Certificate, []*x509.Certificate, crypto.PrivateKey, error) {
+		return nil, nil, nil, errors.New("dial tcp 10.0.0.7:8087: connection refused")
+	}
+
+	req := postGetCRTBatchRequest{Password: "secret", Devices: []DeviceRequest{
+		{KeyAlg: "EC", KeySize: 256, CN: "", DeviceID: "1"},
+		{KeyAlg: "EC", KeySize: 256, CN: "test", DeviceID: "2"},
+	}}
+	resp, err := MakePostGetCRTBatchEndpoint(srv, log.NewNopLogger())(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := resp.(postGetCRTBatchResponse).Results
+	if len(results) != 2 {
+		t.Fatalf("Got %d results; want 2", len(results))
+	}
+	if r := results[0]; r.Status != http.StatusBadRequest || r.Err != errCNEmpty.Error() {
+		t.Errorf("Got device %s status %d and error %q; want %d and %q", r.DeviceID, r.Status, r.Err, http.StatusBadRequest, errCNEmpty)
+	}
+	if r := results[1]; r.Status < 500 || strings.Contains(r.Err, "10.0.0.7") {
+		t.Errorf("Got device %s status %d and error %q; want a server error without its detail", r.DeviceID, r.Status, r.Err)
+	}
+}
+
+func TestGetConfigEndpoint(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.authKeyFile, 0, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
+	stu.client.(*mocks.MockClient).StatusFn = func(ctx context.Context) client.Status {
+		return client.Status{Started: true, InstancesErr: errors.New("Get \"https://consul.internal:8501/v1/health/service/scepextension\": connection refused")}
+	}
+
+	resp, err := MakeGetConfigEndpoint(srv, log.NewNopLogger())(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := resp.(getConfigResponse)
+	if config.InstancesError == "" || strings.Contains(config.InstancesError, "consul.internal") {
+		t.Errorf("Got instances error %q; want a generic detail", config.InstancesError)
+	}
+	if len(config.Instances) != 0 {
+		t.Errorf("Got %d instances; want 0", len(config.Instances))
+	}
+}
+
+func TestPostEnrollCSR(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.authKeyFile, 0, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
+	ctx := context.Background()
+
+	stu.client.(*mocks.MockClient).EnrollCSRFn = func(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, []*x509.Certificate, error) {
+		key, err := testSCEPKey("EC", 256)
 		if err != nil {
 			return nil, nil, err
 		}
+		crt, err := testSCEPCert(key)
+		return crt, nil, err
+	}
+
+	ecKey, _ := testSCEPKey("EC", 256)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	tampered := testCSR(t, pkix.Name{CommonName: "test"}, ecKey)
+	tampered[len(tampered)-1] ^= 0xff
+
+	testCases := []struct {
+		name string
+		csr  string
+		ret  error
+	}{
+		{"CSR is not valid", "this is not a CSR", errInvalidCSR},
+		{"CSR signature is not valid", string(tampered), errCSRSignature},
+		{"RSA Key size is unsupported", string(utils.PEMCSR(testCSR(t, pkix.Name{CommonName: "test"}, rsaKey))), errUnsupportedRSASize},
+		{"CN is empty", string(utils.PEMCSR(testCSR(t, pkix.Name{}, ecKey))), errCNEmpty},
+		{"Country is not valid", string(utils.PEMCSR(testCSR(t, pkix.Name{CommonName: "test", Country: []string{"Spain"}}, ecKey))), errInvalidCountry},
+		{"PEM CSR is valid", string(utils.PEMCSR(testCSR(t, pkix.Name{CommonName: "test", Country: []string{"ES"}}, ecKey))), nil},
+		{"DER CSR is valid", string(testCSR(t, pkix.Name{CommonName: "test"}, ecKey)), nil},
+		{"Ed25519 CSR is valid", string(utils.PEMCSR(testCSR(t, pkix.Name{CommonName: "test"}, edKey))), nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			_, err := srv.PostEnrollCSR(ctx, tc.csr, tc.name, "", tc.name, false)
+			if tc.ret != err {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+		})
+	}
+}
+
+func TestLedgerRecords(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.authKeyFile, 0, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
+	ctx := context.WithValue(context.Background(), jwt.JWTClaimsContextKey, &oidc.Claims{Username: "operator"})
+
+	errUpstream := errors.New("upstream failure")
+	stu.client.(*mocks.MockClient).GetCertificateFn = func(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string) (*x509.Certificate, []*x509.Certificate, crypto.PrivateKey, error) {
+		if cn == "upstream" {
+			return nil, nil, nil, errUpstream
+		}
+		key, err := testSCEPKey(keyAlg, keySize)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		cert, err := testSCEPCert(key)
+		return cert, nil, key, err
+	}
+
+	testCases := []struct {
+		name      string
+		cn        string
+		appendErr error
+		ret       error
+		outcome   string
+	}{
+		{"Issued certificate is recorded", "issued", nil, nil, ledger.OutcomeIssued},
+		{"Upstream failure is recorded", "upstream", nil, errUpstream, ledger.OutcomeFailed},
+		{"Issued certificate is not returned unrecorded", "issued", errors.New("disk full"), errLedgerWrite, ""},
+		{"Upstream failure is returned unrecorded", "upstream", errors.New("disk full"), errUpstream, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			stu.ledger.Records, stu.ledger.AppendErr = nil, tc.appendErr
+			_, err := srv.PostGetCRT(ctx, "EC", 256, "ES", "", "", "", "", tc.cn, "", "device-"+tc.cn, "", "", false)
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			records, _ := srv.GetRecords(ctx, ledger.Filter{})
+			if tc.outcome == "" {
+				if len(records) != 0 {
+					t.Errorf("Got %d records; want none", len(records))
+				}
+				return
+			}
+			if len(records) != 1 {
+				t.Fatalf("Got %d records; want 1", len(records))
+			}
+			rec := records[0]
+			if rec.Outcome != tc.outcome || rec.Operator != "operator" || rec.DeviceID != "device-"+tc.cn || rec.Subject != "CN="+tc.cn+",C=ES" {
+				t.Errorf("Got record %+v", rec)
+			}
+			if (rec.Serial != "") != (tc.outcome == ledger.OutcomeIssued) {
+				t.Errorf("Got serial %q for outcome %s", rec.Serial, rec.Outcome)
+			}
+			if _, err := srv.GetRecord(ctx, rec.ID); err != nil {
+				t.Errorf("Got result is %s; want nil", err)
+			}
+		})
+	}
+
+	if _, err := srv.GetRecord(ctx, "unknown"); err != errRecordNotFound {
+		t.Errorf("Got result is %s; want %s", err, errRecordNotFound)
+	}
+}
+
+func TestLedgerRecordsPagination(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.authKeyFile, 0, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		outcome := ledger.OutcomeIssued
+		if i%2 == 1 {
+			outcome = ledger.OutcomeFailed
+		}
+		stu.ledger.Append(ctx, ledger.Record{DeviceID: fmt.Sprintf("device-%d", i), Outcome: outcome})
+	}
+
+	testCases := []struct {
+		name    string
+		filter  ledger.Filter
+		devices []string
+	}{
+		{"Every record is returned without limit", ledger.Filter{}, []string{"device-0", "device-1", "device-2", "device-3", "device-4"}},
+		{"First page is returned", ledger.Filter{Limit: 2}, []string{"device-0", "device-1"}},
+		{"Next page starts at offset", ledger.Filter{Offset: 2, Limit: 2}, []string{"device-2", "device-3"}},
+		{"Last page is partial", ledger.Filter{Offset: 4, Limit: 2}, []string{"device-4"}},
+		{"Offset past the end is empty", ledger.Filter{Offset: 5, Limit: 2}, []string{}},
+		{"Offset applies to matching records", ledger.Filter{Outcome: ledger.OutcomeIssued, Offset: 1, Limit: 1}, []string{"device-2"}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			records, err := srv.GetRecords(ctx, tc.filter)
+			if err != nil {
+				t.Fatalf("Got result is %s; want nil", err)
+			}
+			devices := []string{}
+			for _, rec := range records {
+				devices = append(devices, rec.DeviceID)
+			}
+			if fmt.Sprint(devices) != fmt.Sprint(tc.devices) {
+				t.Errorf("Got devices %v; want %v", devices, tc.devices)
+			}
+		})
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.authKeyFile, 0, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
+	ctx := context.Background()
+
+	issued := 0
+	errUpstream := errors.New("upstream failure")
+	stu.client.(*mocks.MockClient).GetCertificateFn = func(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string) (*x509.Certificate, []*x509.Certificate, crypto.PrivateKey, error) {
+		if cn == "upstream" {
+			return nil, nil, nil, errUpstream
+		}
+		issued++
+		key, err := testSCEPKey(keyAlg, keySize)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		cert, err := testSCEPCert(key)
+		return cert, nil, key, err
+	}
+
+	// Steps run in order and share the ledger.
+	steps := []struct {
+		name           string
+		cn             string
+		deviceID       string
+		idempotencyKey string
+		reprovision    bool
+		ret            error
+		issued         int
+	}{
+		{"First request issues credentials", "test", "d1", "", false, nil, 1},
+		{"Retry is rejected as already provisioned", "test", "d1", "", false, errAlreadyProvisioned, 1},
+		{"Different request for the device conflicts", "other", "d1", "", false, errIdempotencyConflict, 1},
+		{"Reprovision issues new credentials", "other", "d1", "", true, nil, 2},
+		{"Retry of the reprovisioned request is rejected", "other", "d1", "", false, errAlreadyProvisioned, 2},
+		{"New idempotency key for a provisioned device conflicts", "test", "d1", "key-1", false, errDeviceConflict, 2},
+		{"Reprovision with a new idempotency key issues credentials", "test", "d1", "key-1", true, nil, 3},
+		{"Retry with idempotency key is rejected", "test", "d1", "key-1", false, errAlreadyProvisioned, 3},
+		{"Retry without idempotency key is rejected", "test", "d1", "", false, errAlreadyProvisioned, 3},
+		{"Idempotency key named as a device is not bound to it", "test", "key-1", "", false, nil, 4},
+		{"Idempotency key reused for another device conflicts", "test", "d3", "key-1", false, errIdempotencyConflict, 4},
+		{"Idempotency key reused with another subject conflicts", "other", "d1", "key-1", false, errIdempotencyConflict, 4},
+		{"Reprovision does not rebind an idempotency key", "test", "d3", "key-1", true, errIdempotencyConflict, 4},
+		{"Reprovision with idempotency key reissues the same request", "test", "d1", "key-1", true, nil, 5},
+		{"Failed request is not replayed", "upstream", "d2", "", false, errUpstream, 5},
+		{"Retry of failed request issues credentials", "test", "d2", "", false, nil, 6},
+		{"Request without device ID nor key is not checked", "test", "", "", false, nil, 7},
+		{"Repeated request without device ID nor key is not checked", "test", "", "", false, nil, 8},
+	}
+	for _, step := range steps {
+		_, err := srv.PostGetCRT(ctx, "EC", 256, "", "", "", "", "", step.cn, "", step.deviceID, "", step.idempotencyKey, step.reprovision)
+		if step.ret != err {
+			t.Fatalf("%s: got result is %s; want %s", step.name, err, step.ret)
+		}
+		if issued != step.issued {
+			t.Fatalf("%s: got %d certificates issued; want %d", step.name, issued, step.issued)
+		}
+	}
+}
 
+func TestIdempotencyInProgress(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.authKeyFile, 0, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
+	ctx := context.Background()
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	stu.client.(*mocks.MockClient).GetCertificateFn = func(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string) (*x509.Certificate, []*x509.Certificate, crypto.PrivateKey, error) {
+		close(started)
+		<-finish
+		key, err := testSCEPKey(keyAlg, keySize)
+		if err != nil {
+			return nil, nil, nil, err
+		}
 		cert, err := testSCEPCert(key)
+		return cert, nil, key, err
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := srv.PostGetCRT(ctx, "EC", 256, "", "", "", "", "", "test", "", "d1", "", "", false)
+		done <- err
+	}()
+	<-started
+	if _, err := srv.PostGetCRT(ctx, "EC", 256, "", "", "", "", "", "test", "", "d1", "", "", true); err != errRequestInProgress {
+		t.Errorf("Got result is %s; want %s", err, errRequestInProgress)
+	}
+	close(finish)
+	if err := <-done; err != nil {
+		t.Errorf("Got result is %s; want nil", err)
+	}
+}
+
+func TestIdempotencyReplaysEnrolledCSR(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.authKeyFile, 0, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
+	ctx := context.Background()
+
+	issued := 0
+	stu.client.(*mocks.MockClient).EnrollCSRFn = func(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, []*x509.Certificate, error) {
+		issued++
+		key, err := testSCEPKey("EC", 256)
+		if err != nil {
+			return nil, nil, err
+		}
+		crt, err := testSCEPCert(key)
+		return crt, []*x509.Certificate{crt}, err
+	}
+
+	key, _ := testSCEPKey("EC", 256)
+	csr := string(utils.PEMCSR(testCSR(t, pkix.Name{CommonName: "test"}, key)))
+	first, err := srv.PostEnrollCSR(ctx, csr, "d1", "", "", false)
+	if err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	retry, err := srv.PostEnrollCSR(ctx, csr, "d1", "", "", false)
+	if err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	if issued != 1 || !retry.Certificate.Equal(first.Certificate) || len(retry.Chain) != 1 {
+		t.Error("Retry did not return the certificate issued by the first request")
+	}
+
+	other := string(utils.PEMCSR(testCSR(t, pkix.Name{CommonName: "other"}, key)))
+	if _, err := srv.PostEnrollCSR(ctx, other, "d1", "", "", false); err != errIdempotencyConflict {
+		t.Errorf("Got result is %s; want %s", err, errIdempotencyConflict)
+	}
+}
+
+func TestIdempotencyRegistersUnregisteredCertificate(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.authKeyFile, 0, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
+	ctx := context.Background()
+
+	issued := 0
+	stu.client.(*mocks.MockClient).EnrollCSRFn = func(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, []*x509.Certificate, error) {
+		issued++
+		key, err := testSCEPKey("EC", 256)
+		if err != nil {
+			return nil, nil, err
+		}
+		crt, err := testSCEPCert(key)
+		return crt, []*x509.Certificate{crt}, err
+	}
+	var registered *x509.Certificate
+	stu.registry.(*mocks.MockRegistry).RegisterCertificateFn = func(ctx context.Context, deviceID string, caName string, crt *x509.Certificate) error {
+		if registered == nil {
+			registered = crt
+			return errors.New("unavailable")
+		}
+		registered = crt
+		return nil
+	}
+
+	key, _ := testSCEPKey("EC", 256)
+	csr := string(utils.PEMCSR(testCSR(t, pkix.Name{CommonName: "test"}, key)))
+	if _, err := srv.PostEnrollCSR(ctx, csr, "d1", "", "", false); err != errDeviceRegistration {
+		t.Fatalf("Got result is %s; want %s", err, errDeviceRegistration)
+	}
+	first := stu.ledger.Records[len(stu.ledger.Records)-1]
+	if first.Outcome != ledger.OutcomeUnregistered || first.Serial == "" {
+		t.Errorf("Got ledger record %+v; want the unregistered certificate", first)
+	}
+
+	retry, err := srv.PostEnrollCSR(ctx, csr, "d1", "", "", false)
+	if err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	if issued != 1 || !retry.Certificate.Equal(registered) || utils.SerialNumber(retry.Certificate.SerialNumber) != first.Serial {
+		t.Error("Retry did not register the certificate issued by the first request")
+	}
+	if rec := stu.ledger.Records[len(stu.ledger.Records)-1]; rec.Outcome != ledger.OutcomeIssued || rec.Serial != first.Serial {
+		t.Errorf("Got ledger record %+v; want the certificate issued", rec)
+	}
+}
+
+func TestPostReenroll(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.authKeyFile, 0, stu.keyPolicy, stu.client, stu.registry, stu.ledger, log.NewNopLogger())
+	ctx := context.Background()
+
+	stu.client.(*mocks.MockClient).EnrollCSRFn = func(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, []*x509.Certificate, error) {
+		key, err := testSCEPKey("EC", 256)
 		if err != nil {
 			return nil, nil, err
 		}
+		crt, err := testSCEPCert(key)
+		return crt, nil, err
+	}
+	var renewed *x509.Certificate
+	stu.client.(*mocks.MockClient).ReenrollCSRFn = func(ctx context.Context, csr *x509.CertificateRequest, current *x509.Certificate, caName string) (*x509.Certificate, []*x509.Certificate, error) {
+		key, err := testSCEPKey("EC", 256)
+		if err != nil {
+			return nil, nil, err
+		}
+		renewed, err = testSCEPCert(key)
+		return renewed, nil, err
+	}
+	var registered string
+	stu.registry.(*mocks.MockRegistry).RegisterCertificateFn = func(ctx context.Context, deviceID string, caName string, crt *x509.Certificate) error {
+		registered = deviceID
+		return nil
+	}
 
-		return cert, key, nil
+	key, _ := testSCEPKey("EC", 256)
+	creds, err := srv.PostEnrollCSR(ctx, string(utils.PEMCSR(testCSR(t, pkix.Name{CommonName: "test"}, key))), "d1", "devices", "", false)
+	if err != nil {
+		t.Fatalf("Could not enroll current certificate: %s", err)
 	}
+	current := creds.Certificate
+	unknown, _ := testSCEPCert(key)
+	rotated, _ := testSCEPKey("EC", 256)
+	renewal := string(utils.PEMCSR(testCSR(t, current.Subject, rotated)))
 
 	testCases := []struct {
 		name    string
-		keyAlg  string
-		keySize int
-		cn      string
+		current *x509.Certificate
+		csr     string
 		ret     error
 	}{
-		{"Key Algorithm is unsupported", "unsupportedAlg", 1024, "test", errUnsupportedKey},
-		{"EC Key size is unsupported", "EC", 2048, "test", errUnsupportedECSize},
-		{"RSA Key size is unsupported", "RSA", 1024, "test", errUnsupportedRSASize},
-		{"CN is empty", "RSA", 2048, "", errCNEmpty},
-		{"EC Key, size and CN are valid", "EC", 256, "test", nil},
-		{"RSA Key, size, and CN are valid", "RSA", 2048, "test", nil},
+		{"Certificate was not issued by the service", unknown, string(utils.PEMCSR(testCSR(t, unknown.Subject, rotated))), errUnknownCertificate},
+		{"CSR subject does not match", current, string(utils.PEMCSR(testCSR(t, pkix.Name{CommonName: "other"}, rotated))), errSubjectMismatch},
+		{"CSR is not valid", current, "this is not a CSR", errInvalidCSR},
+		{"Certificate is renewed with a rotated key", current, renewal, nil},
 	}
 	for _, tc := range testCases {
 		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
-			_, err := srv.PostGetCRT(ctx, tc.keyAlg, tc.keySize, "", "", "", "", "", tc.cn, "", "")
+			_, err := srv.PostReenroll(ctx, tc.current, tc.csr, "")
 			if tc.ret != err {
-				t.Errorf("Got result is %s; want %s", err, tc.ret)
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
 			}
 		})
 	}
+
+	rec := stu.ledger.Records[len(stu.ledger.Records)-1]
+	if rec.DeviceID != "d1" || rec.CAName != "devices" || rec.Renews != utils.SerialNumber(current.SerialNumber) || rec.Operator != current.Subject.CommonName {
+		t.Errorf("Got ledger record %+v; want renewal of d1 by the device", rec)
+	}
+	if registered != "d1" {
+		t.Errorf("Got registered device %s; want d1", registered)
+	}
+
+	retry, err := srv.PostReenroll(ctx, current, renewal, "")
+	if err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	if !retry.Certificate.Equal(renewed) {
+		t.Error("Retry did not return the renewed certificate")
+	}
+
+	// A device which lost the key of its first CSR retries with a new one.
+	lost, _ := testSCEPKey("EC", 256)
+	if _, err := srv.PostReenroll(ctx, current, string(utils.PEMCSR(testCSR(t, current.Subject, lost))), ""); err != nil {
+		t.Errorf("Got result is %s; want nil", err)
+	}
 }
 
 func setup(t *testing.T) *serviceSetUp {
@@ -106,8 +743,18 @@ func setup(t *testing.T) *serviceSetUp {
 		t.Fatal("Unable to get configuration variables")
 	}
 	client := &mocks.MockClient{}
+	registry := &mocks.MockRegistry{
+		RegisterCertificateFn: func(ctx context.Context, deviceID string, caName string, crt *x509.Certificate) error {
+			return nil
+		},
+	}
 
-	return &serviceSetUp{authKeyFile: cfg.AuthKeyFile, client: client}
+	keyPolicy, err := NewKeyPolicy(nil)
+	if err != nil {
+		t.Fatal("Unable to create default key policy")
+	}
+
+	return &serviceSetUp{authKeyFile: cfg.AuthKeyFile, keyPolicy: keyPolicy, client: client, registry: registry, ledger: &mocks.MockLedger{}}
 }
 
 func loadTestAuthCRT(t *testing.T) string {
@@ -152,6 +799,16 @@ func testAuthCRT(t *testing.T) string {
 	return out.String()
 }
 
+func testCSR(t *testing.T, subj pkix.Name, key crypto.PrivateKey) []byte {
+	t.Helper()
+
+	derBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: subj}, key)
+	if err != nil {
+		t.Fatal("Failed to create test CSR")
+	}
+	return derBytes
+}
+
 func testSCEPKey(keyAlg string, keySize int) (crypto.PrivateKey, error) {
 	var key crypto.PrivateKey
 	var err error
@@ -160,6 +817,8 @@ func testSCEPKey(keyAlg string, keySize int) (crypto.PrivateKey, error) {
 		key, err = newRSAKey(keySize)
 	case "EC":
 		key, err = newECDSAKey(keySize)
+	case "Ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
 	}
 	if err != nil {
 		return nil, err
@@ -183,6 +842,8 @@ func newECDSAKey(bits int) (crypto.PrivateKey, error) {
 		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	case 384:
 		private, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case 521:
+		private, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
 
 	}
 	if err != nil {
@@ -200,8 +861,13 @@ func testSCEPCert(key crypto.PrivateKey) (*x509.Certificate, error) {
 		Organization: []string{"Test"},
 	}
 
+	// Issued certificates are told apart by serial number in the ledger.
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
 	template := x509.Certificate{
-		SerialNumber:          big.NewInt(1),
+		SerialNumber:          serial,
 		Subject:               subj,
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().Add(time.Hour * 24),
@@ -211,12 +877,13 @@ func testSCEPCert(key crypto.PrivateKey) (*x509.Certificate, error) {
 	}
 
 	var derBytes []byte
-	var err error
 	switch key.(type) {
 	case *rsa.PrivateKey:
 		derBytes, err = x509.CreateCertificate(rand.Reader, &template, &template, key.(*rsa.PrivateKey).Public(), key)
 	case *ecdsa.PrivateKey:
 		derBytes, err = x509.CreateCertificate(rand.Reader, &template, &template, key.(*ecdsa.PrivateKey).Public(), key)
+	case ed25519.PrivateKey:
+		derBytes, err = x509.CreateCertificate(rand.Reader, &template, &template, key.(ed25519.PrivateKey).Public(), key)
 	}
 	if err != nil {
 		return nil, err
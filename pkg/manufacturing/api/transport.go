@@ -3,53 +3,127 @@ package api
 import (
 	"context"
 	"encoding/json"
-	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/auth"
 	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/auth"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/clientcert"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/health"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/ledger"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/oidc"
 
 	"github.com/go-kit/kit/auth/jwt"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/tracing/opentracing"
-
-	stdjwt "github.com/dgrijalva/jwt-go"
 	"github.com/go-kit/kit/transport"
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
 	stdopentracing "github.com/opentracing/opentracing-go"
 )
 
-var claims = &auth.KeycloakClaims{}
+const (
+	defaultRecordsLimit = 100
+	maxRecordsLimit     = 1000
+)
+
+var (
+	errInvalidPagination  = apierrors.New(apierrors.Validation, "invalid query, offset must be a non-negative integer and limit between 1 and 1000")
+	errClientCertRequired = apierrors.New(apierrors.Unauthenticated, "a valid client certificate is required")
+)
 
-func MakeHTTPHandler(s Service, logger log.Logger, auth auth.Auth, otTracer stdopentracing.Tracer) http.Handler {
+// MakeHTTPHandler serves the manufacturing API. Configuring the service
+// requires admin access, issuing device certificates operator access and
+// reading the ledger auditor access under policy. Callers authenticate with
+// a token or, when certs is not nil, a client certificate mapped to an
+// identity by certs. GET /v1/health reports the dependencies checked by
+// checker.
+func MakeHTTPHandler(s Service, logger log.Logger, auth auth.Auth, policy auth.Policy, certs *clientcert.Policy, checker *health.Checker, keyProvider keys.Provider, otTracer stdopentracing.Tracer) http.Handler {
 	r := mux.NewRouter()
-	e := MakeServerEndpoints(s, otTracer)
+	e := MakeServerEndpoints(s, logger, otTracer)
+	authenticate := clientcert.NewAuthenticator(oidc.NewParser(auth.Kf, auth.ClaimsFactory))
 
 	options := []httptransport.ServerOption{
 		httptransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
 		httptransport.ServerErrorEncoder(encodeError),
 		httptransport.ServerBefore(jwt.HTTPToContext()),
+		httptransport.ServerBefore(clientcert.HTTPToContext(certs)),
 	}
 
 	r.Methods("GET").Path("/v1/health").Handler(httptransport.NewServer(
 		e.HealthEndpoint,
 		decodeHealthRequest,
-		encodeResponse,
+		encodeHealthResponse(checker),
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "Health", logger)))...,
 	))
 
 	r.Methods("POST").Path("/v1/device/config").Handler(httptransport.NewServer(
-		jwt.NewParser(auth.Kf, stdjwt.SigningMethodRS256, auth.KeycloakClaimsFactory)(e.PostSetConfigEndpoint),
+		authenticate(policy.RequireAdmin()(e.PostSetConfigEndpoint)),
 		decodePostSetConfigRequest,
 		encodeResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostSetConfig", logger)))...,
 	))
 
+	r.Methods("GET").Path("/v1/device/config").Handler(httptransport.NewServer(
+		authenticate(policy.RequireAuditor()(e.GetConfigEndpoint)),
+		decodeGetConfigRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "GetConfig", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/device/config/rollback").Handler(httptransport.NewServer(
+		authenticate(policy.RequireAdmin()(e.PostRollbackConfigEndpoint)),
+		decodePostRollbackConfigRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostRollbackConfig", logger)))...,
+	))
+
 	r.Methods("POST").Path("/v1/device").Handler(httptransport.NewServer(
-		jwt.NewParser(auth.Kf, stdjwt.SigningMethodRS256, auth.KeycloakClaimsFactory)(e.PostGetCRTEndpoint),
-		decodePostGetCRTRequest,
+		authenticate(policy.RequireOperator()(e.PostGetCRTEndpoint)),
+		decodePostGetCRTRequest(keyProvider),
 		encodePostGetCRTResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostGetCRT", logger)))...,
 	))
 
+	r.Methods("POST").Path("/v1/device/batch").Handler(httptransport.NewServer(
+		authenticate(policy.RequireOperator()(e.PostGetCRTBatchEndpoint)),
+		decodePostGetCRTBatchRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostGetCRTBatch", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/device/csr").Handler(httptransport.NewServer(
+		authenticate(policy.RequireOperator()(e.PostEnrollCSREndpoint)),
+		decodePostEnrollCSRRequest,
+		encodePostEnrollCSRResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostEnrollCSR", logger)))...,
+	))
+
+	// Devices renew their certificate authenticating with it over mTLS
+	// instead of an operator token.
+	r.Methods("POST").Path("/v1/device/reenroll").Handler(httptransport.NewServer(
+		e.PostReenrollEndpoint,
+		decodePostReenrollRequest,
+		encodePostEnrollCSRResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostReenroll", logger)))...,
+	))
+
+	r.Methods("GET").Path("/v1/ledger").Handler(httptransport.NewServer(
+		authenticate(policy.RequireAuditor()(e.GetRecordsEndpoint)),
+		decodeGetRecordsRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "GetRecords", logger)))...,
+	))
+
+	r.Methods("GET").Path("/v1/ledger/{id}").Handler(httptransport.NewServer(
+		authenticate(policy.RequireAuditor()(e.GetRecordEndpoint)),
+		decodeGetRecordRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "GetRecord", logger)))...,
+	))
+
 	return r
 }
 
@@ -65,30 +139,159 @@ func decodeHealthRequest(ctx context.Context, r *http.Request) (request interfac
 func decodePostSetConfigRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
 	var reqData postSetConfigRequest
 	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
-		return nil, err
+		return nil, apierrors.Wrap(apierrors.Validation, err)
 	}
 	return reqData, nil
 }
 
-func decodePostGetCRTRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
-	var reqData postGetCRTRequest
+func decodePostRollbackConfigRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	return nil, nil
+}
+
+func decodeGetConfigRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	return nil, nil
+}
+
+// decodePostGetCRTRequest negotiates the response format among those that
+// can hold the keys of keyProvider.
+func decodePostGetCRTRequest(keyProvider keys.Provider) httptransport.DecodeRequestFunc {
+	formats := offeredCredentialsFormats(keyProvider)
+	return func(ctx context.Context, r *http.Request) (request interface{}, err error) {
+		var reqData postGetCRTRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+			return nil, apierrors.Wrap(apierrors.Validation, err)
+		}
+		reqData.IdempotencyKey = r.Header.Get("Idempotency-Key")
+		reqData.Format, err = negotiateFormat(r.Header.Get("Accept"), formats)
+		if err != nil {
+			return nil, err
+		}
+		if requiresPassword(reqData.Format) && reqData.Password == "" {
+			return nil, errPasswordRequired
+		}
+		return reqData, nil
+	}
+}
+
+// decodePostGetCRTBatchRequest requires a password, as the private keys of
+// a batch are always returned in JSON envelopes encrypted with it.
+func decodePostGetCRTBatchRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var reqData postGetCRTBatchRequest
 	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
-		return nil, err
+		return nil, apierrors.Wrap(apierrors.Validation, err)
+	}
+	if reqData.Password == "" {
+		return nil, errPasswordRequired
 	}
 	return reqData, nil
 }
 
+// decodeGetRecordsRequest reads the ledger filter from the device_id,
+// operator, outcome and serial query parameters, paginated with offset and limit.
+func decodeGetRecordsRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	q := r.URL.Query()
+	filter := ledger.Filter{
+		DeviceID: q.Get("device_id"),
+		Operator: q.Get("operator"),
+		Outcome:  strings.ToUpper(q.Get("outcome")),
+		Serial:   q.Get("serial"),
+		Limit:    defaultRecordsLimit,
+	}
+	if v := q.Get("offset"); v != "" {
+		if filter.Offset, err = strconv.Atoi(v); err != nil || filter.Offset < 0 {
+			return nil, errInvalidPagination
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit <= 0 || filter.Limit > maxRecordsLimit {
+			return nil, errInvalidPagination
+		}
+	}
+	return getRecordsRequest{Filter: filter}, nil
+}
+
+func decodeGetRecordRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	return getRecordRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
 func encodePostGetCRTResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	resp := response.(postGetCRTResponse)
 	if resp.Err != nil {
 		encodeError(ctx, resp.Err, w)
 		return nil
 	}
-	w.Header().Set("Content-Type", "application/pkcs10; charset=utf-8")
-	w.Write(resp.Data)
+	return encodeCredentialsResponse(ctx, w, resp.Format, resp.Credentials, resp.Password)
+}
+
+func decodePostEnrollCSRRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var reqData postEnrollCSRRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		return nil, apierrors.Wrap(apierrors.Validation, err)
+	}
+	reqData.IdempotencyKey = r.Header.Get("Idempotency-Key")
+	reqData.Format, err = negotiateFormat(r.Header.Get("Accept"), certificateFormats)
+	if err != nil {
+		return nil, err
+	}
+	return reqData, nil
+}
+
+// decodePostReenrollRequest takes the current device certificate from the
+// TLS connection, which has already been verified against the trust
+// anchors by the server.
+func decodePostReenrollRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, errClientCertRequired
+	}
+	var reqData postReenrollRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		return nil, apierrors.Wrap(apierrors.Validation, err)
+	}
+	reqData.Current = r.TLS.VerifiedChains[0][0]
+	reqData.IdempotencyKey = r.Header.Get("Idempotency-Key")
+	reqData.Format, err = negotiateFormat(r.Header.Get("Accept"), certificateFormats)
+	if err != nil {
+		return nil, err
+	}
+	return reqData, nil
+}
+
+func encodePostEnrollCSRResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(postEnrollCSRResponse)
+	if resp.Err != nil {
+		encodeError(ctx, resp.Err, w)
+		return nil
+	}
+	return encodeCredentialsResponse(ctx, w, resp.Format, resp.Credentials, "")
+}
+
+func encodeCredentialsResponse(ctx context.Context, w http.ResponseWriter, format string, creds *Credentials, password string) error {
+	contentType, data, err := encodeCredentials(format, creds, password)
+	if err != nil {
+		return err
+	}
+	if contentType != pkcs12ContentType {
+		contentType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
 	return nil
 }
 
+// encodeHealthResponse adds the report of checker to the health of the
+// service. It is always sent with 200 OK: dependencies that are down or
+// degraded are only reported, readiness is served by health.ReadyHandler.
+func encodeHealthResponse(checker *health.Checker) httptransport.EncodeResponseFunc {
+	return func(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+		resp := response.(healthResponse)
+		if checker != nil {
+			report := checker.Run(ctx)
+			resp.Status, resp.Checks = report.Status, report.Checks
+		}
+		return encodeResponse(ctx, w, resp)
+	}
+}
+
 func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	if e, ok := response.(errorer); ok && e.error() != nil {
 		// Not a Go kit transport error, but a business-logic error.
@@ -105,14 +308,14 @@ func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 	if err == nil {
 		panic("encodeError with nil error")
 	}
-	http.Error(w, err.Error(), codeFrom(err))
+	apierrors.EncodeProblem(w, tokenError(err))
 }
 
-func codeFrom(err error) int {
+// tokenError marks the errors of the JWT parser as authentication errors.
+func tokenError(err error) error {
 	switch err {
-	case errGetAuthKey, errInvalidCert, errKeyMatching, errUnsupportedKey, errUnsupportedRSASize, errCNEmpty:
-		return http.StatusBadRequest
-	default:
-		return http.StatusInternalServerError
+	case jwt.ErrTokenContextMissing, jwt.ErrTokenInvalid, jwt.ErrTokenExpired, jwt.ErrTokenMalformed, jwt.ErrTokenNotActive, jwt.ErrUnexpectedSigningMethod:
+		return apierrors.Wrap(apierrors.Unauthenticated, err)
 	}
+	return err
 }
@@ -8,6 +8,50 @@ import (
 )
 
 type Client interface {
+	// StartClient validates and activates authCRT, the DMS certificate, and
+	// sets CA as the configuration of the upstream extension. It can be called again
+	// to swap the certificate at runtime.
 	StartClient(ctx context.Context, CA string, authCRT []tls.Certificate) error
-	GetCertificate(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string, caName string) (*x509.Certificate, crypto.PrivateKey, error)
+	// RollbackCredentials reactivates the DMS certificate replaced by the
+	// last StartClient.
+	RollbackCredentials(ctx context.Context) error
+	// Status reports the configuration set by the last successful
+	// StartClient and the upstream instances currently discovered.
+	Status(ctx context.Context) Status
+	// GetCertificate and EnrollCSR return the issued certificate along
+	// with the CA chain it was verified against, ordered from the issuing
+	// CA up to the trust anchor.
+	GetCertificate(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string, caName string) (*x509.Certificate, []*x509.Certificate, crypto.PrivateKey, error)
+	EnrollCSR(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, []*x509.Certificate, error)
+	// ReenrollCSR renews current, a device certificate previously issued
+	// by caName, for the subject and key of csr.
+	ReenrollCSR(ctx context.Context, csr *x509.CertificateRequest, current *x509.Certificate, caName string) (*x509.Certificate, []*x509.Certificate, error)
+}
+
+// Status is the upstream configuration of a Client. Certificate is the
+// active DMS certificate, nil until one is set. Instances are the upstream
+// extension instances found through service discovery, and InstancesErr
+// the last discovery error, if any.
+type Status struct {
+	Started      bool
+	CA           string
+	Certificate  *x509.Certificate
+	Instances    []string
+	InstancesErr error
+}
+
+// Enroller is implemented by each certificate enrollment protocol backend
+// (EST, SCEP, CMP) used by a Client to obtain device certificates.
+type Enroller interface {
+	// SetCredentials sets the DMS certificate and key used to authenticate
+	// against the enrollment server.
+	SetCredentials(authCRT []tls.Certificate)
+	Enroll(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, error)
+	// Reenroll requests a certificate that renews current, using the
+	// re-enrollment operation of the protocol where the DMS can send it on
+	// behalf of the device.
+	Reenroll(ctx context.Context, csr *x509.CertificateRequest, current *x509.Certificate, caName string) (*x509.Certificate, error)
+	// CACerts returns the CA certificates published by the enrollment
+	// server for caName. They are not verified by the Enroller.
+	CACerts(ctx context.Context, caName string) ([]*x509.Certificate, error)
 }
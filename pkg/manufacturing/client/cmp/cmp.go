@@ -0,0 +1,351 @@
+package cmp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	pkixCMPContentType = "application/pkixcmp"
+	cmpPathPrefix      = "/.well-known/cmp"
+)
+
+// CMP enrolls device certificates using the p10cr message, and renews them
+// with the kur message, defined in RFC 4210, transferred over HTTP as
+// defined in RFC 6712. Messages are protected with a signature of the DMS
+// certificate key.
+type CMP struct {
+	mtx     sync.RWMutex
+	address string
+	anchor  *x509.CertPool
+	client  *http.Client
+	authCRT []tls.Certificate
+	logger  log.Logger
+}
+
+var (
+	ErrNoCredentials = apierrors.New(apierrors.Validation, "CMP signer certificate is not configured")
+	ErrEnroll        = apierrors.New(apierrors.UpstreamUnavailable, "CMP enrollment failed")
+	ErrCACerts       = apierrors.New(apierrors.UpstreamUnavailable, "unable to obtain CMP CA certificates")
+	ErrPending       = apierrors.New(apierrors.Conflict, "CMP enrollment is pending manual approval")
+)
+
+// NewEnroller creates a CMP backend for the server at address. Both the
+// server TLS certificate and the certificate protecting CMP responses are
+// verified against the certificates in the CA file.
+func NewEnroller(address string, CA string, logger log.Logger) (client.Enroller, error) {
+	anchor, err := utils.CreateCAPool(CA)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not create CA Pool to validate CMP server")
+		return nil, err
+	}
+	httpc := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: anchor,
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+	return &CMP{address: strings.TrimSuffix(address, "/"), anchor: anchor, client: httpc, logger: logger}, nil
+}
+
+func (c *CMP) SetCredentials(authCRT []tls.Certificate) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.authCRT = authCRT
+}
+
+func (c *CMP) Enroll(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, error) {
+	return c.certify(ctx, caName, bodyP10CR, csr.Raw)
+}
+
+// Reenroll requests a certificate with a kur message. The public key and
+// subject of the CSR are copied into a CRMF certificate template that
+// refers to the certificate being renewed with the oldCertID control. The
+// CSR signature has been checked by the DMS, so proof of possession is
+// declared as raVerified.
+func (c *CMP) Reenroll(ctx context.Context, csr *x509.CertificateRequest, current *x509.Certificate, caName string) (*x509.Certificate, error) {
+	body, err := keyUpdateRequest(csr, current)
+	if err != nil {
+		level.Error(c.logger).Log("err", err, "msg", "Could not create CMP kur message")
+		return nil, ErrEnroll
+	}
+	return c.certify(ctx, caName, bodyKUR, body)
+}
+
+// certify runs a certificate request transaction with a p10cr or kur body,
+// confirming the issued certificate unless the server grants implicit
+// confirmation.
+func (c *CMP) certify(ctx context.Context, caName string, bodyType int, body []byte) (*x509.Certificate, error) {
+	signerCert, signerKey, chain, err := c.signer()
+	if err != nil {
+		return nil, err
+	}
+	transactionID, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	senderNonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	header := pkiHeader{
+		Sender:        directoryName(signerCert.RawSubject),
+		Recipient:     directoryName([]byte{0x30, 0x00}),
+		MessageTime:   time.Now().UTC(),
+		SenderKID:     signerCert.SubjectKeyId,
+		TransactionID: transactionID,
+		SenderNonce:   senderNonce,
+		GeneralInfo:   []infoTypeAndValue{{InfoType: oidImplicitConfirm, InfoValue: asn1Null}},
+	}
+	req, err := marshalMessage(header, bodyType, body, signerKey, chain)
+	if err != nil {
+		level.Error(c.logger).Log("err", err, "msg", "Could not create CMP request message", "body_type", bodyType)
+		return nil, ErrEnroll
+	}
+	rep, err := c.transfer(ctx, caName, req, transactionID, senderNonce)
+	if err != nil {
+		level.Error(c.logger).Log("err", err, "msg", "CMP certificate request transaction failed", "body_type", bodyType)
+		return nil, ErrEnroll
+	}
+
+	crt, certReqID, err := c.parseCertRep(rep, responseBody(bodyType))
+	if err != nil {
+		return nil, err
+	}
+	if rep.header.implicitConfirm() {
+		return crt, nil
+	}
+
+	// The server did not grant implicit confirmation, the certificate must
+	// be accepted explicitly with a certConf message.
+	certHash := sha256.Sum256(crt.Raw)
+	confBody, err := asn1.Marshal([]certStatus{{CertHash: certHash[:], CertReqID: certReqID}})
+	if err != nil {
+		return nil, ErrEnroll
+	}
+	header.GeneralInfo = nil
+	header.MessageTime = time.Now().UTC()
+	header.Recipient = rep.header.Sender
+	header.RecipNonce = rep.header.SenderNonce
+	if header.SenderNonce, err = newNonce(); err != nil {
+		return nil, err
+	}
+	req, err = marshalMessage(header, bodyCertConf, confBody, signerKey, chain)
+	if err != nil {
+		level.Error(c.logger).Log("err", err, "msg", "Could not create CMP certConf message")
+		return nil, ErrEnroll
+	}
+	conf, err := c.transfer(ctx, caName, req, transactionID, header.SenderNonce)
+	if err != nil || conf.bodyType != bodyPKIConf {
+		level.Error(c.logger).Log("err", err, "msg", "CMP server did not confirm certificate")
+		return nil, ErrEnroll
+	}
+	return crt, nil
+}
+
+// CACerts requests the CA certificates with a genm message of type
+// id-it-caCerts, as defined in RFC 9480 section 4.3.1.
+func (c *CMP) CACerts(ctx context.Context, caName string) ([]*x509.Certificate, error) {
+	signerCert, signerKey, chain, err := c.signer()
+	if err != nil {
+		return nil, err
+	}
+	transactionID, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	senderNonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	header := pkiHeader{
+		Sender:        directoryName(signerCert.RawSubject),
+		Recipient:     directoryName([]byte{0x30, 0x00}),
+		MessageTime:   time.Now().UTC(),
+		SenderKID:     signerCert.SubjectKeyId,
+		TransactionID: transactionID,
+		SenderNonce:   senderNonce,
+	}
+	body, err := asn1.Marshal([]infoTypeAndValue{{InfoType: oidCACerts}})
+	if err != nil {
+		return nil, ErrCACerts
+	}
+	req, err := marshalMessage(header, bodyGenM, body, signerKey, chain)
+	if err != nil {
+		level.Error(c.logger).Log("err", err, "msg", "Could not create CMP genm message")
+		return nil, ErrCACerts
+	}
+	rep, err := c.transfer(ctx, caName, req, transactionID, senderNonce)
+	if err != nil {
+		level.Error(c.logger).Log("err", err, "msg", "CMP genm transaction failed")
+		return nil, ErrCACerts
+	}
+	if rep.bodyType != bodyGenP {
+		level.Error(c.logger).Log("body_type", rep.bodyType, "msg", "Unexpected CMP response body")
+		return nil, ErrCACerts
+	}
+
+	var content []infoTypeAndValue
+	if _, err := asn1.Unmarshal(rep.body, &content); err != nil {
+		level.Error(c.logger).Log("err", err, "msg", "Could not parse CMP genp message")
+		return nil, ErrCACerts
+	}
+	for _, info := range content {
+		if !info.InfoType.Equal(oidCACerts) {
+			continue
+		}
+		var raw []asn1.RawValue
+		if _, err := asn1.Unmarshal(info.InfoValue.FullBytes, &raw); err != nil {
+			level.Error(c.logger).Log("err", err, "msg", "Could not parse CMP caCerts value")
+			return nil, ErrCACerts
+		}
+		certs := make([]*x509.Certificate, 0, len(raw))
+		for _, der := range raw {
+			crt, err := x509.ParseCertificate(der.FullBytes)
+			if err != nil {
+				level.Error(c.logger).Log("err", err, "msg", "Could not parse CMP CA certificate")
+				return nil, ErrCACerts
+			}
+			certs = append(certs, crt)
+		}
+		return certs, nil
+	}
+	level.Error(c.logger).Log("msg", "CMP genp message does not contain CA certificates")
+	return nil, ErrCACerts
+}
+
+func (c *CMP) parseCertRep(rep *message, bodyType int) (*x509.Certificate, int, error) {
+	switch rep.bodyType {
+	case bodyType:
+	case bodyError:
+		var content errorMsgContent
+		asn1.Unmarshal(rep.body, &content)
+		level.Error(c.logger).Log("status", content.PKIStatusInfo.Status, "status_string", strings.Join(content.PKIStatusInfo.StatusString, " "), "msg", "CMP server returned an error message")
+		return nil, 0, ErrEnroll
+	default:
+		level.Error(c.logger).Log("body_type", rep.bodyType, "msg", "Unexpected CMP response body")
+		return nil, 0, ErrEnroll
+	}
+
+	var content certRepMessage
+	if _, err := asn1.Unmarshal(rep.body, &content); err != nil || len(content.Response) != 1 {
+		level.Error(c.logger).Log("err", err, "msg", "Could not parse CMP certificate response message")
+		return nil, 0, ErrEnroll
+	}
+	resp := content.Response[0]
+	switch resp.Status.Status {
+	case statusAccepted, statusGrantedWithMods:
+	case statusWaiting:
+		return nil, 0, ErrPending
+	default:
+		level.Error(c.logger).Log("status", resp.Status.Status, "status_string", strings.Join(resp.Status.StatusString, " "), "msg", "CMP server rejected certificate request")
+		return nil, 0, ErrEnroll
+	}
+	certOrEncCert := resp.CertifiedKeyPair.CertOrEncCert
+	if certOrEncCert.Class != asn1.ClassContextSpecific || certOrEncCert.Tag != 0 {
+		level.Error(c.logger).Log("msg", "CMP certificate response does not contain a plain certificate")
+		return nil, 0, ErrEnroll
+	}
+	crt, err := x509.ParseCertificate(certOrEncCert.Bytes)
+	if err != nil {
+		level.Error(c.logger).Log("err", err, "msg", "Could not parse certificate from CMP certificate response")
+		return nil, 0, ErrEnroll
+	}
+	return crt, resp.CertReqID, nil
+}
+
+// transfer sends a request and returns the response once its protection,
+// transaction ID and nonce have been verified.
+func (c *CMP) transfer(ctx context.Context, caName string, data []byte, transactionID []byte, senderNonce []byte) (*message, error) {
+	u := c.address + cmpPathPrefix
+	if caName != "" {
+		u += "/p/" + url.PathEscape(caName)
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", pkixCMPContentType)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, apierrors.Wrap(apierrors.UpstreamUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if err := apierrors.FromResponse("CMP server", resp); err != nil {
+		return nil, err
+	}
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	rep, err := parseMessage(respData)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := rep.verifyProtection()
+	if err != nil {
+		return nil, err
+	}
+	intermediates := x509.NewCertPool()
+	for _, crt := range rep.extraCerts[1:] {
+		intermediates.AddCert(crt)
+	}
+	if _, err := signer.Verify(x509.VerifyOptions{Roots: c.anchor, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(rep.header.TransactionID, transactionID) || !bytes.Equal(rep.header.RecipNonce, senderNonce) {
+		return nil, errors.New("CMP response does not match request transaction")
+	}
+	return rep, nil
+}
+
+func (c *CMP) signer() (*x509.Certificate, crypto.Signer, [][]byte, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	if len(c.authCRT) == 0 || len(c.authCRT[0].Certificate) == 0 {
+		return nil, nil, nil, ErrNoCredentials
+	}
+	key, ok := c.authCRT[0].PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, nil, errUnsupportedProtection
+	}
+	crt, err := x509.ParseCertificate(c.authCRT[0].Certificate[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return crt, key, c.authCRT[0].Certificate, nil
+}
+
+func newNonce() ([]byte, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,372 @@
+package cmp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
+	"github.com/go-kit/kit/log"
+)
+
+type fakeCA struct {
+	crt             *x509.Certificate
+	key             *ecdsa.PrivateKey
+	implicitConfirm bool
+	issued          *x509.Certificate
+	confirmed       bool
+	oldSerial       *big.Int
+	caName          string
+}
+
+func (ca *fakeCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != pkixCMPContentType {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	ca.caName = strings.TrimPrefix(r.URL.Path, cmpPathPrefix+"/p/")
+	data, _ := ioutil.ReadAll(r.Body)
+	req, err := parseMessage(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := req.verifyProtection(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	nonce, _ := newNonce()
+	header := pkiHeader{
+		Sender:        directoryName(ca.crt.RawSubject),
+		Recipient:     req.header.Sender,
+		MessageTime:   time.Now().UTC(),
+		TransactionID: req.header.TransactionID,
+		SenderNonce:   nonce,
+		RecipNonce:    req.header.SenderNonce,
+	}
+
+	var bodyType int
+	var body []byte
+	switch req.bodyType {
+	case bodyP10CR:
+		bodyType = bodyCP
+		body, err = ca.certRep(req)
+		if ca.implicitConfirm && req.header.implicitConfirm() {
+			header.GeneralInfo = []infoTypeAndValue{{InfoType: oidImplicitConfirm, InfoValue: asn1Null}}
+		}
+	case bodyKUR:
+		bodyType = bodyKUP
+		body, err = ca.keyUpdateRep(req)
+		if ca.implicitConfirm && req.header.implicitConfirm() {
+			header.GeneralInfo = []infoTypeAndValue{{InfoType: oidImplicitConfirm, InfoValue: asn1Null}}
+		}
+	case bodyCertConf:
+		var statuses []certStatus
+		asn1.Unmarshal(req.body, &statuses)
+		hash := sha256.Sum256(ca.issued.Raw)
+		ca.confirmed = len(statuses) == 1 && bytes.Equal(statuses[0].CertHash, hash[:])
+		bodyType = bodyPKIConf
+		body = []byte{0x05, 0x00}
+	case bodyGenM:
+		var caCerts []byte
+		caCerts, err = asn1.Marshal([]asn1.RawValue{{FullBytes: ca.crt.Raw}})
+		bodyType = bodyGenP
+		body, _ = asn1.Marshal([]infoTypeAndValue{{InfoType: oidCACerts, InfoValue: asn1.RawValue{FullBytes: caCerts}}})
+	default:
+		http.Error(w, "unsupported body", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rep, err := marshalMessage(header, bodyType, body, ca.key, [][]byte{ca.crt.Raw})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", pkixCMPContentType)
+	w.Write(rep)
+}
+
+func (ca *fakeCA) certRep(req *message) ([]byte, error) {
+	csr, err := x509.ParseCertificateRequest(req.body)
+	if err != nil {
+		return nil, err
+	}
+	return ca.issue(csr.Subject, csr.PublicKey)
+}
+
+func (ca *fakeCA) keyUpdateRep(req *message) ([]byte, error) {
+	var msgs []certReqMsg
+	if _, err := asn1.Unmarshal(req.body, &msgs); err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 || len(msgs[0].CertReq.Controls) != 1 || !msgs[0].CertReq.Controls[0].InfoType.Equal(oidRegCtrlOldCert) {
+		return nil, fmt.Errorf("kur does not contain oldCertID control")
+	}
+	var oldCertID certID
+	if _, err := asn1.Unmarshal(msgs[0].CertReq.Controls[0].InfoValue.FullBytes, &oldCertID); err != nil {
+		return nil, err
+	}
+	ca.oldSerial = oldCertID.SerialNumber
+
+	tmpl := msgs[0].CertReq.CertTemplate
+	var rdn pkix.RDNSequence
+	if _, err := asn1.Unmarshal(tmpl.Subject.Bytes, &rdn); err != nil {
+		return nil, err
+	}
+	var subject pkix.Name
+	subject.FillFromRDNSequence(&rdn)
+	spki, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: tmpl.PublicKey.Bytes})
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(spki)
+	if err != nil {
+		return nil, err
+	}
+	return ca.issue(subject, pub)
+}
+
+func (ca *fakeCA) issue(subject pkix.Name, pub interface{}) ([]byte, error) {
+	if subject.CommonName == "reject" {
+		return asn1.Marshal(certRepMessage{Response: []certResponse{{
+			CertReqID: -1,
+			Status:    pkiStatusInfo{Status: statusRejection, StatusString: []string{"rejected"}},
+		}}})
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.crt, pub, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	ca.issued, _ = x509.ParseCertificate(der)
+	return asn1.Marshal(certRepMessage{Response: []certResponse{{
+		CertReqID:        -1,
+		Status:           pkiStatusInfo{Status: statusAccepted},
+		CertifiedKeyPair: certifiedKeyPair{CertOrEncCert: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}},
+	}}})
+}
+
+func TestEnroll(t *testing.T) {
+	testCases := []struct {
+		name            string
+		cn              string
+		caName          string
+		credentials     bool
+		implicitConfirm bool
+		ret             error
+	}{
+		{"Certificate is enrolled with implicit confirmation", "device", "devices", true, true, nil},
+		{"Certificate is enrolled with explicit confirmation", "device", "devices", true, false, nil},
+		{"CA name is escaped in the path", "device", "lab/devices?v=2", true, true, nil},
+		{"CMP server rejects enrollment", "reject", "devices", true, true, ErrEnroll},
+		{"Signer certificate is not configured", "device", "devices", false, true, ErrNoCredentials},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			ca := newFakeCA(t)
+			ca.implicitConfirm = tc.implicitConfirm
+			enroller := setup(t, ca)
+			if tc.credentials {
+				enroller.SetCredentials([]tls.Certificate{testSigner(t)})
+			}
+			crt, err := enroller.Enroll(context.Background(), testCSR(t, tc.cn), tc.caName)
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err != nil {
+				return
+			}
+			if ca.caName != tc.caName {
+				t.Errorf("Got request for CA %s; want %s", ca.caName, tc.caName)
+			}
+			if crt.Subject.CommonName != tc.cn {
+				t.Errorf("Got certificate for %s; want %s", crt.Subject.CommonName, tc.cn)
+			}
+			if err := crt.CheckSignatureFrom(ca.crt); err != nil {
+				t.Errorf("Certificate is not signed by CA: %s", err)
+			}
+			if !tc.implicitConfirm && !ca.confirmed {
+				t.Error("Certificate was not confirmed")
+			}
+		})
+	}
+}
+
+func TestReenroll(t *testing.T) {
+	testCases := []struct {
+		name            string
+		cn              string
+		implicitConfirm bool
+		ret             error
+	}{
+		{"Certificate is renewed with implicit confirmation", "device", true, nil},
+		{"Certificate is renewed with explicit confirmation", "device", false, nil},
+		{"CMP server rejects renewal", "reject", true, ErrEnroll},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			ca := newFakeCA(t)
+			ca.implicitConfirm = tc.implicitConfirm
+			enroller := setup(t, ca)
+			enroller.SetCredentials([]tls.Certificate{testSigner(t)})
+
+			current, err := enroller.Enroll(context.Background(), testCSR(t, "device"), "devices")
+			if err != nil {
+				t.Fatalf("Could not enroll current certificate: %s", err)
+			}
+			csr := testCSR(t, tc.cn)
+			crt, err := enroller.Reenroll(context.Background(), csr, current, "devices")
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err != nil {
+				return
+			}
+			if ca.oldSerial == nil || ca.oldSerial.Cmp(current.SerialNumber) != 0 {
+				t.Errorf("Got oldCertID serial %s; want %s", ca.oldSerial, current.SerialNumber)
+			}
+			if crt.Subject.CommonName != tc.cn {
+				t.Errorf("Got certificate for %s; want %s", crt.Subject.CommonName, tc.cn)
+			}
+			if !bytes.Equal(crt.RawSubjectPublicKeyInfo, csr.RawSubjectPublicKeyInfo) {
+				t.Error("Renewed certificate does not certify the CSR public key")
+			}
+			if !tc.implicitConfirm && !ca.confirmed {
+				t.Error("Certificate was not confirmed")
+			}
+		})
+	}
+}
+
+func TestCACerts(t *testing.T) {
+	ca := newFakeCA(t)
+	enroller := setup(t, ca)
+	enroller.SetCredentials([]tls.Certificate{testSigner(t)})
+
+	certs, err := enroller.CACerts(context.Background(), "devices")
+	if err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(ca.crt) {
+		t.Errorf("Got %d CA certificates; want the fake CA certificate", len(certs))
+	}
+}
+
+func setup(t *testing.T, ca *fakeCA) *CMP {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.Handle(cmpPathPrefix+"/p/", ca)
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+
+	dir, err := ioutil.TempDir("", "cmp")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory")
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	caFile := filepath.Join(dir, "ca.crt")
+	anchors := append(utils.PEMCert(srv.Certificate().Raw), utils.PEMCert(ca.crt.Raw)...)
+	if err := ioutil.WriteFile(caFile, anchors, 0644); err != nil {
+		t.Fatal("Unable to write CA certificate")
+	}
+
+	enroller, err := NewEnroller(srv.URL, caFile, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to create CMP enroller: %s", err)
+	}
+	return enroller.(*CMP)
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate CA key")
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake CMP CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal("Unable to create CA certificate")
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Unable to parse CA certificate")
+	}
+	return &fakeCA{crt: crt, key: key}
+}
+
+func testSigner(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate signer key")
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "DMS"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal("Unable to create signer certificate")
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func testCSR(t *testing.T, cn string) *x509.CertificateRequest {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate device key")
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+	if err != nil {
+		t.Fatal("Unable to create CSR")
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal("Unable to parse CSR")
+	}
+	return csr
+}
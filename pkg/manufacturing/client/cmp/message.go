@@ -0,0 +1,313 @@
+package cmp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"time"
+)
+
+// PKIBody choice tags used by this client. See RFC 4210 section 5.1.2.
+const (
+	bodyCP       = 3
+	bodyP10CR    = 4
+	bodyKUR      = 7
+	bodyKUP      = 8
+	bodyPKIConf  = 19
+	bodyGenM     = 21
+	bodyGenP     = 22
+	bodyError    = 23
+	bodyCertConf = 24
+)
+
+// PKIStatus values. See RFC 4210 section 5.2.3.
+const (
+	statusAccepted        = 0
+	statusGrantedWithMods = 1
+	statusRejection       = 2
+	statusWaiting         = 3
+)
+
+const pvnoCMP2000 = 2
+
+var (
+	oidImplicitConfirm = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 4, 13}
+	oidCACerts         = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 4, 17}
+	oidRegCtrlOldCert  = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 5, 1, 5}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+	asn1Null = asn1.RawValue{Tag: asn1.TagNull}
+
+	errUnsupportedProtection = errors.New("unsupported CMP protection algorithm")
+	errBadProtection         = errors.New("invalid CMP message protection")
+)
+
+type pkiMessage struct {
+	Header     asn1.RawValue
+	Body       asn1.RawValue
+	Protection asn1.BitString  `asn1:"explicit,optional,tag:0"`
+	ExtraCerts []asn1.RawValue `asn1:"explicit,optional,tag:1"`
+}
+
+type pkiHeader struct {
+	PVNO          int
+	Sender        asn1.RawValue
+	Recipient     asn1.RawValue
+	MessageTime   time.Time                `asn1:"generalized,explicit,optional,tag:0"`
+	ProtectionAlg pkix.AlgorithmIdentifier `asn1:"explicit,optional,tag:1"`
+	SenderKID     []byte                   `asn1:"explicit,optional,tag:2"`
+	RecipKID      []byte                   `asn1:"explicit,optional,tag:3"`
+	TransactionID []byte                   `asn1:"explicit,optional,tag:4"`
+	SenderNonce   []byte                   `asn1:"explicit,optional,tag:5"`
+	RecipNonce    []byte                   `asn1:"explicit,optional,tag:6"`
+	FreeText      asn1.RawValue            `asn1:"explicit,optional,tag:7"`
+	GeneralInfo   []infoTypeAndValue       `asn1:"explicit,optional,tag:8"`
+}
+
+type infoTypeAndValue struct {
+	InfoType  asn1.ObjectIdentifier
+	InfoValue asn1.RawValue `asn1:"optional"`
+}
+
+type protectedPart struct {
+	Header asn1.RawValue
+	Body   asn1.RawValue
+}
+
+type certRepMessage struct {
+	CAPubs   []asn1.RawValue `asn1:"explicit,optional,tag:1"`
+	Response []certResponse
+}
+
+type certResponse struct {
+	CertReqID        int
+	Status           pkiStatusInfo
+	CertifiedKeyPair certifiedKeyPair `asn1:"optional"`
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type certifiedKeyPair struct {
+	CertOrEncCert asn1.RawValue
+}
+
+// certReqMsg is the CRMF certificate request of RFC 4211. The template
+// only holds the subject and public key, with their context specific tags
+// applied by keyUpdateRequest.
+type certReqMsg struct {
+	CertReq certRequest
+	POPO    asn1.RawValue
+}
+
+type certRequest struct {
+	CertReqID    int
+	CertTemplate certTemplate
+	Controls     []infoTypeAndValue
+}
+
+type certTemplate struct {
+	Subject   asn1.RawValue
+	PublicKey asn1.RawValue
+}
+
+type certID struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type certStatus struct {
+	CertHash  []byte
+	CertReqID int
+}
+
+type errorMsgContent struct {
+	PKIStatusInfo pkiStatusInfo
+}
+
+// message is a decoded PKIMessage.
+type message struct {
+	header     pkiHeader
+	bodyType   int
+	body       []byte
+	extraCerts []*x509.Certificate
+
+	rawHeader  asn1.RawValue
+	rawBody    asn1.RawValue
+	protection asn1.BitString
+}
+
+// directoryName encodes a DER encoded Name as a GeneralName.
+func directoryName(rawName []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: rawName}
+}
+
+// responseBody returns the body type of the response to a certificate
+// request body.
+func responseBody(bodyType int) int {
+	if bodyType == bodyKUR {
+		return bodyKUP
+	}
+	return bodyCP
+}
+
+// keyUpdateRequest builds the CertReqMessages of a kur body for the
+// subject and public key of csr, replacing current.
+func keyUpdateRequest(csr *x509.CertificateRequest, current *x509.Certificate) ([]byte, error) {
+	var spki asn1.RawValue
+	if _, err := asn1.Unmarshal(csr.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	oldCertID, err := asn1.Marshal(certID{Issuer: directoryName(current.RawIssuer), SerialNumber: current.SerialNumber})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal([]certReqMsg{{
+		CertReq: certRequest{
+			CertTemplate: certTemplate{
+				// subject [5] is explicitly tagged as Name is a CHOICE,
+				// publicKey [6] is implicitly tagged.
+				Subject:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 5, IsCompound: true, Bytes: csr.RawSubject},
+				PublicKey: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 6, IsCompound: true, Bytes: spki.Bytes},
+			},
+			Controls: []infoTypeAndValue{{InfoType: oidRegCtrlOldCert, InfoValue: asn1.RawValue{FullBytes: oldCertID}}},
+		},
+		// raVerified [0] NULL
+		POPO: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0},
+	}})
+}
+
+func (h *pkiHeader) implicitConfirm() bool {
+	for _, info := range h.GeneralInfo {
+		if info.InfoType.Equal(oidImplicitConfirm) {
+			return true
+		}
+	}
+	return false
+}
+
+func protectionAlgorithm(key crypto.Signer) (pkix.AlgorithmIdentifier, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1Null}, nil
+	case *ecdsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, nil
+	default:
+		return pkix.AlgorithmIdentifier{}, errUnsupportedProtection
+	}
+}
+
+// marshalMessage builds a PKIMessage with the given body, protected with a
+// signature of key. header.ProtectionAlg is filled from the key type.
+func marshalMessage(header pkiHeader, bodyType int, body []byte, key crypto.Signer, extraCerts [][]byte) ([]byte, error) {
+	alg, err := protectionAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	header.PVNO = pvnoCMP2000
+	header.ProtectionAlg = alg
+	rawHeader, err := asn1.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	rawBody, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: bodyType, IsCompound: true, Bytes: body})
+	if err != nil {
+		return nil, err
+	}
+	protected, err := asn1.Marshal(protectedPart{
+		Header: asn1.RawValue{FullBytes: rawHeader},
+		Body:   asn1.RawValue{FullBytes: rawBody},
+	})
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(protected)
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := pkiMessage{
+		Header:     asn1.RawValue{FullBytes: rawHeader},
+		Body:       asn1.RawValue{FullBytes: rawBody},
+		Protection: asn1.BitString{Bytes: signature, BitLength: len(signature) * 8},
+	}
+	for _, der := range extraCerts {
+		msg.ExtraCerts = append(msg.ExtraCerts, asn1.RawValue{FullBytes: der})
+	}
+	return asn1.Marshal(msg)
+}
+
+func parseMessage(data []byte) (*message, error) {
+	var msg pkiMessage
+	rest, err := asn1.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, asn1.SyntaxError{Msg: "trailing data"}
+	}
+	var header pkiHeader
+	if _, err := asn1.Unmarshal(msg.Header.FullBytes, &header); err != nil {
+		return nil, err
+	}
+	if msg.Body.Class != asn1.ClassContextSpecific || !msg.Body.IsCompound {
+		return nil, asn1.StructuralError{Msg: "invalid PKIBody"}
+	}
+	m := &message{
+		header:     header,
+		bodyType:   msg.Body.Tag,
+		body:       msg.Body.Bytes,
+		rawHeader:  msg.Header,
+		rawBody:    msg.Body,
+		protection: msg.Protection,
+	}
+	for _, raw := range msg.ExtraCerts {
+		crt, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			return nil, err
+		}
+		m.extraCerts = append(m.extraCerts, crt)
+	}
+	return m, nil
+}
+
+// verifyProtection checks the message signature against the first of the
+// extra certificates, which must be the certificate of the sender.
+func (m *message) verifyProtection() (*x509.Certificate, error) {
+	if len(m.extraCerts) == 0 || m.protection.BitLength == 0 {
+		return nil, errBadProtection
+	}
+	var sigAlgo x509.SignatureAlgorithm
+	switch {
+	case m.header.ProtectionAlg.Algorithm.Equal(oidSHA256WithRSA):
+		sigAlgo = x509.SHA256WithRSA
+	case m.header.ProtectionAlg.Algorithm.Equal(oidECDSAWithSHA256):
+		sigAlgo = x509.ECDSAWithSHA256
+	default:
+		return nil, errUnsupportedProtection
+	}
+	protected, err := asn1.Marshal(protectedPart{
+		Header: asn1.RawValue{FullBytes: m.rawHeader.FullBytes},
+		Body:   asn1.RawValue{FullBytes: m.rawBody.FullBytes},
+	})
+	if err != nil {
+		return nil, err
+	}
+	signer := m.extraCerts[0]
+	if err := signer.CheckSignature(sigAlgo, protected, m.protection.RightAlign()); err != nil {
+		return nil, errBadProtection
+	}
+	return signer, nil
+}
@@ -0,0 +1,107 @@
+package est
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"sync"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
+	"github.com/globalsign/est"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// EST enrolls and renews device certificates using the simpleenroll
+// operation defined in RFC 7030, acting as a registration authority.
+type EST struct {
+	mtx     sync.RWMutex
+	host    string
+	anchor  *x509.CertPool
+	authCRT []tls.Certificate
+	logger  log.Logger
+}
+
+var (
+	ErrEnroll  = apierrors.New(apierrors.UpstreamUnavailable, "EST enrollment failed")
+	ErrCACerts = apierrors.New(apierrors.UpstreamUnavailable, "unable to obtain EST CA certificates")
+)
+
+// NewEnroller creates an EST backend for the server at address. The server
+// certificate is verified against the certificates in the CA file.
+func NewEnroller(address string, CA string, logger log.Logger) (client.Enroller, error) {
+	anchor, err := utils.CreateCAPool(CA)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not create CA Pool to validate EST server")
+		return nil, err
+	}
+	host := strings.TrimPrefix(strings.TrimPrefix(address, "https://"), "http://")
+	return &EST{
+		host:   strings.TrimSuffix(host, "/"),
+		anchor: anchor,
+		logger: logger,
+	}, nil
+}
+
+func (e *EST) SetCredentials(authCRT []tls.Certificate) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.authCRT = authCRT
+}
+
+func (e *EST) Enroll(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, error) {
+	crt, err := e.client(caName).Enroll(ctx, csr)
+	if err != nil {
+		level.Error(e.logger).Log("err", err, "msg", "EST server rejected simpleenroll request")
+		return nil, ErrEnroll
+	}
+	return crt, nil
+}
+
+// Reenroll sends a simpleenroll request for the renewal. simplereenroll
+// cannot be used on behalf of devices: EST servers require the subject of
+// the CSR to match the TLS client certificate, which is the DMS certificate
+// rather than the one being renewed (RFC 7030 section 4.2.2). Renewals are
+// authorized by the DMS, which only renews certificates it issued.
+func (e *EST) Reenroll(ctx context.Context, csr *x509.CertificateRequest, current *x509.Certificate, caName string) (*x509.Certificate, error) {
+	crt, err := e.client(caName).Enroll(ctx, csr)
+	if err != nil {
+		level.Error(e.logger).Log("err", err, "msg", "EST server rejected simpleenroll request for renewal", "serial", utils.SerialNumber(current.SerialNumber))
+		return nil, ErrEnroll
+	}
+	return crt, nil
+}
+
+func (e *EST) CACerts(ctx context.Context, caName string) ([]*x509.Certificate, error) {
+	certs, err := e.client(caName).CACerts(ctx)
+	if err != nil {
+		level.Error(e.logger).Log("err", err, "msg", "EST server rejected cacerts request")
+		return nil, ErrCACerts
+	}
+	return certs, nil
+}
+
+func (e *EST) client(caName string) *est.Client {
+	e.mtx.RLock()
+	defer e.mtx.RUnlock()
+	c := &est.Client{
+		Host:                  e.host,
+		AdditionalPathSegment: caName,
+		ExplicitAnchor:        e.anchor,
+	}
+	if len(e.authCRT) > 0 {
+		for _, der := range e.authCRT[0].Certificate {
+			crt, err := x509.ParseCertificate(der)
+			if err != nil {
+				break
+			}
+			c.Certificates = append(c.Certificates, crt)
+		}
+		c.PrivateKey = e.authCRT[0].PrivateKey
+	}
+	return c
+}
@@ -0,0 +1,258 @@
+package est
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
+	"github.com/globalsign/est"
+	"github.com/go-kit/kit/log"
+)
+
+type fakeCA struct {
+	crt        *x509.Certificate
+	key        crypto.Signer
+	reenrolled bool
+}
+
+func (ca *fakeCA) CACerts(ctx context.Context, aps string, r *http.Request) ([]*x509.Certificate, error) {
+	return []*x509.Certificate{ca.crt}, nil
+}
+
+func (ca *fakeCA) CSRAttrs(ctx context.Context, aps string, r *http.Request) (est.CSRAttrs, error) {
+	return est.CSRAttrs{}, nil
+}
+
+func (ca *fakeCA) Enroll(ctx context.Context, csr *x509.CertificateRequest, aps string, r *http.Request) (*x509.Certificate, error) {
+	if aps == "unknown" {
+		return nil, errors.New("unknown CA")
+	}
+	return ca.sign(csr)
+}
+
+func (ca *fakeCA) Reenroll(ctx context.Context, cert *x509.Certificate, csr *x509.CertificateRequest, aps string, r *http.Request) (*x509.Certificate, error) {
+	ca.reenrolled = true
+	return ca.sign(csr)
+}
+
+func (ca *fakeCA) ServerKeyGen(ctx context.Context, csr *x509.CertificateRequest, aps string, r *http.Request) (*x509.Certificate, []byte, error) {
+	return nil, nil, errors.New("not implemented")
+}
+
+func (ca *fakeCA) TPMEnroll(ctx context.Context, csr *x509.CertificateRequest, ekcerts []*x509.Certificate, ekPub, akPub []byte, aps string, r *http.Request) ([]byte, []byte, []byte, error) {
+	return nil, nil, nil, errors.New("not implemented")
+}
+
+func (ca *fakeCA) sign(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.crt, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func TestEnroll(t *testing.T) {
+	ca := newFakeCA(t)
+	enroller := setup(t, ca)
+
+	testCases := []struct {
+		name   string
+		caName string
+		ret    error
+	}{
+		{"Certificate is enrolled", "", nil},
+		{"Certificate is enrolled with a CA label", "devices", nil},
+		{"EST server rejects enrollment", "unknown", ErrEnroll},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			csr := testCSR(t, "device")
+			crt, err := enroller.Enroll(context.Background(), csr, tc.caName)
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err != nil {
+				return
+			}
+			if crt.Subject.CommonName != "device" {
+				t.Errorf("Got certificate for %s; want device", crt.Subject.CommonName)
+			}
+			if err := crt.CheckSignatureFrom(ca.crt); err != nil {
+				t.Errorf("Certificate is not signed by CA: %s", err)
+			}
+		})
+	}
+}
+
+func TestReenroll(t *testing.T) {
+	testCases := []struct {
+		name   string
+		caName string
+		ret    error
+	}{
+		{"Certificate is renewed with the DMS credentials", "devices", nil},
+		{"EST server rejects renewal", "unknown", ErrEnroll},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			ca := newFakeCA(t)
+			enroller := setup(t, ca)
+			enroller.SetCredentials([]tls.Certificate{testDMSCert(t)})
+
+			current, err := enroller.Enroll(context.Background(), testCSR(t, "device"), "devices")
+			if err != nil {
+				t.Fatalf("Could not enroll current certificate: %s", err)
+			}
+			csr := testCSR(t, "device")
+			crt, err := enroller.Reenroll(context.Background(), csr, current, tc.caName)
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err != nil {
+				return
+			}
+			if ca.reenrolled {
+				t.Error("Renewal was sent as simplereenroll, which the server checks against the DMS certificate")
+			}
+			if !bytes.Equal(crt.RawSubjectPublicKeyInfo, csr.RawSubjectPublicKeyInfo) {
+				t.Error("Renewed certificate does not certify the CSR public key")
+			}
+		})
+	}
+}
+
+func TestCACerts(t *testing.T) {
+	ca := newFakeCA(t)
+	enroller := setup(t, ca)
+
+	certs, err := enroller.CACerts(context.Background(), "devices")
+	if err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(ca.crt) {
+		t.Errorf("Got %d CA certificates; want the fake CA certificate", len(certs))
+	}
+}
+
+func setup(t *testing.T, ca *fakeCA) *EST {
+	t.Helper()
+
+	router, err := est.NewRouter(&est.ServerConfig{CA: ca})
+	if err != nil {
+		t.Fatal("Unable to create EST server")
+	}
+	// The server asks for the client certificate, as simplereenroll
+	// requests are checked against it.
+	srv := httptest.NewUnstartedServer(router)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	dir, err := ioutil.TempDir("", "est")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory")
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, utils.PEMCert(srv.Certificate().Raw), 0644); err != nil {
+		t.Fatal("Unable to write CA certificate")
+	}
+
+	enroller, err := NewEnroller(srv.URL, caFile, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to create EST enroller: %s", err)
+	}
+	return enroller.(*EST)
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate CA key")
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake EST CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal("Unable to create CA certificate")
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Unable to parse CA certificate")
+	}
+	return &fakeCA{crt: crt, key: key}
+}
+
+// testDMSCert returns a self-signed certificate standing for the DMS
+// credentials presented to the EST server.
+func testDMSCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate DMS key")
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "DMS"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal("Unable to create DMS certificate")
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func testCSR(t *testing.T, cn string) *x509.CertificateRequest {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate device key")
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+	if err != nil {
+		t.Fatal("Unable to create CSR")
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal("Unable to parse CSR")
+	}
+	return csr
+}
@@ -0,0 +1,89 @@
+package extension
+
+import (
+	"context"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// caCertsTTL bounds how long the CA certificates published by the
+// enrollment server are reused before they are requested again.
+const caCertsTTL = 10 * time.Minute
+
+var ErrChainValidation = apierrors.New(apierrors.UpstreamUnavailable, "issued certificate does not chain to a trust anchor")
+
+type cachedCACerts struct {
+	certs   []*x509.Certificate
+	fetched time.Time
+}
+
+// caCertsCache holds the CA certificates of each CA of the enrollment
+// server, so a batch does not request them once per device.
+type caCertsCache struct {
+	mtx   sync.Mutex
+	certs map[string]cachedCACerts
+}
+
+func (c *caCertsCache) get(caName string) ([]*x509.Certificate, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	cached, ok := c.certs[caName]
+	if !ok || time.Since(cached.fetched) > caCertsTTL {
+		return nil, false
+	}
+	return cached.certs, true
+}
+
+func (c *caCertsCache) set(caName string, certs []*x509.Certificate) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.certs == nil {
+		c.certs = make(map[string]cachedCACerts)
+	}
+	c.certs[caName] = cachedCACerts{certs: certs, fetched: time.Now()}
+}
+
+// verifyChain builds the chain of crt from the CA certificates published
+// by the enrollment server up to one of the configured trust anchors. The
+// returned chain does not include crt. Cached CA certificates are refreshed
+// once if they do not validate crt, in case the CA has been rotated.
+// Without trust anchors crt is not validated and no chain is returned.
+func (s *DMSClient) verifyChain(ctx context.Context, crt *x509.Certificate, caName string) ([]*x509.Certificate, error) {
+	if s.trustAnchors == nil {
+		return nil, nil
+	}
+
+	var err error
+	caCerts, cached := s.caCerts.get(caName)
+	for {
+		if !cached {
+			caCerts, err = s.enroller.CACerts(ctx, caName)
+			if err != nil {
+				return nil, err
+			}
+			s.caCerts.set(caName, caCerts)
+		}
+		intermediates := x509.NewCertPool()
+		for _, ca := range caCerts {
+			intermediates.AddCert(ca)
+		}
+		chains, err := crt.Verify(x509.VerifyOptions{
+			Roots:         s.trustAnchors,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err == nil {
+			return chains[0][1:], nil
+		}
+		if !cached {
+			level.Error(s.logger).Log("err", err, "msg", "Issued certificate does not chain to a trust anchor")
+			return nil, ErrChainValidation
+		}
+		cached = false
+	}
+}
@@ -0,0 +1,167 @@
+package extension
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
+	"github.com/go-kit/kit/log"
+)
+
+type fakeEnroller struct {
+	caCerts        []*x509.Certificate
+	caCertsInvoked int
+	authCRT        []tls.Certificate
+}
+
+func (e *fakeEnroller) SetCredentials(authCRT []tls.Certificate) {
+	e.authCRT = authCRT
+}
+
+func (e *fakeEnroller) Enroll(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (e *fakeEnroller) Reenroll(ctx context.Context, csr *x509.CertificateRequest, current *x509.Certificate, caName string) (*x509.Certificate, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (e *fakeEnroller) CACerts(ctx context.Context, caName string) ([]*x509.Certificate, error) {
+	e.caCertsInvoked++
+	return e.caCerts, nil
+}
+
+func TestVerifyChain(t *testing.T) {
+	root, rootKey := testCA(t, "Root CA", nil, nil)
+	intermediate, intermediateKey := testCA(t, "Issuing CA", root, rootKey)
+	device, _ := testCA(t, "device", intermediate, intermediateKey)
+	otherRoot, _ := testCA(t, "Other Root CA", nil, nil)
+
+	testCases := []struct {
+		name    string
+		anchors []*x509.Certificate
+		caCerts []*x509.Certificate
+		chain   int
+		ret     error
+	}{
+		{"Chain is built up to the trust anchor", []*x509.Certificate{root}, []*x509.Certificate{intermediate, root}, 2, nil},
+		{"Intermediate is missing", []*x509.Certificate{root}, []*x509.Certificate{root}, 0, ErrChainValidation},
+		{"Root is not a trust anchor", []*x509.Certificate{otherRoot}, []*x509.Certificate{intermediate, root}, 0, ErrChainValidation},
+		{"Trust anchors are not configured", nil, []*x509.Certificate{intermediate, root}, 0, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			enroller := &fakeEnroller{caCerts: tc.caCerts}
+			s := &DMSClient{trustAnchors: anchorPool(tc.anchors), enroller: enroller, logger: log.NewNopLogger()}
+			chain, err := s.verifyChain(context.Background(), device, "devices")
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if len(chain) != tc.chain {
+				t.Errorf("Got chain of %d certificates; want %d", len(chain), tc.chain)
+			}
+		})
+	}
+}
+
+func TestVerifyChainRefreshesCachedCACerts(t *testing.T) {
+	root, rootKey := testCA(t, "Root CA", nil, nil)
+	oldIntermediate, _ := testCA(t, "Issuing CA", root, rootKey)
+	intermediate, intermediateKey := testCA(t, "Issuing CA", root, rootKey)
+	device, _ := testCA(t, "device", intermediate, intermediateKey)
+
+	enroller := &fakeEnroller{caCerts: []*x509.Certificate{intermediate}}
+	s := &DMSClient{trustAnchors: anchorPool([]*x509.Certificate{root}), enroller: enroller, logger: log.NewNopLogger()}
+	s.caCerts.set("devices", []*x509.Certificate{oldIntermediate})
+
+	if _, err := s.verifyChain(context.Background(), device, "devices"); err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	if _, err := s.verifyChain(context.Background(), device, "devices"); err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	if enroller.caCertsInvoked != 1 {
+		t.Errorf("CA certificates requested %d times; want 1", enroller.caCertsInvoked)
+	}
+}
+
+func anchorPool(anchors []*x509.Certificate) *x509.CertPool {
+	if anchors == nil {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	for _, crt := range anchors {
+		pool.AddCert(crt)
+	}
+	return pool
+}
+
+func writeAnchors(t *testing.T, anchors []*x509.Certificate) string {
+	t.Helper()
+
+	if anchors == nil {
+		return ""
+	}
+	dir, err := ioutil.TempDir("", "anchors")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory")
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	var data []byte
+	for _, crt := range anchors {
+		data = append(data, utils.PEMCert(crt.Raw)...)
+	}
+	file := filepath.Join(dir, "anchors.crt")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal("Unable to write trust anchors")
+	}
+	return file
+}
+
+// testCA creates a CA certificate for cn signed by parent, or a self-signed
+// one when parent is nil.
+func testCA(t *testing.T, cn string, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate key")
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal("Unable to create certificate")
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Unable to parse certificate")
+	}
+	return crt, key
+}
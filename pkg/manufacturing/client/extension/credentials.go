@@ -0,0 +1,161 @@
+package extension
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+var (
+	ErrNoCredentials         = apierrors.New(apierrors.Validation, "no DMS certificate given")
+	ErrCredentialsExpired    = apierrors.New(apierrors.Validation, "DMS certificate is expired or not yet valid")
+	ErrCredentialsUntrusted  = apierrors.New(apierrors.Validation, "DMS certificate does not chain to the proxy CA")
+	ErrNoPreviousCredentials = apierrors.New(apierrors.Conflict, "no previous DMS certificate to roll back to")
+	ErrCredentialsChanged    = apierrors.New(apierrors.Conflict, "DMS certificate was replaced while it was being renewed")
+)
+
+// credentials holds the DMS certificate presented to the proxy and the
+// enrollment server, and the one it replaced, kept for rollback.
+type credentials struct {
+	mtx      sync.RWMutex
+	current  *tls.Certificate
+	previous *tls.Certificate
+}
+
+func (c *credentials) get() (current, previous *tls.Certificate) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.current, c.previous
+}
+
+func (c *credentials) set(current, previous *tls.Certificate) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.current, c.previous = current, previous
+}
+
+// clientCertificate presents the current DMS certificate in TLS handshakes
+// with the proxy, so swapped credentials are used by new connections
+// without recreating the client.
+func (s *DMSClient) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	current, _ := s.creds.get()
+	if current == nil {
+		return &tls.Certificate{}, nil
+	}
+	return current, nil
+}
+
+// validateCredentials checks that cert is within its validity period and
+// chains to the proxy CA, with the certificates that follow it in cert as
+// intermediates.
+func (s *DMSClient) validateCredentials(cert *tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return ErrNoCredentials
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return ErrNoCredentials
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return ErrCredentialsExpired
+	}
+	roots, err := utils.CreateCAPool(s.proxyCA)
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not create CA Pool to validate DMS certificate")
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range cert.Certificate[1:] {
+		if c, err := x509.ParseCertificate(der); err == nil {
+			intermediates.AddCert(c)
+		}
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "DMS certificate does not chain to the proxy CA")
+		return ErrCredentialsUntrusted
+	}
+	cert.Leaf = leaf
+	return nil
+}
+
+// activate makes the enrollment backend and new connections to the
+// proxy use cert. Idle connections, authenticated with the replaced
+// certificate, are closed.
+func (s *DMSClient) activate(cert *tls.Certificate, previous *tls.Certificate) {
+	s.creds.set(cert, previous)
+	var authCRT []tls.Certificate
+	if cert != nil {
+		authCRT = []tls.Certificate{*cert}
+	}
+	s.enroller.SetCredentials(authCRT)
+	if s.transport != nil {
+		s.transport.CloseIdleConnections()
+	}
+}
+
+// RollbackCredentials swaps back to the DMS certificate replaced by the
+// last StartClient, as long as it is still valid. The replaced certificate
+// is kept, so a rollback can be undone by another one.
+func (s *DMSClient) RollbackCredentials(ctx context.Context) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	current, previous := s.creds.get()
+	if previous == nil {
+		return ErrNoPreviousCredentials
+	}
+	if err := s.validateCredentials(previous); err != nil {
+		return err
+	}
+	s.activate(previous, current)
+	level.Info(s.logger).Log("msg", "DMS certificate rolled back", "serial", utils.SerialNumber(previous.Leaf.SerialNumber))
+	return nil
+}
+
+// Credentials returns the DMS certificate currently presented to the
+// proxy and the enrollment server, or nil before StartClient.
+func (s *DMSClient) Credentials() *tls.Certificate {
+	current, _ := s.creds.get()
+	return current
+}
+
+// SetCredentials swaps in cert, renewed for current, without setting the
+// configuration of the upstream extension again. It fails with
+// ErrCredentialsChanged unless current is still the active certificate, so
+// a certificate set by a concurrent StartClient is never replaced. persist,
+// if not nil, is called under the same lock as StartClient once cert is
+// active, and current is restored if it fails. The replaced certificate is
+// kept for RollbackCredentials.
+func (s *DMSClient) SetCredentials(current *tls.Certificate, cert tls.Certificate, persist func() error) error {
+	if err := s.validateCredentials(&cert); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	active, previous := s.creds.get()
+	if active != current {
+		return ErrCredentialsChanged
+	}
+	s.activate(&cert, active)
+	if persist != nil {
+		if err := persist(); err != nil {
+			level.Error(s.logger).Log("err", err, "msg", "Could not persist DMS certificate, restoring previous one")
+			s.activate(active, previous)
+			return err
+		}
+	}
+	level.Info(s.logger).Log("msg", "DMS certificate swapped", "serial", utils.SerialNumber(cert.Leaf.SerialNumber))
+	return nil
+}
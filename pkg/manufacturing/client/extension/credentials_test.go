@@ -0,0 +1,159 @@
+package extension
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestValidateCredentials(t *testing.T) {
+	root, rootKey := testCA(t, "Proxy CA", nil, nil)
+	intermediate, intermediateKey := testCA(t, "DMS CA", root, rootKey)
+	otherRoot, otherRootKey := testCA(t, "Other CA", nil, nil)
+	proxyCA := writeAnchors(t, []*x509.Certificate{root})
+
+	testCases := []struct {
+		name string
+		cert tls.Certificate
+		ret  error
+	}{
+		{"Certificate chains to the proxy CA", testCredentials(t, root, rootKey, time.Now().Add(time.Hour)), nil},
+		{"Chain includes an intermediate", testCredentials(t, intermediate, intermediateKey, time.Now().Add(time.Hour), intermediate), nil},
+		{"Intermediate is missing", testCredentials(t, intermediate, intermediateKey, time.Now().Add(time.Hour)), ErrCredentialsUntrusted},
+		{"Certificate is expired", testCredentials(t, root, rootKey, time.Now().Add(-time.Minute)), ErrCredentialsExpired},
+		{"Certificate is issued by other CA", testCredentials(t, otherRoot, otherRootKey, time.Now().Add(time.Hour)), ErrCredentialsUntrusted},
+		{"Certificate is missing", tls.Certificate{}, ErrNoCredentials},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			s := &DMSClient{proxyCA: proxyCA, logger: log.NewNopLogger()}
+			err := s.validateCredentials(&tc.cert)
+			if tc.ret != err {
+				t.Errorf("Got result is %v; want %v", err, tc.ret)
+			}
+		})
+	}
+}
+
+func TestRollbackCredentials(t *testing.T) {
+	root, rootKey := testCA(t, "Proxy CA", nil, nil)
+	oldCert := testCredentials(t, root, rootKey, time.Now().Add(time.Hour))
+	newCert := testCredentials(t, root, rootKey, time.Now().Add(time.Hour))
+	enroller := &fakeEnroller{}
+	s := &DMSClient{proxyCA: writeAnchors(t, []*x509.Certificate{root}), enroller: enroller, logger: log.NewNopLogger()}
+
+	if err := s.RollbackCredentials(context.Background()); err != ErrNoPreviousCredentials {
+		t.Fatalf("Got result is %v; want %v", err, ErrNoPreviousCredentials)
+	}
+
+	s.activate(&newCert, &oldCert)
+	if err := s.RollbackCredentials(context.Background()); err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	presented, err := s.clientCertificate(nil)
+	if err != nil || string(presented.Certificate[0]) != string(oldCert.Certificate[0]) {
+		t.Error("Got certificate presented to the proxy is not the previous one")
+	}
+	if len(enroller.authCRT) != 1 || string(enroller.authCRT[0].Certificate[0]) != string(oldCert.Certificate[0]) {
+		t.Error("Got enrollment credentials are not the previous ones")
+	}
+	if _, previous := s.creds.get(); previous == nil || string(previous.Certificate[0]) != string(newCert.Certificate[0]) {
+		t.Error("Got previous certificate is not the replaced one")
+	}
+
+	expired := testCredentials(t, root, rootKey, time.Now().Add(-time.Minute))
+	s.activate(&newCert, &expired)
+	if err := s.RollbackCredentials(context.Background()); err != ErrCredentialsExpired {
+		t.Errorf("Got result is %v; want %v", err, ErrCredentialsExpired)
+	}
+}
+
+func TestSetCredentials(t *testing.T) {
+	root, rootKey := testCA(t, "Proxy CA", nil, nil)
+	oldCert := testCredentials(t, root, rootKey, time.Now().Add(time.Hour))
+	newCert := testCredentials(t, root, rootKey, time.Now().Add(time.Hour))
+	enroller := &fakeEnroller{}
+	s := &DMSClient{proxyCA: writeAnchors(t, []*x509.Certificate{root}), enroller: enroller, logger: log.NewNopLogger()}
+	s.activate(&oldCert, nil)
+
+	expired := testCredentials(t, root, rootKey, time.Now().Add(-time.Minute))
+	if err := s.SetCredentials(s.Credentials(), expired, nil); err != ErrCredentialsExpired {
+		t.Fatalf("Got result is %v; want %v", err, ErrCredentialsExpired)
+	}
+	if string(s.Credentials().Certificate[0]) != string(oldCert.Certificate[0]) {
+		t.Fatal("Got rejected certificate is active")
+	}
+
+	if err := s.SetCredentials(&newCert, newCert, nil); err != ErrCredentialsChanged {
+		t.Fatalf("Got result is %v; want %v", err, ErrCredentialsChanged)
+	}
+
+	errPersist := errors.New("read-only file system")
+	if err := s.SetCredentials(s.Credentials(), newCert, func() error { return errPersist }); err != errPersist {
+		t.Fatalf("Got result is %v; want %v", err, errPersist)
+	}
+	if string(s.Credentials().Certificate[0]) != string(oldCert.Certificate[0]) {
+		t.Fatal("Got certificate that could not be persisted is active")
+	}
+	if len(enroller.authCRT) != 1 || string(enroller.authCRT[0].Certificate[0]) != string(oldCert.Certificate[0]) {
+		t.Fatal("Got enrollment credentials are not restored")
+	}
+
+	persisted := false
+	if err := s.SetCredentials(s.Credentials(), newCert, func() error { persisted = true; return nil }); err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	if !persisted {
+		t.Error("Got new certificate is not persisted")
+	}
+	if string(s.Credentials().Certificate[0]) != string(newCert.Certificate[0]) {
+		t.Error("Got active certificate is not the new one")
+	}
+	if len(enroller.authCRT) != 1 || string(enroller.authCRT[0].Certificate[0]) != string(newCert.Certificate[0]) {
+		t.Error("Got enrollment credentials are not the new ones")
+	}
+	if _, previous := s.creds.get(); previous == nil || string(previous.Certificate[0]) != string(oldCert.Certificate[0]) {
+		t.Error("Got previous certificate is not the replaced one")
+	}
+}
+
+// testCredentials creates a DMS client certificate issued by parent that
+// expires at notAfter, followed in the chain by intermediates.
+func testCredentials(t *testing.T, parent *x509.Certificate, parentKey crypto.Signer, notAfter time.Time, intermediates ...*x509.Certificate) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate key")
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "dms"},
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal("Unable to create certificate")
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	for _, c := range intermediates {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert
+}
@@ -0,0 +1,45 @@
+package extension
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"testing"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys/memory"
+)
+
+func TestMakeCSR(t *testing.T) {
+	testCases := []struct {
+		name    string
+		keyAlg  string
+		keySize int
+		rsaPSS  bool
+		sigAlgo x509.SignatureAlgorithm
+	}{
+		{"RSA 3072", "RSA", 3072, false, x509.SHA256WithRSA},
+		{"RSA-PSS", "RSA", 2048, true, x509.SHA256WithRSAPSS},
+		{"EC P-384", "EC", 384, false, x509.ECDSAWithSHA384},
+		{"EC P-521", "EC", 521, false, x509.ECDSAWithSHA512},
+		{"Ed25519", "Ed25519", 0, false, x509.PureEd25519},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			s := &DMSClient{rsaPSS: tc.rsaPSS}
+			key, err := memory.NewProvider().GenerateKey(context.Background(), tc.keyAlg, tc.keySize)
+			if err != nil {
+				t.Fatalf("Unable to create key: %s", err)
+			}
+			csr, err := makeCSR(&CSROptions{cn: "device", key: key, sigAlgo: s.checkSignatureAlgorithm(tc.keyAlg, tc.keySize)})
+			if err != nil {
+				t.Fatalf("Unable to create CSR: %s", err)
+			}
+			if csr.SignatureAlgorithm != tc.sigAlgo {
+				t.Errorf("Got signature algorithm %s; want %s", csr.SignatureAlgorithm, tc.sigAlgo)
+			}
+			if err := csr.CheckSignature(); err != nil {
+				t.Errorf("Invalid CSR signature: %s", err)
+			}
+		})
+	}
+}
@@ -8,9 +8,12 @@ import (
 	"errors"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys"
 	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
 
 	"github.com/go-kit/kit/log"
@@ -19,8 +22,6 @@ import (
 	"github.com/hashicorp/consul/api"
 	extensionclient "github.com/micromdm/scep/client/extension"
 	stdopentracing "github.com/opentracing/opentracing-go"
-
-	"github.com/lamassuiot/lamassu-est/client/estclient"
 )
 
 const (
@@ -28,62 +29,91 @@ const (
 	rsaPEMBlockType = "RSA PRIVATE KEY"
 )
 
-type SCEPExt struct {
+// DMSClient configures the upstream extension through the proxy and
+// enrolls device certificates through the configured enrollment protocol.
+type DMSClient struct {
 	proxyAddress   string
 	consulProtocol string
 	consulHost     string
 	consulPort     string
 	consulCA       string
 	proxyCA        string
+	trustAnchors   *x509.CertPool
+	rsaPSS         bool
+	mtx            sync.Mutex
 	extClient      extensionclient.Client
+	transport      *http.Transport
+	creds          credentials
+	upstream       upstream
+	keyProvider    keys.Provider
+	enroller       client.Enroller
+	protocol       string
+	caCerts        caCertsCache
 	logger         log.Logger
 	otTracer       stdopentracing.Tracer
 }
 
 type CSROptions struct {
 	cn, org, country, ou, locality, province string
-	key                                      crypto.PrivateKey
+	key                                      crypto.Signer
 	sigAlgo                                  x509.SignatureAlgorithm
 }
 
 var (
 	ErrSignerInfoLoading = errors.New("unable to read Signer info")
 	ErrCSRCreate         = errors.New("unable to create CSR")
-	ErrPKIOperation      = errors.New("unable to perform PKI operation")
+	ErrPKIOperation      = apierrors.New(apierrors.UpstreamUnavailable, "unable to perform PKI operation")
 	ErrCSRRequestCreate  = errors.New("unable to create CSR request")
-	ErrGetRemoteCA       = errors.New("error getting remote CA certificate")
-	ErrRemoteConnection  = errors.New("error connecting to remote server")
-	ErrConsulConnection  = errors.New("error connecting to Service Discovery server")
+	ErrGetRemoteCA       = apierrors.New(apierrors.UpstreamUnavailable, "error getting remote CA certificate")
+	ErrRemoteConnection  = apierrors.New(apierrors.UpstreamUnavailable, "error connecting to remote server")
+	ErrConsulConnection  = apierrors.New(apierrors.UpstreamUnavailable, "error connecting to Service Discovery server")
 )
 
-func NewClient(proxyAddress string, consulProtocol string, consulHost string, consulPort string, consulCA string, proxyCA string, logger log.Logger, otTracer stdopentracing.Tracer) client.Client {
-	return &SCEPExt{
+// NewClient returns a DMSClient validating the CA chain of issued
+// certificates against the root certificates in the trustAnchors file.
+// Without trustAnchors issued certificates are returned without their chain.
+func NewClient(proxyAddress string, consulProtocol string, consulHost string, consulPort string, consulCA string, proxyCA string, trustAnchors string, rsaPSS bool, keyProvider keys.Provider, enroller client.Enroller, protocol string, logger log.Logger, otTracer stdopentracing.Tracer) (*DMSClient, error) {
+	var roots *x509.CertPool
+	if trustAnchors != "" {
+		var err error
+		roots, err = utils.CreateCAPool(trustAnchors)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		level.Warn(logger).Log("msg", "No trust anchors configured, the CA chain of issued certificates is not validated nor returned")
+	}
+	return &DMSClient{
 		proxyAddress:   proxyAddress,
 		consulProtocol: consulProtocol,
 		consulHost:     consulHost,
 		consulPort:     consulPort,
 		consulCA:       consulCA,
 		proxyCA:        proxyCA,
+		trustAnchors:   roots,
+		rsaPSS:         rsaPSS,
+		keyProvider:    keyProvider,
+		enroller:       enroller,
+		protocol:       protocol,
 		logger:         logger,
 		otTracer:       otTracer,
-	}
+	}, nil
 }
 
-func (s *SCEPExt) createClient(authCRT []tls.Certificate) (extensionclient.Client, error) {
+func (s *DMSClient) createClient() (extensionclient.Client, error) {
 	caCertPool, err := utils.CreateCAPool(s.proxyCA)
 	if err != nil {
-		level.Error(s.logger).Log("err", err, "msg", "Could not create CA Pool to validate SCEP Extension")
+		level.Error(s.logger).Log("err", err, "msg", "Could not create CA Pool to validate proxy")
 		return nil, err
 	}
 
-	httpc := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs:      caCertPool,
-				Certificates: authCRT,
-			},
+	s.transport = &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:              caCertPool,
+			GetClientCertificate: s.clientCertificate,
 		},
 	}
+	httpc := &http.Client{Transport: s.transport}
 
 	consulConfig := api.DefaultConfig()
 	consulConfig.Address = s.consulProtocol + "://" + s.consulHost + ":" + s.consulPort
@@ -99,47 +129,69 @@ func (s *SCEPExt) createClient(authCRT []tls.Certificate) (extensionclient.Clien
 	passingOnly := true
 	duration := 500 * time.Millisecond
 	instancer := consulsd.NewInstancer(clientConsul, s.logger, "scepextension", tags, passingOnly)
+	s.upstream.setInstancer(instancer)
 
 	extClient, err := extensionclient.NewSD(s.proxyAddress, duration, instancer, s.logger, httpc, s.otTracer)
 	if err != nil {
-		level.Error(s.logger).Log("err", err, "msg", "Could not start SCEP Extension Client")
+		level.Error(s.logger).Log("err", err, "msg", "Could not start extension client")
 		return nil, err
 	}
-	level.Info(s.logger).Log("msg", "SCEP Extension Client started")
+	level.Info(s.logger).Log("msg", "Extension client started", "protocol", s.protocol)
 	return extClient, nil
 }
 
-func (s *SCEPExt) StartClient(ctx context.Context, CA string, authCRT []tls.Certificate) error {
+// StartClient activates authCRT, the DMS certificate, once it is checked to
+// be valid and to chain to the proxy CA, and sets CA as the configuration of
+// the upstream extension. The extension client is created on first use and
+// picks up later certificates without being recreated. The replaced
+// certificate is restored if the configuration cannot be set, and is kept
+// for RollbackCredentials otherwise.
+func (s *DMSClient) StartClient(ctx context.Context, CA string, authCRT []tls.Certificate) error {
+	if len(authCRT) == 0 {
+		return ErrNoCredentials
+	}
+	cert := authCRT[0]
+	if err := s.validateCredentials(&cert); err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
 	if s.extClient == nil {
-		extClient, err := s.createClient(authCRT)
+		extClient, err := s.createClient()
 		if err != nil {
 			return err
 		}
 		s.extClient = extClient
 	}
+	current, previous := s.creds.get()
+	s.activate(&cert, current)
 	ctx, cancel := context.WithDeadline(ctx, time.Now().Add(time.Second*10))
 	defer cancel()
 	err := s.extClient.PostSetConfig(ctx, CA)
 	if err != nil {
-		level.Error(s.logger).Log("err", err, "msg", "Could not set configuration for SCEP Extension")
+		level.Error(s.logger).Log("err", err, "msg", "Could not set configuration for extension, restoring previous DMS certificate")
+		s.activate(current, previous)
 		return ErrRemoteConnection
 	}
-	level.Info(s.logger).Log("msg", "SCEP Extension configuration succesfully assigned")
+	s.upstream.setCA(CA)
+	level.Info(s.logger).Log("msg", "Extension configuration succesfully assigned", "protocol", s.protocol, "serial", utils.SerialNumber(cert.Leaf.SerialNumber))
 	return nil
 }
 
-func (s *SCEPExt) GetCertificate(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string, caName string) (*x509.Certificate, crypto.PrivateKey, error) {
+func (s *DMSClient) GetCertificate(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string, caName string) (*x509.Certificate, []*x509.Certificate, crypto.PrivateKey, error) {
 	ctx, cancel := context.WithDeadline(ctx, time.Now().Add(time.Second*10))
 	defer cancel()
-	sigAlgo := s.checkSignatureAlgorithm(keyAlg)
+	sigAlgo := s.checkSignatureAlgorithm(keyAlg, keySize)
 	level.Info(s.logger).Log("msg", "CSR signature algorithm checked")
 
-	key, err := makeKey(keyAlg, keySize)
+	key, err := s.keyProvider.GenerateKey(ctx, keyAlg, keySize)
 	if err != nil {
-		level.Error(s.logger).Log("err", err, "msg", "Could not create key for SCEP request")
-		return nil, nil, err
+		level.Error(s.logger).Log("err", err, "msg", "Could not create key for enrollment request")
+		return nil, nil, nil, err
 	}
-	level.Info(s.logger).Log("msg", "Key for SCEP request created")
+	defer key.Destroy()
+	level.Info(s.logger).Log("msg", "Key for enrollment request created")
 
 	opts := &CSROptions{
 		cn:       cn,
@@ -154,38 +206,84 @@ func (s *SCEPExt) GetCertificate(ctx context.Context, keyAlg string, keySize int
 
 	csr, err := makeCSR(opts)
 	if err != nil {
-		level.Error(s.logger).Log("err", err, "msg", "Could not create CSR for SCEP request")
-		return nil, nil, err
+		level.Error(s.logger).Log("err", err, "msg", "Could not create CSR for enrollment request")
+		return nil, nil, nil, err
 	}
-	level.Info(s.logger).Log("msg", "CSR for SCEP request created")
+	level.Info(s.logger).Log("msg", "CSR for enrollment request created")
 
-	/* SWITCH FROM SCEP TO EST HERE */
+	crt, chain, err := s.EnrollCSR(ctx, csr, caName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	//pemcsr := utils.PEMCSR(csr.Raw)
-	//crtData, err := s.extClient.PostGetCRT(ctx, pemcsr)
-	crt, err := estclient.Enroll(csr, caName)
+	private, err := key.Export()
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not export key of enrollment request")
+		return nil, nil, nil, err
+	}
+	return crt, chain, private, nil
+}
 
+func (s *DMSClient) EnrollCSR(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, []*x509.Certificate, error) {
+	ctx, cancel := context.WithDeadline(ctx, time.Now().Add(time.Second*10))
+	defer cancel()
+	crt, err := s.enroller.Enroll(ctx, csr, caName)
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not obtain certificate from enrollment server", "protocol", s.protocol)
+		return nil, nil, err
+	}
+	level.Info(s.logger).Log("msg", "Enrollment server returned certificate", "protocol", s.protocol)
+
+	chain, err := s.verifyChain(ctx, crt, caName)
 	if err != nil {
-		level.Error(s.logger).Log("err", err, "msg", "Could not obtain certificate from SCEP Server")
+		level.Error(s.logger).Log("err", err, "msg", "Could not validate CA chain of issued certificate")
 		return nil, nil, err
 	}
-	level.Info(s.logger).Log("msg", "SCEP Server returned certificate")
-	/*crt, err := utils.ParseCertificate(crtData)
+	level.Info(s.logger).Log("msg", "CA chain of issued certificate validated")
+	return crt, chain, nil
+}
+
+// ReenrollCSR renews current through the re-enrollment operation of the
+// enrollment server and validates the CA chain of the new certificate.
+func (s *DMSClient) ReenrollCSR(ctx context.Context, csr *x509.CertificateRequest, current *x509.Certificate, caName string) (*x509.Certificate, []*x509.Certificate, error) {
+	ctx, cancel := context.WithDeadline(ctx, time.Now().Add(time.Second*10))
+	defer cancel()
+	crt, err := s.enroller.Reenroll(ctx, csr, current, caName)
 	if err != nil {
-		level.Error(s.logger).Log("err", err, "msg", "Could not parse certificate obtained from SCEP Server")
+		level.Error(s.logger).Log("err", err, "msg", "Could not renew certificate with enrollment server", "protocol", s.protocol)
 		return nil, nil, err
-	}*/
-	level.Info(s.logger).Log("msg", "Certificate obtained from SCEP Server parsed")
-	return crt, key, nil
+	}
+	level.Info(s.logger).Log("msg", "Enrollment server returned renewed certificate", "protocol", s.protocol)
 
+	chain, err := s.verifyChain(ctx, crt, caName)
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not validate CA chain of renewed certificate")
+		return nil, nil, err
+	}
+	level.Info(s.logger).Log("msg", "CA chain of renewed certificate validated")
+	return crt, chain, nil
 }
 
-func (s *SCEPExt) checkSignatureAlgorithm(keyAlg string) x509.SignatureAlgorithm {
-	sigAlgo := x509.SHA1WithRSA
-	if keyAlg == "EC" {
-		sigAlgo = x509.ECDSAWithSHA256
-	} else {
-		sigAlgo = x509.SHA256WithRSA
+// checkSignatureAlgorithm returns the CSR signature algorithm for a key.
+// The hash strength follows the curve size for EC keys, and RSA keys are
+// signed with RSA-PSS when it is enabled.
+func (s *DMSClient) checkSignatureAlgorithm(keyAlg string, keySize int) x509.SignatureAlgorithm {
+	switch keyAlg {
+	case "EC":
+		switch keySize {
+		case 384:
+			return x509.ECDSAWithSHA384
+		case 521:
+			return x509.ECDSAWithSHA512
+		default:
+			return x509.ECDSAWithSHA256
+		}
+	case "Ed25519":
+		return x509.PureEd25519
+	default:
+		if s.rsaPSS {
+			return x509.SHA256WithRSAPSS
+		}
+		return x509.SHA256WithRSA
 	}
-	return sigAlgo
 }
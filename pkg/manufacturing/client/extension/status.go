@@ -0,0 +1,108 @@
+package extension
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"sync"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client"
+
+	"github.com/go-kit/kit/sd"
+)
+
+var (
+	errNotStarted  = errors.New("extension client is not started")
+	errNoInstances = errors.New("no extension instances found")
+)
+
+// upstream holds the extension configuration set by the last
+// successful StartClient and the instancer discovering its instances.
+type upstream struct {
+	mtx       sync.RWMutex
+	started   bool
+	ca        string
+	instancer sd.Instancer
+}
+
+func (u *upstream) setCA(CA string) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.started, u.ca = true, CA
+}
+
+func (u *upstream) setInstancer(instancer sd.Instancer) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.instancer = instancer
+}
+
+func (u *upstream) get() (started bool, CA string, instancer sd.Instancer) {
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+	return u.started, u.ca, u.instancer
+}
+
+// Status reports the CA last set in the upstream extension, the active DMS
+// certificate and the upstream extension instances found in Consul. It does
+// not wait for a StartClient in progress.
+func (s *DMSClient) Status(ctx context.Context) client.Status {
+	started, CA, instancer := s.upstream.get()
+	status := client.Status{Started: started, CA: CA}
+	if current, _ := s.creds.get(); current != nil && len(current.Certificate) > 0 {
+		status.Certificate, _ = x509.ParseCertificate(current.Certificate[0])
+	}
+	if instancer != nil {
+		event := discovered(instancer)
+		status.Instances, status.InstancesErr = event.Instances, event.Err
+	}
+	return status
+}
+
+// discovered returns the current state of instancer. The event is read
+// before deregistering, as instancers push the current state on Register
+// and block broadcasting to full channels.
+func discovered(instancer sd.Instancer) sd.Event {
+	events := make(chan sd.Event, 1)
+	instancer.Register(events)
+	event := <-events
+	instancer.Deregister(events)
+	return event
+}
+
+// CheckCredentials reports whether the active DMS certificate is still
+// within its validity period and chains to the proxy CA.
+func (s *DMSClient) CheckCredentials(ctx context.Context) error {
+	current, _ := s.creds.get()
+	if current == nil {
+		return ErrNoCredentials
+	}
+	cert := *current
+	return s.validateCredentials(&cert)
+}
+
+// CheckEnroller reports whether the enrollment server answers a CA
+// certificates request for the CA last set in the upstream extension, or its
+// default CA before any is set.
+func (s *DMSClient) CheckEnroller(ctx context.Context) error {
+	_, CA, _ := s.upstream.get()
+	_, err := s.enroller.CACerts(ctx, CA)
+	return err
+}
+
+// CheckInstances reports whether at least one upstream extension instance is
+// found in Consul.
+func (s *DMSClient) CheckInstances(ctx context.Context) error {
+	_, _, instancer := s.upstream.get()
+	if instancer == nil {
+		return errNotStarted
+	}
+	event := discovered(instancer)
+	if event.Err != nil {
+		return event.Err
+	}
+	if len(event.Instances) == 0 {
+		return errNoInstances
+	}
+	return nil
+}
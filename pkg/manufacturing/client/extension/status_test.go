@@ -0,0 +1,115 @@
+package extension
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+)
+
+// fakeInstancer pushes state on Register, like the Consul instancer.
+type fakeInstancer struct {
+	state      sd.Event
+	registered int
+}
+
+func (i *fakeInstancer) Register(ch chan<- sd.Event) {
+	i.registered++
+	ch <- i.state
+}
+
+func (i *fakeInstancer) Deregister(ch chan<- sd.Event) {
+	i.registered--
+}
+
+func (i *fakeInstancer) Stop() {}
+
+func TestStatus(t *testing.T) {
+	root, rootKey := testCA(t, "Proxy CA", nil, nil)
+	cert := testCredentials(t, root, rootKey, time.Now().Add(time.Hour))
+	s := &DMSClient{enroller: &fakeEnroller{}, logger: log.NewNopLogger()}
+
+	status := s.Status(context.Background())
+	if status.Started || status.Certificate != nil || status.Instances != nil {
+		t.Fatalf("Got status of unconfigured client is %+v; want empty", status)
+	}
+
+	instancer := &fakeInstancer{state: sd.Event{Instances: []string{"scepextension:8088"}}}
+	s.upstream.setInstancer(instancer)
+	s.activate(&cert, nil)
+	s.upstream.setCA("dms")
+	status = s.Status(context.Background())
+	if !status.Started || status.CA != "dms" {
+		t.Errorf("Got started %t with CA %s; want started with dms", status.Started, status.CA)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if status.Certificate == nil || status.Certificate.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Error("Got certificate is not the active one")
+	}
+	if len(status.Instances) != 1 || status.InstancesErr != nil {
+		t.Errorf("Got instances %v with error %v; want 1 instance", status.Instances, status.InstancesErr)
+	}
+	if instancer.registered != 0 {
+		t.Errorf("Got %d channels left registered; want 0", instancer.registered)
+	}
+
+	errConsul := errors.New("consul unavailable")
+	instancer.state = sd.Event{Err: errConsul}
+	if status = s.Status(context.Background()); status.InstancesErr != errConsul {
+		t.Errorf("Got instances error is %v; want %v", status.InstancesErr, errConsul)
+	}
+}
+
+func TestCheckCredentials(t *testing.T) {
+	root, rootKey := testCA(t, "Proxy CA", nil, nil)
+	valid := testCredentials(t, root, rootKey, time.Now().Add(time.Hour))
+	expired := testCredentials(t, root, rootKey, time.Now().Add(-time.Minute))
+
+	testCases := []struct {
+		name string
+		cert *tls.Certificate
+		ret  error
+	}{
+		{"Certificate is valid", &valid, nil},
+		{"Certificate is expired", &expired, ErrCredentialsExpired},
+		{"Certificate is missing", nil, ErrNoCredentials},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			s := &DMSClient{proxyCA: writeAnchors(t, []*x509.Certificate{root}), enroller: &fakeEnroller{}, logger: log.NewNopLogger()}
+			s.activate(tc.cert, nil)
+			if err := s.CheckCredentials(context.Background()); err != tc.ret {
+				t.Errorf("Got result is %v; want %v", err, tc.ret)
+			}
+		})
+	}
+}
+
+func TestCheckInstances(t *testing.T) {
+	testCases := []struct {
+		name      string
+		instancer sd.Instancer
+		ret       error
+	}{
+		{"Instances are found", &fakeInstancer{state: sd.Event{Instances: []string{"scepextension:8088"}}}, nil},
+		{"No instances are found", &fakeInstancer{}, errNoInstances},
+		{"Client is not started", nil, errNotStarted},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			s := &DMSClient{logger: log.NewNopLogger()}
+			if tc.instancer != nil {
+				s.upstream.setInstancer(tc.instancer)
+			}
+			if err := s.CheckInstances(context.Background()); err != tc.ret {
+				t.Errorf("Got result is %v; want %v", err, tc.ret)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package scep
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	microscep "github.com/micromdm/scep/scep"
+)
+
+const (
+	pkiMessageContentType = "application/x-pki-message"
+)
+
+// SCEP enrolls device certificates using the PKCSReq message defined in
+// RFC 8894. Requests are signed with the DMS certificate, which must have
+// an RSA key.
+type SCEP struct {
+	mtx     sync.RWMutex
+	url     string
+	client  *http.Client
+	authCRT []tls.Certificate
+	logger  log.Logger
+}
+
+var (
+	ErrNoCredentials = apierrors.New(apierrors.Validation, "SCEP signer certificate is not configured")
+	ErrSignerKey     = apierrors.New(apierrors.Validation, "SCEP signer key must be an RSA key")
+	ErrGetCACert     = apierrors.New(apierrors.UpstreamUnavailable, "unable to obtain SCEP CA certificate")
+	ErrEnroll        = apierrors.New(apierrors.UpstreamUnavailable, "SCEP enrollment failed")
+	ErrPending       = apierrors.New(apierrors.Conflict, "SCEP enrollment is pending manual approval")
+)
+
+// NewEnroller creates a SCEP backend for the server at address, including
+// the path to the SCEP endpoint (e.g. https://scep/scep). The server
+// certificate is verified against the certificates in the CA file.
+func NewEnroller(address string, CA string, logger log.Logger) (client.Enroller, error) {
+	caCertPool, err := utils.CreateCAPool(CA)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not create CA Pool to validate SCEP server")
+		return nil, err
+	}
+	httpc := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: caCertPool,
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+	return &SCEP{url: address, client: httpc, logger: logger}, nil
+}
+
+func (s *SCEP) SetCredentials(authCRT []tls.Certificate) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.authCRT = authCRT
+}
+
+func (s *SCEP) Enroll(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, error) {
+	return s.pkcsReq(ctx, csr, caName)
+}
+
+// Reenroll sends a PKCSReq message signed by the DMS acting as a
+// registration authority. A RenewalReq must be signed with the key of the
+// certificate being renewed, which the DMS does not hold for devices in
+// the field.
+func (s *SCEP) Reenroll(ctx context.Context, csr *x509.CertificateRequest, current *x509.Certificate, caName string) (*x509.Certificate, error) {
+	return s.pkcsReq(ctx, csr, caName)
+}
+
+func (s *SCEP) pkcsReq(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, error) {
+	signerCert, signerKey, err := s.signer()
+	if err != nil {
+		return nil, err
+	}
+
+	recipients, err := s.getCACert(ctx, caName)
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not obtain SCEP CA certificate")
+		return nil, ErrGetCACert
+	}
+
+	tmpl := &microscep.PKIMessage{
+		MessageType: microscep.PKCSReq,
+		Recipients:  recipients,
+		SignerKey:   signerKey,
+		SignerCert:  signerCert,
+	}
+	msg, err := microscep.NewCSRRequest(csr, tmpl, microscep.WithLogger(s.logger))
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not create SCEP PKCSReq message")
+		return nil, ErrEnroll
+	}
+
+	respData, err := s.do(ctx, "POST", "PKIOperation", "", msg.Raw)
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not send SCEP PKIOperation request")
+		return nil, ErrEnroll
+	}
+	respMsg, err := microscep.ParsePKIMessage(respData, microscep.WithLogger(s.logger))
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not parse SCEP CertRep message")
+		return nil, ErrEnroll
+	}
+	if respMsg.MessageType != microscep.CertRep || respMsg.TransactionID != msg.TransactionID || !bytes.Equal(respMsg.RecipientNonce, msg.SenderNonce) {
+		level.Error(s.logger).Log("msg", "SCEP CertRep message does not match PKCSReq transaction")
+		return nil, ErrEnroll
+	}
+	switch respMsg.PKIStatus {
+	case microscep.SUCCESS:
+	case microscep.PENDING:
+		return nil, ErrPending
+	default:
+		level.Error(s.logger).Log("fail_info", respMsg.FailInfo, "msg", "SCEP server rejected PKCSReq request")
+		return nil, ErrEnroll
+	}
+	if err := respMsg.DecryptPKIEnvelope(signerCert, signerKey); err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not decrypt SCEP CertRep message")
+		return nil, ErrEnroll
+	}
+	return respMsg.CertRepMessage.Certificate, nil
+}
+
+// CACerts returns the CA certificates of the GetCACert response, leaving
+// out the RA certificates some servers include to receive requests.
+func (s *SCEP) CACerts(ctx context.Context, caName string) ([]*x509.Certificate, error) {
+	certs, err := s.getCACert(ctx, caName)
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not obtain SCEP CA certificate")
+		return nil, ErrGetCACert
+	}
+	var cas []*x509.Certificate
+	for _, crt := range certs {
+		if crt.IsCA {
+			cas = append(cas, crt)
+		}
+	}
+	return cas, nil
+}
+
+func (s *SCEP) signer() (*x509.Certificate, *rsa.PrivateKey, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if len(s.authCRT) == 0 || len(s.authCRT[0].Certificate) == 0 {
+		return nil, nil, ErrNoCredentials
+	}
+	key, ok := s.authCRT[0].PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, ErrSignerKey
+	}
+	crt, err := x509.ParseCertificate(s.authCRT[0].Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return crt, key, nil
+}
+
+// getCACert returns the certificates PKCSReq messages must be encrypted
+// for: the RA certificates if the server returns a chain with an RA, the CA
+// certificate otherwise.
+func (s *SCEP) getCACert(ctx context.Context, caName string) ([]*x509.Certificate, error) {
+	data, err := s.do(ctx, "GET", "GetCACert", caName, nil)
+	if err != nil {
+		return nil, err
+	}
+	if crt, err := x509.ParseCertificate(data); err == nil {
+		return []*x509.Certificate{crt}, nil
+	}
+	certs, err := microscep.CACerts(data)
+	if err != nil {
+		return nil, err
+	}
+	var ra []*x509.Certificate
+	for _, crt := range certs {
+		if !crt.IsCA {
+			ra = append(ra, crt)
+		}
+	}
+	if len(ra) > 0 {
+		return ra, nil
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("empty SCEP CA certificate response")
+	}
+	return certs[:1], nil
+}
+
+func (s *SCEP) do(ctx context.Context, method string, operation string, message string, body []byte) ([]byte, error) {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("operation", operation)
+	if message != "" {
+		q.Set("message", message)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", pkiMessageContentType)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, apierrors.Wrap(apierrors.UpstreamUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if err := apierrors.FromResponse("SCEP server", resp); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
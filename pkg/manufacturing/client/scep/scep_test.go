@@ -0,0 +1,252 @@
+package scep
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
+	"github.com/go-kit/kit/log"
+	microscep "github.com/micromdm/scep/scep"
+)
+
+type fakeCA struct {
+	crt         *x509.Certificate
+	key         *rsa.PrivateKey
+	messageType microscep.MessageType
+}
+
+func (ca *fakeCA) SignCertificate(csr *x509.CertificateRequest) ([]byte, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	return x509.CreateCertificate(rand.Reader, template, ca.crt, csr.PublicKey, ca.key)
+}
+
+func (ca *fakeCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("operation") {
+	case "GetCACert":
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		w.Write(ca.crt.Raw)
+	case "PKIOperation":
+		data, _ := ioutil.ReadAll(r.Body)
+		msg, err := microscep.ParsePKIMessage(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ca.messageType = msg.MessageType
+		if err := msg.DecryptPKIEnvelope(ca.crt, ca.key); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var rep *microscep.PKIMessage
+		if msg.CSRReqMessage.CSR.Subject.CommonName == "reject" {
+			rep, err = msg.Fail(ca.crt, ca.key, microscep.BadRequest)
+		} else {
+			rep, err = msg.SignCSR(ca.crt, ca.key, msg.CSRReqMessage.CSR, ca)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", pkiMessageContentType)
+		w.Write(rep.Raw)
+	default:
+		http.Error(w, "unsupported operation", http.StatusBadRequest)
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	ca := newFakeCA(t)
+
+	testCases := []struct {
+		name        string
+		cn          string
+		credentials bool
+		ret         error
+	}{
+		{"Certificate is enrolled", "device", true, nil},
+		{"SCEP server rejects enrollment", "reject", true, ErrEnroll},
+		{"Signer certificate is not configured", "device", false, ErrNoCredentials},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			enroller := setup(t, ca)
+			if tc.credentials {
+				enroller.SetCredentials([]tls.Certificate{testSigner(t)})
+			}
+			crt, err := enroller.Enroll(context.Background(), testCSR(t, tc.cn), "")
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err != nil {
+				return
+			}
+			if crt.Subject.CommonName != tc.cn {
+				t.Errorf("Got certificate for %s; want %s", crt.Subject.CommonName, tc.cn)
+			}
+			if err := crt.CheckSignatureFrom(ca.crt); err != nil {
+				t.Errorf("Certificate is not signed by CA: %s", err)
+			}
+		})
+	}
+}
+
+func TestReenroll(t *testing.T) {
+	testCases := []struct {
+		name string
+		cn   string
+		ret  error
+	}{
+		{"Certificate is renewed", "device", nil},
+		{"SCEP server rejects renewal", "reject", ErrEnroll},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			ca := newFakeCA(t)
+			enroller := setup(t, ca)
+			enroller.SetCredentials([]tls.Certificate{testSigner(t)})
+
+			current, err := enroller.Enroll(context.Background(), testCSR(t, "device"), "")
+			if err != nil {
+				t.Fatalf("Could not enroll current certificate: %s", err)
+			}
+			csr := testCSR(t, tc.cn)
+			crt, err := enroller.Reenroll(context.Background(), csr, current, "")
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err != nil {
+				return
+			}
+			if ca.messageType != microscep.PKCSReq {
+				t.Errorf("Got message type %s; want PKCSReq", ca.messageType)
+			}
+			if !bytes.Equal(crt.RawSubjectPublicKeyInfo, csr.RawSubjectPublicKeyInfo) {
+				t.Error("Renewed certificate does not certify the CSR public key")
+			}
+		})
+	}
+}
+
+func TestCACerts(t *testing.T) {
+	ca := newFakeCA(t)
+	enroller := setup(t, ca)
+
+	certs, err := enroller.CACerts(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(ca.crt) {
+		t.Errorf("Got %d CA certificates; want the fake CA certificate", len(certs))
+	}
+}
+
+func setup(t *testing.T, ca *fakeCA) *SCEP {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(ca)
+	t.Cleanup(srv.Close)
+
+	dir, err := ioutil.TempDir("", "scep")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory")
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, utils.PEMCert(srv.Certificate().Raw), 0644); err != nil {
+		t.Fatal("Unable to write CA certificate")
+	}
+
+	enroller, err := NewEnroller(srv.URL+"/scep", caFile, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to create SCEP enroller: %s", err)
+	}
+	return enroller.(*SCEP)
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Unable to generate CA key")
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake SCEP CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal("Unable to create CA certificate")
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Unable to parse CA certificate")
+	}
+	return &fakeCA{crt: crt, key: key}
+}
+
+func testSigner(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Unable to generate signer key")
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "DMS"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal("Unable to create signer certificate")
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func testCSR(t *testing.T, cn string) *x509.CertificateRequest {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate device key")
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+	if err != nil {
+		t.Fatal("Unable to create CSR")
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal("Unable to parse CSR")
+	}
+	return csr
+}
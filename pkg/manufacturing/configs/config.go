@@ -1,9 +1,14 @@
 package configs
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
 
 type Config struct {
-	Port string
+	Port       string
+	HealthPort string
 
 	UIHost     string
 	UIPort     string
@@ -15,6 +20,17 @@ type Config struct {
 	KeycloakRealm    string
 	KeycloakCA       string
 
+	OIDCIssuer    string
+	OIDCCA        string
+	OIDCAudience  string
+	OIDCKeysTTL   time.Duration
+	UsernameClaim string
+	RolesClaims   []string
+
+	AdminRoles    []string
+	OperatorRoles []string
+	AuditorRoles  []string
+
 	ConsulProtocol string
 	ConsulHost     string
 	ConsulPort     string
@@ -25,6 +41,38 @@ type Config struct {
 	AuthKeyFile  string
 	ProxyAddress string
 	ProxyCA      string
+
+	AuthRenewCAName   string
+	AuthRenewBefore   time.Duration
+	AuthRenewInterval time.Duration
+
+	ClientCAs         string
+	ClientCertPolicy  string
+	RequireClientCert bool
+
+	EnrollmentProtocol string
+	EnrollmentAddress  string
+	EnrollmentCA       string
+
+	TrustAnchors string
+
+	DevicesAddress  string
+	DevicesCA       string
+	DevicesCertFile string
+	DevicesKeyFile  string
+
+	BatchConcurrency int
+
+	LedgerFile string
+
+	AllowedKeys []string
+	RSAPSS      bool
+
+	KeyProvider       string
+	PKCS11Module      string
+	PKCS11TokenLabel  string
+	PKCS11PIN         string
+	PKCS11WrappingKey string
 }
 
 func NewConfig(prefix string) (Config, error) {
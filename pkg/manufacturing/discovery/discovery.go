@@ -1,6 +1,12 @@
 package discovery
 
+import "context"
+
 type Service interface {
-	Register(advProtocol string, advHost string, advPort string) error
+	// Register announces the service at advPort, checked through the
+	// readiness probe served at healthPort.
+	Register(advProtocol string, advHost string, advPort string, healthPort string) error
 	Deregister() error
+	// Check reports whether the discovery server can be reached.
+	Check(ctx context.Context) error
 }
@@ -0,0 +1,39 @@
+package keys
+
+import (
+	"context"
+	"crypto"
+)
+
+// Provider generates the key pairs of devices whose keys are created by the
+// DMS. The keys never leave the provider in a form it does not allow.
+type Provider interface {
+	// GenerateKey creates a key pair of keyAlg (RSA, EC or Ed25519) and
+	// keySize. The returned Key signs the device CSR.
+	GenerateKey(ctx context.Context, keyAlg string, keySize int) (Key, error)
+	// WrapsKeys reports whether its keys are exported as *EncryptedKey,
+	// which cannot be re-encoded in formats such as PKCS#12.
+	WrapsKeys() bool
+	// Close releases the resources held by the provider. Keys which have
+	// not been exported or destroyed yet are lost.
+	Close()
+}
+
+// Key is a device key pair held by a Provider.
+type Key interface {
+	crypto.Signer
+	// Export returns the private key handed to the device: the key itself
+	// for software keys, or an *EncryptedKey when the provider only
+	// releases keys wrapped under one of its own keys.
+	Export() (crypto.PrivateKey, error)
+	// Destroy releases the key from the provider. It is safe to call it
+	// more than once.
+	Destroy() error
+}
+
+// EncryptedKey is a private key exported wrapped by a Provider. DER holds a
+// PKCS#8 EncryptedPrivateKeyInfo, which only the holder of the wrapping key
+// can decrypt.
+type EncryptedKey struct {
+	DER []byte
+}
@@ -0,0 +1,77 @@
+package memory
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys"
+)
+
+var (
+	ErrUnsupportedKey    = errors.New("unsupported key algorithm")
+	ErrUnsupportedECSize = errors.New("unsupported EC key size")
+)
+
+// Provider generates device keys in process memory with crypto/rand and
+// exports them in plain form.
+type Provider struct{}
+
+type memoryKey struct {
+	crypto.Signer
+}
+
+func NewProvider() keys.Provider {
+	return &Provider{}
+}
+
+func (p *Provider) Close() {}
+
+func (p *Provider) WrapsKeys() bool {
+	return false
+}
+
+func (p *Provider) GenerateKey(ctx context.Context, keyAlg string, keySize int) (keys.Key, error) {
+	var signer crypto.Signer
+	var err error
+	switch keyAlg {
+	case "RSA":
+		signer, err = rsa.GenerateKey(rand.Reader, keySize)
+	case "EC":
+		signer, err = newECDSAKey(keySize)
+	case "Ed25519":
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = ErrUnsupportedKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &memoryKey{signer}, nil
+}
+
+func newECDSAKey(bits int) (crypto.Signer, error) {
+	switch bits {
+	case 256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case 384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case 521:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	default:
+		return nil, ErrUnsupportedECSize
+	}
+}
+
+func (k *memoryKey) Export() (crypto.PrivateKey, error) {
+	return k.Signer, nil
+}
+
+func (k *memoryKey) Destroy() error {
+	return nil
+}
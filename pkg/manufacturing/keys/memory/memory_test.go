@@ -0,0 +1,57 @@
+package memory
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func TestGenerateKey(t *testing.T) {
+	testCases := []struct {
+		name    string
+		keyAlg  string
+		keySize int
+		ret     error
+	}{
+		{"RSA 2048", "RSA", 2048, nil},
+		{"EC P-256", "EC", 256, nil},
+		{"EC P-521", "EC", 521, nil},
+		{"Ed25519", "Ed25519", 0, nil},
+		{"EC with unsupported size", "EC", 224, ErrUnsupportedECSize},
+		{"Unsupported algorithm", "DSA", 2048, ErrUnsupportedKey},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			key, err := NewProvider().GenerateKey(context.Background(), tc.keyAlg, tc.keySize)
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err != nil {
+				return
+			}
+			defer key.Destroy()
+
+			var opts crypto.SignerOpts = crypto.SHA256
+			msg := []byte("device")
+			if tc.keyAlg != "Ed25519" {
+				digest := sha256.Sum256(msg)
+				msg = digest[:]
+			} else {
+				opts = crypto.Hash(0)
+			}
+			if _, err := key.Sign(rand.Reader, msg, opts); err != nil {
+				t.Errorf("Unable to sign with key: %s", err)
+			}
+			private, err := key.Export()
+			if err != nil {
+				t.Fatalf("Unable to export key: %s", err)
+			}
+			if !private.(interface{ Equal(crypto.PrivateKey) bool }).Equal(key.(*memoryKey).Signer) {
+				t.Error("Exported key does not match generated key")
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+//go:build cgo
+// +build cgo
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/miekg/pkcs11"
+)
+
+var ErrUnsupportedHash = errors.New("unsupported signature hash")
+
+// digestInfoPrefixes are the DER prefixes of the PKCS#1 v1.5 DigestInfo
+// structure for each hash, which CKM_RSA_PKCS expects the caller to add.
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pssHashes maps a hash to the PKCS#11 hash and MGF1 mechanisms used by
+// CKM_RSA_PKCS_PSS.
+var pssHashes = map[crypto.Hash][2]uint{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algo          pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// key is a key pair generated as session objects of its own session.
+type key struct {
+	mtx      sync.Mutex
+	provider *Provider
+	session  pkcs11.SessionHandle
+	handle   pkcs11.ObjectHandle
+	keyAlg   string
+	public   crypto.PublicKey
+	closed   bool
+}
+
+func (k *key) Public() crypto.PublicKey {
+	return k.public
+}
+
+func (k *key) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	if k.closed {
+		return nil, ErrKeyDestroyed
+	}
+	var mech *pkcs11.Mechanism
+	data := digest
+	switch k.keyAlg {
+	case "RSA":
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			hashes, ok := pssHashes[opts.HashFunc()]
+			if !ok {
+				return nil, ErrUnsupportedHash
+			}
+			saltLength := pssOpts.SaltLength
+			if saltLength == rsa.PSSSaltLengthAuto || saltLength == rsa.PSSSaltLengthEqualsHash {
+				saltLength = opts.HashFunc().Size()
+			}
+			mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, pkcs11.NewPSSParams(hashes[0], hashes[1], uint(saltLength)))
+		} else {
+			prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+			if !ok {
+				return nil, ErrUnsupportedHash
+			}
+			mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+			data = append(append([]byte{}, prefix...), digest...)
+		}
+	case "EC":
+		mech = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	case "Ed25519":
+		if opts.HashFunc() != crypto.Hash(0) {
+			return nil, ErrUnsupportedHash
+		}
+		mech = pkcs11.NewMechanism(ckmEdDSA, nil)
+	}
+
+	ctx := k.provider.ctx
+	if err := ctx.SignInit(k.session, []*pkcs11.Mechanism{mech}, k.handle); err != nil {
+		return nil, err
+	}
+	sig, err := ctx.Sign(k.session, data)
+	if err != nil {
+		return nil, err
+	}
+	if k.keyAlg == "EC" {
+		// CKM_ECDSA returns r and s concatenated, while X.509 expects the
+		// ASN.1 encoding of both integers.
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:half]),
+			new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+	return sig, nil
+}
+
+// Export wraps the private key under the wrapping key of the provider and
+// destroys it. The result is returned as an *keys.EncryptedKey.
+func (k *key) Export() (crypto.PrivateKey, error) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	if k.closed {
+		return nil, ErrKeyDestroyed
+	}
+	p := k.provider
+	wrapped, err := p.ctx.WrapKey(k.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP_PAD, nil)}, p.wrappingKey, k.handle)
+	k.close()
+	if err != nil {
+		level.Error(p.logger).Log("err", err, "msg", "Could not wrap PKCS#11 key")
+		return nil, err
+	}
+	der, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algo:          pkix.AlgorithmIdentifier{Algorithm: p.wrapOID},
+		EncryptedData: wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &keys.EncryptedKey{DER: der}, nil
+}
+
+func (k *key) Destroy() error {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	if k.closed {
+		return nil
+	}
+	return k.close()
+}
+
+// close ends the session of the key, which destroys its session objects.
+func (k *key) close() error {
+	k.closed = true
+	return k.provider.ctx.CloseSession(k.session)
+}
+
+func (k *key) readPublicKey(handle pkcs11.ObjectHandle, keyAlg string) (crypto.PublicKey, error) {
+	ctx := k.provider.ctx
+	if keyAlg == "RSA" {
+		attrs, err := ctx.GetAttributeValue(k.session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+	}
+
+	attrs, err := ctx.GetAttributeValue(k.session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var curve asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(attrs[0].Value, &curve); err != nil {
+		return nil, err
+	}
+	// CKA_EC_POINT holds a DER OCTET STRING, although some modules return
+	// the bare point.
+	point := attrs[1].Value
+	var inner []byte
+	if rest, err := asn1.Unmarshal(point, &inner); err == nil && len(rest) == 0 {
+		point = inner
+	}
+
+	var c elliptic.Curve
+	switch {
+	case curve.Equal(oidCurveEd25519):
+		if len(point) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(point), nil
+	case curve.Equal(oidCurveP256):
+		c = elliptic.P256()
+	case curve.Equal(oidCurveP384):
+		c = elliptic.P384()
+	case curve.Equal(oidCurveP521):
+		c = elliptic.P521()
+	default:
+		return nil, ErrUnsupportedECSize
+	}
+	x, y := elliptic.Unmarshal(c, point)
+	if x == nil {
+		return nil, errors.New("invalid EC public key")
+	}
+	return &ecdsa.PublicKey{Curve: c, X: x, Y: y}, nil
+}
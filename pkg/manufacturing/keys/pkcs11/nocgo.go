@@ -0,0 +1,35 @@
+//go:build !cgo
+// +build !cgo
+
+package pkcs11
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// ErrModuleLoad is returned by NewProvider in builds without cgo, which
+// cannot load PKCS#11 modules.
+var ErrModuleLoad = errors.New("PKCS#11 support requires a build with cgo enabled")
+
+type Provider struct{}
+
+func NewProvider(module string, tokenLabel string, pin string, wrappingKey string, logger log.Logger) (*Provider, error) {
+	level.Error(logger).Log("err", ErrModuleLoad, "msg", "Could not load PKCS#11 module", "module", module)
+	return nil, ErrModuleLoad
+}
+
+func (p *Provider) Close() {}
+
+func (p *Provider) WrapsKeys() bool {
+	return true
+}
+
+func (p *Provider) GenerateKey(ctx context.Context, keyAlg string, keySize int) (keys.Key, error) {
+	return nil, ErrModuleLoad
+}
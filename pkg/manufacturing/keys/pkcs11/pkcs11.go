@@ -0,0 +1,308 @@
+//go:build cgo
+// +build cgo
+
+package pkcs11
+
+import (
+	"context"
+	"encoding/asn1"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/miekg/pkcs11"
+)
+
+// Mechanisms defined in PKCS#11 v3.0 which are not exported by the pkcs11
+// package.
+const (
+	ckmECEdwardsKeyPairGen = 0x00001055
+	ckmEdDSA               = 0x00001057
+)
+
+var (
+	oidCurveP256    = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidCurveP384    = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidCurveP521    = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+	oidCurveEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+var (
+	ErrModuleLoad        = errors.New("unable to load PKCS#11 module")
+	ErrTokenNotFound     = errors.New("PKCS#11 token not found")
+	ErrWrappingKey       = errors.New("PKCS#11 wrapping key not found")
+	ErrUnsupportedKey    = errors.New("unsupported key algorithm")
+	ErrUnsupportedECSize = errors.New("unsupported EC key size")
+	ErrKeyGeneration     = errors.New("unable to generate key in PKCS#11 token")
+	ErrKeyDestroyed      = errors.New("PKCS#11 key has been destroyed")
+)
+
+// module is the part of *pkcs11.Ctx used by the Provider.
+type module interface {
+	Initialize() error
+	Finalize() error
+	Destroy()
+	GetSlotList(tokenPresent bool) ([]uint, error)
+	GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error)
+	OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error)
+	CloseSession(sh pkcs11.SessionHandle) error
+	CloseAllSessions(slotID uint) error
+	Login(sh pkcs11.SessionHandle, userType uint, pin string) error
+	Logout(sh pkcs11.SessionHandle) error
+	FindObjectsInit(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) error
+	FindObjects(sh pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error)
+	FindObjectsFinal(sh pkcs11.SessionHandle) error
+	GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) ([]*pkcs11.Attribute, error)
+	GenerateKeyPair(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, public, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error)
+	SignInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, o pkcs11.ObjectHandle) error
+	Sign(sh pkcs11.SessionHandle, message []byte) ([]byte, error)
+	WrapKey(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, wrappingkey, key pkcs11.ObjectHandle) ([]byte, error)
+}
+
+// Provider generates device keys inside a PKCS#11 token. Keys are session
+// objects which are only extractable wrapped with AES key wrap with padding
+// (RFC 5649) under a secret key stored in the token.
+type Provider struct {
+	mtx         sync.Mutex
+	ctx         module
+	slot        uint
+	session     pkcs11.SessionHandle
+	wrappingKey pkcs11.ObjectHandle
+	wrapOID     asn1.ObjectIdentifier
+	logger      log.Logger
+}
+
+// NewProvider loads the PKCS#11 module, logs in to the token labeled
+// tokenLabel with pin and looks up the AES key labeled wrappingKey.
+func NewProvider(module string, tokenLabel string, pin string, wrappingKey string, logger log.Logger) (*Provider, error) {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		level.Error(logger).Log("msg", "Could not load PKCS#11 module", "module", module)
+		return nil, ErrModuleLoad
+	}
+	return newProvider(ctx, tokenLabel, pin, wrappingKey, logger)
+}
+
+func newProvider(ctx module, tokenLabel string, pin string, wrappingKey string, logger log.Logger) (*Provider, error) {
+	if err := ctx.Initialize(); err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not initialize PKCS#11 module")
+		ctx.Destroy()
+		return nil, ErrModuleLoad
+	}
+	p := &Provider{ctx: ctx, logger: logger}
+	if err := p.open(tokenLabel, pin, wrappingKey); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Provider) open(tokenLabel string, pin string, wrappingKey string) error {
+	slots, err := p.ctx.GetSlotList(true)
+	if err != nil {
+		level.Error(p.logger).Log("err", err, "msg", "Could not list PKCS#11 slots")
+		return ErrTokenNotFound
+	}
+	found := false
+	for _, slot := range slots {
+		info, err := p.ctx.GetTokenInfo(slot)
+		if err == nil && strings.TrimRight(info.Label, " \x00") == tokenLabel {
+			p.slot, found = slot, true
+			break
+		}
+	}
+	if !found {
+		level.Error(p.logger).Log("msg", "Could not find PKCS#11 token", "token", tokenLabel)
+		return ErrTokenNotFound
+	}
+
+	// Login state is shared by every session of the application, so the
+	// session kept open here authenticates the per key sessions as well.
+	p.session, err = p.ctx.OpenSession(p.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		level.Error(p.logger).Log("err", err, "msg", "Could not open PKCS#11 session")
+		return err
+	}
+	if err := p.ctx.Login(p.session, pkcs11.CKU_USER, pin); err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		level.Error(p.logger).Log("err", err, "msg", "Could not log in to PKCS#11 token")
+		return err
+	}
+
+	p.wrappingKey, err = p.findSecretKey(wrappingKey)
+	if err != nil {
+		level.Error(p.logger).Log("err", err, "msg", "Could not find PKCS#11 wrapping key", "label", wrappingKey)
+		return ErrWrappingKey
+	}
+	attrs, err := p.ctx.GetAttributeValue(p.session, p.wrappingKey, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, nil)})
+	if err != nil || len(attrs) != 1 {
+		level.Error(p.logger).Log("err", err, "msg", "Could not read PKCS#11 wrapping key length")
+		return ErrWrappingKey
+	}
+	p.wrapOID = wrapPadOID(bytesToUint(attrs[0].Value))
+	if p.wrapOID == nil {
+		level.Error(p.logger).Log("msg", "PKCS#11 wrapping key is not an AES key")
+		return ErrWrappingKey
+	}
+	level.Info(p.logger).Log("msg", "PKCS#11 key provider started", "token", tokenLabel)
+	return nil
+}
+
+func (p *Provider) findSecretKey(label string) (pkcs11.ObjectHandle, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := p.ctx.FindObjectsInit(p.session, template); err != nil {
+		return 0, err
+	}
+	objs, _, err := p.ctx.FindObjects(p.session, 1)
+	if finalErr := p.ctx.FindObjectsFinal(p.session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(objs) == 0 {
+		return 0, ErrWrappingKey
+	}
+	return objs[0], nil
+}
+
+// Close logs out of the token and unloads the PKCS#11 module. Keys which
+// have not been destroyed yet are lost.
+func (p *Provider) Close() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.session != 0 {
+		p.ctx.Logout(p.session)
+		p.ctx.CloseAllSessions(p.slot)
+		p.session = 0
+	}
+	p.ctx.Finalize()
+	p.ctx.Destroy()
+}
+
+// WrapsKeys reports true: keys leave the token only wrapped under its
+// wrapping key.
+func (p *Provider) WrapsKeys() bool {
+	return true
+}
+
+// GenerateKey creates a key pair in a session of its own. Calls into the
+// module are serialized with those of the other keys being generated and
+// with Close.
+func (p *Provider) GenerateKey(ctx context.Context, keyAlg string, keySize int) (keys.Key, error) {
+	mech, public, err := keyPairTemplate(keyAlg, keySize)
+	if err != nil {
+		return nil, err
+	}
+	private := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.session == 0 {
+		return nil, ErrKeyGeneration
+	}
+
+	// Each key lives in its own session, so closing the session destroys
+	// the key even if the caller never exports it.
+	session, err := p.ctx.OpenSession(p.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		level.Error(p.logger).Log("err", err, "msg", "Could not open PKCS#11 session")
+		return nil, ErrKeyGeneration
+	}
+	pubHandle, privHandle, err := p.ctx.GenerateKeyPair(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, nil)}, public, private)
+	if err != nil {
+		level.Error(p.logger).Log("err", err, "msg", "Could not generate PKCS#11 key pair", "alg", keyAlg, "size", keySize)
+		p.ctx.CloseSession(session)
+		return nil, ErrKeyGeneration
+	}
+	k := &key{provider: p, session: session, handle: privHandle, keyAlg: keyAlg}
+	k.public, err = k.readPublicKey(pubHandle, keyAlg)
+	if err != nil {
+		level.Error(p.logger).Log("err", err, "msg", "Could not read PKCS#11 public key")
+		k.Destroy()
+		return nil, ErrKeyGeneration
+	}
+	return k, nil
+}
+
+func keyPairTemplate(keyAlg string, keySize int) (uint, []*pkcs11.Attribute, error) {
+	public := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+	}
+	var curve asn1.ObjectIdentifier
+	switch keyAlg {
+	case "RSA":
+		public = append(public,
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, keySize),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+		)
+		return pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, public, nil
+	case "EC":
+		switch keySize {
+		case 256:
+			curve = oidCurveP256
+		case 384:
+			curve = oidCurveP384
+		case 521:
+			curve = oidCurveP521
+		default:
+			return 0, nil, ErrUnsupportedECSize
+		}
+		params, _ := asn1.Marshal(curve)
+		return pkcs11.CKM_EC_KEY_PAIR_GEN, append(public, pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params)), nil
+	case "Ed25519":
+		params, _ := asn1.Marshal(oidCurveEd25519)
+		return ckmECEdwardsKeyPairGen, append(public, pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params)), nil
+	default:
+		return 0, nil, ErrUnsupportedKey
+	}
+}
+
+// wrapPadOID returns the identifier of AES key wrap with padding for an AES
+// key of size bytes.
+func wrapPadOID(size uint) asn1.ObjectIdentifier {
+	switch size {
+	case 16:
+		return asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 8}
+	case 24:
+		return asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 28}
+	case 32:
+		return asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 48}
+	default:
+		return nil
+	}
+}
+
+// bytesToUint decodes a CK_ULONG attribute value, which is stored in the
+// native byte order of the platform. The byte order is taken from the
+// encoding the pkcs11 package itself uses for integer attributes.
+func bytesToUint(b []byte) uint {
+	littleEndian := pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 1).Value[0] == 1
+	var n uint
+	for i := range b {
+		if littleEndian {
+			n = n<<8 | uint(b[len(b)-1-i])
+		} else {
+			n = n<<8 | uint(b[i])
+		}
+	}
+	return n
+}
@@ -0,0 +1,251 @@
+//go:build cgo
+// +build cgo
+
+package pkcs11
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/configs"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys"
+
+	"github.com/go-kit/kit/log"
+	"github.com/miekg/pkcs11"
+)
+
+// TestGenerateKey runs against the token configured in the
+// MANUFACTURINGTEST_PKCS11* variables, e.g. a SoftHSM token holding an AES
+// key created with:
+//
+//	pkcs11-tool --module libsofthsm2.so --login --keygen --key-type AES:32 \
+//		--label wrap --extractable=false
+func TestGenerateKey(t *testing.T) {
+	cfg, err := configs.NewConfig("manufacturingtest")
+	if err != nil {
+		t.Fatal("Unable to get configuration variables")
+	}
+	if cfg.PKCS11Module == "" {
+		t.Skip("PKCS#11 module is not configured")
+	}
+	p, err := NewProvider(cfg.PKCS11Module, cfg.PKCS11TokenLabel, cfg.PKCS11PIN, cfg.PKCS11WrappingKey, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to start PKCS#11 provider: %s", err)
+	}
+	defer p.Close()
+
+	testGenerateKey(t, p)
+}
+
+// TestGenerateKeyFakeToken runs the tests of TestGenerateKey against an
+// in-memory token, and checks no session or key is left behind.
+func TestGenerateKeyFakeToken(t *testing.T) {
+	token := newFakeToken("dms", "wrap", 32)
+	p, err := newProvider(token, "dms", fakePIN, "wrap", log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to start PKCS#11 provider: %s", err)
+	}
+	defer p.Close()
+
+	testGenerateKey(t, p)
+	if n := token.openSessions(); n != 1 {
+		t.Errorf("Got %d open sessions; want 1", n)
+	}
+	if n := token.sessionObjects(); n != 0 {
+		t.Errorf("Got %d keys left in the token; want 0", n)
+	}
+}
+
+func testGenerateKey(t *testing.T, p *Provider) {
+	t.Helper()
+
+	testCases := []struct {
+		name    string
+		keyAlg  string
+		keySize int
+		sigAlgo x509.SignatureAlgorithm
+	}{
+		{"RSA", "RSA", 2048, x509.SHA256WithRSA},
+		{"RSA-PSS", "RSA", 3072, x509.SHA256WithRSAPSS},
+		{"EC P-256", "EC", 256, x509.ECDSAWithSHA256},
+		{"EC P-384", "EC", 384, x509.ECDSAWithSHA384},
+		{"EC P-521", "EC", 521, x509.ECDSAWithSHA512},
+		{"Ed25519", "Ed25519", 0, x509.PureEd25519},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			key, err := p.GenerateKey(context.Background(), tc.keyAlg, tc.keySize)
+			if err != nil {
+				t.Fatalf("Unable to generate key: %s", err)
+			}
+			defer key.Destroy()
+
+			template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device"}, SignatureAlgorithm: tc.sigAlgo}
+			der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+			if err != nil {
+				t.Fatalf("Unable to create CSR: %s", err)
+			}
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil {
+				t.Fatalf("Unable to parse CSR: %s", err)
+			}
+			if err := csr.CheckSignature(); err != nil {
+				t.Errorf("Invalid CSR signature: %s", err)
+			}
+
+			private, err := key.Export()
+			if err != nil {
+				t.Fatalf("Unable to export key: %s", err)
+			}
+			wrapped, ok := private.(*keys.EncryptedKey)
+			if !ok {
+				t.Fatalf("Got exported key of type %T; want *keys.EncryptedKey", private)
+			}
+			var info encryptedPrivateKeyInfo
+			if _, err := asn1.Unmarshal(wrapped.DER, &info); err != nil {
+				t.Fatalf("Unable to parse EncryptedPrivateKeyInfo: %s", err)
+			}
+			if !info.Algo.Algorithm.Equal(p.wrapOID) || len(info.EncryptedData) == 0 {
+				t.Error("Exported key is not wrapped with AES key wrap with padding")
+			}
+			if _, err := key.Export(); err != ErrKeyDestroyed {
+				t.Errorf("Got result is %s; want %s", err, ErrKeyDestroyed)
+			}
+		})
+	}
+}
+
+func TestNewProvider(t *testing.T) {
+	testCases := []struct {
+		name        string
+		tokenLabel  string
+		pin         string
+		wrappingKey string
+		keyLen      uint
+		ret         error
+	}{
+		{"Token and wrapping key are found", "dms", fakePIN, "wrap", 16, nil},
+		{"Token is not found", "other", fakePIN, "wrap", 32, ErrTokenNotFound},
+		{"PIN is incorrect", "dms", "0000", "wrap", 32, pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)},
+		{"Wrapping key is not found", "dms", fakePIN, "other", 32, ErrWrappingKey},
+		{"Wrapping key is not an AES key", "dms", fakePIN, "wrap", 20, ErrWrappingKey},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			token := newFakeToken("dms", "wrap", tc.keyLen)
+			p, err := newProvider(token, tc.tokenLabel, tc.pin, tc.wrappingKey, log.NewNopLogger())
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err == nil {
+				p.Close()
+			}
+			if !token.finalized || !token.destroyed || token.openSessions() != 0 {
+				t.Error("PKCS#11 module is not released")
+			}
+		})
+	}
+}
+
+func TestDestroyKey(t *testing.T) {
+	token := newFakeToken("dms", "wrap", 32)
+	p, err := newProvider(token, "dms", fakePIN, "wrap", log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to start PKCS#11 provider: %s", err)
+	}
+	defer p.Close()
+
+	key, err := p.GenerateKey(context.Background(), "EC", 256)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+	if err := key.Destroy(); err != nil {
+		t.Fatalf("Unable to destroy key: %s", err)
+	}
+	if err := key.Destroy(); err != nil {
+		t.Errorf("Got result is %s; want nil", err)
+	}
+	if _, err := key.Sign(rand.Reader, make([]byte, 32), crypto.SHA256); err != ErrKeyDestroyed {
+		t.Errorf("Got result is %s; want %s", err, ErrKeyDestroyed)
+	}
+	if n := token.sessionObjects(); n != 0 {
+		t.Errorf("Got %d keys left in the token; want 0", n)
+	}
+}
+
+func TestGenerateKeyConcurrently(t *testing.T) {
+	token := newFakeToken("dms", "wrap", 32)
+	p, err := newProvider(token, "dms", fakePIN, "wrap", log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to start PKCS#11 provider: %s", err)
+	}
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := p.GenerateKey(context.Background(), "EC", 256)
+			if err == nil {
+				_, err = key.Export()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Unable to generate key: %s", err)
+		}
+	}
+	if token.overlapped != 0 {
+		t.Error("Key pairs were generated concurrently in the module")
+	}
+}
+
+func TestGenerateKeyAfterClose(t *testing.T) {
+	token := newFakeToken("dms", "wrap", 32)
+	p, err := newProvider(token, "dms", fakePIN, "wrap", log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to start PKCS#11 provider: %s", err)
+	}
+	p.Close()
+	if token.loggedIn || !token.finalized {
+		t.Error("Provider is not logged out and finalized")
+	}
+	if _, err := p.GenerateKey(context.Background(), "EC", 256); err != ErrKeyGeneration {
+		t.Errorf("Got result is %s; want %s", err, ErrKeyGeneration)
+	}
+}
+
+func TestKeyPairTemplate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		keyAlg  string
+		keySize int
+		ret     error
+	}{
+		{"RSA", "RSA", 2048, nil},
+		{"EC P-521", "EC", 521, nil},
+		{"Ed25519", "Ed25519", 0, nil},
+		{"EC with unsupported size", "EC", 224, ErrUnsupportedECSize},
+		{"Unsupported algorithm", "DSA", 2048, ErrUnsupportedKey},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			if _, _, err := keyPairTemplate(tc.keyAlg, tc.keySize); tc.ret != err {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+//go:build cgo
+// +build cgo
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"math/big"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+const (
+	fakeSlot uint = 1
+	fakePIN       = "1234"
+)
+
+// fakeObject is an object of a fakeToken. Session objects belong to the
+// session they were created in, token objects to none.
+type fakeObject struct {
+	session  pkcs11.SessionHandle
+	private  crypto.Signer
+	public   crypto.PublicKey
+	label    string
+	valueLen uint
+}
+
+type fakeSignature struct {
+	mech   *pkcs11.Mechanism
+	handle pkcs11.ObjectHandle
+}
+
+// fakeToken is an in-memory module holding a single token with one AES
+// wrapping key. It generates keys with the standard library and records
+// what the Provider leaves behind, so its behaviour can be tested without
+// an HSM.
+type fakeToken struct {
+	mtx         sync.Mutex
+	label       string
+	initialized bool
+	finalized   bool
+	destroyed   bool
+	loggedIn    bool
+	next        uint
+	sessions    map[pkcs11.SessionHandle]bool
+	objects     map[pkcs11.ObjectHandle]*fakeObject
+	signing     map[pkcs11.SessionHandle]fakeSignature
+	found       []pkcs11.ObjectHandle
+
+	// generating counts the GenerateKeyPair calls in progress, and
+	// overlapped is set when two of them run at the same time.
+	generating int32
+	overlapped int32
+}
+
+func newFakeToken(label string, wrappingKey string, wrappingKeyLen uint) *fakeToken {
+	t := &fakeToken{
+		label:    label,
+		next:     1,
+		sessions: make(map[pkcs11.SessionHandle]bool),
+		objects:  make(map[pkcs11.ObjectHandle]*fakeObject),
+		signing:  make(map[pkcs11.SessionHandle]fakeSignature),
+	}
+	t.objects[t.handle()] = &fakeObject{label: wrappingKey, valueLen: wrappingKeyLen}
+	return t
+}
+
+func (t *fakeToken) handle() pkcs11.ObjectHandle {
+	h := pkcs11.ObjectHandle(t.next)
+	t.next++
+	return h
+}
+
+// openSessions returns the number of sessions which have not been closed.
+func (t *fakeToken) openSessions() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return len(t.sessions)
+}
+
+// sessionObjects returns the number of session objects which have not
+// been destroyed.
+func (t *fakeToken) sessionObjects() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	n := 0
+	for _, obj := range t.objects {
+		if obj.session != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *fakeToken) Initialize() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.initialized = true
+	return nil
+}
+
+func (t *fakeToken) Finalize() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.finalized = true
+	return nil
+}
+
+func (t *fakeToken) Destroy() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.destroyed = true
+}
+
+func (t *fakeToken) GetSlotList(tokenPresent bool) ([]uint, error) {
+	return []uint{fakeSlot}, nil
+}
+
+func (t *fakeToken) GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error) {
+	if slotID != fakeSlot {
+		return pkcs11.TokenInfo{}, pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+	return pkcs11.TokenInfo{Label: t.label + strings.Repeat(" ", 32-len(t.label))}, nil
+}
+
+func (t *fakeToken) OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !t.initialized || t.finalized {
+		return 0, pkcs11.Error(pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED)
+	}
+	sh := pkcs11.SessionHandle(t.next)
+	t.next++
+	t.sessions[sh] = true
+	return sh, nil
+}
+
+func (t *fakeToken) CloseSession(sh pkcs11.SessionHandle) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !t.sessions[sh] {
+		return pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+	t.closeSession(sh)
+	return nil
+}
+
+func (t *fakeToken) CloseAllSessions(slotID uint) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for sh := range t.sessions {
+		t.closeSession(sh)
+	}
+	t.loggedIn = false
+	return nil
+}
+
+func (t *fakeToken) closeSession(sh pkcs11.SessionHandle) {
+	delete(t.sessions, sh)
+	delete(t.signing, sh)
+	for h, obj := range t.objects {
+		if obj.session == sh {
+			delete(t.objects, h)
+		}
+	}
+}
+
+func (t *fakeToken) Login(sh pkcs11.SessionHandle, userType uint, pin string) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !t.sessions[sh] {
+		return pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+	if pin != fakePIN {
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+	t.loggedIn = true
+	return nil
+}
+
+func (t *fakeToken) Logout(sh pkcs11.SessionHandle) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.loggedIn = false
+	return nil
+}
+
+func (t *fakeToken) FindObjectsInit(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.found = nil
+	for _, attr := range temp {
+		if attr.Type != pkcs11.CKA_LABEL {
+			continue
+		}
+		for h, obj := range t.objects {
+			if obj.session == 0 && obj.label == string(attr.Value) {
+				t.found = append(t.found, h)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *fakeToken) FindObjects(sh pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if len(t.found) > max {
+		return t.found[:max], true, nil
+	}
+	return t.found, false, nil
+}
+
+func (t *fakeToken) FindObjectsFinal(sh pkcs11.SessionHandle) error {
+	return nil
+}
+
+func (t *fakeToken) GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	obj, ok := t.objects[o]
+	if !ok || !t.sessions[sh] {
+		return nil, pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID)
+	}
+	var attrs []*pkcs11.Attribute
+	for _, attr := range a {
+		switch pub := obj.public.(type) {
+		case *rsa.PublicKey:
+			switch attr.Type {
+			case pkcs11.CKA_MODULUS:
+				attrs = append(attrs, pkcs11.NewAttribute(attr.Type, pub.N.Bytes()))
+			case pkcs11.CKA_PUBLIC_EXPONENT:
+				attrs = append(attrs, pkcs11.NewAttribute(attr.Type, big.NewInt(int64(pub.E)).Bytes()))
+			}
+		case *ecdsa.PublicKey:
+			curve := map[string]asn1.ObjectIdentifier{"P-256": oidCurveP256, "P-384": oidCurveP384, "P-521": oidCurveP521}[pub.Curve.Params().Name]
+			switch attr.Type {
+			case pkcs11.CKA_EC_PARAMS:
+				params, _ := asn1.Marshal(curve)
+				attrs = append(attrs, pkcs11.NewAttribute(attr.Type, params))
+			case pkcs11.CKA_EC_POINT:
+				point, _ := asn1.Marshal(elliptic.Marshal(pub.Curve, pub.X, pub.Y))
+				attrs = append(attrs, pkcs11.NewAttribute(attr.Type, point))
+			}
+		case ed25519.PublicKey:
+			switch attr.Type {
+			case pkcs11.CKA_EC_PARAMS:
+				params, _ := asn1.Marshal(oidCurveEd25519)
+				attrs = append(attrs, pkcs11.NewAttribute(attr.Type, params))
+			case pkcs11.CKA_EC_POINT:
+				point, _ := asn1.Marshal([]byte(pub))
+				attrs = append(attrs, pkcs11.NewAttribute(attr.Type, point))
+			}
+		default:
+			if attr.Type == pkcs11.CKA_VALUE_LEN && obj.valueLen != 0 {
+				attrs = append(attrs, pkcs11.NewAttribute(attr.Type, obj.valueLen))
+			}
+		}
+	}
+	if len(attrs) != len(a) {
+		return nil, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+	}
+	return attrs, nil
+}
+
+func (t *fakeToken) GenerateKeyPair(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, public, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	if atomic.AddInt32(&t.generating, 1) > 1 {
+		atomic.StoreInt32(&t.overlapped, 1)
+	}
+	defer atomic.AddInt32(&t.generating, -1)
+	// Give concurrent callers the chance to overlap.
+	time.Sleep(time.Millisecond)
+
+	signer, err := generateFakeKey(m[0].Mechanism, public)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !t.sessions[sh] || !t.loggedIn {
+		return 0, 0, pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+	pub, priv := t.handle(), t.handle()
+	t.objects[pub] = &fakeObject{session: sh, public: signer.Public()}
+	t.objects[priv] = &fakeObject{session: sh, private: signer}
+	return pub, priv, nil
+}
+
+func generateFakeKey(mech uint, public []*pkcs11.Attribute) (crypto.Signer, error) {
+	attrs := make(map[uint][]byte)
+	for _, attr := range public {
+		attrs[attr.Type] = attr.Value
+	}
+	switch mech {
+	case pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN:
+		return rsa.GenerateKey(rand.Reader, int(bytesToUint(attrs[pkcs11.CKA_MODULUS_BITS])))
+	case pkcs11.CKM_EC_KEY_PAIR_GEN:
+		var curve asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(attrs[pkcs11.CKA_EC_PARAMS], &curve); err != nil {
+			return nil, pkcs11.Error(pkcs11.CKR_TEMPLATE_INCONSISTENT)
+		}
+		switch {
+		case curve.Equal(oidCurveP256):
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		case curve.Equal(oidCurveP384):
+			return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		case curve.Equal(oidCurveP521):
+			return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		}
+	case ckmECEdwardsKeyPairGen:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+}
+
+func (t *fakeToken) SignInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, o pkcs11.ObjectHandle) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if obj, ok := t.objects[o]; !ok || obj.session != sh || obj.private == nil {
+		return pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID)
+	}
+	t.signing[sh] = fakeSignature{mech: m[0], handle: o}
+	return nil
+}
+
+func (t *fakeToken) Sign(sh pkcs11.SessionHandle, message []byte) ([]byte, error) {
+	t.mtx.Lock()
+	op, ok := t.signing[sh]
+	delete(t.signing, sh)
+	obj := t.objects[op.handle]
+	t.mtx.Unlock()
+	if !ok || obj == nil {
+		return nil, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+
+	switch op.mech.Mechanism {
+	case pkcs11.CKM_RSA_PKCS:
+		// The caller provides the DigestInfo, so no hash is given here.
+		return rsa.SignPKCS1v15(rand.Reader, obj.private.(*rsa.PrivateKey), crypto.Hash(0), message)
+	case pkcs11.CKM_RSA_PKCS_PSS:
+		// CK_RSA_PKCS_PSS_PARAMS holds the hash, the MGF and the salt
+		// length as three CK_ULONG.
+		size := len(op.mech.Parameter) / 3
+		hash := map[uint]crypto.Hash{pkcs11.CKM_SHA256: crypto.SHA256, pkcs11.CKM_SHA384: crypto.SHA384, pkcs11.CKM_SHA512: crypto.SHA512}[bytesToUint(op.mech.Parameter[:size])]
+		saltLength := int(bytesToUint(op.mech.Parameter[2*size:]))
+		return rsa.SignPSS(rand.Reader, obj.private.(*rsa.PrivateKey), hash, message, &rsa.PSSOptions{SaltLength: saltLength, Hash: hash})
+	case pkcs11.CKM_ECDSA:
+		key := obj.private.(*ecdsa.PrivateKey)
+		r, s, err := ecdsa.Sign(rand.Reader, key, message)
+		if err != nil {
+			return nil, err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		return sig, nil
+	case ckmEdDSA:
+		return ed25519.Sign(obj.private.(ed25519.PrivateKey), message), nil
+	}
+	return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+}
+
+// WrapKey returns the PKCS#8 encoding of the key, which stands in for its
+// wrapped form.
+func (t *fakeToken) WrapKey(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, wrappingkey, key pkcs11.ObjectHandle) ([]byte, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if m[0].Mechanism != pkcs11.CKM_AES_KEY_WRAP_PAD {
+		return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+	if wrapping, ok := t.objects[wrappingkey]; !ok || wrapping.valueLen == 0 {
+		return nil, pkcs11.Error(pkcs11.CKR_WRAPPING_KEY_HANDLE_INVALID)
+	}
+	obj, ok := t.objects[key]
+	if !ok || obj.session != sh || obj.private == nil {
+		return nil, pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID)
+	}
+	return x509.MarshalPKCS8PrivateKey(obj.private)
+}
@@ -0,0 +1,205 @@
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/ledger"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	recordsBucket = []byte("records")
+	// issuedBucket indexes the sequence number of the last issued record by
+	// idempotency key.
+	issuedBucket = []byte("issued")
+	// devicesBucket indexes the sequence number of the last issued record by
+	// device ID.
+	devicesBucket = []byte("devices")
+	// serialsBucket indexes the sequence number of the last issued record by
+	// certificate issuer and serial number, as serial numbers are only
+	// unique per issuer.
+	serialsBucket = []byte("serials")
+)
+
+var ErrOpen = errors.New("unable to open ledger database")
+
+// Ledger stores records in a BoltDB file, keyed by a sequence number so
+// that iteration follows the order records were appended in.
+type Ledger struct {
+	db     *bolt.DB
+	logger log.Logger
+}
+
+// NewLedger opens or creates the BoltDB database at path.
+func NewLedger(path string, logger log.Logger) (*Ledger, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not open ledger database", "path", path)
+		return nil, ErrOpen
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{recordsBucket, issuedBucket, devicesBucket, serialsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		level.Error(logger).Log("err", err, "msg", "Could not create ledger bucket")
+		return nil, ErrOpen
+	}
+	return &Ledger{db: db, logger: logger}, nil
+}
+
+func (l *Ledger) Close() error {
+	return l.db.Close()
+}
+
+func (l *Ledger) Append(ctx context.Context, rec ledger.Record) (ledger.Record, error) {
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(recordsBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		rec.ID = strconv.FormatUint(seq, 10)
+		rec.CreatedAt = time.Now().UTC()
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(itob(seq), data); err != nil {
+			return err
+		}
+		if rec.Outcome != ledger.OutcomeIssued && rec.Outcome != ledger.OutcomeUnregistered {
+			return nil
+		}
+		if rec.Outcome == ledger.OutcomeIssued && rec.Serial != "" {
+			if err := tx.Bucket(serialsBucket).Put([]byte(serialKey(rec.Issuer, rec.Serial)), itob(seq)); err != nil {
+				return err
+			}
+		}
+		if rec.DeviceID != "" {
+			if err := tx.Bucket(devicesBucket).Put([]byte(rec.DeviceID), itob(seq)); err != nil {
+				return err
+			}
+		}
+		if rec.IdempotencyKey != "" {
+			return tx.Bucket(issuedBucket).Put([]byte(rec.IdempotencyKey), itob(seq))
+		}
+		return nil
+	})
+	if err != nil {
+		level.Error(l.logger).Log("err", err, "msg", "Could not append ledger record", "device_id", rec.DeviceID)
+		return ledger.Record{}, err
+	}
+	return rec, nil
+}
+
+func (l *Ledger) Get(ctx context.Context, id string) (ledger.Record, error) {
+	seq, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return ledger.Record{}, ledger.ErrNotFound
+	}
+	return l.get(itob(seq))
+}
+
+func (l *Ledger) LastIssued(ctx context.Context, idempotencyKey string) (ledger.Record, error) {
+	return l.lookup(issuedBucket, idempotencyKey)
+}
+
+func (l *Ledger) LastIssuedToDevice(ctx context.Context, deviceID string) (ledger.Record, error) {
+	return l.lookup(devicesBucket, deviceID)
+}
+
+func (l *Ledger) BySerial(ctx context.Context, issuer string, serial string) (ledger.Record, error) {
+	return l.lookup(serialsBucket, serialKey(issuer, serial))
+}
+
+// lookup returns the record whose sequence number is stored under key in
+// the index bucket.
+func (l *Ledger) lookup(bucket []byte, key string) (ledger.Record, error) {
+	var seq []byte
+	err := l.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucket).Get([]byte(key)); v != nil {
+			seq = append(seq, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		level.Error(l.logger).Log("err", err, "msg", "Could not read ledger index", "index", string(bucket), "key", key)
+		return ledger.Record{}, err
+	}
+	if seq == nil {
+		return ledger.Record{}, ledger.ErrNotFound
+	}
+	return l.get(seq)
+}
+
+func (l *Ledger) get(seq []byte) (ledger.Record, error) {
+	var rec ledger.Record
+	err := l.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(recordsBucket).Get(seq)
+		if data == nil {
+			return ledger.ErrNotFound
+		}
+		return json.Unmarshal(data, &rec)
+	})
+	if err != nil {
+		return ledger.Record{}, err
+	}
+	return rec, nil
+}
+
+func (l *Ledger) List(ctx context.Context, filter ledger.Filter) ([]ledger.Record, error) {
+	records := []ledger.Record{}
+	err := l.db.View(func(tx *bolt.Tx) error {
+		skipped := 0
+		c := tx.Bucket(recordsBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var rec ledger.Record
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if !filter.Match(rec) {
+				continue
+			}
+			if skipped < filter.Offset {
+				skipped++
+				continue
+			}
+			records = append(records, rec)
+			if filter.Limit > 0 && len(records) == filter.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		level.Error(l.logger).Log("err", err, "msg", "Could not list ledger records")
+		return nil, err
+	}
+	return records, nil
+}
+
+// serialKey is the key of a certificate in the serial number index. It is
+// unambiguous as formatted serial numbers never contain a NUL byte.
+func serialKey(issuer string, serial string) string {
+	return issuer + "\x00" + serial
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,260 @@
+package bolt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/ledger"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ledger.db")
+	ctx := context.Background()
+
+	l, err := NewLedger(path, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to open ledger: %s", err)
+	}
+	appended := []ledger.Record{
+		{DeviceID: "a", Operator: "alice", Outcome: ledger.OutcomeIssued, Serial: "01"},
+		{DeviceID: "b", Operator: "bob", Outcome: ledger.OutcomeFailed, Error: "upstream failure"},
+		{DeviceID: "a", Operator: "bob", Outcome: ledger.OutcomeIssued, Serial: "02"},
+	}
+	for i, rec := range appended {
+		rec, err := l.Append(ctx, rec)
+		if err != nil {
+			t.Fatalf("Unable to append record: %s", err)
+		}
+		if want := fmt.Sprint(i + 1); rec.ID != want || rec.CreatedAt.IsZero() {
+			t.Errorf("Got record ID %s created at %s; want ID %s", rec.ID, rec.CreatedAt, want)
+		}
+	}
+
+	// Records survive reopening the database.
+	l.Close()
+	l, err = NewLedger(path, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to reopen ledger: %s", err)
+	}
+	defer l.Close()
+
+	testCases := []struct {
+		name    string
+		filter  ledger.Filter
+		serials []string
+	}{
+		{"All records", ledger.Filter{}, []string{"01", "", "02"}},
+		{"Records of a device", ledger.Filter{DeviceID: "a"}, []string{"01", "02"}},
+		{"Records of an operator and outcome", ledger.Filter{Operator: "bob", Outcome: ledger.OutcomeIssued}, []string{"02"}},
+		{"Records after an offset", ledger.Filter{Offset: 1, Limit: 1}, []string{""}},
+		{"Records of an unknown device", ledger.Filter{DeviceID: "c"}, []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			records, err := l.List(ctx, tc.filter)
+			if err != nil {
+				t.Fatalf("Unable to list records: %s", err)
+			}
+			serials := []string{}
+			for _, rec := range records {
+				serials = append(serials, rec.Serial)
+			}
+			if fmt.Sprint(serials) != fmt.Sprint(tc.serials) {
+				t.Errorf("Got serials %q; want %q", serials, tc.serials)
+			}
+		})
+	}
+
+	rec, err := l.Get(ctx, "2")
+	if err != nil || rec.Error != "upstream failure" {
+		t.Errorf("Got record %+v and result %v", rec, err)
+	}
+	for _, id := range []string{"4", "not a number"} {
+		if _, err := l.Get(ctx, id); err != ledger.ErrNotFound {
+			t.Errorf("Got result is %s; want %s", err, ledger.ErrNotFound)
+		}
+	}
+}
+
+func TestLastIssued(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	l, err := NewLedger(filepath.Join(dir, "ledger.db"), log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to open ledger: %s", err)
+	}
+	defer l.Close()
+	for _, rec := range []ledger.Record{
+		{IdempotencyKey: "a", Outcome: ledger.OutcomeIssued, Serial: "01"},
+		{IdempotencyKey: "a", Outcome: ledger.OutcomeIssued, Serial: "02"},
+		{IdempotencyKey: "a", Outcome: ledger.OutcomeFailed},
+		{IdempotencyKey: "b", Outcome: ledger.OutcomeFailed},
+		{Outcome: ledger.OutcomeIssued, Serial: "03"},
+		{IdempotencyKey: "c", Outcome: ledger.OutcomeUnregistered, Serial: "04"},
+	} {
+		if _, err := l.Append(ctx, rec); err != nil {
+			t.Fatalf("Unable to append record: %s", err)
+		}
+	}
+
+	testCases := []struct {
+		name   string
+		key    string
+		serial string
+		ret    error
+	}{
+		{"Last issued record is returned", "a", "02", nil},
+		{"Failed records are not returned", "b", "", ledger.ErrNotFound},
+		{"Unregistered records are returned", "c", "04", nil},
+		{"Records without key are not indexed", "", "", ledger.ErrNotFound},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			rec, err := l.LastIssued(ctx, tc.key)
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if rec.Serial != tc.serial {
+				t.Errorf("Got serial %s; want %s", rec.Serial, tc.serial)
+			}
+		})
+	}
+}
+
+func TestLastIssuedToDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	l, err := NewLedger(filepath.Join(dir, "ledger.db"), log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to open ledger: %s", err)
+	}
+	defer l.Close()
+	for _, rec := range []ledger.Record{
+		{IdempotencyKey: "a", DeviceID: "d1", Outcome: ledger.OutcomeIssued, Serial: "01"},
+		{IdempotencyKey: "key:b", DeviceID: "d1", Outcome: ledger.OutcomeIssued, Serial: "02"},
+		{IdempotencyKey: "key:c", DeviceID: "d1", Outcome: ledger.OutcomeFailed},
+		{IdempotencyKey: "key:d", DeviceID: "d2", Outcome: ledger.OutcomeFailed},
+	} {
+		if _, err := l.Append(ctx, rec); err != nil {
+			t.Fatalf("Unable to append record: %s", err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		deviceID string
+		serial   string
+		ret      error
+	}{
+		{"Last issued record of any key is returned", "d1", "02", nil},
+		{"Failed records are not returned", "d2", "", ledger.ErrNotFound},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			rec, err := l.LastIssuedToDevice(ctx, tc.deviceID)
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if rec.Serial != tc.serial {
+				t.Errorf("Got serial %s; want %s", rec.Serial, tc.serial)
+			}
+		})
+	}
+}
+
+func TestLastIssuedStorageError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	l, err := NewLedger(filepath.Join(dir, "ledger.db"), log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to open ledger: %s", err)
+	}
+	if _, err := l.Append(ctx, ledger.Record{IdempotencyKey: "a", Outcome: ledger.OutcomeIssued}); err != nil {
+		t.Fatalf("Unable to append record: %s", err)
+	}
+	l.Close()
+
+	if _, err := l.LastIssued(ctx, "a"); err == nil || err == ledger.ErrNotFound {
+		t.Errorf("Got result is %v; want a storage error", err)
+	}
+}
+
+func TestBySerial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	l, err := NewLedger(filepath.Join(dir, "ledger.db"), log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to open ledger: %s", err)
+	}
+	defer l.Close()
+	for _, rec := range []ledger.Record{
+		{DeviceID: "a", Outcome: ledger.OutcomeIssued, Issuer: "CN=CA 1", Serial: "01"},
+		{DeviceID: "b", Outcome: ledger.OutcomeIssued, Issuer: "CN=CA 1", Serial: "02"},
+		{DeviceID: "c", Outcome: ledger.OutcomeIssued, Issuer: "CN=CA 1", Serial: "02"},
+		{DeviceID: "d", Outcome: ledger.OutcomeIssued, Issuer: "CN=CA 2", Serial: "02"},
+		{DeviceID: "e", Outcome: ledger.OutcomeFailed, Issuer: "CN=CA 1", Serial: "03"},
+		{DeviceID: "f", Outcome: ledger.OutcomeUnregistered, Issuer: "CN=CA 1", Serial: "04"},
+	} {
+		if _, err := l.Append(ctx, rec); err != nil {
+			t.Fatalf("Unable to append record: %s", err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		issuer   string
+		serial   string
+		deviceID string
+		ret      error
+	}{
+		{"Issued record is returned", "CN=CA 1", "01", "a", nil},
+		{"Last issued record is returned", "CN=CA 1", "02", "c", nil},
+		{"Serial is looked up for its issuer", "CN=CA 2", "02", "d", nil},
+		{"Serial of another issuer is not found", "CN=CA 2", "01", "", ledger.ErrNotFound},
+		{"Failed records are not indexed", "CN=CA 1", "03", "", ledger.ErrNotFound},
+		{"Unregistered records are not indexed", "CN=CA 1", "04", "", ledger.ErrNotFound},
+		{"Unknown serial is not found", "CN=CA 1", "05", "", ledger.ErrNotFound},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			rec, err := l.BySerial(ctx, tc.issuer, tc.serial)
+			if tc.ret != err {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if rec.DeviceID != tc.deviceID {
+				t.Errorf("Got device %s; want %s", rec.DeviceID, tc.deviceID)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Outcomes of a provisioning attempt. OutcomeUnregistered marks a
+// certificate that was issued but could not be registered in the Device
+// Manager; a retry of the request registers it instead of issuing another.
+const (
+	OutcomeIssued       = "ISSUED"
+	OutcomeUnregistered = "UNREGISTERED"
+	OutcomeFailed       = "FAILED"
+)
+
+var ErrNotFound = errors.New("ledger record not found")
+
+// Record is the audit entry of one provisioning attempt. Certificate fields
+// are empty when no certificate was issued. IdempotencyKey and RequestHash
+// identify the request, so that retries of it can be detected. Renews is
+// the serial number of the certificate replaced by a re-enrollment.
+type Record struct {
+	ID             string    `json:"id"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	RequestHash    string    `json:"request_hash,omitempty"`
+	DeviceID       string    `json:"device_id"`
+	Subject        string    `json:"subject"`
+	KeyAlg         string    `json:"key_alg"`
+	KeySize        int       `json:"key_size,omitempty"`
+	CAName         string    `json:"ca_name,omitempty"`
+	Serial         string    `json:"serial,omitempty"`
+	Issuer         string    `json:"issuer,omitempty"`
+	NotBefore      time.Time `json:"not_before,omitempty"`
+	NotAfter       time.Time `json:"not_after,omitempty"`
+	Certificate    []byte    `json:"crt,omitempty"`
+	Chain          [][]byte  `json:"chain,omitempty"`
+	Renews         string    `json:"renews,omitempty"`
+	Operator       string    `json:"operator"`
+	Outcome        string    `json:"outcome"`
+	Error          string    `json:"error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Filter selects the records returned by List. Empty fields match any
+// record, and a zero Limit returns every matching record.
+type Filter struct {
+	DeviceID string
+	Operator string
+	Outcome  string
+	Serial   string
+	Offset   int
+	Limit    int
+}
+
+// Ledger is the durable, append only record of the devices provisioned by
+// the manufacturing service.
+type Ledger interface {
+	// Append stores rec with a new ID and creation time, returning the
+	// stored record.
+	Append(ctx context.Context, rec Record) (Record, error)
+	Get(ctx context.Context, id string) (Record, error)
+	// List returns the records matching filter in the order they were
+	// appended.
+	List(ctx context.Context, filter Filter) ([]Record, error)
+	// LastIssued returns the latest record with outcome OutcomeIssued or
+	// OutcomeUnregistered appended with idempotencyKey, or ErrNotFound.
+	LastIssued(ctx context.Context, idempotencyKey string) (Record, error)
+	// LastIssuedToDevice returns the latest record with outcome
+	// OutcomeIssued or OutcomeUnregistered of deviceID, or ErrNotFound.
+	LastIssuedToDevice(ctx context.Context, deviceID string) (Record, error)
+	// BySerial returns the latest record with outcome OutcomeIssued of the
+	// certificate with serial issued by issuer, or ErrNotFound.
+	BySerial(ctx context.Context, issuer string, serial string) (Record, error)
+}
+
+// Match reports whether rec is selected by the fields of f.
+func (f Filter) Match(rec Record) bool {
+	return (f.DeviceID == "" || f.DeviceID == rec.DeviceID) &&
+		(f.Operator == "" || f.Operator == rec.Operator) &&
+		(f.Outcome == "" || f.Outcome == rec.Outcome) &&
+		(f.Serial == "" || f.Serial == rec.Serial)
+}
@@ -5,14 +5,28 @@ import (
 	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client"
 )
 
 type MockClient struct {
 	StartClientFn      func(ctx context.Context, CA string, authCRT []tls.Certificate) error
 	StartClientInvoked bool
 
-	GetCertificateFn      func(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string) (*x509.Certificate, crypto.PrivateKey, error)
+	RollbackCredentialsFn      func(ctx context.Context) error
+	RollbackCredentialsInvoked bool
+
+	StatusFn      func(ctx context.Context) client.Status
+	StatusInvoked bool
+
+	GetCertificateFn      func(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string) (*x509.Certificate, []*x509.Certificate, crypto.PrivateKey, error)
 	GetCertificateInvoked bool
+
+	EnrollCSRFn      func(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, []*x509.Certificate, error)
+	EnrollCSRInvoked bool
+
+	ReenrollCSRFn      func(ctx context.Context, csr *x509.CertificateRequest, current *x509.Certificate, caName string) (*x509.Certificate, []*x509.Certificate, error)
+	ReenrollCSRInvoked bool
 }
 
 func (mc *MockClient) StartClient(ctx context.Context, CA string, authCRT []tls.Certificate) error {
@@ -20,7 +34,27 @@ func (mc *MockClient) StartClient(ctx context.Context, CA string, authCRT []tls.
 	return mc.StartClientFn(ctx, CA, authCRT)
 }
 
-func (mc *MockClient) GetCertificate(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string, caName string) (*x509.Certificate, crypto.PrivateKey, error) {
+func (mc *MockClient) RollbackCredentials(ctx context.Context) error {
+	mc.RollbackCredentialsInvoked = true
+	return mc.RollbackCredentialsFn(ctx)
+}
+
+func (mc *MockClient) Status(ctx context.Context) client.Status {
+	mc.StatusInvoked = true
+	return mc.StatusFn(ctx)
+}
+
+func (mc *MockClient) GetCertificate(ctx context.Context, keyAlg string, keySize int, c string, st string, l string, o string, ou string, cn string, email string, caName string) (*x509.Certificate, []*x509.Certificate, crypto.PrivateKey, error) {
 	mc.GetCertificateInvoked = true
 	return mc.GetCertificateFn(ctx, keyAlg, keySize, c, st, l, o, ou, cn, email)
 }
+
+func (mc *MockClient) EnrollCSR(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, []*x509.Certificate, error) {
+	mc.EnrollCSRInvoked = true
+	return mc.EnrollCSRFn(ctx, csr, caName)
+}
+
+func (mc *MockClient) ReenrollCSR(ctx context.Context, csr *x509.CertificateRequest, current *x509.Certificate, caName string) (*x509.Certificate, []*x509.Certificate, error) {
+	mc.ReenrollCSRInvoked = true
+	return mc.ReenrollCSRFn(ctx, csr, current, caName)
+}
@@ -0,0 +1,95 @@
+package mocks
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/ledger"
+)
+
+// MockLedger keeps records in memory. Append fails with AppendErr when it
+// is set.
+type MockLedger struct {
+	mtx       sync.Mutex
+	Records   []ledger.Record
+	AppendErr error
+}
+
+func (ml *MockLedger) Append(ctx context.Context, rec ledger.Record) (ledger.Record, error) {
+	ml.mtx.Lock()
+	defer ml.mtx.Unlock()
+	if ml.AppendErr != nil {
+		return ledger.Record{}, ml.AppendErr
+	}
+	rec.ID = strconv.Itoa(len(ml.Records) + 1)
+	rec.CreatedAt = time.Now()
+	ml.Records = append(ml.Records, rec)
+	return rec, nil
+}
+
+func (ml *MockLedger) Get(ctx context.Context, id string) (ledger.Record, error) {
+	ml.mtx.Lock()
+	defer ml.mtx.Unlock()
+	for _, rec := range ml.Records {
+		if rec.ID == id {
+			return rec, nil
+		}
+	}
+	return ledger.Record{}, ledger.ErrNotFound
+}
+
+func (ml *MockLedger) List(ctx context.Context, filter ledger.Filter) ([]ledger.Record, error) {
+	ml.mtx.Lock()
+	defer ml.mtx.Unlock()
+	records := []ledger.Record{}
+	skipped := 0
+	for _, rec := range ml.Records {
+		if !filter.Match(rec) {
+			continue
+		}
+		if skipped < filter.Offset {
+			skipped++
+			continue
+		}
+		records = append(records, rec)
+		if filter.Limit > 0 && len(records) == filter.Limit {
+			break
+		}
+	}
+	return records, nil
+}
+
+func (ml *MockLedger) BySerial(ctx context.Context, issuer string, serial string) (ledger.Record, error) {
+	ml.mtx.Lock()
+	defer ml.mtx.Unlock()
+	for i := len(ml.Records) - 1; i >= 0; i-- {
+		if rec := ml.Records[i]; rec.Issuer == issuer && rec.Serial == serial && rec.Outcome == ledger.OutcomeIssued {
+			return rec, nil
+		}
+	}
+	return ledger.Record{}, ledger.ErrNotFound
+}
+
+func (ml *MockLedger) LastIssued(ctx context.Context, idempotencyKey string) (ledger.Record, error) {
+	ml.mtx.Lock()
+	defer ml.mtx.Unlock()
+	for i := len(ml.Records) - 1; i >= 0; i-- {
+		if rec := ml.Records[i]; rec.IdempotencyKey == idempotencyKey && (rec.Outcome == ledger.OutcomeIssued || rec.Outcome == ledger.OutcomeUnregistered) {
+			return rec, nil
+		}
+	}
+	return ledger.Record{}, ledger.ErrNotFound
+}
+
+func (ml *MockLedger) LastIssuedToDevice(ctx context.Context, deviceID string) (ledger.Record, error) {
+	ml.mtx.Lock()
+	defer ml.mtx.Unlock()
+	for i := len(ml.Records) - 1; i >= 0; i-- {
+		if rec := ml.Records[i]; rec.DeviceID == deviceID && (rec.Outcome == ledger.OutcomeIssued || rec.Outcome == ledger.OutcomeUnregistered) {
+			return rec, nil
+		}
+	}
+	return ledger.Record{}, ledger.ErrNotFound
+}
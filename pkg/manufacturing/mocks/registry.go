@@ -0,0 +1,16 @@
+package mocks
+
+import (
+	"context"
+	"crypto/x509"
+)
+
+type MockRegistry struct {
+	RegisterCertificateFn      func(ctx context.Context, deviceID string, caName string, crt *x509.Certificate) error
+	RegisterCertificateInvoked bool
+}
+
+func (mr *MockRegistry) RegisterCertificate(ctx context.Context, deviceID string, caName string, crt *x509.Certificate) error {
+	mr.RegisterCertificateInvoked = true
+	return mr.RegisterCertificateFn(ctx, deviceID, caName, crt)
+}
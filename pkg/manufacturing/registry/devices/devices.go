@@ -0,0 +1,140 @@
+package devices
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/registry"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	defaultAttempts = 3
+	defaultBackoff  = 500 * time.Millisecond
+)
+
+type DeviceManager struct {
+	baseURL  string
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+	logger   log.Logger
+}
+
+type issueRequest struct {
+	CaName       string `json:"ca_name"`
+	SerialNumber string `json:"serial_number"`
+	Issuer       string `json:"issuer"`
+	ValidFrom    string `json:"valid_from"`
+	ValidTo      string `json:"valid_to"`
+}
+
+var (
+	ErrRegistrationRejected = errors.New("device manager rejected certificate registration")
+	ErrRegistryUnavailable  = errors.New("device manager is unavailable")
+)
+
+// NewClient creates a Device Manager client. The client trusts the servers
+// whose certificate chains to CA and, when certFile and keyFile are set,
+// authenticates itself with that key pair.
+func NewClient(baseURL string, CA string, certFile string, keyFile string, logger log.Logger) (registry.Registry, error) {
+	caCertPool, err := utils.CreateCAPool(CA)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not create CA Pool to validate Device Manager")
+		return nil, err
+	}
+	tlsConfig := &tls.Config{RootCAs: caCertPool}
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			level.Error(logger).Log("err", err, "msg", "Could not load Device Manager client certificate")
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	httpc := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+		},
+		Timeout: 10 * time.Second,
+	}
+	return &DeviceManager{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		client:   httpc,
+		attempts: defaultAttempts,
+		backoff:  defaultBackoff,
+		logger:   logger,
+	}, nil
+}
+
+// RegisterCertificate notifies the Device Manager that crt has been issued to
+// the device. Connection errors and 5xx responses are retried with an
+// exponential backoff; any other non 2xx response is a rejection.
+func (d *DeviceManager) RegisterCertificate(ctx context.Context, deviceID string, caName string, crt *x509.Certificate) error {
+	body, err := json.Marshal(issueRequest{
+		CaName:       caName,
+		SerialNumber: utils.SerialNumber(crt.SerialNumber),
+		Issuer:       crt.Issuer.String(),
+		ValidFrom:    crt.NotBefore.UTC().Format(time.RFC3339),
+		ValidTo:      crt.NotAfter.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	u := d.baseURL + "/v1/devices/" + url.PathEscape(deviceID) + "/issue/dms/"
+
+	backoff := d.backoff
+	for attempt := 1; ; attempt++ {
+		err = d.post(ctx, u, body)
+		if err == nil || errors.Is(err, ErrRegistrationRejected) || attempt >= d.attempts {
+			break
+		}
+		level.Warn(d.logger).Log("err", err, "msg", "Device Manager registration failed, retrying", "device_id", deviceID, "attempt", attempt)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		level.Error(d.logger).Log("err", err, "msg", "Could not register certificate in Device Manager", "device_id", deviceID)
+		return err
+	}
+	level.Info(d.logger).Log("msg", "Certificate registered in Device Manager", "device_id", deviceID)
+	return nil
+}
+
+func (d *DeviceManager) post(ctx context.Context, u string, body []byte) error {
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRegistryUnavailable, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("%w: status %d", ErrRegistryUnavailable, resp.StatusCode)
+	default:
+		return fmt.Errorf("%w: status %d", ErrRegistrationRejected, resp.StatusCode)
+	}
+}
@@ -0,0 +1,94 @@
+package devices
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestRegisterCertificate(t *testing.T) {
+	crt := &x509.Certificate{
+		SerialNumber: big.NewInt(0x1a2b3c),
+		Issuer:       pkix.Name{CommonName: "Lamassu DMS CA"},
+		NotBefore:    time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	testCases := []struct {
+		name     string
+		statuses []int
+		calls    int
+		ret      error
+	}{
+		{"Device Manager accepts registration", []int{http.StatusOK}, 1, nil},
+		{"Device Manager rejects registration", []int{http.StatusBadRequest}, 1, ErrRegistrationRejected},
+		{"Device Manager recovers after failure", []int{http.StatusServiceUnavailable, http.StatusCreated}, 2, nil},
+		{"Device Manager is unavailable", []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError}, 3, ErrRegistryUnavailable},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			calls := 0
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/devices/dev-1/issue/dms/" {
+					t.Errorf("Got path %s", r.URL.Path)
+				}
+				var req issueRequest
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					t.Errorf("Unable to decode request: %s", err)
+				}
+				if req.SerialNumber != "1a:2b:3c" || req.Issuer != "CN=Lamassu DMS CA" || req.ValidTo != "2022-01-01T00:00:00Z" || req.CaName != "ca" {
+					t.Errorf("Got unexpected registration request %+v", req)
+				}
+				w.WriteHeader(tc.statuses[calls])
+				calls++
+			}))
+			defer srv.Close()
+
+			d := setup(t, srv)
+			err := d.RegisterCertificate(context.Background(), "dev-1", "ca", crt)
+			if !errors.Is(err, tc.ret) {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+			if calls != tc.calls {
+				t.Errorf("Got %d calls; want %d", calls, tc.calls)
+			}
+		})
+	}
+}
+
+func setup(t *testing.T, srv *httptest.Server) *DeviceManager {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "devices")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory")
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, utils.PEMCert(srv.Certificate().Raw), 0644); err != nil {
+		t.Fatal("Unable to write CA certificate")
+	}
+
+	r, err := NewClient(srv.URL, caFile, "", "", log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to create Device Manager client: %s", err)
+	}
+	d := r.(*DeviceManager)
+	d.backoff = time.Millisecond
+	return d
+}
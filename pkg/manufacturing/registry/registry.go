@@ -0,0 +1,10 @@
+package registry
+
+import (
+	"context"
+	"crypto/x509"
+)
+
+type Registry interface {
+	RegisterCertificate(ctx context.Context, deviceID string, caName string, crt *x509.Certificate) error
+}
@@ -0,0 +1,287 @@
+// Package rotation renews the certificate the DMS authenticates with
+// against the proxy and the enrollment server before it expires.
+package rotation
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/client"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/keys/memory"
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+)
+
+const (
+	// DefaultRenewBefore and DefaultInterval are used when the rotator is
+	// created with zero durations.
+	DefaultRenewBefore = 30 * 24 * time.Hour
+	DefaultInterval    = time.Hour
+
+	// enrollTimeout bounds a renewal request to the enrollment server.
+	enrollTimeout = 30 * time.Second
+)
+
+var (
+	errUnsupportedKey = errors.New("unsupported DMS key algorithm")
+	errKeyMismatch    = errors.New("renewed DMS certificate does not match the generated key")
+)
+
+// Store holds the active DMS certificate. SetCredentials validates cert
+// and, as long as current is still active, activates it without restarting
+// the clients that use it and calls persist under the lock that serialises
+// it with configuration changes, restoring current if persist fails.
+type Store interface {
+	Credentials() *tls.Certificate
+	SetCredentials(current *tls.Certificate, cert tls.Certificate, persist func() error) error
+}
+
+// Rotator watches the expiry of the active DMS certificate and, once it is
+// within renewBefore of it, renews it for a new key through the
+// re-enrollment operation of the enrollment backend.
+type Rotator struct {
+	store       Store
+	enroller    client.Enroller
+	keyFile     string
+	caName      string
+	renewBefore time.Duration
+	interval    time.Duration
+	expiryDays  metrics.Gauge
+	rotations   metrics.Counter
+	logger      log.Logger
+}
+
+// NewRotator returns a Rotator renewing the certificate of store with caName
+// of enroller and persisting it with its key to keyFile. expiryDays is set to the
+// days left before the active certificate expires, and rotations counts
+// renewals by outcome in the error label.
+func NewRotator(store Store, enroller client.Enroller, keyFile string, caName string, renewBefore time.Duration, interval time.Duration, expiryDays metrics.Gauge, rotations metrics.Counter, logger log.Logger) *Rotator {
+	if renewBefore <= 0 {
+		renewBefore = DefaultRenewBefore
+	}
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Rotator{
+		store:       store,
+		enroller:    enroller,
+		keyFile:     keyFile,
+		caName:      caName,
+		renewBefore: renewBefore,
+		interval:    interval,
+		expiryDays:  expiryDays,
+		rotations:   rotations,
+		logger:      logger,
+	}
+}
+
+// Run checks the certificate every interval until ctx is done. Failed
+// renewals are retried on the next check.
+func (r *Rotator) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Check(ctx); err != nil {
+			level.Error(r.logger).Log("err", err, "msg", "Could not renew DMS certificate")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check reports the days left before the active certificate expires and
+// renews it when it is within the renewal window. Nothing is done until a
+// certificate is configured.
+func (r *Rotator) Check(ctx context.Context) error {
+	current := r.store.Credentials()
+	if current == nil || len(current.Certificate) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(current.Certificate[0])
+	if err != nil {
+		return err
+	}
+	r.expiryDays.Set(time.Until(leaf.NotAfter).Hours() / 24)
+	if time.Until(leaf.NotAfter) > r.renewBefore {
+		return nil
+	}
+
+	level.Info(r.logger).Log("msg", "Renewing DMS certificate", "serial", utils.SerialNumber(leaf.SerialNumber), "not_after", leaf.NotAfter)
+	renewed, err := r.rotate(ctx, current, leaf)
+	r.rotations.With("error", fmt.Sprint(err != nil)).Add(1)
+	if err != nil {
+		return err
+	}
+	r.expiryDays.Set(time.Until(renewed.NotAfter).Hours() / 24)
+	level.Info(r.logger).Log("msg", "DMS certificate renewed", "serial", utils.SerialNumber(renewed.SerialNumber), "not_after", renewed.NotAfter)
+	return nil
+}
+
+// rotate renews leaf for a new key of the same algorithm and size. The
+// renewed certificate chain and its key are staged together next to
+// keyFile and replace it in a single rename once the certificate has been
+// activated, so keyFile always holds a pair the DMS has used.
+func (r *Rotator) rotate(ctx context.Context, current *tls.Certificate, leaf *x509.Certificate) (*x509.Certificate, error) {
+	keyAlg, keySize, err := keyParams(leaf.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := memory.NewProvider().GenerateKey(ctx, keyAlg, keySize)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:        leaf.Subject,
+		DNSNames:       leaf.DNSNames,
+		EmailAddresses: leaf.EmailAddresses,
+		IPAddresses:    leaf.IPAddresses,
+		URIs:           leaf.URIs,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, enrollTimeout)
+	defer cancel()
+	crt, err := r.enroller.Reenroll(ctx, csr, leaf, r.caName)
+	if err != nil {
+		return nil, err
+	}
+	if !publicKeyEqual(crt.PublicKey, key.Public()) {
+		return nil, errKeyMismatch
+	}
+
+	private, err := key.Export()
+	if err != nil {
+		return nil, err
+	}
+	renewed := tls.Certificate{Certificate: [][]byte{crt.Raw}, PrivateKey: private}
+	renewed.Certificate = append(renewed.Certificate, current.Certificate[1:]...)
+	bundle, err := pemBundle(renewed)
+	if err != nil {
+		return nil, err
+	}
+	staged, err := stageFile(r.keyFile, bundle)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(staged)
+
+	err = r.store.SetCredentials(current, renewed, func() error {
+		return os.Rename(staged, r.keyFile)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return crt, nil
+}
+
+// LoadCredentials returns the DMS certificate chain and key persisted to
+// keyFile by a renewal, or nil when keyFile is missing or only holds a key.
+func LoadCredentials(keyFile string) (*tls.Certificate, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !hasCertificate(data) {
+		return nil, nil
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// pemBundle encodes the certificate chain of cert followed by its key.
+func pemBundle(cert tls.Certificate) ([]byte, error) {
+	var bundle []byte
+	for _, der := range cert.Certificate {
+		bundle = append(bundle, utils.PEMCert(der)...)
+	}
+	keyPEM, err := utils.PEMKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(bundle, keyPEM...), nil
+}
+
+func hasCertificate(data []byte) bool {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return false
+		}
+		if block.Type == utils.CertPEMBlockType {
+			return true
+		}
+	}
+}
+
+// stageFile writes data to a new file in the directory of file, synced to
+// disk, so it can atomically replace file with a rename.
+func stageFile(file string, data []byte) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func keyParams(pub crypto.PublicKey) (string, int, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return "RSA", pub.N.BitLen(), nil
+	case *ecdsa.PublicKey:
+		return "EC", pub.Curve.Params().BitSize, nil
+	case ed25519.PublicKey:
+		return "Ed25519", 0, nil
+	default:
+		return "", 0, errUnsupportedKey
+	}
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
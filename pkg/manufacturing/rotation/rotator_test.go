@@ -0,0 +1,307 @@
+package rotation
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/manufacturing/utils"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/generic"
+)
+
+var errChanged = errors.New("certificate changed")
+
+// fakeStore swaps certificates like the DMS client. replacement, when set,
+// is activated before the renewed certificate, as by a concurrent
+// configuration.
+type fakeStore struct {
+	current     *tls.Certificate
+	replacement *tls.Certificate
+	err         error
+}
+
+func (s *fakeStore) Credentials() *tls.Certificate {
+	return s.current
+}
+
+func (s *fakeStore) SetCredentials(current *tls.Certificate, cert tls.Certificate, persist func() error) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.replacement != nil {
+		s.current = s.replacement
+	}
+	if s.current != current {
+		return errChanged
+	}
+	s.current = &cert
+	if err := persist(); err != nil {
+		s.current = current
+		return err
+	}
+	return nil
+}
+
+type fakeEnroller struct {
+	ca    *x509.Certificate
+	caKey crypto.Signer
+	err   error
+}
+
+func (e *fakeEnroller) SetCredentials(authCRT []tls.Certificate) {}
+
+func (e *fakeEnroller) Enroll(ctx context.Context, csr *x509.CertificateRequest, caName string) (*x509.Certificate, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (e *fakeEnroller) Reenroll(ctx context.Context, csr *x509.CertificateRequest, current *x509.Certificate, caName string) (*x509.Certificate, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	if csr.Subject.CommonName != current.Subject.CommonName {
+		return nil, errors.New("subject changed")
+	}
+	return issue(e.ca, e.caKey, csr.Subject, csr.PublicKey, time.Now().Add(365*24*time.Hour))
+}
+
+func (e *fakeEnroller) CACerts(ctx context.Context, caName string) ([]*x509.Certificate, error) {
+	return []*x509.Certificate{e.ca}, nil
+}
+
+// fakeCounter records the error label of the rotations counted.
+type fakeCounter struct {
+	labels *[]string
+}
+
+func (c fakeCounter) With(labelValues ...string) metrics.Counter {
+	*c.labels = append(*c.labels, labelValues[len(labelValues)-1])
+	return c
+}
+
+func (c fakeCounter) Add(delta float64) {}
+
+func issue(parent *x509.Certificate, parentKey crypto.Signer, subject pkix.Name, pub crypto.PublicKey, notAfter time.Time) (*x509.Certificate, error) {
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// testSetup returns a CA, the DMS certificate it issued expiring at
+// notAfter and a key file holding a placeholder for its key.
+func testSetup(t *testing.T, notAfter time.Time) (*fakeEnroller, *fakeStore, string) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate CA key")
+	}
+	ca, err := issue(nil, caKey, pkix.Name{CommonName: "DMS CA"}, caKey.Public(), time.Now().Add(2*365*24*time.Hour))
+	if err != nil {
+		t.Fatal("Unable to create CA certificate")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate key")
+	}
+	crt, err := issue(ca, caKey, pkix.Name{CommonName: "dms"}, key.Public(), notAfter)
+	if err != nil {
+		t.Fatal("Unable to create certificate")
+	}
+	keyFile := filepath.Join(t.TempDir(), "dms.key")
+	if err := ioutil.WriteFile(keyFile, []byte("old key"), 0600); err != nil {
+		t.Fatal("Unable to write key file")
+	}
+	store := &fakeStore{current: &tls.Certificate{Certificate: [][]byte{crt.Raw, ca.Raw}, PrivateKey: key}}
+	return &fakeEnroller{ca: ca, caKey: caKey}, store, keyFile
+}
+
+func TestCheck(t *testing.T) {
+	errEnroll := errors.New("enrollment server unavailable")
+	errStore := errors.New("certificate rejected")
+
+	testCases := []struct {
+		name     string
+		notAfter time.Time
+		enroll   error
+		store    error
+		rotated  bool
+		counted  string
+		ret      error
+	}{
+		{"Certificate is outside the renewal window", time.Now().Add(60 * 24 * time.Hour), nil, nil, false, "", nil},
+		{"Certificate is within the renewal window", time.Now().Add(10 * 24 * time.Hour), nil, nil, true, "false", nil},
+		{"Enrollment server fails", time.Now().Add(10 * 24 * time.Hour), errEnroll, nil, false, "true", errEnroll},
+		{"Renewed certificate is rejected", time.Now().Add(10 * 24 * time.Hour), nil, errStore, false, "true", errStore},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			enroller, store, keyFile := testSetup(t, tc.notAfter)
+			enroller.err = tc.enroll
+			store.err = tc.store
+			old := store.current
+			expiryDays := generic.NewGauge("expiry_days")
+			var labels []string
+			rotations := fakeCounter{labels: &labels}
+			r := NewRotator(store, enroller, keyFile, "dms", 0, 0, expiryDays, rotations, log.NewNopLogger())
+
+			err := r.Check(context.Background())
+			if err != tc.ret {
+				t.Fatalf("Got result is %v; want %v", err, tc.ret)
+			}
+			if got := store.current != old; got != tc.rotated {
+				t.Errorf("Got certificate swapped is %t; want %t", got, tc.rotated)
+			}
+			if got := strings.Join(labels, ","); got != tc.counted {
+				t.Errorf("Got rotations counted with error %q; want %q", got, tc.counted)
+			}
+
+			data, err := ioutil.ReadFile(keyFile)
+			if err != nil {
+				t.Fatal("Unable to read key file")
+			}
+			if got := string(data) != "old key"; got != tc.rotated {
+				t.Errorf("Got key file replaced is %t; want %t", got, tc.rotated)
+			}
+			files, _ := ioutil.ReadDir(filepath.Dir(keyFile))
+			if len(files) != 1 {
+				t.Errorf("Got %d files next to the key file; want 1", len(files))
+			}
+			if !tc.rotated {
+				return
+			}
+
+			persisted, err := LoadCredentials(keyFile)
+			if err != nil || persisted == nil {
+				t.Fatalf("Got key file does not hold the renewed certificate: %v", err)
+			}
+			if !reflect.DeepEqual(persisted.Certificate, store.current.Certificate) {
+				t.Error("Got persisted chain is not the renewed one")
+			}
+			if len(store.current.Certificate) != 2 {
+				t.Errorf("Got chain of %d certificates; want 2", len(store.current.Certificate))
+			}
+			if days := expiryDays.Value(); days < 364 {
+				t.Errorf("Got expiry days is %f; want about 365", days)
+			}
+		})
+	}
+}
+
+func TestCheckKeyFileNotReplaced(t *testing.T) {
+	enroller, store, keyFile := testSetup(t, time.Now().Add(10*24*time.Hour))
+	old := store.current
+	// A directory cannot be replaced by renaming a file over it.
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatal("Unable to remove key file")
+	}
+	if err := os.MkdirAll(filepath.Join(keyFile, "dir"), 0700); err != nil {
+		t.Fatal("Unable to create directory")
+	}
+	var labels []string
+	r := NewRotator(store, enroller, keyFile, "dms", 0, 0, generic.NewGauge("expiry_days"), fakeCounter{labels: &labels}, log.NewNopLogger())
+
+	if err := r.Check(context.Background()); err == nil {
+		t.Fatal("Got result is nil; want error")
+	}
+	if store.current != old {
+		t.Error("Got renewed certificate is active; want it rolled back")
+	}
+	files, _ := ioutil.ReadDir(filepath.Dir(keyFile))
+	if len(files) != 1 {
+		t.Errorf("Got %d files next to the key file; want 1", len(files))
+	}
+}
+
+func TestCheckConcurrentConfig(t *testing.T) {
+	enroller, store, keyFile := testSetup(t, time.Now().Add(10*24*time.Hour))
+	replacement := &tls.Certificate{Certificate: store.current.Certificate, PrivateKey: store.current.PrivateKey}
+	store.replacement = replacement
+	var labels []string
+	r := NewRotator(store, enroller, keyFile, "dms", 0, 0, generic.NewGauge("expiry_days"), fakeCounter{labels: &labels}, log.NewNopLogger())
+
+	if err := r.Check(context.Background()); err != errChanged {
+		t.Fatalf("Got result is %v; want %v", err, errChanged)
+	}
+	if store.current != replacement {
+		t.Error("Got certificate set by the configuration is replaced")
+	}
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil || string(data) != "old key" {
+		t.Error("Got key file replaced; want it unchanged")
+	}
+}
+
+func TestLoadCredentials(t *testing.T) {
+	_, store, keyFile := testSetup(t, time.Now().Add(10*24*time.Hour))
+	if cert, err := LoadCredentials(filepath.Join(filepath.Dir(keyFile), "missing.key")); err != nil || cert != nil {
+		t.Errorf("Got result is %v, %v for a missing file; want nil, nil", cert, err)
+	}
+
+	keyPEM, err := utils.PEMKey(store.current.PrivateKey)
+	if err != nil {
+		t.Fatal("Unable to encode key")
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal("Unable to write key file")
+	}
+	if cert, err := LoadCredentials(keyFile); err != nil || cert != nil {
+		t.Errorf("Got result is %v, %v for a key file; want nil, nil", cert, err)
+	}
+
+	bundle, err := pemBundle(*store.current)
+	if err != nil {
+		t.Fatal("Unable to encode bundle")
+	}
+	if err := ioutil.WriteFile(keyFile, bundle, 0600); err != nil {
+		t.Fatal("Unable to write key file")
+	}
+	cert, err := LoadCredentials(keyFile)
+	if err != nil || cert == nil {
+		t.Fatalf("Got result is %v, %v; want the persisted certificate", cert, err)
+	}
+	if !reflect.DeepEqual(cert.Certificate, store.current.Certificate) {
+		t.Error("Got loaded chain is not the persisted one")
+	}
+
+	other, _, _ := testSetup(t, time.Now().Add(10*24*time.Hour))
+	mismatched := append(utils.PEMCert(other.ca.Raw), keyPEM...)
+	if err := ioutil.WriteFile(keyFile, mismatched, 0600); err != nil {
+		t.Fatal("Unable to write key file")
+	}
+	if _, err := LoadCredentials(keyFile); err == nil {
+		t.Error("Got result is nil for a certificate of another key; want error")
+	}
+}
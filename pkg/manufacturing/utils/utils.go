@@ -1,19 +1,28 @@
 package utils
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/big"
+	"strings"
 )
 
 const (
-	CertPEMBlockType = "CERTIFICATE"
-	KeyPEMBlockType  = "RSA PRIVATE KEY"
-	CSRPEMBlockType  = "CERTIFICATE REQUEST"
-	PublicKeyHeader  = "-----BEGIN PUBLIC KEY-----"
-	PublicKeyFooter  = "-----END PUBLIC KEY-----"
+	CertPEMBlockType         = "CERTIFICATE"
+	KeyPEMBlockType          = "RSA PRIVATE KEY"
+	ECKeyPEMBlockType        = "EC PRIVATE KEY"
+	PKCS8KeyPEMBlockType     = "PRIVATE KEY"
+	EncryptedKeyPEMBlockType = "ENCRYPTED PRIVATE KEY"
+	CSRPEMBlockType          = "CERTIFICATE REQUEST"
+	PublicKeyHeader          = "-----BEGIN PUBLIC KEY-----"
+	PublicKeyFooter          = "-----END PUBLIC KEY-----"
 )
 
 func PEMCSR(derBytes []byte) []byte {
@@ -26,14 +35,31 @@ func PEMCSR(derBytes []byte) []byte {
 	return out
 }
 
-func PEMKey(derBytes []byte) []byte {
-	pemBlock := &pem.Block{
-		Type:    KeyPEMBlockType,
-		Headers: nil,
-		Bytes:   derBytes,
+// PEMKey encodes a private key in the traditional format of its algorithm,
+// PKCS#1 for RSA keys and SEC 1 for EC keys, with the matching block type.
+// Ed25519 keys, which have no traditional format, are encoded as PKCS#8.
+func PEMKey(key crypto.PrivateKey) ([]byte, error) {
+	var pemBlock *pem.Block
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		pemBlock = &pem.Block{Type: KeyPEMBlockType, Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case *ecdsa.PrivateKey:
+		derBytes, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		pemBlock = &pem.Block{Type: ECKeyPEMBlockType, Bytes: derBytes}
+	case ed25519.PrivateKey:
+		derBytes, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		pemBlock = &pem.Block{Type: PKCS8KeyPEMBlockType, Bytes: derBytes}
+	default:
+		return nil, errors.New("unsupported private key type")
 	}
 	out := pem.EncodeToMemory(pemBlock)
-	return out
+	return out, nil
 }
 
 func PEMCert(derBytes []byte) []byte {
@@ -88,3 +114,17 @@ func ParseCertificate(data []byte) (*x509.Certificate, error) {
 	}
 	return crt, nil
 }
+
+// SerialNumber formats a certificate serial number as colon separated
+// hexadecimal bytes.
+func SerialNumber(serial *big.Int) string {
+	b := serial.Bytes()
+	if len(b) == 0 {
+		b = []byte{0}
+	}
+	hex := make([]string, len(b))
+	for i, v := range b {
+		hex[i] = fmt.Sprintf("%02x", v)
+	}
+	return strings.Join(hex, ":")
+}
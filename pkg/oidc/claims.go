@@ -0,0 +1,148 @@
+package oidc
+
+import (
+	"encoding/json"
+	"strings"
+
+	stdjwt "github.com/dgrijalva/jwt-go"
+)
+
+// DefaultUsernameClaim and DefaultRolesClaims map the claims of Keycloak
+// tokens, used when a ClaimMapping leaves them empty.
+var (
+	DefaultUsernameClaim = "preferred_username"
+	DefaultRolesClaims   = []string{"realm_access.roles", "resource_access.*.roles"}
+)
+
+// Claims are the claims of a token issued by any OIDC provider. Username
+// and Roles are not read from the token but resolved by a ClaimMapping
+// once it is verified.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+
+	Username string                 `json:"-"`
+	Roles    []string               `json:"-"`
+	Raw      map[string]interface{} `json:"-"`
+}
+
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	type claims Claims
+	if err := json.Unmarshal(data, (*claims)(c)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &c.Raw)
+}
+
+// Valid checks the time based claims.
+func (c *Claims) Valid() error {
+	return stdjwt.StandardClaims{ExpiresAt: c.ExpiresAt, NotBefore: c.NotBefore, IssuedAt: c.IssuedAt}.Valid()
+}
+
+// HasRole reports whether role is one of the resolved roles.
+func (c *Claims) HasRole(role string) bool {
+	if role == "" {
+		return false
+	}
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// ClaimMapping names the claims holding the username and roles of a token.
+// Claims are dot separated paths into nested objects. A * segment matches
+// every key of an object and prefixes the roles found under it with the key
+// and a colon, so resource_access.*.roles maps the Keycloak client roles
+// to client:role.
+type ClaimMapping struct {
+	UsernameClaim string
+	RolesClaims   []string
+}
+
+// Resolve sets the Username and Roles of c from its raw claims.
+func (m ClaimMapping) Resolve(c *Claims) {
+	usernameClaim := m.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = DefaultUsernameClaim
+	}
+	rolesClaims := m.RolesClaims
+	if len(rolesClaims) == 0 {
+		rolesClaims = DefaultRolesClaims
+	}
+
+	c.Username = ""
+	for _, v := range lookup(c.Raw, strings.Split(usernameClaim, "."), "") {
+		c.Username = v
+		break
+	}
+	c.Roles = nil
+	for _, claim := range rolesClaims {
+		c.Roles = append(c.Roles, lookup(c.Raw, strings.Split(claim, "."), "")...)
+	}
+}
+
+// lookup returns the strings found at path in v, prefixed with the keys
+// matched by * segments.
+func lookup(v interface{}, path []string, prefix string) []string {
+	if len(path) == 0 {
+		switch v := v.(type) {
+		case string:
+			return []string{prefix + v}
+		case []interface{}:
+			var values []string
+			for _, e := range v {
+				if s, ok := e.(string); ok {
+					values = append(values, prefix+s)
+				}
+			}
+			return values
+		}
+		return nil
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if path[0] != "*" {
+		return lookup(obj[path[0]], path[1:], prefix)
+	}
+	var values []string
+	for key, e := range obj {
+		values = append(values, lookup(e, path[1:], prefix+key+":")...)
+	}
+	return values
+}
+
+// Audience is the aud claim, a single string or an array of strings.
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Contains reports whether aud is one of the audiences.
+func (a Audience) Contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	token := `{"sub":"0c6d","preferred_username":"operator","email":"operator@example.com","groups":["operators"],"realm_access":{"roles":["operator"]},"resource_access":{"lamassu-dms":{"roles":["auditor"]},"account":{"roles":["view-profile"]}}}`
+	testCases := []struct {
+		name     string
+		mapping  ClaimMapping
+		username string
+		roles    map[string]bool
+	}{
+		{"Default mapping", ClaimMapping{}, "operator", map[string]bool{
+			"operator":             true,
+			"auditor":              false,
+			"lamassu-dms:auditor":  true,
+			"lamassu-dms:operator": false,
+			"account:view-profile": true,
+			"unknown:auditor":      false,
+			"":                     false,
+		}},
+		{"Custom mapping", ClaimMapping{UsernameClaim: "email", RolesClaims: []string{"groups", "realm_access.roles"}}, "operator@example.com", map[string]bool{
+			"operators":           true,
+			"operator":            true,
+			"lamassu-dms:auditor": false,
+		}},
+		{"Missing claims", ClaimMapping{UsernameClaim: "upn", RolesClaims: []string{"roles"}}, "", map[string]bool{
+			"operator": false,
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			var claims Claims
+			if err := json.Unmarshal([]byte(token), &claims); err != nil {
+				t.Fatalf("Could not parse claims: %s", err)
+			}
+			tc.mapping.Resolve(&claims)
+			if claims.Username != tc.username {
+				t.Errorf("Got username is %q; want %q", claims.Username, tc.username)
+			}
+			for role, want := range tc.roles {
+				if ret := claims.HasRole(role); ret != want {
+					t.Errorf("Got result for role %q is %t; want %t", role, ret, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAudience(t *testing.T) {
+	testCases := []struct {
+		name string
+		data string
+		want Audience
+	}{
+		{"Single audience", `"enroller"`, Audience{"enroller"}},
+		{"Audience list", `["enroller","account"]`, Audience{"enroller", "account"}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			var aud Audience
+			if err := json.Unmarshal([]byte(tc.data), &aud); err != nil {
+				t.Fatalf("Got error is %s; want nil", err)
+			}
+			if fmt.Sprint(aud) != fmt.Sprint(tc.want) {
+				t.Errorf("Got result is %v; want %v", aud, tc.want)
+			}
+			if !aud.Contains("enroller") {
+				t.Error("Got audience does not contain enroller")
+			}
+		})
+	}
+}
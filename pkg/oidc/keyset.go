@@ -0,0 +1,327 @@
+// Package oidc validates JWTs with the signing keys an OpenID Connect
+// provider publishes in the JWKS of its discovery document.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/device-manufacturing-system/pkg/apierrors"
+)
+
+const (
+	// DefaultTTL is how long the keys are used before they are fetched
+	// again when no TTL is configured.
+	DefaultTTL = 10 * time.Minute
+
+	// minRefreshInterval bounds how often tokens signed with unknown keys
+	// trigger a refresh.
+	minRefreshInterval = 10 * time.Second
+)
+
+var (
+	ErrUnknownKey         = apierrors.New(apierrors.Unauthenticated, "token signed with an unknown key")
+	ErrAlgorithmMismatch  = apierrors.New(apierrors.Unauthenticated, "token signing algorithm does not match its key")
+	errDiscovery          = apierrors.New(apierrors.UpstreamUnavailable, "unable to obtain OIDC discovery document")
+	errKeySet             = apierrors.New(apierrors.UpstreamUnavailable, "unable to obtain OIDC signing keys")
+	errNoKeys             = apierrors.New(apierrors.UpstreamUnavailable, "OIDC provider publishes no signing keys")
+	errUnsupportedKeyType = errors.New("unsupported JWK key type")
+)
+
+// Discovery is the part of the OpenID Provider configuration used to
+// validate tokens.
+type Discovery struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// jwk is a public JSON Web Key (RFC 7517) of an RSA or EC key.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type key struct {
+	alg string
+	pub crypto.PublicKey
+}
+
+// KeySet caches the signing keys of a provider for a TTL. A token signed
+// with a key that is not in the cache refreshes it, so rotated keys are
+// picked up before the TTL expires. Keys are fetched without holding the
+// lock of the set, and concurrent refreshes share a single fetch.
+type KeySet struct {
+	discoveryURL string
+	client       *http.Client
+	ttl          time.Duration
+
+	mtx         sync.Mutex
+	issuer      string
+	keys        map[string]key
+	fetched     time.Time
+	lastRefresh time.Time
+	refreshErr  error
+	// refreshing is closed when the refresh in progress, if any, completes.
+	refreshing chan struct{}
+}
+
+// NewKeySet returns the key set of the provider with the discovery document
+// at discoveryURL. Keys are fetched on first use.
+func NewKeySet(discoveryURL string, client *http.Client, ttl time.Duration) *KeySet {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &KeySet{discoveryURL: discoveryURL, client: client, ttl: ttl}
+}
+
+// Issuer returns the issuer of the discovery document.
+func (s *KeySet) Issuer() (string, error) {
+	if err := s.refreshIfStale(context.Background()); err != nil {
+		return "", err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.issuer, nil
+}
+
+// Key returns the public key with ID kid to verify a token signed with alg.
+// An empty kid is accepted when the set has a single key.
+func (s *KeySet) Key(kid, alg string) (crypto.PublicKey, error) {
+	ctx := context.Background()
+	if err := s.refreshIfStale(ctx); err != nil {
+		return nil, err
+	}
+	s.mtx.Lock()
+	k, ok := s.lookup(kid)
+	unknown := !ok && time.Since(s.lastRefresh) >= minRefreshInterval
+	s.mtx.Unlock()
+	if unknown {
+		if err := s.refresh(ctx); err != nil {
+			return nil, err
+		}
+		s.mtx.Lock()
+		k, ok = s.lookup(kid)
+		s.mtx.Unlock()
+	}
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if !matches(k, alg) {
+		return nil, ErrAlgorithmMismatch
+	}
+	return k.pub, nil
+}
+
+// Check reports whether the keys can be retrieved from the provider. It
+// refreshes them when stale, within ctx, and fails while the last refresh
+// failed, even if stale keys are still used to validate tokens.
+func (s *KeySet) Check(ctx context.Context) error {
+	if err := s.refreshIfStale(ctx); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.refreshErr != nil {
+		return s.refreshErr
+	}
+	if len(s.keys) == 0 {
+		return errNoKeys
+	}
+	return nil
+}
+
+// lookup must be called with the lock held.
+func (s *KeySet) lookup(kid string) (key, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, k := range s.keys {
+			return k, true
+		}
+	}
+	k, ok := s.keys[kid]
+	return k, ok
+}
+
+// refreshIfStale fetches the keys when the TTL expired. Stale keys are kept
+// while the provider cannot be reached.
+func (s *KeySet) refreshIfStale(ctx context.Context) error {
+	s.mtx.Lock()
+	fresh := s.keys != nil && (time.Since(s.fetched) < s.ttl || time.Since(s.lastRefresh) < minRefreshInterval)
+	s.mtx.Unlock()
+	if fresh {
+		return nil
+	}
+	err := s.refresh(ctx)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err != nil && s.keys == nil {
+		return err
+	}
+	return nil
+}
+
+// refresh fetches the keys, or waits for the refresh already in progress
+// and returns its result.
+func (s *KeySet) refresh(ctx context.Context) error {
+	s.mtx.Lock()
+	if done := s.refreshing; done != nil {
+		s.mtx.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		return s.refreshErr
+	}
+	done := make(chan struct{})
+	s.refreshing = done
+	s.lastRefresh = time.Now()
+	s.mtx.Unlock()
+
+	issuer, keys, err := s.fetch(ctx)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err == nil {
+		s.issuer, s.keys, s.fetched = issuer, keys, time.Now()
+	}
+	s.refreshErr = err
+	s.refreshing = nil
+	close(done)
+	return err
+}
+
+func (s *KeySet) fetch(ctx context.Context) (string, map[string]key, error) {
+	var d Discovery
+	if err := s.get(ctx, s.discoveryURL, &d); err != nil || d.JWKSURI == "" {
+		return "", nil, errDiscovery
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := s.get(ctx, d.JWKSURI, &set); err != nil {
+		return "", nil, errKeySet
+	}
+	keys := make(map[string]key)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key{alg: k.Alg, pub: pub}
+	}
+	return d.Issuer, keys, nil
+}
+
+func (s *KeySet) get(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	r, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if err := apierrors.FromResponse("OIDC provider", r); err != nil {
+		return err
+	}
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent in JWK %q", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve := curves[k.Crv]
+		if curve == nil {
+			return nil, fmt.Errorf("unsupported curve %q in JWK %q", k.Crv, k.Kid)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid EC point in JWK %q", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, errUnsupportedKeyType
+	}
+}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// ecAlgorithms are the curves of the ES algorithms.
+var ecAlgorithms = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+// matches reports whether the key can verify signatures of alg.
+func matches(k key, alg string) bool {
+	if k.alg != "" && k.alg != alg {
+		return false
+	}
+	switch pub := k.pub.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+			return true
+		}
+	case *ecdsa.PublicKey:
+		return ecAlgorithms[alg] == pub.Curve.Params().Name
+	}
+	return false
+}
@@ -0,0 +1,281 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type provider struct {
+	srv *httptest.Server
+
+	mtx      sync.Mutex
+	keys     []jwk
+	requests int
+	gate     chan struct{}
+	held     chan struct{}
+}
+
+func newProvider(t *testing.T, keys ...jwk) *provider {
+	t.Helper()
+	p := &provider{keys: keys}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Discovery{Issuer: p.srv.URL, JWKSURI: p.srv.URL + "/certs"})
+	})
+	mux.HandleFunc("/certs", func(w http.ResponseWriter, r *http.Request) {
+		p.mtx.Lock()
+		gate, held := p.gate, p.held
+		p.mtx.Unlock()
+		if gate != nil {
+			held <- struct{}{}
+			<-gate
+		}
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		p.requests++
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": p.keys})
+	})
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+func (p *provider) rotate(keys ...jwk) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.keys = keys
+}
+
+// hold makes JWKS requests wait until release is called. Every held request
+// is signalled on the returned channel.
+func (p *provider) hold() (held <-chan struct{}, release func()) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.gate = make(chan struct{})
+	p.held = make(chan struct{}, 16)
+	gate := p.gate
+	var once sync.Once
+	return p.held, func() { once.Do(func() { close(gate) }) }
+}
+
+func (p *provider) keySet(ttl time.Duration) *KeySet {
+	return NewKeySet(p.srv.URL+"/.well-known/openid-configuration", p.srv.Client(), ttl)
+}
+
+func rsaJWK(t *testing.T, kid string) (jwk, *rsa.PublicKey) {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Unable to generate RSA key")
+	}
+	return jwk{Kid: kid, Kty: "RSA", Alg: "RS256", Use: "sig", N: encodeInt(k.N), E: encodeInt(big.NewInt(int64(k.E)))}, &k.PublicKey
+}
+
+func ecJWK(t *testing.T, kid string) (jwk, *ecdsa.PublicKey) {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate EC key")
+	}
+	return jwk{Kid: kid, Kty: "EC", Crv: "P-256", X: encodeInt(k.X), Y: encodeInt(k.Y)}, &k.PublicKey
+}
+
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func TestKey(t *testing.T) {
+	rsaKey, rsaPub := rsaJWK(t, "rsa")
+	ecKey, ecPub := ecJWK(t, "ec")
+	encKey, _ := rsaJWK(t, "enc")
+	encKey.Use = "enc"
+	s := newProvider(t, rsaKey, ecKey, encKey).keySet(time.Hour)
+
+	testCases := []struct {
+		name string
+		kid  string
+		alg  string
+		want interface{}
+		err  error
+	}{
+		{"RSA key", "rsa", "RS256", rsaPub, nil},
+		{"EC key", "ec", "ES256", ecPub, nil},
+		{"Algorithm not in JWK", "rsa", "RS512", nil, ErrAlgorithmMismatch},
+		{"EC key with RSA algorithm", "ec", "RS256", nil, ErrAlgorithmMismatch},
+		{"EC key with other curve", "ec", "ES384", nil, ErrAlgorithmMismatch},
+		{"Encryption key", "enc", "RS256", nil, ErrUnknownKey},
+		{"Unknown key", "unknown", "RS256", nil, ErrUnknownKey},
+		{"Missing kid with several keys", "", "RS256", nil, ErrUnknownKey},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			key, err := s.Key(tc.kid, tc.alg)
+			if err != tc.err {
+				t.Fatalf("Got error is %v; want %v", err, tc.err)
+			}
+			if tc.want == nil {
+				return
+			}
+			switch want := tc.want.(type) {
+			case *rsa.PublicKey:
+				if !want.Equal(key) {
+					t.Error("Got key is not the RSA key of the JWKS")
+				}
+			case *ecdsa.PublicKey:
+				if !want.Equal(key) {
+					t.Error("Got key is not the EC key of the JWKS")
+				}
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey, _ := rsaJWK(t, "old")
+	newKey, newPub := rsaJWK(t, "new")
+	p := newProvider(t, oldKey)
+	s := p.keySet(time.Hour)
+
+	if _, err := s.Key("", "RS256"); err != nil {
+		t.Fatalf("Got error is %s; want key of the single key set", err)
+	}
+	p.rotate(oldKey, newKey)
+	s.lastRefresh = time.Now().Add(-minRefreshInterval)
+
+	key, err := s.Key("new", "RS256")
+	if err != nil {
+		t.Fatalf("Got error is %s; want rotated key", err)
+	}
+	if !newPub.Equal(key) {
+		t.Error("Got key is not the rotated key")
+	}
+	if p.requests != 2 {
+		t.Errorf("Got %d JWKS requests; want 2", p.requests)
+	}
+
+	if _, err := s.Key("unknown", "RS256"); err != ErrUnknownKey {
+		t.Errorf("Got error is %v; want %v", err, ErrUnknownKey)
+	}
+	if p.requests != 2 {
+		t.Errorf("Got %d JWKS requests; want unknown keys to be rate limited", p.requests)
+	}
+}
+
+func TestStaleKeys(t *testing.T) {
+	k, _ := rsaJWK(t, "rsa")
+	p := newProvider(t, k)
+	s := p.keySet(time.Millisecond)
+
+	if _, err := s.Key("rsa", "RS256"); err != nil {
+		t.Fatalf("Got error is %s; want key", err)
+	}
+	p.srv.Close()
+	s.lastRefresh = time.Time{}
+
+	if _, err := s.Key("rsa", "RS256"); err != nil {
+		t.Errorf("Got error is %s; want stale key while the provider is down", err)
+	}
+}
+
+func TestProviderUnavailable(t *testing.T) {
+	p := newProvider(t)
+	s := p.keySet(time.Hour)
+	p.srv.Close()
+
+	if _, err := s.Key("rsa", "RS256"); err != errDiscovery {
+		t.Errorf("Got error is %v; want %v", err, errDiscovery)
+	}
+	if _, err := s.Issuer(); err != errDiscovery {
+		t.Errorf("Got error is %v; want %v", err, errDiscovery)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	k, _ := rsaJWK(t, "rsa")
+	p := newProvider(t, k)
+	s := p.keySet(time.Millisecond)
+
+	if err := s.Check(context.Background()); err != nil {
+		t.Fatalf("Got error is %s; want nil", err)
+	}
+	p.srv.Close()
+	s.fetched, s.lastRefresh = time.Time{}, time.Time{}
+
+	if err := s.Check(context.Background()); err != errDiscovery {
+		t.Errorf("Got error is %v; want %v while the provider is down", err, errDiscovery)
+	}
+	if _, err := s.Key("rsa", "RS256"); err != nil {
+		t.Errorf("Got error is %s; want stale key while the provider is down", err)
+	}
+
+	empty := newProvider(t).keySet(time.Hour)
+	if err := empty.Check(context.Background()); err != errNoKeys {
+		t.Errorf("Got error is %v; want %v", err, errNoKeys)
+	}
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	k, _ := rsaJWK(t, "rsa")
+	p := newProvider(t, k)
+	s := p.keySet(time.Hour)
+	held, release := p.hold()
+	defer release()
+
+	errs := make(chan error, 3)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := s.Key("rsa", "RS256")
+			errs <- err
+		}()
+	}
+	<-held
+	time.Sleep(10 * time.Millisecond)
+	release()
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Got error is %s; want key of the shared refresh", err)
+		}
+	}
+	if p.requests != 1 {
+		t.Errorf("Got %d JWKS requests; want concurrent refreshes to share 1", p.requests)
+	}
+}
+
+func TestRefreshOutsideLock(t *testing.T) {
+	k, _ := rsaJWK(t, "rsa")
+	p := newProvider(t, k)
+	s := p.keySet(time.Hour)
+	if _, err := s.Key("rsa", "RS256"); err != nil {
+		t.Fatalf("Got error is %s; want key of the key set", err)
+	}
+	held, release := p.hold()
+	defer release()
+	s.mtx.Lock()
+	s.fetched, s.lastRefresh = time.Time{}, time.Time{}
+	s.mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.Check(ctx) }()
+	<-held
+
+	if _, err := s.Key("rsa", "RS256"); err != nil {
+		t.Errorf("Got error is %s; want cached key while the refresh is pending", err)
+	}
+	if err := <-done; err != errKeySet {
+		t.Errorf("Got error is %v; want %v once the context expires", err, errKeySet)
+	}
+}
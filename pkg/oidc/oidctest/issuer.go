@@ -0,0 +1,131 @@
+// Package oidctest provides a fake OIDC provider to test token validation
+// without a running identity server.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	stdjwt "github.com/dgrijalva/jwt-go"
+)
+
+type signingKey struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+// Issuer is an OIDC provider serving its discovery document and JWKS over
+// HTTPS. Tokens are signed with RS256 by the latest key.
+type Issuer struct {
+	srv *httptest.Server
+
+	mtx  sync.Mutex
+	keys []signingKey
+}
+
+// NewIssuer starts an Issuer with a single signing key. It must be closed
+// with Close.
+func NewIssuer() *Issuer {
+	i := &Issuer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", i.discovery)
+	mux.HandleFunc("/certs", i.jwks)
+	i.srv = httptest.NewTLSServer(mux)
+	i.RotateKey()
+	return i
+}
+
+// URL returns the issuer identifier, also the iss claim of its tokens.
+func (i *Issuer) URL() string {
+	return i.srv.URL
+}
+
+// CA returns the PEM encoded certificate of the issuer server, to be
+// trusted by clients.
+func (i *Issuer) CA() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: i.srv.Certificate().Raw})
+}
+
+// Client returns an HTTP client trusting the issuer server.
+func (i *Issuer) Client() *http.Client {
+	return i.srv.Client()
+}
+
+// Close shuts down the issuer server.
+func (i *Issuer) Close() {
+	i.srv.Close()
+}
+
+// RotateKey signs the following tokens with a new key. Previous keys are
+// still published.
+func (i *Issuer) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("oidctest: failed to generate signing key: %v", err))
+	}
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	i.keys = append(i.keys, signingKey{kid: fmt.Sprintf("key-%d", len(i.keys)+1), key: key})
+}
+
+// Token returns a token with claims signed by the latest key. The iss and
+// exp claims default to the issuer URL and an hour from now.
+func (i *Issuer) Token(claims map[string]interface{}) string {
+	c := stdjwt.MapClaims{
+		"iss": i.URL(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+	i.mtx.Lock()
+	k := i.keys[len(i.keys)-1]
+	i.mtx.Unlock()
+
+	token := stdjwt.NewWithClaims(stdjwt.SigningMethodRS256, c)
+	token.Header["kid"] = k.kid
+	signed, err := token.SignedString(k.key)
+	if err != nil {
+		panic(fmt.Sprintf("oidctest: failed to sign token: %v", err))
+	}
+	return signed
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":   i.URL(),
+		"jwks_uri": i.URL() + "/certs",
+	})
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	keys := make([]map[string]string, 0, len(i.keys))
+	for _, k := range i.keys {
+		keys = append(keys, map[string]string{
+			"kid": k.kid,
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   encodeInt(k.key.N),
+			"e":   encodeInt(big.NewInt(int64(k.key.E))),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
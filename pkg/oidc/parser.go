@@ -0,0 +1,52 @@
+package oidc
+
+import (
+	"context"
+
+	stdjwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+)
+
+// Algorithms are the JWT signing algorithms accepted by NewParser.
+var Algorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// NewParser returns an endpoint middleware like jwt.NewParser of go-kit
+// that accepts any of the Algorithms, leaving to keyFunc to check the
+// algorithm matches the signing key.
+func NewParser(keyFunc stdjwt.Keyfunc, newClaims jwt.ClaimsFactory) endpoint.Middleware {
+	parser := &stdjwt.Parser{ValidMethods: Algorithms}
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			tokenString, ok := ctx.Value(jwt.JWTTokenContextKey).(string)
+			if !ok {
+				return nil, jwt.ErrTokenContextMissing
+			}
+
+			token, err := parser.ParseWithClaims(tokenString, newClaims(), keyFunc)
+			if err != nil {
+				if e, ok := err.(*stdjwt.ValidationError); ok {
+					switch {
+					case e.Errors&stdjwt.ValidationErrorMalformed != 0:
+						return nil, jwt.ErrTokenMalformed
+					case e.Errors&stdjwt.ValidationErrorExpired != 0:
+						return nil, jwt.ErrTokenExpired
+					case e.Errors&stdjwt.ValidationErrorNotValidYet != 0:
+						return nil, jwt.ErrTokenNotActive
+					case e.Errors&stdjwt.ValidationErrorSignatureInvalid != 0:
+						return nil, jwt.ErrTokenInvalid
+					case e.Inner != nil:
+						return nil, e.Inner
+					}
+				}
+				return nil, err
+			}
+			if !token.Valid {
+				return nil, jwt.ErrTokenInvalid
+			}
+
+			ctx = context.WithValue(ctx, jwt.JWTClaimsContextKey, token.Claims)
+			return next(ctx, request)
+		}
+	}
+}